@@ -1,22 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/Financial-Times/api-endpoint"
-	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
 	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
 	logger "github.com/Financial-Times/go-logger/v2"
 	"github.com/Financial-Times/http-handlers-go/v2/httphandlers"
 	"github.com/Financial-Times/relations-api/v3/relations"
+	"github.com/Financial-Times/service-status-go/gtg"
 	status "github.com/Financial-Times/service-status-go/httphandlers"
 	"github.com/gorilla/mux"
 	cli "github.com/jawher/mow.cli"
 	metrics "github.com/rcrowley/go-metrics"
+	"github.com/redis/go-redis/v9"
 )
 
 const (
@@ -24,13 +33,144 @@ const (
 	serviceDescription = "A public RESTful API for accessing Relations in neo4j"
 )
 
+type serverConfig struct {
+	port                string
+	readHeaderTimeout   time.Duration
+	readTimeout         time.Duration
+	writeTimeout        time.Duration
+	idleTimeout         time.Duration
+	shutdownDelay       time.Duration
+	shutdownGracePeriod time.Duration
+	debugLookups        bool
+	neoProbeInterval    time.Duration
+	// materializedStoreFile, when set, serves the relations from the materialized store it holds
+	materializedStoreFile string
+	// surrogateCacheDuration, when set, is sent to the CDN as Surrogate-Control
+	surrogateCacheDuration time.Duration
+	// staleWhileRevalidate and staleIfError extend the --cache-duration policy of 200 responses
+	staleWhileRevalidate time.Duration
+	staleIfError         time.Duration
+	// notFoundCache and errorCacheDuration let 404 and 5xx responses be cached when their max-age is set
+	notFoundCache      relations.CachePolicy
+	errorCacheDuration time.Duration
+	// instanceID names the instance in the responses of the calls only applying to it
+	instanceID string
+}
+
+type healthConfig struct {
+	interval             time.Duration
+	schemaRequiredForGTG bool
+	snapshotMaxAge       time.Duration
+	relations.HealthConfig
+}
+
+type cacheConfig struct {
+	ttl        time.Duration
+	maxEntries int
+	// staleMaxStaleness, when set, serves the last relations found while Neo4j fails, for up to its duration
+	staleMaxStaleness time.Duration
+	staleMaxEntries   int
+	// redisAddresses, when set, shares the cache across replicas in Redis instead of keeping it in-process
+	redisAddresses []string
+	// redisSentinelMaster, when set, is the master monitored by the Sentinels of redisAddresses
+	redisSentinelMaster string
+	// RedisCacheConfig configures the Redis cache, its TTL is ttl
+	relations.RedisCacheConfig
+	warmup warmupConfig
+	// auditLogFile, when set, receives the cache admin actions as JSON lines instead of the service log
+	auditLogFile string
+}
+
+type warmupConfig struct {
+	// uuidsFile, when set, lists the content the cache is warmed up with
+	uuidsFile string
+	relations.WarmupConfig
+}
+
+type webhookConfig struct {
+	enabled        bool
+	deadLetterFile string
+	relations.WebhookConfig
+}
+
+type purgeConfig struct {
+	// url is the base URL of the CDN PURGE requests are sent to, the purge is disabled when empty
+	url string
+	// auth is the Authorization header of the PURGE requests, none is sent when empty
+	auth string
+	relations.PurgeConfig
+}
+
+type notificationsConfig struct {
+	enabled    bool
+	pageSize   int
+	maxEntries int
+	retention  time.Duration
+}
+
+type adminHandlers struct {
+	auth     *relations.AdminAuth
+	webhooks *relations.WebhookNotifier
+	exporter *relations.RelationsExporter
+	purge    *relations.PurgeEmitter
+	cache    *relations.CacheAdmin
+}
+
+type consumerConfig struct {
+	kafkaAddresses []string
+	topic          string
+	consumerGroup  string
+}
+
 func main() {
 	app := cli.App(serviceName, serviceDescription)
+	backend := app.String(cli.StringOpt{
+		Name:   "backend",
+		Value:  backendNeo4j,
+		Desc:   "Store the relations are read from (neo4j, sqlite, postgres)",
+		EnvVar: "BACKEND",
+	})
+	sqlDSN := app.String(cli.StringOpt{
+		Name:   "sql-dsn",
+		Value:  "",
+		Desc:   "Data source of the sqlite or postgres --backend, a file path for SQLite and a postgres:// URL for Postgres",
+		EnvVar: "SQL_DSN",
+	})
+	snapshotFile := app.String(cli.StringOpt{
+		Name:   "snapshot",
+		Value:  "",
+		Desc:   "Snapshot file written by snapshot create the relations are served from, without connecting to the --backend",
+		EnvVar: "SNAPSHOT_FILE",
+	})
+	snapshotMaxAge := app.String(cli.StringOpt{
+		Name:   "snapshot-max-age",
+		Value:  "0s",
+		Desc:   "Age after which the health check of the --snapshot fails, 0s to only report its age",
+		EnvVar: "SNAPSHOT_MAX_AGE",
+	})
+	materializedStoreFile := app.String(cli.StringOpt{
+		Name:   "materialized-store-file",
+		Value:  "",
+		Desc:   "bbolt file the relations are materialized to on publish and served from, the relations are computed on every read when empty",
+		EnvVar: "MATERIALIZED_STORE_FILE",
+	})
 	neoURL := app.String(cli.StringOpt{
 		Name:   "neo-url",
 		Value:  "bolt://localhost:7687",
-		Desc:   "neo-url value must use the bolt protocol",
+		Desc:   "Comma separated bolt:// or neo4j:// URLs of the Neo4j members reads are routed to, neo4j:// URLs being routed further to followers and read replicas by the driver",
 		EnvVar: "NEO_URL"})
+	neoRoutingPolicy := app.String(cli.StringOpt{
+		Name:   "neo-routing-policy",
+		Value:  relations.RoutingRoundRobin,
+		Desc:   "How reads are routed across the Neo4j members of --neo-url (round-robin, ordered, least-latency)",
+		EnvVar: "NEO_ROUTING_POLICY",
+	})
+	neoProbeInterval := app.String(cli.StringOpt{
+		Name:   "neo-probe-interval",
+		Value:  "10s",
+		Desc:   "How often every Neo4j member of --neo-url is probed to fail over from it or back to it",
+		EnvVar: "NEO_PROBE_INTERVAL",
+	})
 	port := app.String(cli.StringOpt{
 		Name:   "port",
 		Value:  "8080",
@@ -43,6 +183,48 @@ func main() {
 		Desc:   "Duration Get requests should be cached for. e.g. 2h45m would set the max-age value to '9900' seconds",
 		EnvVar: "CACHE_DURATION",
 	})
+	cacheStaleWhileRevalidate := app.String(cli.StringOpt{
+		Name:   "cache-stale-while-revalidate",
+		Value:  "0s",
+		Desc:   "Duration caches may serve stale 200 responses for while revalidating them in the background, 0s omits the directive",
+		EnvVar: "CACHE_STALE_WHILE_REVALIDATE",
+	})
+	cacheStaleIfError := app.String(cli.StringOpt{
+		Name:   "cache-stale-if-error",
+		Value:  "0s",
+		Desc:   "Duration caches may serve stale 200 responses for when revalidating them fails, 0s omits the directive",
+		EnvVar: "CACHE_STALE_IF_ERROR",
+	})
+	notFoundCacheDuration := app.String(cli.StringOpt{
+		Name:   "not-found-cache-duration",
+		Value:  "0s",
+		Desc:   "Duration 404 responses should be cached for, 0s sends no Cache-Control on 404s",
+		EnvVar: "NOT_FOUND_CACHE_DURATION",
+	})
+	notFoundStaleWhileRevalidate := app.String(cli.StringOpt{
+		Name:   "not-found-stale-while-revalidate",
+		Value:  "0s",
+		Desc:   "Duration caches may serve stale 404 responses for while revalidating them in the background, 0s omits the directive",
+		EnvVar: "NOT_FOUND_STALE_WHILE_REVALIDATE",
+	})
+	notFoundStaleIfError := app.String(cli.StringOpt{
+		Name:   "not-found-stale-if-error",
+		Value:  "0s",
+		Desc:   "Duration caches may serve stale 404 responses for when revalidating them fails, 0s omits the directive",
+		EnvVar: "NOT_FOUND_STALE_IF_ERROR",
+	})
+	errorCacheDuration := app.String(cli.StringOpt{
+		Name:   "error-cache-duration",
+		Value:  "0s",
+		Desc:   "Duration 5xx responses should be cached for, briefly sparing a struggling Neo4j, 0s sends no Cache-Control on 5xx",
+		EnvVar: "ERROR_CACHE_DURATION",
+	})
+	surrogateCacheDuration := app.String(cli.StringOpt{
+		Name:   "surrogate-cache-duration",
+		Value:  "0s",
+		Desc:   "Duration the CDN should cache relations responses for, sent as Surrogate-Control max-age, 0s sends no Surrogate-Control",
+		EnvVar: "SURROGATE_CACHE_DURATION",
+	})
 	apiYml := app.String(cli.StringOpt{
 		Name:   "api-yml",
 		Value:  "./api.yml",
@@ -66,78 +248,910 @@ func main() {
 		Desc:   "API Gateway URL used when building the thing ID url in the response, in the format scheme://host",
 		EnvVar: "API_HOST",
 	})
+	thingURL := app.String(cli.StringOpt{
+		Name:   "thing-url",
+		Value:  "http://api.ft.com/things/",
+		Desc:   "Base URL of the thing IDs in the response",
+		EnvVar: "THING_URL",
+	})
+	legacyThingURL := app.String(cli.StringOpt{
+		Name:   "legacy-thing-url",
+		Value:  "",
+		Desc:   "Base URL of the legacy thing IDs sent on request with idFormat=legacy or idFormat=both while migrating from it",
+		EnvVar: "LEGACY_THING_URL",
+	})
+	apiHostAllowList := app.String(cli.StringOpt{
+		Name:   "api-host-allow-list",
+		Value:  "",
+		Desc:   "Comma separated hosts trusted in X-Forwarded-Host to build the apiUrl of a response instead of apiURL, e.g. api.ft.com,api-t.ft.com",
+		EnvVar: "API_HOST_ALLOW_LIST",
+	})
+	readHeaderTimeout := app.String(cli.StringOpt{
+		Name:   "http-read-header-timeout",
+		Value:  "10s",
+		Desc:   "Maximum duration for reading the request headers",
+		EnvVar: "HTTP_READ_HEADER_TIMEOUT",
+	})
+	readTimeout := app.String(cli.StringOpt{
+		Name:   "http-read-timeout",
+		Value:  "15s",
+		Desc:   "Maximum duration for reading the entire request, including the body",
+		EnvVar: "HTTP_READ_TIMEOUT",
+	})
+	writeTimeout := app.String(cli.StringOpt{
+		Name:   "http-write-timeout",
+		Value:  "30s",
+		Desc:   "Maximum duration before timing out writes of the response",
+		EnvVar: "HTTP_WRITE_TIMEOUT",
+	})
+	idleTimeout := app.String(cli.StringOpt{
+		Name:   "http-idle-timeout",
+		Value:  "120s",
+		Desc:   "Maximum amount of time to wait for the next request when keep-alives are enabled",
+		EnvVar: "HTTP_IDLE_TIMEOUT",
+	})
+	shutdownDelay := app.String(cli.StringOpt{
+		Name:   "shutdown-delay",
+		Value:  "5s",
+		Desc:   "Time to keep serving requests after SIGTERM while /__gtg reports not good to go, so load balancers can stop routing traffic",
+		EnvVar: "SHUTDOWN_DELAY",
+	})
+	shutdownGracePeriod := app.String(cli.StringOpt{
+		Name:   "shutdown-grace-period",
+		Value:  "20s",
+		Desc:   "Maximum time to wait for in-flight requests to complete during shutdown",
+		EnvVar: "SHUTDOWN_GRACE_PERIOD",
+	})
+	healthCheckInterval := app.String(cli.StringOpt{
+		Name:   "health-check-interval",
+		Value:  "10s",
+		Desc:   "How often the health checks run in the background, /__health and /__gtg report their last results",
+		EnvVar: "HEALTH_CHECK_INTERVAL",
+	})
+	healthCanaryUUID := app.String(cli.StringOpt{
+		Name:   "health-canary-uuid",
+		Value:  "",
+		Desc:   "UUID of content with known relations looked up by the canary health check, leave empty to disable it",
+		EnvVar: "HEALTH_CANARY_UUID",
+	})
+	healthCanaryExpect := app.String(cli.StringOpt{
+		Name:   "health-canary-expect",
+		Value:  "",
+		Desc:   "Comma separated relations of the canary content expected to be non empty (curatedRelatedContent, contains, containedIn)",
+		EnvVar: "HEALTH_CANARY_EXPECT",
+	})
+	healthLatencyBudget := app.String(cli.StringOpt{
+		Name:   "health-latency-budget",
+		Value:  "2s",
+		Desc:   "Longest the canary lookup, or a read without canary, may take before the latency health check fails, 0s disables it",
+		EnvVar: "HEALTH_LATENCY_BUDGET",
+	})
+	schemaRequiredForGTG := app.Bool(cli.BoolOpt{
+		Name:   "schema-required-for-gtg",
+		Value:  false,
+		Desc:   "Report not good to go while the uuid uniqueness constraints the lookups rely on are missing from Neo4j",
+		EnvVar: "SCHEMA_REQUIRED_FOR_GTG",
+	})
+	cacheTTL := app.String(cli.StringOpt{
+		Name:   "cache-ttl",
+		Value:  "0s",
+		Desc:   "Time relations are kept in the in-process cache, 0s disables the cache",
+		EnvVar: "CACHE_TTL",
+	})
+	cacheMaxEntries := app.Int(cli.IntOpt{
+		Name:   "cache-max-entries",
+		Value:  10000,
+		Desc:   "Maximum number of content and content collection relations kept in the in-process cache",
+		EnvVar: "CACHE_MAX_ENTRIES",
+	})
+	redisAddress := app.String(cli.StringOpt{
+		Name:   "redis-address",
+		Value:  "",
+		Desc:   "host:port address of the Redis relations are cached in for --cache-ttl, and webhook subscriptions kept in, shared by every replica, or comma separated Sentinel addresses with --redis-sentinel-master, leave empty to cache in-process",
+		EnvVar: "REDIS_ADDRESS",
+	})
+	redisSentinelMaster := app.String(cli.StringOpt{
+		Name:   "redis-sentinel-master",
+		Value:  "",
+		Desc:   "Name of the master monitored by the Redis Sentinels of --redis-address, leave empty to connect to a single Redis",
+		EnvVar: "REDIS_SENTINEL_MASTER",
+	})
+	redisTimeout := app.String(cli.StringOpt{
+		Name:   "redis-timeout",
+		Value:  "100ms",
+		Desc:   "Longest a Redis command may take before the lookup falls through to Neo4j",
+		EnvVar: "REDIS_TIMEOUT",
+	})
+	redisBreakerThreshold := app.Int(cli.IntOpt{
+		Name:   "redis-breaker-threshold",
+		Value:  5,
+		Desc:   "Number of Redis failures in a row after which Redis is no longer tried for --redis-breaker-cooldown",
+		EnvVar: "REDIS_BREAKER_THRESHOLD",
+	})
+	redisBreakerCooldown := app.String(cli.StringOpt{
+		Name:   "redis-breaker-cooldown",
+		Value:  "30s",
+		Desc:   "Time lookups go straight to Neo4j once the Redis circuit breaker opened",
+		EnvVar: "REDIS_BREAKER_COOLDOWN",
+	})
+	cacheAuditLogFile := app.String(cli.StringOpt{
+		Name:   "cache-audit-log-file",
+		Value:  "",
+		Desc:   "File the actions of the cache admin endpoints are appended to as JSON lines, they are logged when empty",
+		EnvVar: "CACHE_AUDIT_LOG_FILE",
+	})
+	warmupUUIDsFile := app.String(cli.StringOpt{
+		Name:   "warmup-uuids-file",
+		Value:  "",
+		Desc:   "File listing one content UUID per line whose relations are cached on startup, before reporting good to go",
+		EnvVar: "WARMUP_UUIDS_FILE",
+	})
+	warmupRecentCollections := app.Int(cli.IntOpt{
+		Name:   "warmup-recent-collections",
+		Value:  0,
+		Desc:   "Number of most recently modified curations and content collections whose relations, and the relations of their content, are cached on startup",
+		EnvVar: "WARMUP_RECENT_COLLECTIONS",
+	})
+	warmupConcurrency := app.Int(cli.IntOpt{
+		Name:   "warmup-concurrency",
+		Value:  8,
+		Desc:   "Number of lookups run at a time by the cache warm-up",
+		EnvVar: "WARMUP_CONCURRENCY",
+	})
+	warmupTimeout := app.String(cli.StringOpt{
+		Name:   "warmup-timeout",
+		Value:  "60s",
+		Desc:   "Longest the cache warm-up may hold back good to go, the remaining relations are then looked up on request",
+		EnvVar: "WARMUP_TIMEOUT",
+	})
+	staleMaxStaleness := app.String(cli.StringOpt{
+		Name:   "stale-if-error-max-staleness",
+		Value:  "0s",
+		Desc:   "Longest the last relations found may be served for, flagged by a Warning header, while Neo4j lookups fail, 0s returns 503 on failures",
+		EnvVar: "STALE_IF_ERROR_MAX_STALENESS",
+	})
+	staleMaxEntries := app.Int(cli.IntOpt{
+		Name:   "stale-if-error-max-entries",
+		Value:  10000,
+		Desc:   "Maximum number of content and content collection relations kept to be served stale",
+		EnvVar: "STALE_IF_ERROR_MAX_ENTRIES",
+	})
+	kafkaAddress := app.String(cli.StringOpt{
+		Name:   "kafka-address",
+		Value:  "",
+		Desc:   "Comma separated Kafka broker addresses to read publish events from, leave empty to disable the consumer",
+		EnvVar: "KAFKA_ADDRESS",
+	})
+	kafkaTopic := app.String(cli.StringOpt{
+		Name:   "kafka-topic",
+		Value:  "PostPublicationEvents",
+		Desc:   "Kafka topic carrying content collection publish events",
+		EnvVar: "KAFKA_TOPIC",
+	})
+	kafkaConsumerGroup := app.String(cli.StringOpt{
+		Name:   "kafka-consumer-group",
+		Value:  "relations-api",
+		Desc:   "Prefix of the Kafka consumer groups, each instance joins the group of the prefix and its --instance-id so that every instance reads every event",
+		EnvVar: "KAFKA_CONSUMER_GROUP",
+	})
+	instanceID := app.String(cli.StringOpt{
+		Name:   "instance-id",
+		Value:  "",
+		Desc:   "Stable name of this instance among the replicas, required with --kafka-address, the hostname when empty",
+		EnvVar: "INSTANCE_ID",
+	})
+	adminTokens := app.String(cli.StringOpt{
+		Name:   "admin-tokens",
+		Value:  "",
+		Desc:   "Comma separated name:token pairs accepted as bearer tokens by the admin endpoints, the name identifies the caller",
+		EnvVar: "ADMIN_TOKENS",
+	})
+	debugLookups := app.Bool(cli.BoolOpt{
+		Name:   "debug-lookups-enabled",
+		Value:  false,
+		Desc:   "Attach the executed queries to the relations responses of requests with ?debug=true and an admin token",
+		EnvVar: "DEBUG_LOOKUPS_ENABLED",
+	})
+	exportBatchSize := app.Int(cli.IntOpt{
+		Name:   "export-batch-size",
+		Value:  500,
+		Desc:   "Number of content UUIDs listed from Neo4j at a time by the relations export",
+		EnvVar: "EXPORT_BATCH_SIZE",
+	})
+	webhooksEnabled := app.Bool(cli.BoolOpt{
+		Name:   "webhooks-enabled",
+		Value:  false,
+		Desc:   "Notify registered webhooks when the relations of a content item change, requires admin tokens",
+		EnvVar: "WEBHOOKS_ENABLED",
+	})
+	webhookMaxAttempts := app.Int(cli.IntOpt{
+		Name:   "webhook-max-attempts",
+		Value:  5,
+		Desc:   "Number of times a webhook delivery is tried before it is written to the dead-letter log",
+		EnvVar: "WEBHOOK_MAX_ATTEMPTS",
+	})
+	webhookInitialBackoff := app.String(cli.StringOpt{
+		Name:   "webhook-initial-backoff",
+		Value:  "1s",
+		Desc:   "Wait before the first webhook retry, doubled on every following retry",
+		EnvVar: "WEBHOOK_INITIAL_BACKOFF",
+	})
+	webhookReevaluationInterval := app.String(cli.StringOpt{
+		Name:   "webhook-reevaluation-interval",
+		Value:  "0s",
+		Desc:   "How often the relations of every tracked content item are re-evaluated, 0s disables periodic re-evaluation",
+		EnvVar: "WEBHOOK_REEVALUATION_INTERVAL",
+	})
+	webhookMaxTrackedContent := app.Int(cli.IntOpt{
+		Name:   "webhook-max-tracked-content",
+		Value:  100000,
+		Desc:   "Maximum number of content items whose last relations are kept to detect changes",
+		EnvVar: "WEBHOOK_MAX_TRACKED_CONTENT",
+	})
+	webhookMaxConcurrentDeliveries := app.Int(cli.IntOpt{
+		Name:   "webhook-max-concurrent-deliveries",
+		Value:  10,
+		Desc:   "Maximum number of webhook deliveries in flight, the following ones wait for a slot",
+		EnvVar: "WEBHOOK_MAX_CONCURRENT_DELIVERIES",
+	})
+	webhookDeadLetterFile := app.String(cli.StringOpt{
+		Name:   "webhook-dead-letter-file",
+		Value:  "",
+		Desc:   "File failed webhook deliveries are appended to as JSON lines, failed deliveries are logged when empty",
+		EnvVar: "WEBHOOK_DEAD_LETTER_FILE",
+	})
+	notificationsEnabled := app.Bool(cli.BoolOpt{
+		Name:   "notifications-enabled",
+		Value:  false,
+		Desc:   "Serve the relations change notifications feed, recorded from content collection publish events",
+		EnvVar: "NOTIFICATIONS_ENABLED",
+	})
+	notificationsPageSize := app.Int(cli.IntOpt{
+		Name:   "notifications-page-size",
+		Value:  50,
+		Desc:   "Maximum number of notifications in a page of the feed",
+		EnvVar: "NOTIFICATIONS_PAGE_SIZE",
+	})
+	notificationsMaxEntries := app.Int(cli.IntOpt{
+		Name:   "notifications-max-entries",
+		Value:  100000,
+		Desc:   "Maximum number of notifications kept in the feed, and of collections whose last version is kept to detect changes",
+		EnvVar: "NOTIFICATIONS_MAX_ENTRIES",
+	})
+	notificationsRetention := app.String(cli.StringOpt{
+		Name:   "notifications-retention",
+		Value:  "72h",
+		Desc:   "Time notifications are kept in the feed",
+		EnvVar: "NOTIFICATIONS_RETENTION",
+	})
+	cdnPurgeURL := app.String(cli.StringOpt{
+		Name:   "cdn-purge-url",
+		Value:  "",
+		Desc:   "Base URL of the CDN PURGE requests are sent to when collections change, in the format scheme://host, leave empty to disable the purge",
+		EnvVar: "CDN_PURGE_URL",
+	})
+	cdnPurgeAuth := app.String(cli.StringOpt{
+		Name:   "cdn-purge-auth",
+		Value:  "",
+		Desc:   "Authorization header of the PURGE requests, e.g. Bearer <token>, leave empty to send none",
+		EnvVar: "CDN_PURGE_AUTH",
+	})
+	cdnPurgeBatchSize := app.Int(cli.IntOpt{
+		Name:   "cdn-purge-batch-size",
+		Value:  50,
+		Desc:   "Maximum number of surrogate keys purged at a time",
+		EnvVar: "CDN_PURGE_BATCH_SIZE",
+	})
+	cdnPurgeFlushInterval := app.String(cli.StringOpt{
+		Name:   "cdn-purge-flush-interval",
+		Value:  "1s",
+		Desc:   "Longest surrogate keys wait for their purge batch to fill up",
+		EnvVar: "CDN_PURGE_FLUSH_INTERVAL",
+	})
+	cdnPurgeMaxAttempts := app.Int(cli.IntOpt{
+		Name:   "cdn-purge-max-attempts",
+		Value:  5,
+		Desc:   "Number of times a purge batch is tried before its surrogate keys are given up",
+		EnvVar: "CDN_PURGE_MAX_ATTEMPTS",
+	})
+	cdnPurgeInitialBackoff := app.String(cli.StringOpt{
+		Name:   "cdn-purge-initial-backoff",
+		Value:  "1s",
+		Desc:   "Wait before the first purge retry, doubled on every following retry",
+		EnvVar: "CDN_PURGE_INITIAL_BACKOFF",
+	})
+	cdnPurgeDelay := app.String(cli.StringOpt{
+		Name:   "cdn-purge-delay",
+		Value:  "5s",
+		Desc:   "Wait before purging the responses affected by a publish event, so that Neo4j and the caches of every replica are up to date",
+		EnvVar: "CDN_PURGE_DELAY",
+	})
 
 	log := logger.NewUPPLogger(serviceName, *logLevel)
-	app.Action = func() {
-		dbDriverLog := logger.NewUPPLogger(serviceName+"-cm-neo4j-driver", *dbDriverLogLevel)
+	urlOpts := urlOptions{
+		publicAPIURL:     publicAPIURL,
+		thingURL:         thingURL,
+		legacyThingURL:   legacyThingURL,
+		apiHostAllowList: apiHostAllowList,
+	}
+	neoOpts := neoOptions{
+		urls:             neoURL,
+		routingPolicy:    neoRoutingPolicy,
+		dbDriverLogLevel: dbDriverLogLevel,
+	}
+	backendOpts := backendOptions{
+		backend:  backend,
+		sqlDSN:   sqlDSN,
+		snapshot: snapshotFile,
+		neo:      neoOpts,
+	}
 
+	app.Action = func() {
 		log.WithField("args", os.Args).Info("Application started")
-		log.Infof("relations-api will listen on port: %s, connecting to: %s", *port, *neoURL)
+		if *snapshotFile != "" {
+			log.Infof("relations-api will listen on port: %s, serving the snapshot: %s", *port, *snapshotFile)
+		} else if *backend == backendNeo4j {
+			log.Infof("relations-api will listen on port: %s, connecting to: %s", *port, *neoURL)
+		} else {
+			log.Infof("relations-api will listen on port: %s, reading the %s backend", *port, *backend)
+		}
+
+		config := serverConfig{
+			port:                   *port,
+			readHeaderTimeout:      parseDuration(log, "http-read-header-timeout", *readHeaderTimeout),
+			readTimeout:            parseDuration(log, "http-read-timeout", *readTimeout),
+			writeTimeout:           parseDuration(log, "http-write-timeout", *writeTimeout),
+			idleTimeout:            parseDuration(log, "http-idle-timeout", *idleTimeout),
+			shutdownDelay:          parseDuration(log, "shutdown-delay", *shutdownDelay),
+			shutdownGracePeriod:    parseDuration(log, "shutdown-grace-period", *shutdownGracePeriod),
+			debugLookups:           *debugLookups,
+			neoProbeInterval:       parseDuration(log, "neo-probe-interval", *neoProbeInterval),
+			materializedStoreFile:  *materializedStoreFile,
+			surrogateCacheDuration: parseDuration(log, "surrogate-cache-duration", *surrogateCacheDuration),
+			staleWhileRevalidate:   parseDuration(log, "cache-stale-while-revalidate", *cacheStaleWhileRevalidate),
+			staleIfError:           parseDuration(log, "cache-stale-if-error", *cacheStaleIfError),
+			notFoundCache: relations.CachePolicy{
+				MaxAge:               parseDuration(log, "not-found-cache-duration", *notFoundCacheDuration),
+				StaleWhileRevalidate: parseDuration(log, "not-found-stale-while-revalidate", *notFoundStaleWhileRevalidate),
+				StaleIfError:         parseDuration(log, "not-found-stale-if-error", *notFoundStaleIfError),
+			},
+			errorCacheDuration: parseDuration(log, "error-cache-duration", *errorCacheDuration),
+		}
+
+		health := healthConfig{
+			interval:             parseDuration(log, "health-check-interval", *healthCheckInterval),
+			schemaRequiredForGTG: *schemaRequiredForGTG,
+			snapshotMaxAge:       parseDuration(log, "snapshot-max-age", *snapshotMaxAge),
+			HealthConfig: relations.HealthConfig{
+				CanaryUUID:    *healthCanaryUUID,
+				LatencyBudget: parseDuration(log, "health-latency-budget", *healthLatencyBudget),
+			},
+		}
+		if *healthCanaryExpect != "" {
+			health.CanaryExpect = strings.Split(*healthCanaryExpect, ",")
+		}
+
+		cache := cacheConfig{
+			ttl:               parseDuration(log, "cache-ttl", *cacheTTL),
+			maxEntries:        *cacheMaxEntries,
+			staleMaxStaleness: parseDuration(log, "stale-if-error-max-staleness", *staleMaxStaleness),
+			staleMaxEntries:   *staleMaxEntries,
+			RedisCacheConfig: relations.RedisCacheConfig{
+				Timeout:          parseDuration(log, "redis-timeout", *redisTimeout),
+				FailureThreshold: *redisBreakerThreshold,
+				Cooldown:         parseDuration(log, "redis-breaker-cooldown", *redisBreakerCooldown),
+			},
+			auditLogFile: *cacheAuditLogFile,
+			warmup: warmupConfig{
+				uuidsFile: *warmupUUIDsFile,
+				WarmupConfig: relations.WarmupConfig{
+					RecentCollections: *warmupRecentCollections,
+					Concurrency:       *warmupConcurrency,
+					Timeout:           parseDuration(log, "warmup-timeout", *warmupTimeout),
+				},
+			},
+		}
+		if *redisAddress != "" {
+			cache.redisAddresses = strings.Split(*redisAddress, ",")
+		}
+		// several addresses would make a Redis Cluster client, the multi-key
+		// commands and scans of the cache need every key on a single primary
+		cache.redisSentinelMaster = *redisSentinelMaster
+		if len(cache.redisAddresses) > 1 && cache.redisSentinelMaster == "" {
+			log.Fatal("--redis-address takes a single address, or Sentinel addresses with --redis-sentinel-master, Redis Cluster is not supported")
+		}
 
-		runServer(*neoURL, *port, *cacheDuration, *apiYml, *publicAPIURL, log, dbDriverLog)
+		// The consumer group of the instance is kept by Kafka across restarts, a
+		// hostname changing on every deploy would leak a group starting from the
+		// latest events each time
+		if *instanceID == "" && *kafkaAddress != "" {
+			log.Fatal("--instance-id is required to read events from Kafka, set it to a name stable across restarts")
+		}
+		if *instanceID == "" {
+			hostname, err := os.Hostname()
+			if err != nil {
+				log.WithError(err).Fatal("Failed to read the hostname, set --instance-id")
+			}
+			*instanceID = hostname
+		}
+		config.instanceID = *instanceID
+		consumer := consumerConfig{
+			topic:         *kafkaTopic,
+			consumerGroup: *kafkaConsumerGroup + "-" + *instanceID,
+		}
+		if *kafkaAddress != "" {
+			consumer.kafkaAddresses = strings.Split(*kafkaAddress, ",")
+		}
+
+		webhooks := webhookConfig{
+			enabled:        *webhooksEnabled,
+			deadLetterFile: *webhookDeadLetterFile,
+			WebhookConfig: relations.WebhookConfig{
+				MaxAttempts:             *webhookMaxAttempts,
+				InitialBackoff:          parseDuration(log, "webhook-initial-backoff", *webhookInitialBackoff),
+				ReevaluationInterval:    parseDuration(log, "webhook-reevaluation-interval", *webhookReevaluationInterval),
+				MaxTrackedContent:       *webhookMaxTrackedContent,
+				MaxConcurrentDeliveries: *webhookMaxConcurrentDeliveries,
+			},
+		}
+
+		notifications := notificationsConfig{
+			enabled:    *notificationsEnabled,
+			pageSize:   *notificationsPageSize,
+			maxEntries: *notificationsMaxEntries,
+			retention:  parseDuration(log, "notifications-retention", *notificationsRetention),
+		}
+
+		purge := purgeConfig{
+			url:  *cdnPurgeURL,
+			auth: *cdnPurgeAuth,
+			PurgeConfig: relations.PurgeConfig{
+				BatchSize:      *cdnPurgeBatchSize,
+				FlushInterval:  parseDuration(log, "cdn-purge-flush-interval", *cdnPurgeFlushInterval),
+				MaxAttempts:    *cdnPurgeMaxAttempts,
+				InitialBackoff: parseDuration(log, "cdn-purge-initial-backoff", *cdnPurgeInitialBackoff),
+				Delay:          parseDuration(log, "cdn-purge-delay", *cdnPurgeDelay),
+			},
+		}
+
+		if *exportBatchSize < 1 {
+			log.Fatal("--export-batch-size must be at least 1")
+		}
+
+		adminAuth, err := relations.NewAdminAuth(*adminTokens)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to parse admin tokens")
+		}
+
+		urls, err := urlOpts.publicURLs()
+		if err != nil {
+			log.WithError(err).Fatal("Failed to validate the public API URLs")
+		}
+
+		runServer(backendOpts, *cacheDuration, *apiYml, urls, config, health, cache, consumer, webhooks, notifications, purge, adminAuth, *exportBatchSize, log)
 	}
+	app.Command("snapshot", "Manage the snapshot files the relations can be served from without a relations store", snapshotCommand(backendOpts, log))
+	app.Command("rebuild", "Rebuild the materialized store of --materialized-store-file from the relations store", rebuildCommand(backendOpts, materializedStoreFile, log))
+	app.Command("audit", "Check the consistency of the relations graph in Neo4j, exiting with 1 when violations are found", auditCommand(neoOpts, log))
+	app.Command("get", "Print the relations of a content item or collection without starting the server, exiting with 1 when not found", getCommand(backendOpts, urlOpts, log))
+	app.Command("export", "Write the relations of every content item in a Curation or ContentPackage as NDJSON", exportCommand(backendOpts, urlOpts, exportBatchSize, log))
+
 	err := app.Run(os.Args)
 	if err != nil {
 		log.WithError(err).Fatal("Failed to start application")
 	}
 }
 
-func runServer(neoURL, port, cacheDuration, apiYml, publicAPIURL string, log, dbDriverLog *logger.UPPLogger) {
+func parseDuration(log *logger.UPPLogger, name, value string) time.Duration {
+	duration, err := time.ParseDuration(value)
+	if err != nil {
+		log.WithError(err).Fatalf("Failed to parse %s duration string", name)
+	}
+	return duration
+}
+
+func readWarmupUUIDs(file string) ([]string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return relations.ReadWarmupUUIDs(f)
+}
+
+func runServer(backendOpts backendOptions, cacheDuration, apiYml string, urls *relations.PublicURLs, config serverConfig, healthConf healthConfig, cacheConf cacheConfig, consumerConf consumerConfig, webhookConf webhookConfig, notificationsConf notificationsConfig, purgeConf purgeConfig, adminAuth *relations.AdminAuth, exportBatchSize int, log *logger.UPPLogger) {
 	var cacheControlHeader string
 	if duration, durationErr := time.ParseDuration(cacheDuration); durationErr != nil {
 		log.WithError(durationErr).Fatal("Failed to parse cache duration string")
 	} else {
-		cacheControlHeader = fmt.Sprintf("max-age=%s, public", strconv.FormatFloat(duration.Seconds(), 'f', 0, 64))
+		cacheControlHeader = relations.CachePolicy{
+			MaxAge:               duration,
+			StaleWhileRevalidate: config.staleWhileRevalidate,
+			StaleIfError:         config.staleIfError,
+		}.Header()
 	}
 
-	driver, err := cmneo4j.NewDefaultDriver(neoURL, dbDriverLog)
-	if err != nil {
-		log.WithError(err).Fatal("Failed to create new cmneo4j driver")
+	store := openRelationsStore(backendOpts, log)
+	storeDriver := store.driver
+	cluster := store.cluster
+
+	var relationsDriver = storeDriver
+	var materializedStore *relations.MaterializedStore
+	if config.materializedStoreFile != "" {
+		var err error
+		materializedStore, err = relations.OpenMaterializedStore(config.materializedStoreFile)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to open the materialized store")
+		}
+		defer materializedStore.Close()
+		relationsDriver = relations.NewMaterializedDriver(materializedStore)
+	}
+	// The relations are recorded for stale-if-error as they are loaded, beneath the cache
+	var staleStore *relations.StaleStore
+	if cacheConf.staleMaxStaleness > 0 {
+		if cacheConf.staleMaxEntries < 1 {
+			log.Fatal("--stale-if-error-max-entries must be at least 1")
+		}
+		staleStore = relations.NewStaleStore(cacheConf.staleMaxEntries, cacheConf.staleMaxStaleness)
+		relationsDriver = relations.NewStaleRecordingDriver(relationsDriver, staleStore)
 	}
 
-	cypherDriver, err := relations.NewCypherDriver(driver, publicAPIURL)
-	if err != nil {
-		log.WithError(err).Fatalf("Failed to create new cypher driver")
+	var collectionEventHandlers []relations.CollectionEventHandler
+	var relationsCache relations.RelationsCache
+	var redisClient redis.UniversalClient
+	if len(cacheConf.redisAddresses) > 0 {
+		if cacheConf.ttl <= 0 || cacheConf.Timeout <= 0 || cacheConf.FailureThreshold < 1 {
+			log.Fatal("The Redis cache requires a positive --cache-ttl, --redis-timeout and --redis-breaker-threshold")
+		}
+		redisClient = redis.NewUniversalClient(&redis.UniversalOptions{Addrs: cacheConf.redisAddresses, MasterName: cacheConf.redisSentinelMaster})
+		defer redisClient.Close()
+		redisConf := cacheConf.RedisCacheConfig
+		redisConf.TTL = cacheConf.ttl
+		relationsCache = relations.NewRedisCache(redisClient, redisConf, log)
+	} else if cacheConf.ttl > 0 {
+		relationsCache = relations.NewCache(cacheConf.maxEntries, cacheConf.ttl)
+	}
+	if relationsCache != nil {
+		relationsDriver = relations.NewCachedDriver(relationsDriver, relationsCache)
+		collectionEventHandlers = append(collectionEventHandlers, relations.NewCacheInvalidator(relationsCache, storeDriver, log))
+	}
+	// The materializer passes the events on to the cache once it stored the
+	// relations, so that the cache is not filled again with the previous ones
+	var materializer *relations.Materializer
+	if materializedStore != nil {
+		materializer = relations.NewMaterializer(storeDriver, materializedStore, log, collectionEventHandlers...)
+		collectionEventHandlers = []relations.CollectionEventHandler{materializer}
+	}
+
+	var warmer *relations.CacheWarmer
+	if cacheConf.warmup.RecentCollections > 0 && store.neo == nil {
+		log.Warn("The recently modified collections are only listed from Neo4j, the cache will not be warmed up with them")
+		cacheConf.warmup.RecentCollections = 0
+	}
+	if cacheConf.warmup.uuidsFile != "" || cacheConf.warmup.RecentCollections > 0 {
+		if relationsCache == nil {
+			log.Warn("The cache warm-up is configured but the cache is disabled, the cache will not be warmed up")
+		} else {
+			var uuids []string
+			var err error
+			if cacheConf.warmup.uuidsFile != "" {
+				uuids, err = readWarmupUUIDs(cacheConf.warmup.uuidsFile)
+				if err != nil {
+					log.WithError(err).Fatal("Failed to read the cache warm-up UUIDs")
+				}
+			}
+			warmer = relations.NewCacheWarmer(relationsDriver, store.neo, uuids, cacheConf.warmup.WarmupConfig, log)
+		}
+	}
+
+	admin := adminHandlers{auth: adminAuth}
+	if adminAuth.Enabled() {
+		exporter, err := relations.NewRelationsExporter(storeDriver, urls, exportBatchSize, log)
+		if err != nil {
+			log.WithError(err).Fatal("Failed to create the relations exporter")
+		}
+		admin.exporter = exporter
+		if relationsCache != nil {
+			var audit io.Writer
+			if cacheConf.auditLogFile != "" {
+				f, err := os.OpenFile(cacheConf.auditLogFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+				if err != nil {
+					log.WithError(err).Fatal("Failed to open cache audit log file")
+				}
+				defer f.Close()
+				audit = f
+			}
+			admin.cache = relations.NewCacheAdmin(relationsCache, config.instanceID, audit, log)
+		}
+	}
+	backgroundCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+	var background sync.WaitGroup
+	if cluster != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			cluster.Start(backgroundCtx, config.neoProbeInterval)
+		}()
+	}
+	if materializer != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			materializer.Start(backgroundCtx)
+		}()
+	}
+	if warmer != nil {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			warmer.Start(backgroundCtx)
+		}()
+	}
+	if webhookConf.enabled {
+		if !adminAuth.Enabled() {
+			log.Fatal("Webhooks are enabled but no admin tokens are configured to register them")
+		}
+		var deadLetter io.Writer
+		if webhookConf.deadLetterFile != "" {
+			f, err := os.OpenFile(webhookConf.deadLetterFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				log.WithError(err).Fatal("Failed to open webhook dead-letter file")
+			}
+			defer f.Close()
+			deadLetter = f
+		}
+		if webhookConf.MaxConcurrentDeliveries < 1 {
+			log.Fatal("--webhook-max-concurrent-deliveries must be at least 1")
+		}
+		// Without Redis, the subscriptions are only known to the instance they
+		// were registered with and are lost on restart
+		webhookStore := relations.NewMemoryWebhookStore()
+		if redisClient != nil {
+			webhookStore = relations.NewRedisWebhookStore(redisClient)
+		} else {
+			log.Warn("Webhook subscriptions are kept in memory, set --redis-address to share them across replicas and restarts")
+		}
+		admin.webhooks = relations.NewWebhookNotifier(storeDriver, webhookStore, urls, webhookConf.WebhookConfig, &http.Client{Timeout: 10 * time.Second}, deadLetter, log)
+		collectionEventHandlers = append(collectionEventHandlers, admin.webhooks)
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			admin.webhooks.Start(backgroundCtx)
+		}()
 	}
 
-	httpHandlers := relations.NewHttpHandlers(cypherDriver, cacheControlHeader)
+	var changeFeed *relations.RelationsChangeFeed
+	if notificationsConf.enabled {
+		if notificationsConf.maxEntries < 1 {
+			log.Fatal("--notifications-max-entries must be at least 1")
+		}
+		changeFeed = relations.NewRelationsChangeFeed(storeDriver, urls, notificationsConf.pageSize, notificationsConf.maxEntries, notificationsConf.retention, log)
+		collectionEventHandlers = append(collectionEventHandlers, changeFeed)
+	}
+
+	if purgeConf.url != "" {
+		if purgeConf.BatchSize < 1 || purgeConf.FlushInterval <= 0 || purgeConf.MaxAttempts < 1 {
+			log.Fatal("The CDN purge batch size, flush interval and max attempts must be positive")
+		}
+		purger, err := relations.NewHTTPPurger(purgeConf.url, purgeConf.auth, &http.Client{Timeout: 10 * time.Second})
+		if err != nil {
+			log.WithError(err).Fatal("Failed to validate the CDN purge URL")
+		}
+		// Without Redis, every replica purges the responses affected by the events it reads
+		var claims relations.PurgeClaims
+		if redisClient != nil {
+			claims = relations.NewRedisPurgeClaims(redisClient)
+		}
+		emitter := relations.NewPurgeEmitter(storeDriver, purger, claims, purgeConf.PurgeConfig, log)
+		collectionEventHandlers = append(collectionEventHandlers, emitter)
+		if adminAuth.Enabled() {
+			admin.purge = emitter
+		}
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			emitter.Start(backgroundCtx)
+		}()
+	}
+
+	consumerCtx, stopConsumer := context.WithCancel(context.Background())
+	defer stopConsumer()
+	var queue relations.Queue
+	if len(consumerConf.kafkaAddresses) > 0 {
+		if len(collectionEventHandlers) == 0 {
+			log.Warn("Kafka address is set but nothing consumes collection events, not starting the consumer")
+		} else {
+			queue = relations.NewKafkaQueue(consumerConf.kafkaAddresses, consumerConf.topic, consumerConf.consumerGroup)
+			consumer := relations.NewPublishEventConsumer(queue, log, collectionEventHandlers...)
+			go func() {
+				if err := consumer.Start(consumerCtx); err != nil {
+					log.WithError(err).Error("Publish event consumer stopped")
+				}
+			}()
+		}
+	} else if webhookConf.enabled || notificationsConf.enabled || purgeConf.url != "" || materializer != nil {
+		log.Warn("No Kafka address is set, collection publish events will not be received")
+	}
+
+	httpHandlers := relations.NewHttpHandlers(relationsDriver, urls, cacheControlHeader)
+	var notFoundCacheControlHeader, errorCacheControlHeader string
+	if config.notFoundCache.MaxAge > 0 {
+		notFoundCacheControlHeader = config.notFoundCache.Header()
+	}
+	if config.errorCacheDuration > 0 {
+		errorCacheControlHeader = relations.CachePolicy{MaxAge: config.errorCacheDuration}.Header()
+	}
+	httpHandlers = httpHandlers.WithErrorCacheControl(notFoundCacheControlHeader, errorCacheControlHeader)
+	if staleStore != nil {
+		httpHandlers = httpHandlers.WithStaleIfError(staleStore)
+	}
+	if config.surrogateCacheDuration > 0 {
+		httpHandlers = httpHandlers.WithSurrogateControl(fmt.Sprintf("max-age=%s", strconv.FormatFloat(config.surrogateCacheDuration.Seconds(), 'f', 0, 64)))
+	}
+	if config.debugLookups {
+		if !adminAuth.Enabled() {
+			log.Fatal("Debug lookups are enabled but no admin tokens are configured to request them")
+		}
+		httpHandlers = httpHandlers.WithDebug(adminAuth)
+	}
 	// The following endpoints should not be monitored or logged (varnish calls one of these every second, depending on config)
 	// The top one of these build info endpoints feels more correct, but the lower one matches what we have in Dropwizard,
 	// so it's what apps expect currently same as ping, the content of build-info needs more definition
+	deepChecks, err := relations.NewDeepHealthChecks(storeDriver, healthConf.HealthConfig)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to configure the health checks")
+	}
+	// The write connectivity and the schema are only checked in Neo4j, which
+	// other services write to
+	var schema *relations.SchemaVerifier
+	checks := deepChecks
+	if store.neo != nil {
+		schema = relations.NewSchemaVerifier(store.neo, log)
+		if cacheConf.warmup.RecentCollections > 0 {
+			schema = schema.WithRecentCollectionsIndexes()
+		}
+		checks = append([]fthealth.Check{httpHandlers.HealthCheck(*backendOpts.neo.urls)}, deepChecks...)
+		checks = append(checks, schema.HealthCheck())
+	}
+	if cluster != nil {
+		checks = append(checks, cluster.HealthChecks()...)
+	}
+	if store.snapshot != nil {
+		checks = append(checks, store.snapshot.HealthCheck(healthConf.snapshotMaxAge))
+	}
+	if materializedStore != nil {
+		checks = append(checks, materializedStore.HealthCheck())
+	}
+	monitor := relations.NewHealthMonitor(checks, healthConf.interval, log)
+	background.Add(1)
+	go func() {
+		defer background.Done()
+		monitor.Start(backgroundCtx)
+	}()
 	healthCheck := fthealth.TimedHealthCheck{
 		HealthCheck: fthealth.HealthCheck{
 			SystemCode:  "upp-relations-api",
 			Name:        "RelationsApi Healthchecks",
 			Description: "Checks for accessing neo4j",
-			Checks:      []fthealth.Check{httpHandlers.HealthCheck(neoURL)},
+			Checks:      monitor.Checks(),
 		},
 		Timeout: 10 * time.Second,
 	}
-	http.HandleFunc("/__health", fthealth.Handler(healthCheck))
-	http.HandleFunc(status.PingPath, status.PingHandler)
-	http.HandleFunc(status.PingPathDW, status.PingHandler)
-	http.HandleFunc(status.BuildInfoPath, status.BuildInfoHandler)
-	http.HandleFunc(status.BuildInfoPathDW, status.BuildInfoHandler)
-	http.HandleFunc("/__gtg", status.NewGoodToGoHandler(httpHandlers.GTG))
+	var shuttingDown atomic.Bool
+	gtgHandler := func() gtg.Status {
+		if shuttingDown.Load() {
+			return gtg.Status{GoodToGo: false, Message: "Service is shutting down"}
+		}
+		if status := monitor.GTG(); !status.GoodToGo {
+			return status
+		}
+		if warmer != nil {
+			if status := warmer.GTG(); !status.GoodToGo {
+				return status
+			}
+		}
+		if healthConf.schemaRequiredForGTG && schema != nil {
+			return schema.GTG()
+		}
+		return gtg.Status{GoodToGo: true}
+	}
+
+	serveMux := http.NewServeMux()
+	serveMux.HandleFunc("/__health", fthealth.Handler(healthCheck))
+	serveMux.HandleFunc(status.PingPath, status.PingHandler)
+	serveMux.HandleFunc(status.PingPathDW, status.PingHandler)
+	serveMux.HandleFunc(status.BuildInfoPath, status.BuildInfoHandler)
+	serveMux.HandleFunc(status.BuildInfoPathDW, status.BuildInfoHandler)
+	serveMux.HandleFunc("/__gtg", status.NewGoodToGoHandler(gtgHandler))
+	if schema != nil {
+		serveMux.HandleFunc("/__schema", schema.ServeReport)
+	}
+
+	serveMux.Handle("/", router(httpHandlers, changeFeed, admin, apiYml, log))
+
+	server := &http.Server{
+		Addr:              ":" + config.port,
+		Handler:           serveMux,
+		ReadHeaderTimeout: config.readHeaderTimeout,
+		ReadTimeout:       config.readTimeout,
+		WriteTimeout:      config.writeTimeout,
+		IdleTimeout:       config.idleTimeout,
+	}
+
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.WithError(err).Fatal("Unable to start server")
+		}
+	}()
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	sig := <-signals
 
-	http.Handle("/", router(httpHandlers, apiYml, log))
+	// Report not good to go first, so the load balancer stops sending new
+	// requests before the listener is closed.
+	log.Infof("Received %v, shutting down", sig)
+	shuttingDown.Store(true)
+	time.Sleep(config.shutdownDelay)
 
-	if err := http.ListenAndServe(":"+port, nil); err != nil {
-		log.WithError(err).Fatal("Unable to start server")
+	ctx, cancel := context.WithTimeout(context.Background(), config.shutdownGracePeriod)
+	defer cancel()
+	if err := server.Shutdown(ctx); err != nil {
+		log.WithError(err).Error("In-flight requests did not complete within the shutdown grace period")
 	}
+
+	stopConsumer()
+	if queue != nil {
+		if err := queue.Close(); err != nil {
+			log.WithError(err).Error("Failed to close publish event queue")
+		}
+	}
+
+	stopBackground()
+	background.Wait()
+
+	if err := store.close(); err != nil {
+		log.WithError(err).Error("Failed to close the relations store")
+	}
+	log.Info("Application stopped")
 }
 
-func router(hh relations.HttpHandlers, apiYml string, log *logger.UPPLogger) http.Handler {
+func router(hh relations.HttpHandlers, changeFeed *relations.RelationsChangeFeed, admin adminHandlers, apiYml string, log *logger.UPPLogger) http.Handler {
 	servicesRouter := mux.NewRouter()
 
+	if changeFeed != nil {
+		servicesRouter.HandleFunc("/content/relations/notifications", changeFeed.GetNotifications).Methods("GET")
+	}
 	servicesRouter.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
 	servicesRouter.HandleFunc("/contentcollection/{uuid}/relations", hh.GetContentCollectionRelations).Methods("GET")
+	if admin.webhooks != nil {
+		servicesRouter.HandleFunc("/__webhooks", admin.auth.Wrap(admin.webhooks.ListSubscriptions)).Methods("GET")
+		servicesRouter.HandleFunc("/__webhooks", admin.auth.Wrap(admin.webhooks.CreateSubscription)).Methods("POST")
+		servicesRouter.HandleFunc("/__webhooks/{id}", admin.auth.Wrap(admin.webhooks.DeleteSubscription)).Methods("DELETE")
+	}
+	if admin.exporter != nil {
+		servicesRouter.HandleFunc("/__export/relations", admin.auth.Wrap(admin.exporter.ExportRelations)).Methods("GET")
+	}
+	if admin.cache != nil {
+		servicesRouter.HandleFunc("/__cache/stats", admin.auth.Wrap(admin.cache.Stats)).Methods("GET")
+		servicesRouter.HandleFunc("/__cache/entries/{uuid}", admin.auth.Wrap(admin.cache.Lookup)).Methods("GET")
+		servicesRouter.HandleFunc("/__cache/entries/{uuid}", admin.auth.Wrap(admin.cache.Evict)).Methods("DELETE")
+		servicesRouter.HandleFunc("/__cache/contentcollection/{uuid}", admin.auth.Wrap(admin.cache.EvictCollection)).Methods("DELETE")
+		servicesRouter.HandleFunc("/__cache", admin.auth.Wrap(admin.cache.Flush)).Methods("DELETE")
+	}
+	if admin.purge != nil {
+		servicesRouter.HandleFunc("/__purge/contentcollection/{uuid}", admin.auth.Wrap(admin.purge.PurgeCollection)).Methods("POST")
+	}
 	if apiYml != "" {
 		if endpoint, err := api.NewAPIEndpointForFile(apiYml); err == nil {
 			servicesRouter.HandleFunc(api.DefaultPath, endpoint.ServeHTTP).Methods("GET")
 		}
 	}
 
+	servicesRouter.NotFoundHandler = http.HandlerFunc(relations.NotFound)
+	servicesRouter.MethodNotAllowedHandler = relations.MethodNotAllowed(servicesRouter)
+
 	var monitoringRouter http.Handler = servicesRouter
 	monitoringRouter = httphandlers.TransactionAwareRequestLoggingHandler(log, monitoringRouter)
 	monitoringRouter = httphandlers.HTTPMetricsHandler(metrics.DefaultRegistry, monitoringRouter)
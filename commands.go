@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/relations-api/v3/relations"
+	_ "github.com/jackc/pgx/v5/stdlib"
+	cli "github.com/jawher/mow.cli"
+	_ "modernc.org/sqlite"
+)
+
+// The relations stores --backend selects
+const (
+	backendNeo4j    = "neo4j"
+	backendSQLite   = "sqlite"
+	backendPostgres = "postgres"
+)
+
+// urlOptions are the options the URLs of the responses are built from
+type urlOptions struct {
+	publicAPIURL     *string
+	thingURL         *string
+	legacyThingURL   *string
+	apiHostAllowList *string
+}
+
+func (o urlOptions) publicURLs() (*relations.PublicURLs, error) {
+	return relations.NewPublicURLs(*o.publicAPIURL, *o.thingURL, *o.legacyThingURL, strings.Split(*o.apiHostAllowList, ","))
+}
+
+// neoOptions are the options the Neo4j driver is created from
+type neoOptions struct {
+	urls             *string
+	routingPolicy    *string
+	dbDriverLogLevel *string
+}
+
+// connect creates a driver per Neo4j URL. Several URLs form a cluster the
+// reads are routed across, which is returned as well to monitor its members.
+func (o neoOptions) connect(log *logger.UPPLogger) (relations.NeoDriver, *relations.NeoCluster, error) {
+	dbDriverLog := logger.NewUPPLogger(serviceName+"-cm-neo4j-driver", *o.dbDriverLogLevel)
+
+	var members []relations.ClusterMember
+	closeMembers := func() {
+		for _, m := range members {
+			m.Driver.Close()
+		}
+	}
+	for _, address := range strings.Split(*o.urls, ",") {
+		address = strings.TrimSpace(address)
+		if address == "" {
+			continue
+		}
+		driver, err := cmneo4j.NewDefaultDriver(address, dbDriverLog)
+		if err != nil {
+			closeMembers()
+			return nil, nil, err
+		}
+		members = append(members, relations.ClusterMember{Address: address, Driver: driver})
+	}
+
+	cluster, err := relations.NewNeoCluster(members, *o.routingPolicy, log)
+	if err != nil {
+		closeMembers()
+		return nil, nil, err
+	}
+	if len(members) == 1 {
+		return members[0].Driver, nil, nil
+	}
+	return cluster, cluster, nil
+}
+
+// backendOptions are the options the relations store is opened from
+type backendOptions struct {
+	backend *string
+	sqlDSN  *string
+	// snapshot, when set, is the snapshot file read instead of the backend
+	snapshot *string
+	neo      neoOptions
+}
+
+// relationsStore is an opened relations store.
+type relationsStore struct {
+	driver relations.Driver
+	// neo and cluster are only set by the Neo4j backend
+	neo     relations.NeoDriver
+	cluster *relations.NeoCluster
+	// snapshot is only set when the relations are read from a snapshot file
+	snapshot *relations.Snapshot
+	close    func() error
+}
+
+// open connects to the relations store of the backend. The SQLSchema tables
+// are created in SQLite, the Postgres schema is expected to be applied already.
+// A snapshot file is read in memory, no backend is connected to then.
+func (o backendOptions) open(log *logger.UPPLogger) (relationsStore, error) {
+	if *o.snapshot != "" {
+		snapshot, err := relations.OpenSnapshot(*o.snapshot)
+		if err != nil {
+			return relationsStore{}, err
+		}
+		return relationsStore{driver: relations.NewSnapshotDriver(snapshot), snapshot: snapshot, close: func() error { return nil }}, nil
+	}
+	switch *o.backend {
+	case backendNeo4j:
+		driver, cluster, err := o.neo.connect(log)
+		if err != nil {
+			return relationsStore{}, err
+		}
+		return relationsStore{driver: relations.NewCypherDriver(driver), neo: driver, cluster: cluster, close: driver.Close}, nil
+	case backendSQLite, backendPostgres:
+		if *o.sqlDSN == "" {
+			return relationsStore{}, fmt.Errorf("--sql-dsn is required by the %s backend", *o.backend)
+		}
+		driverName := "pgx"
+		if *o.backend == backendSQLite {
+			driverName = "sqlite"
+		}
+		db, err := sql.Open(driverName, *o.sqlDSN)
+		if err != nil {
+			return relationsStore{}, err
+		}
+		if *o.backend == backendSQLite {
+			if err := relations.InitialiseSQLSchema(db); err != nil {
+				db.Close()
+				return relationsStore{}, err
+			}
+		}
+		return relationsStore{driver: relations.NewSQLDriver(db), close: db.Close}, nil
+	}
+	return relationsStore{}, fmt.Errorf("unknown backend %s", *o.backend)
+}
+
+func openRelationsStore(backendOpts backendOptions, log *logger.UPPLogger) relationsStore {
+	store, err := backendOpts.open(log)
+	if err != nil {
+		log.WithError(err).WithField("backend", *backendOpts.backend).Fatal("Failed to open the relations store")
+	}
+	return store
+}
+
+func newNeoDriver(neoOpts neoOptions, log *logger.UPPLogger) relations.NeoDriver {
+	driver, _, err := neoOpts.connect(log)
+	if err != nil {
+		log.WithError(err).Fatal("Failed to create new cmneo4j driver")
+	}
+	return driver
+}
+
+func auditCommand(neoOpts neoOptions, log *logger.UPPLogger) func(cmd *cli.Cmd) {
+	return func(cmd *cli.Cmd) {
+		format := cmd.String(cli.StringOpt{
+			Name:  "format",
+			Value: "text",
+			Desc:  "Report format (text, json)",
+		})
+		limit := cmd.Int(cli.IntOpt{
+			Name:  "limit",
+			Value: 1000,
+			Desc:  "Maximum number of violations reported per check",
+		})
+
+		cmd.Action = func() {
+			if *format != "text" && *format != "json" {
+				log.Fatalf("Unknown report format %s", *format)
+			}
+
+			driver := newNeoDriver(neoOpts, log)
+			report, err := relations.NewAuditor(driver, *limit).Run()
+			driver.Close()
+			if err != nil {
+				log.WithError(err).Error("Failed to audit the relations graph")
+				cli.Exit(2)
+			}
+
+			if *format == "json" {
+				err = report.WriteJSON(os.Stdout)
+			} else {
+				err = report.WriteText(os.Stdout)
+			}
+			if err != nil {
+				log.WithError(err).Error("Failed to write the audit report")
+				cli.Exit(2)
+			}
+			if report.Violations > 0 {
+				cli.Exit(1)
+			}
+		}
+	}
+}
+
+func getCommand(backendOpts backendOptions, urlOpts urlOptions, log *logger.UPPLogger) func(cmd *cli.Cmd) {
+	return func(cmd *cli.Cmd) {
+		format := cmd.String(cli.StringOpt{
+			Name:  "format",
+			Value: "text",
+			Desc:  "Output format (text, json)",
+		})
+
+		cmd.Command("content", "Print the relations of a content item", lookupCommand(backendOpts, format, urlOpts, relations.LookupContentRelations, log))
+		cmd.Command("collection", "Print the relations of a content collection", lookupCommand(backendOpts, format, urlOpts, relations.LookupContentCollectionRelations, log))
+	}
+}
+
+type lookupFunc func(driver relations.Driver, urls *relations.PublicURLs, uuid string) (relations.LookupResult, error)
+
+func lookupCommand(backendOpts backendOptions, format *string, urlOpts urlOptions, lookup lookupFunc, log *logger.UPPLogger) func(cmd *cli.Cmd) {
+	return func(cmd *cli.Cmd) {
+		cmd.Spec = "UUID"
+		uuid := cmd.StringArg("UUID", "", "UUID to look up")
+
+		cmd.Action = func() {
+			if *format != "text" && *format != "json" {
+				log.Fatalf("Unknown output format %s", *format)
+			}
+
+			urls, err := urlOpts.publicURLs()
+			if err != nil {
+				log.WithError(err).Fatal("A valid --apiURL and --thing-url are required")
+			}
+
+			store := openRelationsStore(backendOpts, log)
+			result, err := lookup(store.driver, urls, *uuid)
+			store.close()
+			if err != nil {
+				log.WithError(err).WithUUID(*uuid).Error("Failed to look up relations")
+				cli.Exit(2)
+			}
+
+			if *format == "json" {
+				err = result.WriteJSON(os.Stdout)
+			} else {
+				err = result.WriteTable(os.Stdout)
+			}
+			if err != nil {
+				log.WithError(err).Error("Failed to write the relations")
+				cli.Exit(2)
+			}
+			if !result.Found {
+				cli.Exit(1)
+			}
+		}
+	}
+}
+
+func exportCommand(backendOpts backendOptions, urlOpts urlOptions, batchSize *int, log *logger.UPPLogger) func(cmd *cli.Cmd) {
+	return func(cmd *cli.Cmd) {
+		cursor := cmd.String(cli.StringOpt{
+			Name:  "cursor",
+			Value: "",
+			Desc:  "Resume the export after this content UUID",
+		})
+		limit := cmd.Int(cli.IntOpt{
+			Name:  "limit",
+			Value: 0,
+			Desc:  "Maximum number of lines written, 0 for no limit",
+		})
+		output := cmd.String(cli.StringOpt{
+			Name:  "output",
+			Value: "",
+			Desc:  "File the export is written to, stdout when empty",
+		})
+
+		cmd.Action = func() {
+			urls, err := urlOpts.publicURLs()
+			if err != nil {
+				log.WithError(err).Fatal("A valid --apiURL and --thing-url are required")
+			}
+
+			if *batchSize < 1 {
+				log.Fatal("--export-batch-size must be at least 1")
+			}
+
+			w := os.Stdout
+			if *output != "" {
+				f, err := os.Create(*output)
+				if err != nil {
+					log.WithError(err).Fatal("Failed to create the export file")
+				}
+				defer f.Close()
+				w = f
+			}
+
+			store := openRelationsStore(backendOpts, log)
+			exporter, err := relations.NewRelationsExporter(store.driver, urls, *batchSize, log)
+			if err != nil {
+				store.close()
+				log.WithError(err).Fatal("Failed to create the relations exporter")
+			}
+			next, err := exporter.Export(context.Background(), w, *cursor, *limit)
+			store.close()
+			if err != nil {
+				log.WithError(err).WithField("cursor", next).Error("Relations export interrupted, resume it with --cursor")
+				cli.Exit(2)
+			}
+			if next != "" {
+				log.WithField("cursor", next).Info("Relations export limit reached, resume it with --cursor")
+			}
+		}
+	}
+}
+
+func rebuildCommand(backendOpts backendOptions, storeFile *string, log *logger.UPPLogger) func(cmd *cli.Cmd) {
+	return func(cmd *cli.Cmd) {
+		batchSize := cmd.Int(cli.IntOpt{
+			Name:  "batch-size",
+			Value: 500,
+			Desc:  "Number of content UUIDs listed and stored at a time",
+		})
+
+		cmd.Action = func() {
+			if *storeFile == "" {
+				log.Fatal("--materialized-store-file is required to rebuild the materialized store")
+			}
+			if *batchSize < 1 {
+				log.Fatal("--batch-size must be at least 1")
+			}
+
+			store := openRelationsStore(backendOpts, log)
+			count, err := relations.RebuildMaterializedStore(context.Background(), store.driver, *storeFile, *batchSize, log)
+			store.close()
+			if err != nil {
+				log.WithError(err).Error("Failed to rebuild the materialized store")
+				cli.Exit(2)
+			}
+			log.WithField("content", count).Info("Rebuilt the materialized store, start the service to serve it")
+		}
+	}
+}
+
+func snapshotCommand(backendOpts backendOptions, log *logger.UPPLogger) func(cmd *cli.Cmd) {
+	return func(cmd *cli.Cmd) {
+		cmd.Command("create", "Write every content and collection relation of the relations store to a snapshot file", snapshotCreateCommand(backendOpts, log))
+	}
+}
+
+func snapshotCreateCommand(backendOpts backendOptions, log *logger.UPPLogger) func(cmd *cli.Cmd) {
+	return func(cmd *cli.Cmd) {
+		output := cmd.String(cli.StringOpt{
+			Name:  "output",
+			Value: "relations.snapshot",
+			Desc:  "File the snapshot is written to, replaced once the snapshot is complete",
+		})
+		batchSize := cmd.Int(cli.IntOpt{
+			Name:  "batch-size",
+			Value: 500,
+			Desc:  "Number of content UUIDs listed at a time",
+		})
+
+		cmd.Action = func() {
+			if *batchSize < 1 {
+				log.Fatal("--batch-size must be at least 1")
+			}
+
+			store := openRelationsStore(backendOpts, log)
+			stats, err := relations.CreateSnapshot(context.Background(), store.driver, *output, *batchSize)
+			store.close()
+			if err != nil {
+				log.WithError(err).Error("Failed to create the snapshot")
+				cli.Exit(2)
+			}
+			log.WithField("content", stats.Content).WithField("collections", stats.Collections).WithField("file", *output).Info("Created the snapshot")
+		}
+	}
+}
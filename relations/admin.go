@@ -0,0 +1,74 @@
+package relations
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strings"
+)
+
+type adminIdentityKey struct{}
+
+// AdminAuth authenticates requests to the admin endpoints using named bearer tokens.
+type AdminAuth struct {
+	tokens map[string]string
+}
+
+// NewAdminAuth parses a comma separated list of name:token pairs. The name is
+// used to identify the caller in logs.
+func NewAdminAuth(config string) (*AdminAuth, error) {
+	tokens := map[string]string{}
+	for _, pair := range strings.Split(config, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+		name, token, ok := strings.Cut(pair, ":")
+		if !ok || name == "" || token == "" {
+			return nil, errors.New("Invalid admin tokens, expected a comma separated list of name:token pairs")
+		}
+		tokens[token] = name
+	}
+	return &AdminAuth{tokens: tokens}, nil
+}
+
+// Enabled reports whether any admin token is configured.
+func (a *AdminAuth) Enabled() bool {
+	return a != nil && len(a.tokens) > 0
+}
+
+// Wrap rejects requests without a valid admin token and stores the caller identity in the request context.
+func (a *AdminAuth) Wrap(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		identity, ok := a.identify(r)
+		if !ok {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeError(w, r, apiError{
+				status:  http.StatusUnauthorized,
+				problem: problemUnauthorized,
+				detail:  "A valid admin token is required",
+			})
+			return
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), adminIdentityKey{}, identity)))
+	}
+}
+
+func (a *AdminAuth) identify(r *http.Request) (string, bool) {
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if a == nil || token == "" {
+		return "", false
+	}
+	for t, name := range a.tokens {
+		if subtle.ConstantTimeCompare([]byte(t), []byte(token)) == 1 {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func adminIdentity(r *http.Request) string {
+	identity, _ := r.Context().Value(adminIdentityKey{}).(string)
+	return identity
+}
@@ -0,0 +1,181 @@
+package relations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+)
+
+// maxPackageDepth bounds the CONTAINS paths followed when looking for packages containing themselves
+const maxPackageDepth = 10
+
+type auditCheck struct {
+	name        string
+	description string
+	// cypher must return uuid, related and detail columns and accept a $limit parameter
+	cypher string
+}
+
+var auditChecks = []auditCheck{
+	{
+		name:        "orphan-content-collections",
+		description: "ContentCollections with no parent ContentPackage",
+		cypher: `
+                MATCH (cc:ContentCollection)
+                WHERE NOT cc:Curation AND NOT (cc)<-[:CONTAINS]-(:ContentPackage)
+                RETURN cc.uuid as uuid, [] as related, '' as detail
+                LIMIT $limit
+                `,
+	},
+	{
+		name:        "uncurated-curations",
+		description: "Curations with no IS_CURATED_FOR target",
+		cypher: `
+                MATCH (cc:Curation)
+                WHERE NOT (cc)-[:IS_CURATED_FOR]->()
+                RETURN cc.uuid as uuid, [] as related, '' as detail
+                LIMIT $limit
+                `,
+	},
+	{
+		name:        "content-in-multiple-packages",
+		description: "Content contained in more than one ContentPackage",
+		cypher: `
+                MATCH (c:Content)<-[:CONTAINS]-(:ContentCollection)<-[:CONTAINS]-(cp:ContentPackage)
+                WITH c, COLLECT(DISTINCT cp.uuid) as packages
+                WHERE size(packages) > 1
+                RETURN c.uuid as uuid, packages as related, '' as detail
+                LIMIT $limit
+                `,
+	},
+	{
+		name:        "self-containing-packages",
+		description: "ContentPackages containing themselves transitively",
+		cypher: fmt.Sprintf(`
+                MATCH path = (cp:ContentPackage)-[:CONTAINS*2..%d]->(cp)
+                WITH cp, MIN(length(path)) as depth
+                RETURN cp.uuid as uuid, [] as related, 'contains itself at depth ' + toString(depth) as detail
+                LIMIT $limit
+                `, maxPackageDepth),
+	},
+	{
+		name:        "dangling-references",
+		description: "Items selected or contained by a collection that were never written as Content",
+		cypher: `
+                MATCH (t:Thing)<-[:SELECTS|CONTAINS]-(cc)
+                WHERE NOT t:Content AND (cc:Curation OR cc:ContentCollection)
+                RETURN t.uuid as uuid, COLLECT(DISTINCT cc.uuid) as related, '' as detail
+                LIMIT $limit
+                `,
+	},
+	{
+		name:        "missing-order",
+		description: "SELECTS and CONTAINS edges of a collection with no order",
+		cypher: `
+                MATCH (cc)-[rel:SELECTS|CONTAINS]->(t:Thing)
+                WHERE (cc:Curation OR cc:ContentCollection) AND rel.order IS NULL
+                RETURN cc.uuid as uuid, COLLECT(t.uuid) as related, '' as detail
+                LIMIT $limit
+                `,
+	},
+	{
+		name:        "duplicate-order",
+		description: "SELECTS and CONTAINS edges of a collection sharing the same order",
+		cypher: `
+                MATCH (cc)-[rel:SELECTS|CONTAINS]->(t:Thing)
+                WHERE (cc:Curation OR cc:ContentCollection) AND rel.order IS NOT NULL
+                WITH cc, rel.order as order, COLLECT(t.uuid) as items
+                WHERE size(items) > 1
+                RETURN cc.uuid as uuid, items as related, 'order ' + toString(order) + ' is used ' + toString(size(items)) + ' times' as detail
+                LIMIT $limit
+                `,
+	},
+}
+
+type AuditViolation struct {
+	UUID    string   `json:"uuid"`
+	Related []string `json:"related,omitempty"`
+	Detail  string   `json:"detail,omitempty"`
+}
+
+type AuditCheckResult struct {
+	Name        string           `json:"name"`
+	Description string           `json:"description"`
+	Violations  []AuditViolation `json:"violations"`
+}
+
+type AuditReport struct {
+	Checks     []AuditCheckResult `json:"checks"`
+	Violations int                `json:"violations"`
+}
+
+// Auditor checks the integrity of the relations graph in Neo4j.
+type Auditor struct {
+	driver NeoDriver
+	limit  int
+}
+
+// NewAuditor creates an auditor reporting at most limit violations per check.
+func NewAuditor(driver NeoDriver, limit int) *Auditor {
+	return &Auditor{driver: driver, limit: limit}
+}
+
+// Run executes every check. Checks are run one query at a time, as the driver
+// stops executing queries after one that returns no results.
+func (a *Auditor) Run() (AuditReport, error) {
+	report := AuditReport{Checks: []AuditCheckResult{}}
+	for _, check := range auditChecks {
+		violations := []AuditViolation{}
+		query := &cmneo4j.Query{
+			Cypher: check.cypher,
+			Params: map[string]interface{}{"limit": a.limit},
+			Result: &violations,
+		}
+		if err := a.driver.Read(query); err != nil && !errors.Is(err, cmneo4j.ErrNoResultsFound) {
+			return AuditReport{}, fmt.Errorf("Error running audit check %s, err=%v", check.name, err)
+		}
+
+		report.Checks = append(report.Checks, AuditCheckResult{
+			Name:        check.name,
+			Description: check.description,
+			Violations:  violations,
+		})
+		report.Violations += len(violations)
+	}
+	return report, nil
+}
+
+func (r AuditReport) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
+
+func (r AuditReport) WriteText(w io.Writer) error {
+	var b strings.Builder
+	for _, check := range r.Checks {
+		status := "OK"
+		if len(check.Violations) > 0 {
+			status = "FAIL"
+		}
+		fmt.Fprintf(&b, "[%s] %s: %s (%d)\n", status, check.Name, check.Description, len(check.Violations))
+		for _, v := range check.Violations {
+			fmt.Fprintf(&b, "    %s", v.UUID)
+			if len(v.Related) > 0 {
+				fmt.Fprintf(&b, " -> %s", strings.Join(v.Related, ", "))
+			}
+			if v.Detail != "" {
+				fmt.Fprintf(&b, " (%s)", v.Detail)
+			}
+			b.WriteString("\n")
+		}
+	}
+	fmt.Fprintf(&b, "%d violation(s) found\n", r.Violations)
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
@@ -0,0 +1,70 @@
+//go:build integration
+// +build integration
+
+package relations
+
+import (
+	"testing"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAudit_OrphanContentCollection(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Short flag is set. Skipping integration test")
+	}
+	driver := getNeo4jDriver(t)
+	contents := []payloadData{leadContentCP, relatedContent1, relatedContent2}
+
+	writeContent(t, driver, contents)
+	writeContentCollection(t, driver, []payloadData{contentPackage}, "ContentPackage")
+	defer cleanDB(t, driver, allData)
+
+	auditor := NewAuditor(driver, 1000)
+	report, err := auditor.Run()
+	require.NoError(t, err)
+	assert.NotContains(t, auditedUUIDs(report, "orphan-content-collections"), contentPackage.uuid)
+	assert.NotContains(t, auditedUUIDs(report, "missing-order"), contentPackage.uuid)
+	assert.NotContains(t, auditedUUIDs(report, "duplicate-order"), contentPackage.uuid)
+
+	// Removing the lead content leaves the collection without a parent package
+	err = driver.Write(&cmneo4j.Query{
+		Cypher: `MATCH (a:Thing {uuid: $uuid}) DETACH DELETE a`,
+		Params: map[string]interface{}{"uuid": leadContentCP.uuid},
+	})
+	require.NoError(t, err)
+
+	report, err = auditor.Run()
+	require.NoError(t, err)
+	assert.Contains(t, auditedUUIDs(report, "orphan-content-collections"), contentPackage.uuid)
+	assert.NotZero(t, report.Violations)
+}
+
+func TestAudit_DanglingReferences(t *testing.T) {
+	if testing.Short() {
+		t.Skip("Short flag is set. Skipping integration test")
+	}
+	driver := getNeo4jDriver(t)
+	writeContent(t, driver, []payloadData{leadContentSP, relatedContent1, relatedContent2, relatedContent3})
+	writeContentCollection(t, driver, []payloadData{storyPackage}, "StoryPackage")
+	defer cleanDB(t, driver, append(allData, unresolvedContent))
+
+	report, err := NewAuditor(driver, 1000).Run()
+	require.NoError(t, err)
+	assert.Equal(t, []string{unresolvedContent.uuid}, auditedUUIDs(report, "dangling-references"),
+		"The item of the story package never written as Content should be reported once")
+}
+
+func auditedUUIDs(report AuditReport, check string) []string {
+	var uuids []string
+	for _, c := range report.Checks {
+		if c.Name == check {
+			for _, v := range c.Violations {
+				uuids = append(uuids, v.UUID)
+			}
+		}
+	}
+	return uuids
+}
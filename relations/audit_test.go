@@ -0,0 +1,37 @@
+package relations
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAuditReportWriteText(t *testing.T) {
+	report := AuditReport{
+		Checks: []AuditCheckResult{
+			{Name: "orphan-content-collections", Description: "ContentCollections with no parent ContentPackage", Violations: []AuditViolation{}},
+			{Name: "duplicate-order", Description: "SELECTS and CONTAINS edges of a collection sharing the same order", Violations: []AuditViolation{
+				{UUID: collectionUUID, Related: []string{item1UUID, item2UUID}, Detail: "order 1 is used 2 times"},
+			}},
+		},
+		Violations: 1,
+	}
+
+	var out bytes.Buffer
+	require.NoError(t, report.WriteText(&out))
+	assert.Equal(t, `[OK] orphan-content-collections: ContentCollections with no parent ContentPackage (0)
+[FAIL] duplicate-order: SELECTS and CONTAINS edges of a collection sharing the same order (1)
+    63559ba7-b48d-4467-1b1b-ce956f9e9494 -> 3fc9fe3e-af8c-1a1a-961a-e5065392bb31, 3fc9fe3e-af8c-2a2a-961a-e5065392bb31 (order 1 is used 2 times)
+1 violation(s) found
+`, out.String())
+
+	out.Reset()
+	require.NoError(t, report.WriteJSON(&out))
+	assert.JSONEq(t, `{"checks":[
+		{"name":"orphan-content-collections","description":"ContentCollections with no parent ContentPackage","violations":[]},
+		{"name":"duplicate-order","description":"SELECTS and CONTAINS edges of a collection sharing the same order","violations":[
+			{"uuid":"63559ba7-b48d-4467-1b1b-ce956f9e9494","related":["3fc9fe3e-af8c-1a1a-961a-e5065392bb31","3fc9fe3e-af8c-2a2a-961a-e5065392bb31"],"detail":"order 1 is used 2 times"}]}],
+		"violations":1}`, out.String())
+}
@@ -0,0 +1,502 @@
+package relations
+
+import (
+	"container/list"
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+)
+
+const (
+	contentCacheKeyPrefix           = "content/"
+	contentCollectionCacheKeyPrefix = "contentcollection/"
+)
+
+// RelationsCache stores the relations looked up by the cached driver, keyed
+// by content or content collection, and drops the entries built from the
+// UUIDs invalidated by collection events.
+type RelationsCache interface {
+	get(key string) (cacheEntry, bool)
+	// set stores the entry, unless one of its dependencies was invalidated
+	// since the lookup of its relations started
+	set(entry cacheEntry)
+	Invalidate(uuids ...string)
+	// startLookup returns the generation a lookup started at, which is kept
+	// in the entry it sets; endLookup is called once the entry is set
+	startLookup() uint64
+	endLookup()
+
+	// shared reports whether every replica reads and writes the same cache
+	shared() bool
+	// stats, lookup, evict, invalidate and flush administer the cache, see CacheAdmin
+	stats() (CacheStats, error)
+	lookup(uuid string) ([]CachedEntry, error)
+	evict(uuid string) (int, error)
+	invalidate(uuids ...string) (int, error)
+	flush() (int, error)
+}
+
+// CacheStats describes the content of a cache and how well it serves lookups.
+type CacheStats struct {
+	Backend    string  `json:"backend"`
+	Entries    int     `json:"entries"`
+	MaxEntries int     `json:"maxEntries,omitempty"`
+	Hits       int64   `json:"hits"`
+	Misses     int64   `json:"misses"`
+	HitRatio   float64 `json:"hitRatio"`
+	// Evictions counts the entries dropped to make room for new ones
+	Evictions int64 `json:"evictions"`
+	// Invalidations counts the entries dropped by collection events or admins
+	Invalidations int64 `json:"invalidations"`
+}
+
+func hitRatio(hits, misses int64) float64 {
+	if hits+misses == 0 {
+		return 0
+	}
+	return float64(hits) / float64(hits+misses)
+}
+
+// CachedEntry describes the cached relations of a content or content collection.
+type CachedEntry struct {
+	Key string `json:"key"`
+	// Found is false for cached lookups that found no relations
+	Found     bool      `json:"relationsFound"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// cacheKeys lists the keys the relations of the UUID are cached under, as content or as content collection.
+func cacheKeys(uuid string) []string {
+	return []string{contentCacheKeyPrefix + uuid, contentCollectionCacheKeyPrefix + uuid}
+}
+
+// invalidationLog records the UUIDs invalidated while lookups are in flight,
+// so that a lookup which started before an invalidation does not cache the
+// relations it read before it.
+type invalidationLog struct {
+	logMu      sync.Mutex
+	generation uint64
+	inFlight   int
+	// invalidated maps the UUIDs to the generation they were last invalidated
+	// at, it is cleared once no lookup is in flight
+	invalidated map[string]uint64
+	// flushed is the generation of the last invalidation of every UUID
+	flushed uint64
+}
+
+func (l *invalidationLog) startLookup() uint64 {
+	l.logMu.Lock()
+	defer l.logMu.Unlock()
+	l.inFlight++
+	return l.generation
+}
+
+func (l *invalidationLog) endLookup() {
+	l.logMu.Lock()
+	defer l.logMu.Unlock()
+	if l.inFlight--; l.inFlight == 0 {
+		l.invalidated = nil
+	}
+}
+
+func (l *invalidationLog) record(uuids ...string) {
+	l.logMu.Lock()
+	defer l.logMu.Unlock()
+	l.generation++
+	if l.inFlight == 0 {
+		return
+	}
+	if l.invalidated == nil {
+		l.invalidated = map[string]uint64{}
+	}
+	for _, u := range uuids {
+		l.invalidated[u] = l.generation
+	}
+}
+
+func (l *invalidationLog) recordFlush() {
+	l.logMu.Lock()
+	defer l.logMu.Unlock()
+	l.generation++
+	l.flushed = l.generation
+}
+
+// invalidatedSince reports whether any of the dependencies was invalidated
+// after the lookup that started at the generation.
+func (l *invalidationLog) invalidatedSince(started uint64, dependencies []string) bool {
+	l.logMu.Lock()
+	defer l.logMu.Unlock()
+	if l.flushed > started {
+		return true
+	}
+	for _, dep := range dependencies {
+		if l.invalidated[dep] > started {
+			return true
+		}
+	}
+	return false
+}
+
+// Cache is an in-process LRU cache of content and content collection relations.
+// Entries expire after a fixed TTL and are dropped early when one of the UUIDs
+// they were built from is invalidated.
+type Cache struct {
+	invalidationLog
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	entries    map[string]*list.Element
+	lru        *list.List
+	// dependants maps a content or collection UUID to the keys of the entries built from it
+	dependants map[string]map[string]struct{}
+	now        func() time.Time
+
+	hits          int64
+	misses        int64
+	evictions     int64
+	invalidations int64
+}
+
+type cacheEntry struct {
+	key          string
+	contentRel   relations
+	ccRel        ccRelations
+	found        bool
+	dependencies []string
+	expires      time.Time
+	// lookupStarted is the generation the lookup of the relations started at
+	lookupStarted uint64
+}
+
+func NewCache(maxEntries int, ttl time.Duration) *Cache {
+	return &Cache{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		entries:    map[string]*list.Element{},
+		lru:        list.New(),
+		dependants: map[string]map[string]struct{}{},
+		now:        time.Now,
+	}
+}
+
+func (c *Cache) get(key string) (cacheEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.entries[key]
+	if !ok {
+		c.misses++
+		return cacheEntry{}, false
+	}
+	entry := el.Value.(*cacheEntry)
+	if !c.now().Before(entry.expires) {
+		c.remove(el)
+		c.misses++
+		return cacheEntry{}, false
+	}
+	c.lru.MoveToFront(el)
+	c.hits++
+	return *entry, true
+}
+
+func (c *Cache) set(entry cacheEntry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.invalidatedSince(entry.lookupStarted, entry.dependencies) {
+		return
+	}
+	if el, ok := c.entries[entry.key]; ok {
+		c.remove(el)
+	}
+	entry.expires = c.now().Add(c.ttl)
+	c.entries[entry.key] = c.lru.PushFront(&entry)
+	for _, dep := range entry.dependencies {
+		keys, ok := c.dependants[dep]
+		if !ok {
+			keys = map[string]struct{}{}
+			c.dependants[dep] = keys
+		}
+		keys[entry.key] = struct{}{}
+	}
+
+	for c.maxEntries > 0 && c.lru.Len() > c.maxEntries {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// Invalidate drops every entry that was built from any of the given content or collection UUIDs.
+func (c *Cache) Invalidate(uuids ...string) {
+	c.invalidate(uuids...)
+}
+
+func (c *Cache) invalidate(uuids ...string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record(uuids...)
+	var dropped int
+	for _, u := range uuids {
+		for key := range c.dependants[u] {
+			if el, ok := c.entries[key]; ok {
+				c.remove(el)
+				dropped++
+			}
+		}
+	}
+	c.invalidations += int64(dropped)
+	return dropped, nil
+}
+
+func (c *Cache) stats() (CacheStats, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return CacheStats{
+		Backend:       "in-process",
+		Entries:       c.lru.Len(),
+		MaxEntries:    c.maxEntries,
+		Hits:          c.hits,
+		Misses:        c.misses,
+		HitRatio:      hitRatio(c.hits, c.misses),
+		Evictions:     c.evictions,
+		Invalidations: c.invalidations,
+	}, nil
+}
+
+// lookup lists the unexpired entries of the UUID, without counting as a use of them.
+func (c *Cache) lookup(uuid string) ([]CachedEntry, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached := []CachedEntry{}
+	for _, key := range cacheKeys(uuid) {
+		if el, ok := c.entries[key]; ok {
+			entry := el.Value.(*cacheEntry)
+			if c.now().Before(entry.expires) {
+				cached = append(cached, CachedEntry{Key: key, Found: entry.found, ExpiresAt: entry.expires})
+			}
+		}
+	}
+	return cached, nil
+}
+
+// evict drops the entries of the UUID, not the entries built from it.
+func (c *Cache) evict(uuid string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.record(uuid)
+	var dropped int
+	for _, key := range cacheKeys(uuid) {
+		if el, ok := c.entries[key]; ok {
+			c.remove(el)
+			dropped++
+		}
+	}
+	c.invalidations += int64(dropped)
+	return dropped, nil
+}
+
+func (c *Cache) shared() bool {
+	return false
+}
+
+func (c *Cache) flush() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.recordFlush()
+	dropped := c.lru.Len()
+	c.entries = map[string]*list.Element{}
+	c.lru.Init()
+	c.dependants = map[string]map[string]struct{}{}
+	c.invalidations += int64(dropped)
+	return dropped, nil
+}
+
+func (c *Cache) remove(el *list.Element) {
+	entry := c.lru.Remove(el).(*cacheEntry)
+	delete(c.entries, entry.key)
+	for _, dep := range entry.dependencies {
+		if keys, ok := c.dependants[dep]; ok {
+			delete(keys, entry.key)
+			if len(keys) == 0 {
+				delete(c.dependants, dep)
+			}
+		}
+	}
+}
+
+// CacheInvalidator drops the cached relations built from published
+// collections: those of the collection, of the content it lists and of its
+// lead content, which the previous relations may not have been built from.
+type CacheInvalidator struct {
+	cache  RelationsCache
+	driver Driver
+	log    *logger.UPPLogger
+}
+
+// NewCacheInvalidator creates the handler invalidating the cache on collection
+// events, the leads of the collections are read from the driver.
+func NewCacheInvalidator(cache RelationsCache, driver Driver, log *logger.UPPLogger) *CacheInvalidator {
+	return &CacheInvalidator{cache: cache, driver: driver, log: log}
+}
+
+// HandleCollectionEvent invalidates the collection, every content item listed in the event and the leads of the collection.
+func (ci *CacheInvalidator) HandleCollectionEvent(event CollectionEvent) {
+	leads, err := ci.driver.findContentCollectionLeads(event.UUID)
+	if err != nil {
+		ci.log.WithError(err).WithUUID(event.UUID).Warn("Failed to find the leads of the collection, their cached relations are served until they expire")
+	}
+	ci.cache.Invalidate(mergeUUIDs(event.AffectedUUIDs(), leads)...)
+}
+
+type cachedDriver struct {
+	driver Driver
+	cache  RelationsCache
+}
+
+// NewCachedDriver wraps the given driver so that lookups are served from the cache when possible.
+func NewCachedDriver(driver Driver, cache RelationsCache) Driver {
+	return &cachedDriver{driver: driver, cache: cache}
+}
+
+func (cd *cachedDriver) checkConnectivity() error {
+	return cd.driver.checkConnectivity()
+}
+
+func (cd *cachedDriver) checkReadConnectivity() error {
+	return cd.driver.checkReadConnectivity()
+}
+
+func (cd *cachedDriver) findContentCollectionLeads(contentCollectionUUID string) ([]string, error) {
+	return cd.driver.findContentCollectionLeads(contentCollectionUUID)
+}
+
+func (cd *cachedDriver) findRelatedContentUUIDs(afterUUID string, limit int) ([]string, error) {
+	return cd.driver.findRelatedContentUUIDs(afterUUID, limit)
+}
+
+func (cd *cachedDriver) findContentRelations(contentUUID string) (relations, bool, error) {
+	key := contentCacheKeyPrefix + contentUUID
+	if entry, ok := cd.cache.get(key); ok {
+		return entry.contentRel, entry.found, nil
+	}
+
+	started := cd.cache.startLookup()
+	defer cd.cache.endLookup()
+	rel, found, err := cd.driver.findContentRelations(contentUUID)
+	if err != nil {
+		return rel, found, err
+	}
+
+	cd.cache.set(cacheEntry{
+		key:           key,
+		contentRel:    rel,
+		found:         found,
+		dependencies:  append([]string{contentUUID}, rel.collectionUUIDs...),
+		lookupStarted: started,
+	})
+	return rel, found, nil
+}
+
+func (cd *cachedDriver) findContentCollectionRelations(contentCollectionUUID string) (ccRelations, bool, error) {
+	key := contentCollectionCacheKeyPrefix + contentCollectionUUID
+	if entry, ok := cd.cache.get(key); ok {
+		return entry.ccRel, entry.found, nil
+	}
+
+	started := cd.cache.startLookup()
+	defer cd.cache.endLookup()
+	rel, found, err := cd.driver.findContentCollectionRelations(contentCollectionUUID)
+	if err != nil {
+		return rel, found, err
+	}
+
+	cd.cache.set(cacheEntry{
+		key:           key,
+		ccRel:         rel,
+		found:         found,
+		dependencies:  []string{contentCollectionUUID},
+		lookupStarted: started,
+	})
+	return rel, found, nil
+}
+
+// storedEntry is the JSON a cache entry is stored as out of process, in Redis
+// or in the materialized store, as the relations keep the UUIDs of the
+// related content and the collections in unexported fields.
+type storedEntry struct {
+	Found        bool                    `json:"found"`
+	Content      *storedContentRelations `json:"content,omitempty"`
+	Collection   *ccRelations            `json:"collection,omitempty"`
+	Dependencies []string                `json:"dependencies,omitempty"`
+}
+
+type storedContentRelations struct {
+	CuratedRelatedContents []storedRelatedContent `json:"curatedRelatedContent,omitempty"`
+	Contains               []storedRelatedContent `json:"contains,omitempty"`
+	ContainedIn            []storedRelatedContent `json:"containedIn,omitempty"`
+	CollectionUUIDs        []string               `json:"collectionUUIDs,omitempty"`
+}
+
+type storedRelatedContent struct {
+	UUID       string `json:"uuid"`
+	Unresolved bool   `json:"unresolved,omitempty"`
+}
+
+func encodeStoredEntry(entry cacheEntry) ([]byte, error) {
+	stored := storedEntry{Found: entry.found, Dependencies: entry.dependencies}
+	if strings.HasPrefix(entry.key, contentCacheKeyPrefix) {
+		stored.Content = &storedContentRelations{
+			CuratedRelatedContents: toStoredRelatedContent(entry.contentRel.CuratedRelatedContents),
+			Contains:               toStoredRelatedContent(entry.contentRel.Contains),
+			ContainedIn:            toStoredRelatedContent(entry.contentRel.ContainedIn),
+			CollectionUUIDs:        entry.contentRel.collectionUUIDs,
+		}
+	} else {
+		stored.Collection = &entry.ccRel
+	}
+	return json.Marshal(stored)
+}
+
+func decodeStoredEntry(key string, data []byte) (cacheEntry, error) {
+	var stored storedEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return cacheEntry{}, err
+	}
+	entry := cacheEntry{key: key, found: stored.Found, dependencies: stored.Dependencies}
+	if stored.Content != nil {
+		entry.contentRel = relations{
+			CuratedRelatedContents: fromStoredRelatedContent(stored.Content.CuratedRelatedContents),
+			Contains:               fromStoredRelatedContent(stored.Content.Contains),
+			ContainedIn:            fromStoredRelatedContent(stored.Content.ContainedIn),
+			collectionUUIDs:        stored.Content.CollectionUUIDs,
+		}
+	}
+	if stored.Collection != nil {
+		entry.ccRel = *stored.Collection
+	}
+	return entry, nil
+}
+
+func toStoredRelatedContent(related []relatedContent) []storedRelatedContent {
+	var stored []storedRelatedContent
+	for _, rc := range related {
+		stored = append(stored, storedRelatedContent{UUID: rc.uuid, Unresolved: rc.Unresolved})
+	}
+	return stored
+}
+
+func fromStoredRelatedContent(stored []storedRelatedContent) []relatedContent {
+	related := []relatedContent{}
+	for _, rc := range stored {
+		related = append(related, relatedContent{uuid: rc.UUID, Unresolved: rc.Unresolved})
+	}
+	return related
+}
@@ -0,0 +1,179 @@
+package relations
+
+import (
+	"testing"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	leadUUID       = "3fc9fe3e-af8c-1b1b-961a-e5065392bb31"
+	collectionUUID = "63559ba7-b48d-4467-1b1b-ce956f9e9494"
+)
+
+type countingDriverMock struct {
+	cypherDriverMock
+	contentReads    int
+	collectionReads int
+}
+
+func (cdm *countingDriverMock) findContentRelations(contentUUID string) (relations, bool, error) {
+	cdm.contentReads++
+	rel, found, err := cdm.cypherDriverMock.findContentRelations(contentUUID)
+	if found {
+		rel.collectionUUIDs = []string{collectionUUID}
+	}
+	return rel, found, err
+}
+
+func (cdm *countingDriverMock) findContentCollectionRelations(contentCollectionUUID string) (ccRelations, bool, error) {
+	cdm.collectionReads++
+	return cdm.cypherDriverMock.findContentCollectionRelations(contentCollectionUUID)
+}
+
+func TestCachedDriverServesRepeatedLookupsFromCache(t *testing.T) {
+	mock := &countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}
+	driver := NewCachedDriver(mock, NewCache(10, time.Minute))
+
+	for i := 0; i < 3; i++ {
+		_, found, err := driver.findContentRelations(leadUUID)
+		assert.NoError(t, err)
+		assert.True(t, found)
+		_, found, err = driver.findContentRelations(knownUUID)
+		assert.NoError(t, err)
+		assert.False(t, found)
+	}
+
+	assert.Equal(t, 2, mock.contentReads, "Both found and not found results should be cached")
+}
+
+func TestCachedDriverDoesNotCacheErrors(t *testing.T) {
+	mock := &countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID, failRead: true}}
+	driver := NewCachedDriver(mock, NewCache(10, time.Minute))
+
+	_, _, err := driver.findContentRelations(leadUUID)
+	assert.Error(t, err)
+	_, _, err = driver.findContentRelations(leadUUID)
+	assert.Error(t, err)
+
+	assert.Equal(t, 2, mock.contentReads)
+}
+
+func TestCacheEntriesExpire(t *testing.T) {
+	now := time.Now()
+	cache := NewCache(10, time.Minute)
+	cache.now = func() time.Time { return now }
+	mock := &countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}
+	driver := NewCachedDriver(mock, cache)
+
+	driver.findContentCollectionRelations(leadUUID)
+	now = now.Add(59 * time.Second)
+	driver.findContentCollectionRelations(leadUUID)
+	assert.Equal(t, 1, mock.collectionReads)
+
+	now = now.Add(time.Second)
+	driver.findContentCollectionRelations(leadUUID)
+	assert.Equal(t, 2, mock.collectionReads)
+}
+
+func TestCacheEvictsLeastRecentlyUsed(t *testing.T) {
+	cache := NewCache(2, time.Minute)
+	cache.set(cacheEntry{key: "a", dependencies: []string{"a"}})
+	cache.set(cacheEntry{key: "b", dependencies: []string{"b"}})
+	cache.get("a")
+	cache.set(cacheEntry{key: "c", dependencies: []string{"c"}})
+
+	_, ok := cache.get("a")
+	assert.True(t, ok)
+	_, ok = cache.get("b")
+	assert.False(t, ok)
+	_, ok = cache.get("c")
+	assert.True(t, ok)
+	assert.NotContains(t, cache.dependants, "b")
+}
+
+func TestCacheInvalidatesEntriesBuiltFromCollection(t *testing.T) {
+	mock := &countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}
+	cache := NewCache(10, time.Minute)
+	driver := NewCachedDriver(mock, cache)
+
+	driver.findContentRelations(leadUUID)
+	driver.findContentRelations(knownUUID)
+	invalidator := NewCacheInvalidator(cache, mock, logger.NewUPPLogger("test", "PANIC"))
+	invalidator.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{}})
+	driver.findContentRelations(leadUUID)
+	driver.findContentRelations(knownUUID)
+	assert.Equal(t, 3, mock.contentReads, "Only the entry built from the collection should be invalidated")
+
+	invalidator.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: knownUUID}}})
+	driver.findContentRelations(knownUUID)
+	assert.Equal(t, 4, mock.contentReads, "Entries of the collection items should be invalidated")
+}
+
+// leadsDriverMock reads the given leads for every collection.
+type leadsDriverMock struct {
+	countingDriverMock
+	leads []string
+}
+
+func (ldm *leadsDriverMock) findContentCollectionLeads(contentCollectionUUID string) ([]string, error) {
+	return ldm.leads, nil
+}
+
+func TestCacheInvalidatesLeadsOfCollection(t *testing.T) {
+	mock := &leadsDriverMock{countingDriverMock: countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}}
+	cache := NewCache(10, time.Minute)
+	driver := NewCachedDriver(mock, cache)
+
+	_, found, _ := driver.findContentRelations(knownUUID)
+	assert.False(t, found)
+	mock.leads = []string{knownUUID}
+	NewCacheInvalidator(cache, mock, logger.NewUPPLogger("test", "PANIC")).HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{}})
+	driver.findContentRelations(knownUUID)
+	assert.Equal(t, 2, mock.contentReads, "the relations of the lead the collection was attached to should be invalidated")
+}
+
+// invalidatingDriverMock runs an invalidation while a lookup is in flight.
+type invalidatingDriverMock struct {
+	countingDriverMock
+	duringLookup func()
+}
+
+func (idm *invalidatingDriverMock) findContentRelations(contentUUID string) (relations, bool, error) {
+	rel, found, err := idm.countingDriverMock.findContentRelations(contentUUID)
+	if idm.duringLookup != nil {
+		idm.duringLookup()
+		idm.duringLookup = nil
+	}
+	return rel, found, err
+}
+
+func TestCachedDriverDoesNotCacheLookupsInvalidatedInFlight(t *testing.T) {
+	for name, invalidate := range map[string]func(cache *Cache){
+		"invalidate": func(cache *Cache) { cache.Invalidate(collectionUUID) },
+		"flush":      func(cache *Cache) { cache.flush() },
+	} {
+		t.Run(name, func(t *testing.T) {
+			cache := NewCache(10, time.Minute)
+			mock := &invalidatingDriverMock{countingDriverMock: countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}}
+			mock.duringLookup = func() { invalidate(cache) }
+			driver := NewCachedDriver(mock, cache)
+
+			driver.findContentRelations(leadUUID)
+			driver.findContentRelations(leadUUID)
+			assert.Equal(t, 2, mock.contentReads, "The relations read before the invalidation should not be cached")
+			driver.findContentRelations(leadUUID)
+			assert.Equal(t, 2, mock.contentReads, "The relations read after the invalidation should be cached")
+		})
+	}
+
+	cache := NewCache(10, time.Minute)
+	mock := &invalidatingDriverMock{countingDriverMock: countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}}
+	mock.duringLookup = func() { cache.Invalidate(knownUUID) }
+	driver := NewCachedDriver(mock, cache)
+	driver.findContentRelations(leadUUID)
+	driver.findContentRelations(leadUUID)
+	assert.Equal(t, 1, mock.contentReads, "Invalidating other UUIDs should not prevent caching")
+}
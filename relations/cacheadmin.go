@@ -0,0 +1,198 @@
+package relations
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/gorilla/mux"
+)
+
+// cacheAuditRecord is a line of the cache audit log.
+type cacheAuditRecord struct {
+	Time     time.Time `json:"time"`
+	Instance string    `json:"instance"`
+	Caller   string    `json:"caller"`
+	Action   string    `json:"action"`
+	UUID     string    `json:"uuid,omitempty"`
+	Evicted  *int      `json:"evicted,omitempty"`
+	Error    string    `json:"error,omitempty"`
+}
+
+// CacheAdmin serves the admin endpoints inspecting and evicting cached
+// relations. Every action is written to the audit log with the admin calling it.
+// Unless the cache is shared by every replica, the actions only apply to the
+// instance the call reached, which every response reports.
+type CacheAdmin struct {
+	cache      RelationsCache
+	instanceID string
+	// audit receives a JSON line per action, the actions are logged when nil
+	audit   io.Writer
+	auditMu sync.Mutex
+	log     *logger.UPPLogger
+}
+
+// NewCacheAdmin creates the admin endpoints of the cache of the instance.
+func NewCacheAdmin(cache RelationsCache, instanceID string, audit io.Writer, log *logger.UPPLogger) *CacheAdmin {
+	return &CacheAdmin{cache: cache, instanceID: instanceID, audit: audit, log: log}
+}
+
+// cacheScope tells which instances an admin call applied to: every replica
+// when the cache is shared, otherwise only the instance that served it.
+type cacheScope struct {
+	Instance string `json:"instance"`
+	Shared   bool   `json:"shared"`
+}
+
+type cacheStatsResponse struct {
+	cacheScope
+	CacheStats
+}
+
+type cacheLookupResponse struct {
+	cacheScope
+	UUID    string        `json:"uuid"`
+	Cached  bool          `json:"cached"`
+	Entries []CachedEntry `json:"entries"`
+}
+
+type cacheEvictionResponse struct {
+	cacheScope
+	Evicted int `json:"evicted"`
+}
+
+func (ca *CacheAdmin) scope() cacheScope {
+	return cacheScope{Instance: ca.instanceID, Shared: ca.cache.shared()}
+}
+
+// Stats serves the size, hit ratio and evictions of the cache.
+func (ca *CacheAdmin) Stats(w http.ResponseWriter, r *http.Request) {
+	stats, err := ca.cache.stats()
+	ca.record(r, "stats", "", nil, err)
+	if err != nil {
+		ca.writeUnavailable(w, r, "Error reading the cache stats", err)
+		return
+	}
+	writeAdminJSON(w, r, http.StatusOK, cacheStatsResponse{cacheScope: ca.scope(), CacheStats: stats})
+}
+
+// Lookup serves whether the relations of the UUID are cached, and until when,
+// in the cache of the instance serving it when the cache isn't shared.
+func (ca *CacheAdmin) Lookup(w http.ResponseWriter, r *http.Request) {
+	u, ok := ca.uuid(w, r)
+	if !ok {
+		return
+	}
+	entries, err := ca.cache.lookup(u)
+	ca.record(r, "lookup", u, nil, err)
+	if err != nil {
+		ca.writeUnavailable(w, r, "Error looking up the cache for "+u, err)
+		return
+	}
+	writeAdminJSON(w, r, http.StatusOK, cacheLookupResponse{cacheScope: ca.scope(), UUID: u, Cached: len(entries) > 0, Entries: entries})
+}
+
+// Evict drops the cached relations of the UUID, as content or content collection.
+func (ca *CacheAdmin) Evict(w http.ResponseWriter, r *http.Request) {
+	u, ok := ca.uuid(w, r)
+	if !ok {
+		return
+	}
+	ca.evicted(w, r, "evict", u, func() (int, error) { return ca.cache.evict(u) })
+}
+
+// EvictCollection drops every cached relations built from the content collection.
+func (ca *CacheAdmin) EvictCollection(w http.ResponseWriter, r *http.Request) {
+	u, ok := ca.uuid(w, r)
+	if !ok {
+		return
+	}
+	ca.evicted(w, r, "evict-collection", u, func() (int, error) { return ca.cache.invalidate(u) })
+}
+
+// Flush drops every cached relations.
+func (ca *CacheAdmin) Flush(w http.ResponseWriter, r *http.Request) {
+	ca.evicted(w, r, "flush", "", ca.cache.flush)
+}
+
+func (ca *CacheAdmin) evicted(w http.ResponseWriter, r *http.Request, action, u string, evict func() (int, error)) {
+	evicted, err := evict()
+	ca.record(r, action, u, &evicted, err)
+	if err != nil {
+		ca.writeUnavailable(w, r, "Error evicting from the cache", err)
+		return
+	}
+	writeAdminJSON(w, r, http.StatusOK, cacheEvictionResponse{cacheScope: ca.scope(), Evicted: evicted})
+}
+
+func (ca *CacheAdmin) uuid(w http.ResponseWriter, r *http.Request) (string, bool) {
+	u := mux.Vars(r)["uuid"]
+	if err := validateUuid(u); err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidUUID,
+			detail:  fmt.Sprintf("The given uuid is not valid, err=%v", err),
+		})
+		return "", false
+	}
+	return u, true
+}
+
+func (ca *CacheAdmin) record(r *http.Request, action, u string, evicted *int, err error) {
+	record := cacheAuditRecord{Time: time.Now().UTC(), Instance: ca.instanceID, Caller: adminIdentity(r), Action: action, UUID: u, Evicted: evicted}
+	if err != nil {
+		record.Error = err.Error()
+	}
+
+	if ca.audit == nil {
+		entry := ca.log.WithField("admin", record.Caller).WithField("action", action).WithField("instance", ca.instanceID)
+		if u != "" {
+			entry = entry.WithUUID(u)
+		}
+		if evicted != nil {
+			entry = entry.WithField("evicted", *evicted)
+		}
+		if err != nil {
+			entry = entry.WithError(err)
+		}
+		entry.Info("Cache administered")
+		return
+	}
+
+	line, _ := json.Marshal(record)
+	ca.auditMu.Lock()
+	defer ca.auditMu.Unlock()
+	if _, werr := ca.audit.Write(append(line, '\n')); werr != nil {
+		ca.log.WithError(werr).WithField("record", string(line)).Error("Failed to write the cache audit log")
+	}
+}
+
+func (ca *CacheAdmin) writeUnavailable(w http.ResponseWriter, r *http.Request, detail string, err error) {
+	writeError(w, r, apiError{
+		status:  http.StatusServiceUnavailable,
+		problem: problemUnavailable,
+		detail:  fmt.Sprintf("%s, err=%v", detail, err),
+	})
+}
+
+// writeAdminJSON encodes the body before the status is sent, so that a
+// failure is still reported as an error.
+func writeAdminJSON(w http.ResponseWriter, r *http.Request, status int, body interface{}) {
+	data, err := json.Marshal(body)
+	if err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusInternalServerError,
+			problem: problemEncoding,
+			detail:  fmt.Sprintf("Error encoding the response, err=%v", err),
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	_, _ = w.Write(append(data, '\n'))
+}
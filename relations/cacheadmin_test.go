@@ -0,0 +1,163 @@
+package relations
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newCacheAdminRouter(t *testing.T, cache RelationsCache, audit *bytes.Buffer) *mux.Router {
+	auth, err := NewAdminAuth("ops:token-1")
+	require.NoError(t, err)
+	ca := NewCacheAdmin(cache, "relations-api-1", audit, logger.NewUPPLogger("test", "PANIC"))
+	r := mux.NewRouter()
+	r.HandleFunc("/__cache/stats", auth.Wrap(ca.Stats)).Methods("GET")
+	r.HandleFunc("/__cache/entries/{uuid}", auth.Wrap(ca.Lookup)).Methods("GET")
+	r.HandleFunc("/__cache/entries/{uuid}", auth.Wrap(ca.Evict)).Methods("DELETE")
+	r.HandleFunc("/__cache/contentcollection/{uuid}", auth.Wrap(ca.EvictCollection)).Methods("DELETE")
+	r.HandleFunc("/__cache", auth.Wrap(ca.Flush)).Methods("DELETE")
+	return r
+}
+
+func serveCacheAdmin(r *mux.Router, method, path string, body interface{}) int {
+	req := httptest.NewRequest(method, path, nil)
+	req.Header.Set("Authorization", "Bearer token-1")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	if body != nil {
+		json.NewDecoder(rec.Body).Decode(body)
+	}
+	return rec.Code
+}
+
+func auditRecords(t *testing.T, audit *bytes.Buffer) []cacheAuditRecord {
+	var records []cacheAuditRecord
+	scanner := bufio.NewScanner(bytes.NewReader(audit.Bytes()))
+	for scanner.Scan() {
+		var record cacheAuditRecord
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &record))
+		records = append(records, record)
+	}
+	return records
+}
+
+func testCacheAdmin(t *testing.T, cache RelationsCache) {
+	mock := &countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}
+	driver := NewCachedDriver(mock, cache)
+	driver.findContentRelations(leadUUID)
+	driver.findContentRelations(leadUUID)
+	driver.findContentRelations(knownUUID)
+	driver.findContentCollectionRelations(leadUUID)
+
+	audit := &bytes.Buffer{}
+	r := newCacheAdminRouter(t, cache, audit)
+
+	var stats cacheStatsResponse
+	require.Equal(t, http.StatusOK, serveCacheAdmin(r, "GET", "/__cache/stats", &stats))
+	assert.Equal(t, cacheScope{Instance: "relations-api-1", Shared: cache.shared()}, stats.cacheScope)
+	assert.Equal(t, 3, stats.Entries)
+	assert.Equal(t, int64(1), stats.Hits)
+	assert.Equal(t, int64(3), stats.Misses)
+	assert.Equal(t, 0.25, stats.HitRatio)
+
+	var lookup cacheLookupResponse
+	require.Equal(t, http.StatusOK, serveCacheAdmin(r, "GET", "/__cache/entries/"+leadUUID, &lookup))
+	assert.True(t, lookup.Cached)
+	require.Len(t, lookup.Entries, 2)
+	assert.Equal(t, contentCacheKeyPrefix+leadUUID, lookup.Entries[0].Key)
+	assert.True(t, lookup.Entries[0].Found)
+	assert.WithinDuration(t, time.Now().Add(time.Minute), lookup.Entries[0].ExpiresAt, 5*time.Second)
+
+	var evicted cacheEvictionResponse
+	require.Equal(t, http.StatusOK, serveCacheAdmin(r, "DELETE", "/__cache/entries/"+leadUUID, &evicted))
+	assert.Equal(t, 2, evicted.Evicted)
+	assert.Equal(t, "relations-api-1", evicted.Instance)
+	require.Equal(t, http.StatusOK, serveCacheAdmin(r, "GET", "/__cache/entries/"+leadUUID, &lookup))
+	assert.False(t, lookup.Cached)
+	assert.Empty(t, lookup.Entries)
+
+	driver.findContentRelations(leadUUID)
+	require.Equal(t, http.StatusOK, serveCacheAdmin(r, "DELETE", "/__cache/contentcollection/"+collectionUUID, &evicted))
+	assert.Equal(t, 1, evicted.Evicted, "only the content built from the collection should be evicted")
+
+	require.Equal(t, http.StatusOK, serveCacheAdmin(r, "DELETE", "/__cache", &evicted))
+	assert.Equal(t, 1, evicted.Evicted)
+	require.Equal(t, http.StatusOK, serveCacheAdmin(r, "GET", "/__cache/stats", &stats))
+	assert.Equal(t, 0, stats.Entries)
+
+	assert.Equal(t, http.StatusBadRequest, serveCacheAdmin(r, "DELETE", "/__cache/entries/not-a-uuid", nil))
+
+	records := auditRecords(t, audit)
+	require.Len(t, records, 7)
+	for _, record := range records {
+		assert.Equal(t, "ops", record.Caller)
+		assert.Equal(t, "relations-api-1", record.Instance)
+	}
+	assert.Equal(t, "evict", records[2].Action)
+	assert.Equal(t, leadUUID, records[2].UUID)
+	require.NotNil(t, records[2].Evicted)
+	assert.Equal(t, 2, *records[2].Evicted)
+	assert.Equal(t, "evict-collection", records[4].Action)
+	assert.Equal(t, "flush", records[5].Action)
+}
+
+func TestRedisCacheAdmin(t *testing.T) {
+	cache, _ := newTestRedisCache(t)
+	testCacheAdmin(t, cache)
+}
+
+// The in-process cache is administered on the instance the call reached only,
+// which the responses report.
+func TestInProcessCacheAdmin(t *testing.T) {
+	testCacheAdmin(t, NewCache(10, time.Minute))
+}
+
+func TestRedisCacheAdminUnavailable(t *testing.T) {
+	cache, mr := newTestRedisCache(t)
+	audit := &bytes.Buffer{}
+	r := newCacheAdminRouter(t, cache, audit)
+	mr.SetError("connection reset")
+
+	assert.Equal(t, http.StatusServiceUnavailable, serveCacheAdmin(r, "DELETE", "/__cache", nil))
+	records := auditRecords(t, audit)
+	require.Len(t, records, 1)
+	assert.Equal(t, "flush", records[0].Action)
+	assert.NotEmpty(t, records[0].Error)
+}
+
+func TestCacheAdminRequiresToken(t *testing.T) {
+	audit := &bytes.Buffer{}
+	r := newCacheAdminRouter(t, NewCache(10, time.Minute), audit)
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("DELETE", "/__cache", nil))
+
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+	assert.Empty(t, audit.String())
+}
+
+func TestCacheStatsEvictions(t *testing.T) {
+	cache := NewCache(1, time.Minute)
+	cache.set(cacheEntry{key: "a"})
+	cache.set(cacheEntry{key: "b"})
+
+	stats, err := cache.stats()
+	require.NoError(t, err)
+	assert.Equal(t, 1, stats.Entries)
+	assert.Equal(t, int64(1), stats.Evictions)
+}
+
+func TestWriteAdminJSONEncodingFailure(t *testing.T) {
+	rec := httptest.NewRecorder()
+	writeAdminJSON(rec, httptest.NewRequest("GET", "/__cache/stats", nil), http.StatusOK, map[string]interface{}{"entries": make(chan int)})
+	assert.Equal(t, http.StatusInternalServerError, rec.Code, "the error should be sent instead of the status")
+	assert.Contains(t, rec.Body.String(), "Error encoding the response")
+}
@@ -0,0 +1,147 @@
+package relations
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+)
+
+// collectionVersion is a version of a collection, as given by its publish event.
+type collectionVersion struct {
+	lastModified     time.Time
+	publishReference string
+}
+
+// supersedes reports whether the version is a new one after the previous
+// version seen. Without a valid lastModified, versions are only told apart by
+// their publish reference.
+func (v collectionVersion) supersedes(previous collectionVersion) bool {
+	if v.publishReference == previous.publishReference {
+		return false
+	}
+	return v.lastModified.IsZero() || !v.lastModified.Before(previous.lastModified)
+}
+
+// collectionState is the last version of a collection seen, with its leads and items.
+type collectionState struct {
+	uuid    string
+	version collectionVersion
+	leads   []string
+	items   []string
+}
+
+// changeTracker works out which content has different relations after a new
+// version of a content collection is published, by comparing its leads and
+// items with the version seen before. The last versions of at most
+// maxCollections collections are kept, the least recently published are
+// forgotten first: every content of a collection not seen before changed.
+type changeTracker struct {
+	driver         Driver
+	maxCollections int
+	mu             sync.Mutex
+	collections    map[string]*list.Element
+	lru            *list.List
+}
+
+func newChangeTracker(driver Driver, maxCollections int) *changeTracker {
+	return &changeTracker{
+		driver:         driver,
+		maxCollections: maxCollections,
+		collections:    map[string]*list.Element{},
+		lru:            list.New(),
+	}
+}
+
+// changedContent returns the content whose relations changed with the version
+// of the collection, and false when this version was already seen or is older
+// than the last one seen. When the leads can't be read, every content of both
+// versions is returned with the error.
+func (ct *changeTracker) changedContent(event CollectionEvent, version collectionVersion) ([]string, bool, error) {
+	leads, leadsErr := ct.driver.findContentCollectionLeads(event.UUID)
+	items := event.ItemUUIDs()
+
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	var previous collectionState
+	el, seen := ct.collections[event.UUID]
+	if seen {
+		previous = *el.Value.(*collectionState)
+		if !version.supersedes(previous.version) {
+			return nil, false, nil
+		}
+	}
+
+	if leadsErr != nil {
+		ct.put(collectionState{uuid: event.UUID, version: version, leads: previous.leads, items: items})
+		return mergeUUIDs(previous.leads, items, previous.items), true, leadsErr
+	}
+	ct.put(collectionState{uuid: event.UUID, version: version, leads: leads, items: items})
+	if !seen {
+		return mergeUUIDs(leads, items), true, nil
+	}
+	return changedBetween(previous, leads, items), true, nil
+}
+
+func (ct *changeTracker) put(state collectionState) {
+	if el, ok := ct.collections[state.uuid]; ok {
+		ct.lru.Remove(el)
+	}
+	ct.collections[state.uuid] = ct.lru.PushFront(&state)
+	for ct.lru.Len() > ct.maxCollections {
+		oldest := ct.lru.Remove(ct.lru.Back()).(*collectionState)
+		delete(ct.collections, oldest.uuid)
+	}
+}
+
+// changedBetween lists the content whose relations differ between the
+// previous version of a collection and its new leads and items. The leads and
+// items are related to each other: when the leads change, every lead and item
+// of both versions changed; otherwise the leads changed when the items or
+// their order did, along with the items added or removed.
+func changedBetween(previous collectionState, leads, items []string) []string {
+	if !sameUUIDSet(previous.leads, leads) {
+		return mergeUUIDs(previous.leads, leads, previous.items, items)
+	}
+	if sameUUIDList(previous.items, items) {
+		return nil
+	}
+
+	added := missingUUIDs(items, previous.items)
+	removed := missingUUIDs(previous.items, items)
+	return mergeUUIDs(leads, added, removed)
+}
+
+func sameUUIDList(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func sameUUIDSet(a, b []string) bool {
+	a, b = append([]string{}, a...), append([]string{}, b...)
+	sort.Strings(a)
+	sort.Strings(b)
+	return sameUUIDList(a, b)
+}
+
+// missingUUIDs returns the UUIDs of the list missing from the other one.
+func missingUUIDs(list, other []string) []string {
+	in := map[string]bool{}
+	for _, u := range other {
+		in[u] = true
+	}
+	var missing []string
+	for _, u := range list {
+		if !in[u] {
+			missing = append(missing, u)
+		}
+	}
+	return missing
+}
@@ -0,0 +1,252 @@
+package relations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	logger "github.com/Financial-Times/go-logger/v2"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const (
+	// RoutingRoundRobin spreads the reads across the available members
+	RoutingRoundRobin = "round-robin"
+	// RoutingOrdered sends the reads to the first available member, in the configured order
+	RoutingOrdered = "ordered"
+	// RoutingLeastLatency sends the reads to the available member that answered the last probe the fastest
+	RoutingLeastLatency = "least-latency"
+)
+
+// failovers counts the reads retried on another member after theirs became unavailable
+var failovers = metrics.GetOrRegisterCounter("relations.neo4j_failovers", metrics.DefaultRegistry)
+
+// NeoDriver is what the relations queries need from Neo4j, implemented by
+// the cmneo4j driver of a single member and by a cluster of them.
+type NeoDriver interface {
+	Read(queries ...*cmneo4j.Query) error
+	VerifyWriteConnectivity() error
+	Close() error
+}
+
+// ClusterMember is a Neo4j member reads can be routed to. The address is
+// a bolt:// or neo4j:// URL, the latter being routed further by the driver.
+type ClusterMember struct {
+	Address string
+	Driver  NeoDriver
+}
+
+type memberState struct {
+	ClusterMember
+	mu        sync.Mutex
+	available bool
+	latency   time.Duration
+}
+
+// NeoCluster routes the reads across its members according to the routing
+// policy, failing over to the next member when the current one disappears.
+// Members are considered available until a probe fails and are probed again
+// in the background to notice when they come back.
+type NeoCluster struct {
+	members []*memberState
+	policy  string
+	next    atomic.Uint64
+	log     *logger.UPPLogger
+}
+
+// NewNeoCluster creates a cluster of the given members, at least one being required.
+func NewNeoCluster(members []ClusterMember, policy string, log *logger.UPPLogger) (*NeoCluster, error) {
+	switch policy {
+	case RoutingRoundRobin, RoutingOrdered, RoutingLeastLatency:
+	default:
+		return nil, fmt.Errorf("Unknown routing policy %s, expected one of %s, %s, %s", policy, RoutingRoundRobin, RoutingOrdered, RoutingLeastLatency)
+	}
+	if len(members) == 0 {
+		return nil, errors.New("A Neo4j cluster needs at least one member")
+	}
+
+	c := &NeoCluster{policy: policy, log: log}
+	for _, m := range members {
+		c.members = append(c.members, &memberState{ClusterMember: m, available: true})
+	}
+	return c, nil
+}
+
+// Start probes every member at the given interval until the context is done.
+func (c *NeoCluster) Start(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		c.probeAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Read executes the queries on a member chosen by the routing policy. When
+// they fail on a member that no longer answers probes, they are retried on
+// the next one. Errors of members that are still available, e.g. when no
+// results are found, are returned as is.
+func (c *NeoCluster) Read(queries ...*cmneo4j.Query) error {
+	var err error
+	for _, m := range c.candidates() {
+		err = m.Driver.Read(queries...)
+		if err == nil || errors.Is(err, cmneo4j.ErrNoResultsFound) || c.probe(m) == nil {
+			return err
+		}
+		failovers.Inc(1)
+		c.log.WithError(err).WithField("member", redactedAddress(m.Address)).Warn("Neo4j member unavailable, failing over to the next one")
+	}
+	return err
+}
+
+// VerifyWriteConnectivity reports an error unless a core member accepts
+// writes. The members with a neo4j:// routing URL, whose driver sends the
+// writes to the leader, are checked first. Read replicas refuse writes, so a
+// single core member accepting them is enough.
+func (c *NeoCluster) VerifyWriteConnectivity() error {
+	var routing, direct []*memberState
+	for _, m := range c.members {
+		if strings.HasPrefix(m.Address, "neo4j") {
+			routing = append(routing, m)
+		} else {
+			direct = append(direct, m)
+		}
+	}
+
+	var refused []string
+	for _, m := range append(routing, direct...) {
+		err := m.Driver.VerifyWriteConnectivity()
+		if err == nil {
+			return nil
+		}
+		refused = append(refused, fmt.Sprintf("%s: %v", redactedAddress(m.Address), err))
+	}
+	return fmt.Errorf("No Neo4j core member accepts writes, %s", strings.Join(refused, "; "))
+}
+
+// Close closes the drivers of every member.
+func (c *NeoCluster) Close() error {
+	var errs []error
+	for _, m := range c.members {
+		errs = append(errs, m.Driver.Close())
+	}
+	return errors.Join(errs...)
+}
+
+// HealthChecks returns a check per member. A single member being down only
+// reduces capacity, as reads fail over to the others.
+func (c *NeoCluster) HealthChecks() []fthealth.Check {
+	checks := make([]fthealth.Check, 0, len(c.members))
+	for _, m := range c.members {
+		m := m
+		address := redactedAddress(m.Address)
+		checks = append(checks, fthealth.Check{
+			BusinessImpact:   "Reads fail over to the other Neo4j members, with less capacity left to serve them",
+			Name:             "Check connectivity to Neo4j member " + address,
+			PanicGuide:       "https://runbooks.in.ft.com/upp-relations-api",
+			Severity:         2,
+			TechnicalSummary: fmt.Sprintf("Cannot read from the Neo4j member %s. Check that it is up and running and part of the cluster", address),
+			Checker: func() (string, error) {
+				if err := c.probe(m); err != nil {
+					return "Error reading from Neo4j member", err
+				}
+				return fmt.Sprintf("Neo4j member is available, answered in %v", m.probeLatency()), nil
+			},
+		})
+	}
+	return checks
+}
+
+// candidates lists the available members in the order of the routing
+// policy, followed by the unavailable ones as a last resort in case their
+// state is stale.
+func (c *NeoCluster) candidates() []*memberState {
+	var available, unavailable []*memberState
+	for _, m := range c.members {
+		if m.isAvailable() {
+			available = append(available, m)
+		} else {
+			unavailable = append(unavailable, m)
+		}
+	}
+
+	switch c.policy {
+	case RoutingRoundRobin:
+		if len(available) > 1 {
+			start := int(c.next.Add(1) % uint64(len(available)))
+			available = append(available[start:], available[:start]...)
+		}
+	case RoutingLeastLatency:
+		sort.SliceStable(available, func(i, j int) bool {
+			return available[i].probeLatency() < available[j].probeLatency()
+		})
+	}
+	return append(available, unavailable...)
+}
+
+func (c *NeoCluster) probeAll() {
+	var wg sync.WaitGroup
+	for _, m := range c.members {
+		wg.Add(1)
+		go func(m *memberState) {
+			defer wg.Done()
+			_ = c.probe(m)
+		}(m)
+	}
+	wg.Wait()
+}
+
+// probe reads from the member and records whether it is available.
+func (c *NeoCluster) probe(m *memberState) error {
+	start := time.Now()
+	err := m.Driver.Read(connectivityQuery())
+	latency := time.Since(start)
+
+	m.mu.Lock()
+	wasAvailable := m.available
+	m.available = err == nil
+	m.latency = latency
+	m.mu.Unlock()
+
+	entry := c.log.WithField("member", redactedAddress(m.Address))
+	if wasAvailable && err != nil {
+		entry.WithError(err).Error("Neo4j member became unavailable")
+	} else if !wasAvailable && err == nil {
+		entry.Info("Neo4j member is available again")
+	}
+	return err
+}
+
+func (m *memberState) isAvailable() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.available
+}
+
+func (m *memberState) probeLatency() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.latency
+}
+
+// redactedAddress hides the password of the member URL in logs and health checks.
+func redactedAddress(address string) string {
+	u, err := url.Parse(address)
+	if err != nil {
+		return address
+	}
+	return u.Redacted()
+}
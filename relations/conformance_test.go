@@ -0,0 +1,331 @@
+package relations
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	_ "modernc.org/sqlite"
+)
+
+type payloadData struct {
+	uuid   string
+	path   string
+	id     string
+	apiURL string
+}
+
+var (
+	leadContentSP = payloadData{"3fc9fe3e-af8c-4a4a-961a-e5065392bb31", "./fixtures/Content-with-SP-3fc9fe3e-af8c-4a4a-961a-e5065392bb31.json",
+		"http://api.ft.com/things/3fc9fe3e-af8c-4a4a-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-4a4a-961a-e5065392bb31"}
+	leadContentCP = payloadData{"3fc9fe3e-af8c-1b1b-961a-e5065392bb31", "./fixtures/Content-with-CP-3fc9fe3e-af8c-1b1b-961a-e5065392bb31.json",
+		"http://api.ft.com/things/3fc9fe3e-af8c-1b1b-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-1b1b-961a-e5065392bb31"}
+	relatedContent1 = payloadData{"3fc9fe3e-af8c-1a1a-961a-e5065392bb31", "./fixtures/Content-3fc9fe3e-af8c-1a1a-961a-e5065392bb31.json",
+		"http://api.ft.com/things/3fc9fe3e-af8c-1a1a-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-1a1a-961a-e5065392bb31"}
+	relatedContent2 = payloadData{"3fc9fe3e-af8c-2a2a-961a-e5065392bb31", "./fixtures/Content-3fc9fe3e-af8c-2a2a-961a-e5065392bb31.json",
+		"http://api.ft.com/things/3fc9fe3e-af8c-2a2a-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-2a2a-961a-e5065392bb31"}
+	relatedContent3 = payloadData{"3fc9fe3e-af8c-3a3a-961a-e5065392bb31", "./fixtures/Content-3fc9fe3e-af8c-3a3a-961a-e5065392bb31.json",
+		"http://api.ft.com/things/3fc9fe3e-af8c-3a3a-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-3a3a-961a-e5065392bb31"}
+	storyPackage = payloadData{"63559ba7-b48d-4467-b2b0-ce956f9e9494", "./fixtures/StoryPackage-63559ba7-b48d-4467-b2b0-ce956f9e9494.json",
+		"", ""}
+	contentPackage = payloadData{"63559ba7-b48d-4467-1b1b-ce956f9e9494", "./fixtures/ContentPackage-63559ba7-b48d-4467-1b1b-ce956f9e9494.json",
+		"", ""}
+	// unresolvedContent is selected by the story package but never written as content
+	unresolvedContent = payloadData{uuid: "3fc9fe3e-af8c-9a9a-961a-e5065392bb31"}
+	allData           = []payloadData{leadContentSP, leadContentCP, relatedContent1, relatedContent2, relatedContent3, storyPackage, contentPackage}
+)
+
+// conformanceStore is a relations store backing a Driver, which the
+// conformance scenarios write the fixtures to.
+type conformanceStore interface {
+	writeContent(t *testing.T, data []payloadData)
+	// writeContentCollection writes StoryPackage or ContentPackage fixtures
+	writeContentCollection(t *testing.T, data []payloadData, ccType string)
+	driver() Driver
+}
+
+// conformanceStores open an empty store per backend. The stores needing a
+// running database are added by the integration tests.
+var conformanceStores = map[string]func(t *testing.T) conformanceStore{
+	"sqlite":       newSQLiteConformanceStore,
+	"materialized": newMaterializedConformanceStore,
+	"snapshot":     newSnapshotConformanceStore,
+}
+
+// TestDriverConformance runs the same scenarios against every backend, so
+// that the API answers the same whichever store it reads.
+func TestDriverConformance(t *testing.T) {
+	scenarios := map[string]func(t *testing.T, store conformanceStore){
+		"FindContentRelations_StoryPackage_Ok":           testFindContentRelationsStoryPackage,
+		"FindContentRelations_StoryPackage_Unresolved":   testFindContentRelationsStoryPackageUnresolved,
+		"FindContentRelations_ContentPackage_Ok":         testFindContentRelationsContentPackage,
+		"FindContentRelations_Content_In_ContentPackage": testFindContentRelationsContentInContentPackage,
+		"FindContentRelations_NotFound":                  testFindContentRelationsNotFound,
+		"FindContentCollectionRelations_Ok":              testFindContentCollectionRelations,
+		"FindContentCollectionLeads_Ok":                  testFindContentCollectionLeads,
+		"FindRelatedContentUUIDs_Ok":                     testFindRelatedContentUUIDs,
+		"FindContentRelationsBatch_Ok":                   testFindContentRelationsBatch,
+	}
+	for backend, open := range conformanceStores {
+		for name, scenario := range scenarios {
+			t.Run(backend+"/"+name, func(t *testing.T) {
+				scenario(t, open(t))
+			})
+		}
+	}
+}
+
+func testFindContentRelationsStoryPackage(t *testing.T, store conformanceStore) {
+	expectedResponse := relations{
+		CuratedRelatedContents: []relatedContent{
+			{ID: relatedContent1.id, APIURL: relatedContent1.apiURL, uuid: relatedContent1.uuid},
+			{ID: relatedContent2.id, APIURL: relatedContent2.apiURL, uuid: relatedContent2.uuid},
+			{ID: relatedContent3.id, APIURL: relatedContent3.apiURL, uuid: relatedContent3.uuid},
+		},
+	}
+	store.writeContent(t, []payloadData{leadContentSP, relatedContent1, relatedContent2, relatedContent3})
+	store.writeContentCollection(t, []payloadData{storyPackage}, "StoryPackage")
+
+	actualRelations, found, err := store.driver().findContentRelations(leadContentSP.uuid)
+	assert.NoError(t, err, "Unexpected error for content %s", leadContentSP.uuid)
+	assert.True(t, found, "Found no relations for content %s", leadContentSP.uuid)
+	actualRelations = testURLs.defaults().relations(actualRelations)
+
+	actualRelations = actualRelations.withoutUnresolved()
+	assert.Equal(t, expectedResponse.CuratedRelatedContents, actualRelations.CuratedRelatedContents, "the curated related content should be in the order of the story package")
+}
+
+func testFindContentRelationsStoryPackageUnresolved(t *testing.T, store conformanceStore) {
+	expectedResponse := relations{
+		CuratedRelatedContents: []relatedContent{
+			{ID: relatedContent1.id, APIURL: relatedContent1.apiURL, uuid: relatedContent1.uuid},
+			{ID: relatedContent2.id, APIURL: relatedContent2.apiURL, uuid: relatedContent2.uuid},
+			{ID: relatedContent3.id, APIURL: relatedContent3.apiURL, uuid: relatedContent3.uuid},
+			{ID: "http://api.ft.com/things/" + unresolvedContent.uuid, APIURL: "http://api.ft.com/content/" + unresolvedContent.uuid, Unresolved: true, uuid: unresolvedContent.uuid},
+		},
+	}
+	store.writeContent(t, []payloadData{leadContentSP, relatedContent1, relatedContent2, relatedContent3})
+	store.writeContentCollection(t, []payloadData{storyPackage}, "StoryPackage")
+
+	actualRelations, found, err := store.driver().findContentRelations(leadContentSP.uuid)
+	assert.NoError(t, err, "Unexpected error for content %s", leadContentSP.uuid)
+	assert.True(t, found, "Found no relations for content %s", leadContentSP.uuid)
+	actualRelations = testURLs.defaults().relations(actualRelations)
+
+	assert.Equal(t, expectedResponse.CuratedRelatedContents, actualRelations.CuratedRelatedContents)
+	assert.Equal(t, []string{storyPackage.uuid}, actualRelations.collectionUUIDs)
+}
+
+func testFindContentRelationsContentPackage(t *testing.T, store conformanceStore) {
+	expectedResponse := relations{
+		Contains: []relatedContent{
+			{ID: relatedContent1.id, APIURL: relatedContent1.apiURL, uuid: relatedContent1.uuid},
+			{ID: relatedContent2.id, APIURL: relatedContent2.apiURL, uuid: relatedContent2.uuid},
+		},
+	}
+	store.writeContent(t, []payloadData{leadContentCP, relatedContent1, relatedContent2})
+	store.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	actualRelations, found, err := store.driver().findContentRelations(leadContentCP.uuid)
+	assert.NoError(t, err, "Unexpected error for content %s", leadContentCP.uuid)
+	assert.True(t, found, "Found no relations for content %s", leadContentCP.uuid)
+	actualRelations = testURLs.defaults().relations(actualRelations)
+
+	assert.Equal(t, expectedResponse.Contains, actualRelations.Contains, "the content should be in the order of the content package")
+}
+
+func testFindContentRelationsContentInContentPackage(t *testing.T, store conformanceStore) {
+	expectedResponse := relations{
+		ContainedIn: []relatedContent{
+			{ID: leadContentCP.id, APIURL: leadContentCP.apiURL, uuid: leadContentCP.uuid},
+		},
+	}
+	store.writeContent(t, []payloadData{leadContentCP, relatedContent1, relatedContent2})
+	store.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	actualRelations, found, err := store.driver().findContentRelations(relatedContent1.uuid)
+	assert.NoError(t, err, "Unexpected error for content %s", relatedContent1.uuid)
+	assert.True(t, found, "Found no relations for content %s", relatedContent1.uuid)
+	actualRelations = testURLs.defaults().relations(actualRelations)
+
+	assert.Equal(t, expectedResponse.ContainedIn, actualRelations.ContainedIn)
+	assert.Equal(t, []string{contentPackage.uuid}, actualRelations.collectionUUIDs)
+}
+
+func testFindContentRelationsNotFound(t *testing.T, store conformanceStore) {
+	store.writeContent(t, []payloadData{relatedContent3})
+
+	_, found, err := store.driver().findContentRelations(relatedContent3.uuid)
+	assert.NoError(t, err)
+	assert.False(t, found, "content in no collection should have no relations")
+
+	_, found, err = store.driver().findContentCollectionRelations(contentPackage.uuid)
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func testFindContentCollectionRelations(t *testing.T, store conformanceStore) {
+	expectedResponse := ccRelations{
+		ContainedIn: "3fc9fe3e-af8c-1b1b-961a-e5065392bb31",
+		Contains:    []string{"3fc9fe3e-af8c-1a1a-961a-e5065392bb31", "3fc9fe3e-af8c-2a2a-961a-e5065392bb31"},
+	}
+	store.writeContent(t, []payloadData{leadContentCP, relatedContent1, relatedContent2})
+	store.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	actualRelations, found, err := store.driver().findContentCollectionRelations(contentPackage.uuid)
+	assert.NoError(t, err, "Unexpected error for content package %s", contentPackage.uuid)
+	assert.True(t, found, "Found no relations for content package %s", contentPackage.uuid)
+
+	assert.Equal(t, actualRelations.ContainedIn, expectedResponse.ContainedIn)
+	assert.Equal(t, expectedResponse.Contains, actualRelations.Contains, "the content should be in the order of the content package")
+}
+
+func testFindContentCollectionLeads(t *testing.T, store conformanceStore) {
+	store.writeContent(t, []payloadData{leadContentSP, leadContentCP, relatedContent1, relatedContent2, relatedContent3})
+	store.writeContentCollection(t, []payloadData{storyPackage}, "StoryPackage")
+	store.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	leads, err := store.driver().findContentCollectionLeads(storyPackage.uuid)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{leadContentSP.uuid}, leads)
+
+	leads, err = store.driver().findContentCollectionLeads(contentPackage.uuid)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{leadContentCP.uuid}, leads)
+}
+
+func testFindRelatedContentUUIDs(t *testing.T, store conformanceStore) {
+	store.writeContent(t, []payloadData{leadContentSP, leadContentCP, relatedContent1, relatedContent2, relatedContent3})
+	store.writeContentCollection(t, []payloadData{storyPackage}, "StoryPackage")
+	store.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	// content only selected by a story package has no relations of its own
+	first, err := store.driver().findRelatedContentUUIDs("", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{relatedContent1.uuid, leadContentCP.uuid}, first)
+
+	rest, err := store.driver().findRelatedContentUUIDs(first[1], 10)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{relatedContent2.uuid, leadContentSP.uuid}, rest)
+}
+
+// testFindContentRelationsBatch checks that the batch lookup of the export
+// finds the same relations as findContentRelations, on the drivers having one.
+func testFindContentRelationsBatch(t *testing.T, store conformanceStore) {
+	bf, ok := store.driver().(batchRelationsFinder)
+	if !ok {
+		t.Skip("The driver has no batch lookup")
+	}
+	store.writeContent(t, []payloadData{leadContentSP, leadContentCP, relatedContent1, relatedContent2, relatedContent3})
+	store.writeContentCollection(t, []payloadData{storyPackage}, "StoryPackage")
+	store.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	uuids := []string{leadContentSP.uuid, leadContentCP.uuid, relatedContent1.uuid, relatedContent3.uuid, unresolvedContent.uuid}
+	found, err := bf.findContentRelationsBatch(uuids)
+	require.NoError(t, err)
+	for _, u := range uuids {
+		rel, ok, err := store.driver().findContentRelations(u)
+		require.NoError(t, err)
+		batched, batchedOK := found[u]
+		assert.Equal(t, ok, batchedOK, u)
+		if ok {
+			assert.Equal(t, rel, batched, u)
+		}
+	}
+}
+
+// sqlConformanceStore writes the fixtures to the SQLSchema tables.
+type sqlConformanceStore struct {
+	db *sql.DB
+}
+
+func newSQLiteConformanceStore(t *testing.T) conformanceStore {
+	db, err := sql.Open("sqlite", filepath.Join(t.TempDir(), "relations.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { db.Close() })
+	require.NoError(t, InitialiseSQLSchema(db))
+	return sqlConformanceStore{db: db}
+}
+
+func (s sqlConformanceStore) driver() Driver {
+	return NewSQLDriver(s.db)
+}
+
+func (s sqlConformanceStore) writeContent(t *testing.T, data []payloadData) {
+	for _, d := range data {
+		var content struct {
+			UUID           string `json:"uuid"`
+			StoryPackage   string `json:"storyPackage"`
+			ContentPackage string `json:"contentPackage"`
+		}
+		readFixture(t, d.path, &content)
+		s.exec(t, "INSERT INTO content (uuid) VALUES ($1) ON CONFLICT DO NOTHING", content.UUID)
+		if content.StoryPackage != "" {
+			s.exec(t, "INSERT INTO curations (uuid, curated_for) VALUES ($1, $2) ON CONFLICT (uuid) DO UPDATE SET curated_for = excluded.curated_for",
+				content.StoryPackage, content.UUID)
+		}
+		if content.ContentPackage != "" {
+			s.exec(t, "INSERT INTO collections (uuid, package_uuid) VALUES ($1, $2) ON CONFLICT (uuid) DO UPDATE SET package_uuid = excluded.package_uuid",
+				content.ContentPackage, content.UUID)
+		}
+	}
+}
+
+func (s sqlConformanceStore) writeContentCollection(t *testing.T, data []payloadData, ccType string) {
+	collections, items, itemsKey := "collections", "collection_contains", "collection_uuid"
+	if ccType == "StoryPackage" {
+		collections, items, itemsKey = "curations", "curation_selects", "curation_uuid"
+	}
+
+	for _, d := range data {
+		var collection struct {
+			UUID  string `json:"uuid"`
+			Items []struct {
+				UUID string `json:"uuid"`
+			} `json:"items"`
+		}
+		readFixture(t, d.path, &collection)
+		s.exec(t, fmt.Sprintf("INSERT INTO %s (uuid) VALUES ($1) ON CONFLICT DO NOTHING", collections), collection.UUID)
+		s.exec(t, fmt.Sprintf("DELETE FROM %s WHERE %s = $1", items, itemsKey), collection.UUID)
+		for i, item := range collection.Items {
+			s.exec(t, fmt.Sprintf("INSERT INTO %s (%s, item_uuid, item_order) VALUES ($1, $2, $3)", items, itemsKey), collection.UUID, item.UUID, i)
+		}
+	}
+}
+
+// The content packages containing the content are listed in the order of its
+// position in their collections.
+func TestSQLDriverContainedInOrder(t *testing.T) {
+	store := newSQLiteConformanceStore(t).(sqlConformanceStore)
+	for _, p := range []struct{ pkg, collection string }{{leadUUID, collectionUUID}, {otherUUID, item1UUID}} {
+		store.exec(t, "INSERT INTO content (uuid) VALUES ($1)", p.pkg)
+		store.exec(t, "INSERT INTO collections (uuid, package_uuid) VALUES ($1, $2)", p.collection, p.pkg)
+	}
+	store.exec(t, "INSERT INTO content (uuid) VALUES ($1)", knownUUID)
+	store.exec(t, "INSERT INTO collection_contains (collection_uuid, item_uuid, item_order) VALUES ($1, $2, 2)", collectionUUID, knownUUID)
+	store.exec(t, "INSERT INTO collection_contains (collection_uuid, item_uuid, item_order) VALUES ($1, $2, 0)", item1UUID, knownUUID)
+
+	rel, found, err := store.driver().findContentRelations(knownUUID)
+	require.NoError(t, err)
+	require.True(t, found)
+	require.Len(t, rel.ContainedIn, 2)
+	assert.Equal(t, otherUUID, rel.ContainedIn[0].uuid)
+	assert.Equal(t, leadUUID, rel.ContainedIn[1].uuid)
+}
+
+func (s sqlConformanceStore) exec(t *testing.T, query string, args ...interface{}) {
+	_, err := s.db.Exec(query, args...)
+	require.NoError(t, err)
+}
+
+func readFixture(t *testing.T, path string, v interface{}) {
+	f, err := os.Open(path)
+	require.NoError(t, err)
+	defer f.Close()
+	require.NoError(t, json.NewDecoder(f).Decode(v))
+}
@@ -0,0 +1,92 @@
+package relations
+
+import (
+	"context"
+	"encoding/json"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+)
+
+// CollectionEvent is a published content collection (StoryPackage or ContentPackage).
+type CollectionEvent struct {
+	UUID             string           `json:"uuid"`
+	Items            []collectionItem `json:"items"`
+	PublishReference string           `json:"publishReference"`
+	LastModified     string           `json:"lastModified"`
+}
+
+type collectionItem struct {
+	UUID string `json:"uuid"`
+}
+
+// ItemUUIDs returns the UUIDs of the content listed in the collection.
+func (e CollectionEvent) ItemUUIDs() []string {
+	uuids := make([]string, 0, len(e.Items))
+	for _, item := range e.Items {
+		uuids = append(uuids, item.UUID)
+	}
+	return uuids
+}
+
+// AffectedUUIDs returns the collection UUID followed by the UUIDs of the content it lists.
+func (e CollectionEvent) AffectedUUIDs() []string {
+	return append([]string{e.UUID}, e.ItemUUIDs()...)
+}
+
+// eventID identifies the event alike on every replica reading it: its publish
+// reference, or the collection and its modification time without one.
+func (e CollectionEvent) eventID() string {
+	if e.PublishReference != "" {
+		return e.PublishReference
+	}
+	return e.UUID + "@" + e.LastModified
+}
+
+// CollectionEventHandler reacts to published content collections.
+type CollectionEventHandler interface {
+	HandleCollectionEvent(event CollectionEvent)
+}
+
+// PublishEventConsumer reads publish messages from a queue and passes the
+// content collection events among them to the registered handlers.
+type PublishEventConsumer struct {
+	queue    Queue
+	handlers []CollectionEventHandler
+	log      *logger.UPPLogger
+}
+
+func NewPublishEventConsumer(queue Queue, log *logger.UPPLogger, handlers ...CollectionEventHandler) *PublishEventConsumer {
+	return &PublishEventConsumer{queue: queue, handlers: handlers, log: log}
+}
+
+// Start consumes messages until the context is cancelled.
+func (c *PublishEventConsumer) Start(ctx context.Context) error {
+	return c.queue.Consume(ctx, c.handleMessage)
+}
+
+func (c *PublishEventConsumer) handleMessage(msg Message) {
+	event, ok := parseCollectionEvent(msg)
+	if !ok {
+		return
+	}
+
+	c.log.WithTransactionID(msg.Headers["X-Request-Id"]).
+		WithUUID(event.UUID).
+		Debugf("Received content collection event with %d items", len(event.Items))
+	for _, h := range c.handlers {
+		h.HandleCollectionEvent(event)
+	}
+}
+
+// parseCollectionEvent decodes a publish message, reporting false for anything
+// that is not a content collection, i.e. has no uuid or no items list.
+func parseCollectionEvent(msg Message) (CollectionEvent, bool) {
+	var event CollectionEvent
+	if err := json.Unmarshal(msg.Body, &event); err != nil {
+		return CollectionEvent{}, false
+	}
+	if event.UUID == "" || event.Items == nil {
+		return CollectionEvent{}, false
+	}
+	return event, true
+}
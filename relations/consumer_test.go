@@ -0,0 +1,79 @@
+package relations
+
+import (
+	"context"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recordingEventHandler struct {
+	mu     sync.Mutex
+	events []CollectionEvent
+}
+
+func (h *recordingEventHandler) HandleCollectionEvent(event CollectionEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.events = append(h.events, event)
+}
+
+func (h *recordingEventHandler) received() []CollectionEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]CollectionEvent{}, h.events...)
+}
+
+func TestPublishEventConsumerPassesCollectionEventsToHandlers(t *testing.T) {
+	storyPackage, err := os.ReadFile("./fixtures/StoryPackage-63559ba7-b48d-4467-b2b0-ce956f9e9494.json")
+	require.NoError(t, err)
+	contentPackage, err := os.ReadFile("./fixtures/ContentPackage-63559ba7-b48d-4467-1b1b-ce956f9e9494.json")
+	require.NoError(t, err)
+	content, err := os.ReadFile("./fixtures/Content-3fc9fe3e-af8c-1a1a-961a-e5065392bb31.json")
+	require.NoError(t, err)
+
+	queue := NewMemoryQueue(10)
+	handler := &recordingEventHandler{}
+	consumer := NewPublishEventConsumer(queue, logger.NewUPPLogger("test", "PANIC"), handler)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go consumer.Start(ctx)
+
+	for _, body := range [][]byte{storyPackage, content, []byte("not json"), contentPackage} {
+		require.NoError(t, queue.Publish(Message{Body: body}))
+	}
+
+	assert.Eventually(t, func() bool { return len(handler.received()) == 2 }, time.Second, 10*time.Millisecond)
+	events := handler.received()
+	assert.Equal(t, "63559ba7-b48d-4467-b2b0-ce956f9e9494", events[0].UUID)
+	assert.Equal(t, []string{
+		"63559ba7-b48d-4467-b2b0-ce956f9e9494",
+		"3fc9fe3e-af8c-1a1a-961a-e5065392bb31",
+		"3fc9fe3e-af8c-2a2a-961a-e5065392bb31",
+		"3fc9fe3e-af8c-3a3a-961a-e5065392bb31",
+		"3fc9fe3e-af8c-9a9a-961a-e5065392bb31",
+	}, events[0].AffectedUUIDs())
+	assert.Equal(t, "63559ba7-b48d-4467-1b1b-ce956f9e9494", events[1].UUID)
+	assert.Equal(t, "2017-03-03T12:17:51.288Z", events[1].LastModified)
+}
+
+func TestMemoryQueueStopsConsumingWhenClosed(t *testing.T) {
+	queue := NewMemoryQueue(1)
+	done := make(chan error)
+	go func() { done <- queue.Consume(context.Background(), func(Message) {}) }()
+
+	require.NoError(t, queue.Close())
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Consume did not return after the queue was closed")
+	}
+	assert.Error(t, queue.Publish(Message{}))
+}
@@ -3,53 +3,160 @@ package relations
 import (
 	"errors"
 	"fmt"
-	"net/url"
+	"strings"
+	"time"
 
 	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+	metrics "github.com/rcrowley/go-metrics"
 )
 
+// danglingReferenceLookups counts the selected or contained items that were
+// never written as Content, every time an uncached lookup returns them. It
+// follows the lookup traffic hitting them, the audit command lists the
+// distinct dangling references.
+var danglingReferenceLookups = metrics.GetOrRegisterCounter("relations.dangling_reference_lookups", metrics.DefaultRegistry)
+
 type Driver interface {
 	findContentRelations(UUID string) (res relations, found bool, err error)
 	findContentCollectionRelations(UUID string) (res ccRelations, found bool, err error)
+	findContentCollectionLeads(UUID string) (leadUUIDs []string, err error)
+	// findRelatedContentUUIDs lists, in order, up to limit UUIDs after the given one of content taking part in a Curation or ContentPackage
+	findRelatedContentUUIDs(afterUUID string, limit int) (uuids []string, err error)
 	checkConnectivity() error
+	// checkReadConnectivity runs a trivial read, as the API never needs to write
+	checkReadConnectivity() error
 }
 
 type cypherDriver struct {
-	driver       *cmneo4j.Driver
-	publicAPIURL string
+	driver NeoDriver
+	// trace, when set, records every executed query and the raw UUIDs found
+	trace *lookupTrace
+}
+
+func NewCypherDriver(driver NeoDriver) Driver {
+	return &cypherDriver{driver: driver}
 }
 
-func NewCypherDriver(driver *cmneo4j.Driver, publicAPIURL string) (Driver, error) {
-	_, err := url.ParseRequestURI(publicAPIURL)
-	if err != nil {
-		return nil, err
+func (cd *cypherDriver) findRelatedContentUUIDs(afterUUID string, limit int) ([]string, error) {
+	neoUUIDs := []struct {
+		UUID string `json:"uuid"`
+	}{}
+
+	query := &cmneo4j.Query{
+		// Each side walks the uuid index of its label in order from afterUUID and
+		// stops after limit rows, instead of sorting every related UUID per page
+		Cypher: `
+                CALL {
+                    MATCH (c:Content)
+                    WHERE c.uuid > $afterUUID
+                      AND (EXISTS { (c)<-[:IS_CURATED_FOR]-(:Curation) }
+                           OR EXISTS { (c)<-[:CONTAINS]-(:ContentCollection)<-[:CONTAINS]-(:ContentPackage) })
+                    RETURN c.uuid as uuid
+                    ORDER BY uuid
+                    LIMIT $limit
+                    UNION
+                    MATCH (cp:ContentPackage)
+                    WHERE cp.uuid > $afterUUID AND EXISTS { (cp)-[:CONTAINS]->(:ContentCollection) }
+                    RETURN cp.uuid as uuid
+                    ORDER BY uuid
+                    LIMIT $limit
+                }
+                RETURN uuid
+                ORDER BY uuid
+                LIMIT $limit
+                `,
+		Params: map[string]interface{}{"afterUUID": afterUUID, "limit": limit},
+		Result: &neoUUIDs,
+	}
+
+	err := cd.read(query)
+	if err != nil && !errors.Is(err, cmneo4j.ErrNoResultsFound) {
+		return nil, fmt.Errorf("Error listing related content after uuid=%s, err=%v", afterUUID, err)
 	}
 
-	return &cypherDriver{
-		driver:       driver,
-		publicAPIURL: publicAPIURL,
-	}, nil
+	uuids := make([]string, 0, len(neoUUIDs))
+	for _, u := range neoUUIDs {
+		uuids = append(uuids, u.UUID)
+	}
+	return uuids, nil
+}
+
+// withTrace returns a copy of the driver recording its queries to trace.
+func (cd *cypherDriver) withTrace(trace *lookupTrace) *cypherDriver {
+	traced := *cd
+	traced.trace = trace
+	return &traced
+}
+
+// read executes the queries in a single transaction, or one at a time when
+// tracing so that each can be timed. Either way no query is executed after
+// one that returns no results.
+func (cd *cypherDriver) read(queries ...*cmneo4j.Query) error {
+	if cd.trace == nil {
+		return cd.driver.Read(queries...)
+	}
+
+	for _, q := range queries {
+		start := time.Now()
+		err := cd.driver.Read(q)
+		trace := QueryTrace{
+			Cypher:   strings.TrimSpace(q.Cypher),
+			Params:   q.Params,
+			Rows:     resultRows(q.Result, err),
+			Duration: time.Since(start),
+		}
+		if err != nil {
+			trace.Error = err.Error()
+		}
+		cd.trace.addQuery(trace)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func (cd *cypherDriver) checkConnectivity() error {
 	return cd.driver.VerifyWriteConnectivity()
 }
 
-func (cd *cypherDriver) findContentRelations(contentUUID string) (relations, bool, error) {
-	var neoCRC, neoCPContains, neoCPContainedIn struct {
-		UUIDs []string `json:"uuids"`
+func (cd *cypherDriver) checkReadConnectivity() error {
+	return cd.driver.Read(connectivityQuery())
+}
+
+// connectivityQuery returns a read answered by any available Neo4j member, including read replicas.
+func connectivityQuery() *cmneo4j.Query {
+	return &cmneo4j.Query{
+		Cypher: "RETURN 1 AS ok",
+		Result: &[]struct {
+			OK int `json:"ok"`
+		}{},
 	}
+}
+
+// neoContentRelations holds the UUIDs found by one of the relations queries of a content item.
+type neoContentRelations struct {
+	UUIDs           []string `json:"uuids"`
+	UnresolvedUUIDs []string `json:"unresolvedUUIDs"`
+	CollectionUUIDs []string `json:"collectionUUIDs"`
+}
+
+func (cd *cypherDriver) findContentRelations(contentUUID string) (relations, bool, error) {
+	var neoCRC, neoCPContains, neoCPContainedIn neoContentRelations
 
 	// All of the queries use OPTIONAL MATCH because when a query doesn't match
-	// anything, the driver is not executing the queries after that one
+	// anything, the driver is not executing the queries after that one.
+	// Selected and contained items are matched as Thing, so that items which
+	// were never written as Content are returned as unresolved
 
 	queryCRC := &cmneo4j.Query{
 		Cypher: `
                 OPTIONAL MATCH (c:Content{uuid:$contentUUID})<-[:IS_CURATED_FOR]-(cc:Curation)
-                OPTIONAL MATCH (cc)-[rel:SELECTS]->(t:Content)
-                WITH t.uuid as uuid
+                OPTIONAL MATCH (cc)-[rel:SELECTS]->(t:Thing)
+                WITH cc.uuid as collectionUUID, t.uuid as uuid, t:Content as resolved
                 ORDER BY rel.order
-                RETURN COLLECT(uuid) as uuids
+                RETURN COLLECT(uuid) as uuids, COLLECT(CASE WHEN NOT resolved THEN uuid END) as unresolvedUUIDs,
+                       COLLECT(DISTINCT collectionUUID) as collectionUUIDs
                 `,
 		Params: map[string]interface{}{"contentUUID": contentUUID},
 		Result: &neoCRC,
@@ -58,10 +165,11 @@ func (cd *cypherDriver) findContentRelations(contentUUID string) (relations, boo
 	queryCPContains := &cmneo4j.Query{
 		Cypher: `
                 OPTIONAL MATCH (cp:ContentPackage{uuid:$contentUUID})-[:CONTAINS]->(cc:ContentCollection)
-                OPTIONAL MATCH (cc)-[rel:CONTAINS]->(c:Content)
-                WITH c.uuid as uuid
+                OPTIONAL MATCH (cc)-[rel:CONTAINS]->(c:Thing)
+                WITH cc.uuid as collectionUUID, c.uuid as uuid, c:Content as resolved
                 ORDER BY rel.order
-                RETURN COLLECT(uuid) as uuids
+                RETURN COLLECT(uuid) as uuids, COLLECT(CASE WHEN NOT resolved THEN uuid END) as unresolvedUUIDs,
+                       COLLECT(DISTINCT collectionUUID) as collectionUUIDs
                 `,
 		Params: map[string]interface{}{"contentUUID": contentUUID},
 		Result: &neoCPContains,
@@ -71,27 +179,101 @@ func (cd *cypherDriver) findContentRelations(contentUUID string) (relations, boo
 		Cypher: `
                 OPTIONAL MATCH (c:Content{uuid:$contentUUID})<-[:CONTAINS]-(cc:ContentCollection)
                 OPTIONAL MATCH (cc)<-[rel:CONTAINS]-(cp:ContentPackage)
-                WITH cp.uuid as uuid
+                WITH cc.uuid as collectionUUID, cp.uuid as uuid
                 ORDER BY rel.order
-                RETURN COLLECT(uuid) as uuids
+                RETURN COLLECT(uuid) as uuids, COLLECT(DISTINCT collectionUUID) as collectionUUIDs
                 `,
 		Params: map[string]interface{}{"contentUUID": contentUUID},
 		Result: &neoCPContainedIn,
 	}
 
-	err := cd.driver.Read(queryCRC, queryCPContains, queryCPContainedIn)
+	err := cd.read(queryCRC, queryCPContains, queryCPContainedIn)
 	if err != nil && !errors.Is(err, cmneo4j.ErrNoResultsFound) {
 		return relations{}, false, fmt.Errorf("Error querying Neo for uuid=%s, err=%v", contentUUID, err)
 	}
 
-	found := len(neoCRC.UUIDs) != 0 || len(neoCPContains.UUIDs) != 0 || len(neoCPContainedIn.UUIDs) != 0
+	cd.trace.addUUIDs("curatedRelatedContent", neoCRC.UUIDs)
+	cd.trace.addUUIDs("contains", neoCPContains.UUIDs)
+	cd.trace.addUUIDs("containedIn", neoCPContainedIn.UUIDs)
+	rel, found := toContentRelations(neoCRC, neoCPContains, neoCPContainedIn)
+	return rel, found, nil
+}
+
+// findContentRelationsBatch returns the relations of the content found among
+// uuids, running the queries of findContentRelations as subqueries of a single
+// query for all of them.
+func (cd *cypherDriver) findContentRelationsBatch(uuids []string) (map[string]relations, error) {
+	neoBatch := []struct {
+		UUID                  string              `json:"uuid"`
+		CuratedRelatedContent neoContentRelations `json:"curatedRelatedContent"`
+		Contains              neoContentRelations `json:"contains"`
+		ContainedIn           neoContentRelations `json:"containedIn"`
+	}{}
 
-	mappedCRC := transformToRelatedContent(neoCRC.UUIDs, cd.publicAPIURL)
-	mappedCPC := transformToRelatedContent(neoCPContains.UUIDs, cd.publicAPIURL)
-	mappedCIC := transformToRelatedContent(neoCPContainedIn.UUIDs, cd.publicAPIURL)
-	relations := relations{mappedCRC, mappedCPC, mappedCIC}
+	query := &cmneo4j.Query{
+		Cypher: `
+                UNWIND $uuids as contentUUID
+                CALL {
+                    WITH contentUUID
+                    OPTIONAL MATCH (c:Content{uuid:contentUUID})<-[:IS_CURATED_FOR]-(cc:Curation)
+                    OPTIONAL MATCH (cc)-[rel:SELECTS]->(t:Thing)
+                    WITH cc.uuid as collectionUUID, t.uuid as uuid, t:Content as resolved
+                    ORDER BY rel.order
+                    RETURN {uuids: COLLECT(uuid), unresolvedUUIDs: COLLECT(CASE WHEN NOT resolved THEN uuid END),
+                            collectionUUIDs: COLLECT(DISTINCT collectionUUID)} as curatedRelatedContent
+                }
+                CALL {
+                    WITH contentUUID
+                    OPTIONAL MATCH (cp:ContentPackage{uuid:contentUUID})-[:CONTAINS]->(cc:ContentCollection)
+                    OPTIONAL MATCH (cc)-[rel:CONTAINS]->(c:Thing)
+                    WITH cc.uuid as collectionUUID, c.uuid as uuid, c:Content as resolved
+                    ORDER BY rel.order
+                    RETURN {uuids: COLLECT(uuid), unresolvedUUIDs: COLLECT(CASE WHEN NOT resolved THEN uuid END),
+                            collectionUUIDs: COLLECT(DISTINCT collectionUUID)} as contains
+                }
+                CALL {
+                    WITH contentUUID
+                    OPTIONAL MATCH (c:Content{uuid:contentUUID})<-[:CONTAINS]-(cc:ContentCollection)
+                    OPTIONAL MATCH (cc)<-[rel:CONTAINS]-(cp:ContentPackage)
+                    WITH cc.uuid as collectionUUID, cp.uuid as uuid
+                    ORDER BY rel.order
+                    RETURN {uuids: COLLECT(uuid), collectionUUIDs: COLLECT(DISTINCT collectionUUID)} as containedIn
+                }
+                RETURN contentUUID as uuid, curatedRelatedContent, contains, containedIn
+                `,
+		Params: map[string]interface{}{"uuids": uuids},
+		Result: &neoBatch,
+	}
+
+	err := cd.read(query)
+	if err != nil && !errors.Is(err, cmneo4j.ErrNoResultsFound) {
+		return nil, fmt.Errorf("Error querying Neo for %d uuids, err=%v", len(uuids), err)
+	}
+
+	found := make(map[string]relations, len(neoBatch))
+	for _, r := range neoBatch {
+		if rel, ok := toContentRelations(r.CuratedRelatedContent, r.Contains, r.ContainedIn); ok {
+			found[r.UUID] = rel
+		}
+	}
+	return found, nil
+}
+
+func toContentRelations(neoCRC, neoCPContains, neoCPContainedIn neoContentRelations) (relations, bool) {
+	found := len(neoCRC.UUIDs) != 0 || len(neoCPContains.UUIDs) != 0 || len(neoCPContainedIn.UUIDs) != 0
 
-	return relations, found, nil
+	mappedCRC := transformToRelatedContent(neoCRC.UUIDs)
+	mappedCPC := transformToRelatedContent(neoCPContains.UUIDs)
+	mappedCIC := transformToRelatedContent(neoCPContainedIn.UUIDs)
+	flagUnresolved(mappedCRC, neoCRC.UUIDs, neoCRC.UnresolvedUUIDs)
+	flagUnresolved(mappedCPC, neoCPContains.UUIDs, neoCPContains.UnresolvedUUIDs)
+	danglingReferenceLookups.Inc(int64(len(neoCRC.UnresolvedUUIDs) + len(neoCPContains.UnresolvedUUIDs)))
+	return relations{
+		CuratedRelatedContents: mappedCRC,
+		Contains:               mappedCPC,
+		ContainedIn:            mappedCIC,
+		collectionUUIDs:        mergeUUIDs(neoCRC.CollectionUUIDs, neoCPContains.CollectionUUIDs, neoCPContainedIn.CollectionUUIDs),
+	}, found
 }
 
 func (cd *cypherDriver) findContentCollectionRelations(contentCollectionUUID string) (ccRelations, bool, error) {
@@ -112,24 +294,52 @@ func (cd *cypherDriver) findContentCollectionRelations(contentCollectionUUID str
 
 	queryCPContains := &cmneo4j.Query{
 		Cypher: `
-                MATCH (cc:ContentCollection{uuid:$contentCollectionUUID})-[rel:CONTAINS]->(c:Content)
-                RETURN c.uuid as uuid
+                MATCH (cc:ContentCollection{uuid:$contentCollectionUUID})-[rel:CONTAINS]->(c:Thing)
+                RETURN c.uuid as uuid, c:Content as resolved
                 ORDER BY rel.order
                 `,
 		Params: map[string]interface{}{"contentCollectionUUID": contentCollectionUUID},
 		Result: &neoCPContains,
 	}
 
-	err := cd.driver.Read(queryCPContains, queryCPContainedIn)
+	err := cd.read(queryCPContains, queryCPContainedIn)
 	if err != nil && !errors.Is(err, cmneo4j.ErrNoResultsFound) {
 		return ccRelations{}, false, fmt.Errorf("Error querying Neo for uuid=%s, err=%v", contentCollectionUUID, err)
 	}
 
 	found := len(neoCPContainedIn) != 0
+	cd.trace.addUUIDs("contains", neoUUIDs(neoCPContains))
+	cd.trace.addUUIDs("containedIn", neoUUIDs(neoCPContainedIn))
 
 	mappedContainedIn := transformContainedInToCCRelations(neoCPContainedIn)
-	mappedContains := transformContainsToCCRelations(neoCPContains)
-	ccRelations := ccRelations{mappedContainedIn, mappedContains}
+	mappedContains, unresolvedContains := transformContainsToCCRelations(neoCPContains)
+	danglingReferenceLookups.Inc(int64(len(unresolvedContains)))
+	ccRelations := ccRelations{mappedContainedIn, mappedContains, unresolvedContains}
 
 	return ccRelations, found, nil
 }
+
+func (cd *cypherDriver) findContentCollectionLeads(contentCollectionUUID string) ([]string, error) {
+	var neoLeads struct {
+		UUIDs []string `json:"uuids"`
+	}
+
+	// A story package is curated for its lead content, a content package
+	// collection is contained by its lead content
+	query := &cmneo4j.Query{
+		Cypher: `
+                OPTIONAL MATCH (curation:Curation{uuid:$contentCollectionUUID})-[:IS_CURATED_FOR]->(c:Content)
+                OPTIONAL MATCH (cc:ContentCollection{uuid:$contentCollectionUUID})<-[:CONTAINS]-(cp:ContentPackage)
+                RETURN COLLECT(DISTINCT c.uuid) + COLLECT(DISTINCT cp.uuid) as uuids
+                `,
+		Params: map[string]interface{}{"contentCollectionUUID": contentCollectionUUID},
+		Result: &neoLeads,
+	}
+
+	err := cd.read(query)
+	if err != nil && !errors.Is(err, cmneo4j.ErrNoResultsFound) {
+		return nil, fmt.Errorf("Error querying Neo for uuid=%s, err=%v", contentCollectionUUID, err)
+	}
+
+	return neoLeads.UUIDs, nil
+}
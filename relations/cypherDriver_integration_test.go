@@ -5,26 +5,22 @@ package relations
 
 import (
 	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"path/filepath"
-	"reflect"
 	"testing"
+	"time"
 
 	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
 	"github.com/Financial-Times/content-collection-rw-neo4j/collection"
 	"github.com/Financial-Times/content-rw-neo4j/v3/content"
 	"github.com/Financial-Times/go-logger/v2"
+	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
 
-type payloadData struct {
-	uuid   string
-	path   string
-	id     string
-	apiURL string
-}
-
 type collectionService interface {
 	DecodeJSON(dec *json.Decoder) (interface{}, string, error)
 	Write(newThing interface{}, transactionID string) error
@@ -35,129 +31,89 @@ type contentService interface {
 	DecodeJSON(dec *json.Decoder) (interface{}, string, error)
 }
 
-var (
-	leadContentSP = payloadData{"3fc9fe3e-af8c-4a4a-961a-e5065392bb31", "./fixtures/Content-with-SP-3fc9fe3e-af8c-4a4a-961a-e5065392bb31.json",
-		"http://api.ft.com/things/3fc9fe3e-af8c-4a4a-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-4a4a-961a-e5065392bb31"}
-	leadContentCP = payloadData{"3fc9fe3e-af8c-1b1b-961a-e5065392bb31", "./fixtures/Content-with-CP-3fc9fe3e-af8c-1b1b-961a-e5065392bb31.json",
-		"http://api.ft.com/things/3fc9fe3e-af8c-1b1b-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-1b1b-961a-e5065392bb31"}
-	relatedContent1 = payloadData{"3fc9fe3e-af8c-1a1a-961a-e5065392bb31", "./fixtures/Content-3fc9fe3e-af8c-1a1a-961a-e5065392bb31.json",
-		"http://api.ft.com/things/3fc9fe3e-af8c-1a1a-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-1a1a-961a-e5065392bb31"}
-	relatedContent2 = payloadData{"3fc9fe3e-af8c-2a2a-961a-e5065392bb31", "./fixtures/Content-3fc9fe3e-af8c-2a2a-961a-e5065392bb31.json",
-		"http://api.ft.com/things/3fc9fe3e-af8c-2a2a-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-2a2a-961a-e5065392bb31"}
-	relatedContent3 = payloadData{"3fc9fe3e-af8c-3a3a-961a-e5065392bb31", "./fixtures/Content-3fc9fe3e-af8c-3a3a-961a-e5065392bb31.json",
-		"http://api.ft.com/things/3fc9fe3e-af8c-3a3a-961a-e5065392bb31", "http://api.ft.com/content/3fc9fe3e-af8c-3a3a-961a-e5065392bb31"}
-	storyPackage = payloadData{"63559ba7-b48d-4467-b2b0-ce956f9e9494", "./fixtures/StoryPackage-63559ba7-b48d-4467-b2b0-ce956f9e9494.json",
-		"", ""}
-	contentPackage = payloadData{"63559ba7-b48d-4467-1b1b-ce956f9e9494", "./fixtures/ContentPackage-63559ba7-b48d-4467-1b1b-ce956f9e9494.json",
-		"", ""}
-	allData = []payloadData{leadContentSP, leadContentCP, relatedContent1, relatedContent2, relatedContent3, storyPackage, contentPackage}
-)
-
-func TestFindContentRelations_StoryPackage_Ok(t *testing.T) {
-	if testing.Short() {
-		t.Skip("Short flag is set. Skipping integration test")
-	}
-	expectedResponse := relations{
-		CuratedRelatedContents: []relatedContent{
-			{relatedContent1.id, relatedContent1.apiURL},
-			{relatedContent2.id, relatedContent2.apiURL},
-			{relatedContent3.id, relatedContent3.apiURL},
-		},
-	}
-	driver := getNeo4jDriver(t)
-	contents := []payloadData{leadContentSP, relatedContent1, relatedContent2, relatedContent3}
-
-	writeContent(t, driver, contents)
-	writeContentCollection(t, driver, []payloadData{storyPackage}, "StoryPackage")
-	defer cleanDB(t, driver, allData)
-
-	cypherDriver, err := NewCypherDriver(driver, publicAPIURL)
-	assert.NoError(t, err)
-	actualRelations, found, err := cypherDriver.findContentRelations(leadContentSP.uuid)
-	assert.NoError(t, err, "Unexpected error for content %s", leadContentSP.uuid)
-	assert.True(t, found, "Found no relations for content %s", leadContentSP.uuid)
+func init() {
+	conformanceStores["neo4j"] = newNeo4jConformanceStore
+}
 
-	assert.Equal(t, len(expectedResponse.CuratedRelatedContents), len(actualRelations.CuratedRelatedContents), "Didn't get the same number of curated related content")
-	assertListContainsAll(t, actualRelations.CuratedRelatedContents, expectedResponse.CuratedRelatedContents)
+// neo4jConformanceStore writes the fixtures with the services writing them to Neo4j in production.
+type neo4jConformanceStore struct {
+	neo *cmneo4j.Driver
 }
 
-func TestFindContentRelations_ContentPackage_Ok(t *testing.T) {
+func newNeo4jConformanceStore(t *testing.T) conformanceStore {
 	if testing.Short() {
 		t.Skip("Short flag is set. Skipping integration test")
 	}
-	expectedResponse := relations{
-		Contains: []relatedContent{
-			{relatedContent1.id, relatedContent1.apiURL},
-			{relatedContent2.id, relatedContent2.apiURL},
-		},
-	}
 	driver := getNeo4jDriver(t)
-	contents := []payloadData{leadContentCP, relatedContent1, relatedContent2}
+	t.Cleanup(func() { cleanDB(t, driver, append(allData, unresolvedContent)) })
+	return neo4jConformanceStore{neo: driver}
+}
 
-	writeContent(t, driver, contents)
-	writeContentCollection(t, driver, []payloadData{contentPackage}, "ContentPackage")
-	defer cleanDB(t, driver, allData)
+func (s neo4jConformanceStore) driver() Driver {
+	return NewCypherDriver(s.neo)
+}
 
-	cypherDriver, err := NewCypherDriver(driver, publicAPIURL)
-	assert.NoError(t, err)
-	actualRelations, found, err := cypherDriver.findContentRelations(leadContentCP.uuid)
-	assert.NoError(t, err, "Unexpected error for content %s", leadContentCP.uuid)
-	assert.True(t, found, "Found no relations for content %s", leadContentCP.uuid)
+func (s neo4jConformanceStore) writeContent(t *testing.T, data []payloadData) {
+	writeContent(t, s.neo, data)
+}
 
-	assert.Equal(t, len(expectedResponse.Contains), len(actualRelations.Contains), "Didn't get the same number of content in contains")
-	assertListContainsAll(t, actualRelations.Contains, expectedResponse.Contains)
+func (s neo4jConformanceStore) writeContentCollection(t *testing.T, data []payloadData, ccType string) {
+	writeContentCollection(t, s.neo, data, ccType)
 }
 
-func TestFindContentRelations_Content_In_ContentPackage_Ok(t *testing.T) {
+func TestFindContentRelations_StoryPackage_Traced(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Short flag is set. Skipping integration test")
 	}
-	expectedResponse := relations{
-		ContainedIn: []relatedContent{
-			{leadContentCP.id, leadContentCP.apiURL},
-		},
-	}
 	driver := getNeo4jDriver(t)
-	contents := []payloadData{leadContentCP, relatedContent1, relatedContent2}
-
-	writeContent(t, driver, contents)
-	writeContentCollection(t, driver, []payloadData{contentPackage}, "ContentPackage")
+	writeContent(t, driver, []payloadData{leadContentSP, relatedContent1, relatedContent2, relatedContent3})
+	writeContentCollection(t, driver, []payloadData{storyPackage}, "StoryPackage")
 	defer cleanDB(t, driver, allData)
 
-	cypherDriver, err := NewCypherDriver(driver, publicAPIURL)
+	cypherDriver := NewCypherDriver(driver)
+	result, err := LookupContentRelations(cypherDriver, testURLs, leadContentSP.uuid)
 	assert.NoError(t, err)
-	actualRelations, found, err := cypherDriver.findContentRelations(relatedContent1.uuid)
-	assert.NoError(t, err, "Unexpected error for content %s", relatedContent1.uuid)
-	assert.True(t, found, "Found no relations for content %s", relatedContent1.uuid)
-
-	assert.Equal(t, len(expectedResponse.ContainedIn), len(actualRelations.ContainedIn), "Didn't get the same number of containedIn content")
-	assertListContainsAll(t, actualRelations.ContainedIn, expectedResponse.ContainedIn)
+	assert.True(t, result.Found)
+	assert.Len(t, result.Queries, 3, "Each query should be traced")
+	for _, q := range result.Queries {
+		assert.Equal(t, leadContentSP.uuid, q.Params["contentUUID"])
+		assert.Equal(t, 1, q.Rows)
+	}
 }
 
-func TestFindContentCollectionRelations_Ok(t *testing.T) {
+func TestGetContentRelations_Debug(t *testing.T) {
 	if testing.Short() {
 		t.Skip("Short flag is set. Skipping integration test")
 	}
-	expectedResponse := ccRelations{
-		ContainedIn: "3fc9fe3e-af8c-1b1b-961a-e5065392bb31",
-		Contains:    []string{"3fc9fe3e-af8c-1a1a-961a-e5065392bb31", "3fc9fe3e-af8c-2a2a-961a-e5065392bb31"},
-	}
 	driver := getNeo4jDriver(t)
-	contents := []payloadData{leadContentCP, relatedContent1, relatedContent2}
-
-	writeContent(t, driver, contents)
-	writeContentCollection(t, driver, []payloadData{contentPackage}, "ContentPackage")
+	writeContent(t, driver, []payloadData{leadContentSP, relatedContent1, relatedContent2, relatedContent3})
+	writeContentCollection(t, driver, []payloadData{storyPackage}, "StoryPackage")
 	defer cleanDB(t, driver, allData)
 
-	cypherDriver, err := NewCypherDriver(driver, publicAPIURL)
+	cypherDriver := NewCypherDriver(driver)
+	auth, err := NewAdminAuth("ops:token-1")
 	assert.NoError(t, err)
-	actualRelations, found, err := cypherDriver.findContentCollectionRelations(contentPackage.uuid)
-	assert.NoError(t, err, "Unexpected error for content package %s", contentPackage.uuid)
-	assert.True(t, found, "Found no relations for content package %s", contentPackage.uuid)
-
-	assert.Equal(t, actualRelations.ContainedIn, expectedResponse.ContainedIn)
-	assert.Equal(t, len(expectedResponse.Contains), len(actualRelations.Contains), "Didn't get the same number of content in contains")
-	assertListContainsAll(t, actualRelations.Contains, expectedResponse.Contains)
+	hh := NewHttpHandlers(NewCachedDriver(cypherDriver, NewCache(10, time.Minute)), testURLs, "max-age=30").WithDebug(auth)
+
+	req := httptest.NewRequest("GET", "/content/"+leadContentSP.uuid+"/relations?debug=true", nil)
+	req.Header.Set("Authorization", "Bearer token-1")
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	assert.Empty(t, rec.Header().Get("Surrogate-Key"), "debug responses should not be cached by the CDN")
+	var body struct {
+		Debug struct {
+			Queries  []map[string]interface{} `json:"queries"`
+			RawUUIDs map[string][]string      `json:"rawUUIDs"`
+		} `json:"_debug"`
+	}
+	assert.NoError(t, json.NewDecoder(rec.Body).Decode(&body))
+	assert.Len(t, body.Debug.Queries, 3)
+	assert.ElementsMatch(t, []string{relatedContent1.uuid, relatedContent2.uuid, relatedContent3.uuid}, body.Debug.RawUUIDs["curatedRelatedContent"])
 }
 
 func writeContent(t testing.TB, driver *cmneo4j.Driver, data []payloadData) {
@@ -211,22 +167,6 @@ func writeJSONWithContentCollectionService(t testing.TB, service collectionServi
 	require.NoError(t, err)
 }
 
-func assertListContainsAll(t *testing.T, list interface{}, items ...interface{}) {
-	if reflect.TypeOf(items[0]).Kind().String() == "slice" {
-		expected := reflect.ValueOf(items[0])
-		expectedLength := expected.Len()
-		assert.Len(t, list, expectedLength)
-		for i := 0; i < expectedLength; i++ {
-			assert.Contains(t, list, expected.Index(i).Interface())
-		}
-	} else {
-		assert.Len(t, list, len(items))
-		for _, item := range items {
-			assert.Contains(t, list, item)
-		}
-	}
-}
-
 func getNeo4jDriver(t testing.TB) *cmneo4j.Driver {
 	t.Helper()
 
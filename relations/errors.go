@@ -0,0 +1,169 @@
+package relations
+
+import (
+	"encoding/json"
+	"fmt"
+	"mime"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	transactionidutils "github.com/Financial-Times/transactionid-utils-go"
+	"github.com/gorilla/mux"
+)
+
+const (
+	problemContentType = "application/problem+json"
+	// problemTypeBase prefixes the type of every problem reported by the API
+	problemTypeBase = "urn:ft:relations-api:problem:"
+)
+
+type problemType struct {
+	name  string
+	title string
+}
+
+var (
+	problemInvalidUUID         = problemType{"invalid-uuid", "Invalid UUID"}
+	problemInvalidParameter    = problemType{"invalid-parameter", "Invalid parameter"}
+	problemInvalidSubscription = problemType{"invalid-subscription", "Invalid webhook subscription"}
+	problemUnauthorized        = problemType{"unauthorized", "Unauthorized"}
+	problemRelationsNotFound   = problemType{"relations-not-found", "Relations not found"}
+	problemNotFound            = problemType{"not-found", "Not found"}
+	problemMethodNotAllowed    = problemType{"method-not-allowed", "Method not allowed"}
+	problemUnavailable         = problemType{"relations-unavailable", "Relations unavailable"}
+	problemEncoding            = problemType{"encoding-failed", "Response encoding failed"}
+)
+
+// apiError is an error response of the API.
+type apiError struct {
+	status  int
+	problem problemType
+	detail  string
+	// debug is attached to the response of debugged lookups
+	debug *lookupDebug
+}
+
+// problemDetails is the RFC 7807 shape of an error response.
+type problemDetails struct {
+	Type          string       `json:"type"`
+	Title         string       `json:"title"`
+	Status        int          `json:"status"`
+	Detail        string       `json:"detail"`
+	Instance      string       `json:"instance"`
+	TransactionID string       `json:"transactionId,omitempty"`
+	Debug         *lookupDebug `json:"_debug,omitempty"`
+}
+
+// ErrorMessage is the legacy shape of an error response, sent unless problem details are accepted.
+type ErrorMessage struct {
+	Message string       `json:"message"`
+	Debug   *lookupDebug `json:"_debug,omitempty"`
+}
+
+// writeError writes the error as problem details when the client accepts
+// them, otherwise in the legacy {"message": ...} shape.
+func writeError(w http.ResponseWriter, r *http.Request, e apiError) {
+	var body interface{}
+	if acceptsProblem(r) {
+		w.Header().Set("Content-Type", problemContentType)
+		body = problemDetails{
+			Type:          problemTypeBase + e.problem.name,
+			Title:         e.problem.title,
+			Status:        e.status,
+			Detail:        e.detail,
+			Instance:      r.URL.RequestURI(),
+			TransactionID: transactionID(w, r),
+			Debug:         e.debug,
+		}
+	} else {
+		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+		body = ErrorMessage{Message: e.detail, Debug: e.debug}
+	}
+
+	w.WriteHeader(e.status)
+	msg, err := json.Marshal(body)
+	if err != nil {
+		w.Write([]byte(fmt.Sprintf("Error message couldn't be encoded in json: , err=%s", err.Error())))
+		return
+	}
+	w.Write(msg)
+}
+
+// acceptsProblem reports whether problem details are listed in the Accept header with a non zero quality.
+func acceptsProblem(r *http.Request) bool {
+	for _, accepted := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accepted))
+		if err != nil || mediaType != problemContentType {
+			continue
+		}
+		if q, err := strconv.ParseFloat(params["q"], 64); err == nil && q == 0 {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// transactionID returns the transaction ID sent back by the request logging handler, or the one of the request.
+func transactionID(w http.ResponseWriter, r *http.Request) string {
+	if tid := w.Header().Get(transactionidutils.TransactionIDHeader); tid != "" {
+		return tid
+	}
+	return r.Header.Get(transactionidutils.TransactionIDHeader)
+}
+
+// NotFound responds to requests matching no route.
+func NotFound(w http.ResponseWriter, r *http.Request) {
+	writeError(w, r, apiError{
+		status:  http.StatusNotFound,
+		problem: problemNotFound,
+		detail:  fmt.Sprintf("No endpoint found for %s", r.URL.Path),
+	})
+}
+
+// MethodNotAllowed returns a handler responding to requests matching a route
+// of the router with another method, listing the allowed methods.
+func MethodNotAllowed(router *mux.Router) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		allowed := allowedMethods(router, r.URL.Path)
+		if len(allowed) > 0 {
+			w.Header().Set("Allow", strings.Join(allowed, ", "))
+		}
+		writeError(w, r, apiError{
+			status:  http.StatusMethodNotAllowed,
+			problem: problemMethodNotAllowed,
+			detail:  fmt.Sprintf("Method %s is not allowed for %s", r.Method, r.URL.Path),
+		})
+	}
+}
+
+func allowedMethods(router *mux.Router, path string) []string {
+	methods := map[string]bool{}
+	_ = router.Walk(func(route *mux.Route, _ *mux.Router, _ []*mux.Route) error {
+		pathRegexp, err := route.GetPathRegexp()
+		if err != nil {
+			return nil
+		}
+		if matched, _ := regexp.MatchString(pathRegexp, path); !matched {
+			return nil
+		}
+		routeMethods, err := route.GetMethods()
+		if err != nil {
+			return nil
+		}
+		for _, m := range routeMethods {
+			methods[m] = true
+		}
+		return nil
+	})
+
+	allowed := make([]string, 0, len(methods))
+	for m := range methods {
+		allowed = append(allowed, m)
+	}
+	sort.Strings(allowed)
+	return allowed
+}
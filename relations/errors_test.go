@@ -0,0 +1,68 @@
+package relations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWriteErrorNegotiation(t *testing.T) {
+	e := apiError{status: http.StatusBadRequest, problem: problemInvalidUUID, detail: "The given uuid is not valid"}
+	tests := []struct {
+		name        string
+		accept      string
+		contentType string
+		body        string
+	}{
+		{"Default", "", "application/json; charset=UTF-8", `{"message":"The given uuid is not valid"}`},
+		{"JSON", "application/json", "application/json; charset=UTF-8", `{"message":"The given uuid is not valid"}`},
+		{"ProblemRefused", "application/json, application/problem+json;q=0", "application/json; charset=UTF-8", `{"message":"The given uuid is not valid"}`},
+		{"Problem", "application/json;q=0.5, application/problem+json", problemContentType, `{
+			"type":"urn:ft:relations-api:problem:invalid-uuid","title":"Invalid UUID","status":400,
+			"detail":"The given uuid is not valid","instance":"/content/99999/relations?includeUnresolved=true","transactionId":"tid_test"}`},
+	}
+
+	for _, test := range tests {
+		req := newRequest("GET", "/content/99999/relations?includeUnresolved=true", nil)
+		req.Header.Set("X-Request-Id", "tid_test")
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		writeError(rec, req, e)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, test.name)
+		assert.Equal(t, test.contentType, rec.Header().Get("Content-Type"), test.name)
+		assert.JSONEq(t, test.body, rec.Body.String(), test.name)
+	}
+}
+
+func TestUnknownRoutesAndMethods(t *testing.T) {
+	hh := NewHttpHandlers(&cypherDriverMock{contentUUID: knownUUID}, testURLs, "")
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+	r.HandleFunc("/__webhooks", func(w http.ResponseWriter, r *http.Request) {}).Methods("GET", "POST")
+	r.NotFoundHandler = http.HandlerFunc(NotFound)
+	r.MethodNotAllowedHandler = MethodNotAllowed(r)
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("DELETE", "/content/"+knownUUID+"/relations", nil))
+	assert.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+	assert.Equal(t, "GET", rec.Header().Get("Allow"))
+	assert.JSONEq(t, message("Method DELETE is not allowed for /content/"+knownUUID+"/relations"), rec.Body.String())
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("PUT", "/__webhooks", nil))
+	assert.Equal(t, "GET, POST", rec.Header().Get("Allow"))
+
+	req := newRequest("GET", "/unknown", nil)
+	req.Header.Set("Accept", problemContentType)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.JSONEq(t, `{"type":"urn:ft:relations-api:problem:not-found","title":"Not found","status":404,
+		"detail":"No endpoint found for /unknown","instance":"/unknown"}`, rec.Body.String())
+}
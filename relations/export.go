@@ -0,0 +1,188 @@
+package relations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	uuid "github.com/google/uuid"
+)
+
+const exportContentType = "application/x-ndjson"
+
+// exportLine is a line of the export, the relations of a content item as returned by /content/{uuid}/relations
+type exportLine struct {
+	UUID string `json:"uuid"`
+	relations
+}
+
+// RelationsExporter writes the relations of every content item taking part in
+// a Curation or ContentPackage, ordered by UUID so that exports can be resumed.
+type RelationsExporter struct {
+	driver    Driver
+	urls      *PublicURLs
+	batchSize int
+	log       *logger.UPPLogger
+}
+
+// NewRelationsExporter creates an exporter listing content from the driver batchSize UUIDs at a time.
+func NewRelationsExporter(driver Driver, urls *PublicURLs, batchSize int, log *logger.UPPLogger) (*RelationsExporter, error) {
+	if batchSize < 1 {
+		return nil, fmt.Errorf("the export batch size must be at least 1, got %d", batchSize)
+	}
+	return &RelationsExporter{driver: driver, urls: urls, batchSize: batchSize, log: log}, nil
+}
+
+// Export writes one NDJSON line per content item with a UUID after cursor,
+// stopping after limit lines when limit is positive. It returns the cursor to
+// resume the export from, which is empty once every content item has been written.
+func (e *RelationsExporter) Export(ctx context.Context, w io.Writer, cursor string, limit int) (string, error) {
+	return e.export(ctx, w, e.urls.defaults(), cursor, limit)
+}
+
+func (e *RelationsExporter) export(ctx context.Context, w io.Writer, urls urlBuilder, cursor string, limit int) (string, error) {
+	enc := json.NewEncoder(w)
+	written := 0
+	for {
+		if err := ctx.Err(); err != nil {
+			return cursor, err
+		}
+		batchSize := e.batchSize
+		if limit > 0 && limit-written < batchSize {
+			batchSize = limit - written
+		}
+		uuids, err := e.driver.findRelatedContentUUIDs(cursor, batchSize)
+		if err != nil {
+			return cursor, err
+		}
+
+		found, err := e.lookup(ctx, uuids)
+		if err != nil {
+			return cursor, err
+		}
+		for _, contentUUID := range uuids {
+			rel, ok := found[contentUUID]
+			rel = rel.withoutUnresolved()
+			if ok && !rel.isEmpty() {
+				if err = enc.Encode(exportLine{UUID: contentUUID, relations: urls.relations(rel)}); err != nil {
+					return cursor, err
+				}
+				written++
+			}
+			cursor = contentUUID
+		}
+
+		if len(uuids) < batchSize {
+			return "", nil
+		}
+		if limit > 0 && written >= limit {
+			return cursor, nil
+		}
+		if f, ok := w.(interface{ Flush() error }); ok {
+			if err = f.Flush(); err != nil {
+				return cursor, err
+			}
+		}
+	}
+}
+
+// batchRelationsFinder is implemented by the drivers able to find the
+// relations of several content items with a single query.
+type batchRelationsFinder interface {
+	findContentRelationsBatch(uuids []string) (map[string]relations, error)
+}
+
+// lookup returns the relations of the content found among uuids, in a single
+// query when the driver supports it.
+func (e *RelationsExporter) lookup(ctx context.Context, uuids []string) (map[string]relations, error) {
+	if bf, ok := e.driver.(batchRelationsFinder); ok {
+		return bf.findContentRelationsBatch(uuids)
+	}
+	found := make(map[string]relations, len(uuids))
+	for _, contentUUID := range uuids {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		rel, ok, err := e.driver.findContentRelations(contentUUID)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found[contentUUID] = rel
+		}
+	}
+	return found, nil
+}
+
+// ExportRelations streams the export as NDJSON. Every line carries the uuid it
+// was written for, an interrupted export is resumed by passing the last uuid
+// received as the cursor parameter.
+func (e *RelationsExporter) ExportRelations(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cursor := query.Get("cursor")
+	if cursor != "" {
+		if _, err := uuid.Parse(cursor); err != nil {
+			writeError(w, r, apiError{
+				status:  http.StatusBadRequest,
+				problem: problemInvalidParameter,
+				detail:  fmt.Sprintf("The given cursor is not valid, err=%v", err),
+			})
+			return
+		}
+	}
+	limit := 0
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit < 0 {
+			writeError(w, r, apiError{
+				status:  http.StatusBadRequest,
+				problem: problemInvalidParameter,
+				detail:  "The given limit is not a positive number",
+			})
+			return
+		}
+	}
+
+	urls, err := e.urls.forRequest(r)
+	if err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidParameter,
+			detail:  fmt.Sprintf("The given idFormat is not valid, err=%v", err),
+		})
+		return
+	}
+
+	// the export outlives the server write timeout
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", exportContentType)
+	e.urls.setVary(w)
+	w.WriteHeader(http.StatusOK)
+	next, err := e.export(r.Context(), flushWriter{w, rc}, urls, cursor, limit)
+	if err != nil {
+		// the status is already sent, the client resumes from the last line received
+		e.log.WithError(err).WithField("cursor", next).WithField("admin", adminIdentity(r)).Error("Relations export interrupted")
+		return
+	}
+	e.log.WithField("cursor", next).WithField("admin", adminIdentity(r)).Info("Relations export completed")
+}
+
+type flushWriter struct {
+	io.Writer
+	rc *http.ResponseController
+}
+
+func (fw flushWriter) Flush() error {
+	if err := fw.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
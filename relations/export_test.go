@@ -0,0 +1,114 @@
+package relations
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type exportDriverMock struct {
+	mutableDriverMock
+	listCalls int
+}
+
+func (m *exportDriverMock) findRelatedContentUUIDs(afterUUID string, limit int) ([]string, error) {
+	m.listCalls++
+	uuids := []string{}
+	for u := range m.relations {
+		if u > afterUUID {
+			uuids = append(uuids, u)
+		}
+	}
+	sort.Strings(uuids)
+	if len(uuids) > limit {
+		uuids = uuids[:limit]
+	}
+	return uuids, nil
+}
+
+func newExportDriverMock() *exportDriverMock {
+	related := []relatedContent{{uuid: knownUUID}}
+	m := &exportDriverMock{mutableDriverMock: mutableDriverMock{relations: map[string]relations{}}}
+	m.set("00000000-0000-0000-0000-000000000001", relations{CuratedRelatedContents: related})
+	m.set("00000000-0000-0000-0000-000000000002", relations{Contains: []relatedContent{{uuid: leadUUID, Unresolved: true}}})
+	m.set("00000000-0000-0000-0000-000000000003", relations{ContainedIn: related})
+	m.set("00000000-0000-0000-0000-000000000004", relations{Contains: related})
+	return m
+}
+
+func exportedUUIDs(t *testing.T, body []byte) []string {
+	uuids := []string{}
+	scanner := bufio.NewScanner(bytes.NewReader(body))
+	for scanner.Scan() {
+		var line map[string]interface{}
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &line))
+		uuids = append(uuids, line["uuid"].(string))
+	}
+	return uuids
+}
+
+func TestExportResumesFromCursor(t *testing.T) {
+	driver := newExportDriverMock()
+	exporter, err := NewRelationsExporter(driver, testURLs, 2, logger.NewUPPLogger("test", "PANIC"))
+	require.NoError(t, err)
+
+	var first bytes.Buffer
+	cursor, err := exporter.Export(context.Background(), &first, "", 1)
+	require.NoError(t, err)
+	assert.Equal(t, "00000000-0000-0000-0000-000000000001", cursor)
+	assert.JSONEq(t, `{"uuid":"00000000-0000-0000-0000-000000000001","curatedRelatedContent":[{"id":"http://api.ft.com/things/`+knownUUID+`","apiUrl":"http://api.ft.com/content/`+knownUUID+`"}]}`, first.String())
+
+	// content with only unresolved relations is skipped
+	var rest bytes.Buffer
+	cursor, err = exporter.Export(context.Background(), &rest, cursor, 0)
+	require.NoError(t, err)
+	assert.Empty(t, cursor, "The export should be complete")
+	assert.Equal(t, []string{"00000000-0000-0000-0000-000000000003", "00000000-0000-0000-0000-000000000004"}, exportedUUIDs(t, rest.Bytes()))
+}
+
+func TestExportRelationsHandler(t *testing.T) {
+	exporter, err := NewRelationsExporter(newExportDriverMock(), testURLs, 10, logger.NewUPPLogger("test", "PANIC"))
+	require.NoError(t, err)
+
+	rec := httptest.NewRecorder()
+	exporter.ExportRelations(rec, newRequest("GET", "/__export/relations?cursor=00000000-0000-0000-0000-000000000001&limit=1", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, exportContentType, rec.Header().Get("Content-Type"))
+	assert.Equal(t, []string{"00000000-0000-0000-0000-000000000003"}, exportedUUIDs(t, rec.Body.Bytes()))
+
+	rec = httptest.NewRecorder()
+	exporter.ExportRelations(rec, newRequest("GET", "/__export/relations?cursor=99999", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	exporter.ExportRelations(rec, newRequest("GET", "/__export/relations?limit=-1", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestNewRelationsExporterRefusesEmptyBatches(t *testing.T) {
+	_, err := NewRelationsExporter(newExportDriverMock(), testURLs, 0, logger.NewUPPLogger("test", "PANIC"))
+	assert.Error(t, err)
+}
+
+func TestExportStopsWhenCancelled(t *testing.T) {
+	driver := newExportDriverMock()
+	exporter, err := NewRelationsExporter(driver, testURLs, 2, logger.NewUPPLogger("test", "PANIC"))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	var out bytes.Buffer
+	cursor, err := exporter.Export(ctx, &out, "", 0)
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Empty(t, cursor)
+	assert.Zero(t, driver.listCalls, "No content should be listed once cancelled")
+}
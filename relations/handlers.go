@@ -1,27 +1,91 @@
 package relations
 
 import (
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
 	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
-	"github.com/Financial-Times/service-status-go/gtg"
 	uuid "github.com/google/uuid"
 	"github.com/gorilla/mux"
 )
 
 type HttpHandlers struct {
 	cypherDriver       Driver
+	urls               *PublicURLs
 	cacheControlHeader string
+	// notFoundCacheControlHeader and errorCacheControlHeader, when set, let
+	// 404 and 5xx responses be cached, sparing Neo4j repeated failing lookups
+	notFoundCacheControlHeader string
+	errorCacheControlHeader    string
+	// surrogateControlHeader, when set, tells the CDN how long to cache the relations responses
+	surrogateControlHeader string
+	// stale, when set, answers the lookups failing on Neo4j errors with the last relations found
+	stale *StaleStore
+	// debugAuth, when enabled, allows its callers to request a _debug block with ?debug=true
+	debugAuth *AdminAuth
 }
 
-type ErrorMessage struct {
-	Message string `json:"message"`
+func NewHttpHandlers(cypherDriver Driver, urls *PublicURLs, cacheControlHeader string) HttpHandlers {
+	return HttpHandlers{cypherDriver: cypherDriver, urls: urls, cacheControlHeader: cacheControlHeader}
 }
 
-func NewHttpHandlers(cypherDriver Driver, cacheControlHeader string) HttpHandlers {
-	return HttpHandlers{cypherDriver, cacheControlHeader}
+// CachePolicy is how long responses may be cached, and served stale, by clients and caches.
+type CachePolicy struct {
+	MaxAge time.Duration
+	// StaleWhileRevalidate is how long a stale response may be served while it is revalidated in the background
+	StaleWhileRevalidate time.Duration
+	// StaleIfError is how long a stale response may be served when revalidating it fails
+	StaleIfError time.Duration
+}
+
+// Header formats the policy as a public Cache-Control header.
+func (p CachePolicy) Header() string {
+	directives := []string{"max-age=" + seconds(p.MaxAge)}
+	if p.StaleWhileRevalidate > 0 {
+		directives = append(directives, "stale-while-revalidate="+seconds(p.StaleWhileRevalidate))
+	}
+	if p.StaleIfError > 0 {
+		directives = append(directives, "stale-if-error="+seconds(p.StaleIfError))
+	}
+	return strings.Join(append(directives, "public"), ", ")
+}
+
+func seconds(d time.Duration) string {
+	return strconv.FormatFloat(d.Seconds(), 'f', 0, 64)
+}
+
+// WithErrorCacheControl returns handlers sending the given Cache-Control
+// headers on 404 and 5xx relations responses, which are not cached otherwise.
+func (hh HttpHandlers) WithErrorCacheControl(notFoundHeader, errorHeader string) HttpHandlers {
+	hh.notFoundCacheControlHeader = notFoundHeader
+	hh.errorCacheControlHeader = errorHeader
+	return hh
+}
+
+// WithStaleIfError returns handlers recording the relations found in the
+// store, and serving them with a Warning header when lookups fail.
+func (hh HttpHandlers) WithStaleIfError(store *StaleStore) HttpHandlers {
+	hh.stale = store
+	return hh
+}
+
+// WithSurrogateControl returns handlers sending the given Surrogate-Control
+// header along the Surrogate-Key header of the relations responses.
+func (hh HttpHandlers) WithSurrogateControl(header string) HttpHandlers {
+	hh.surrogateControlHeader = header
+	return hh
+}
+
+// WithDebug returns handlers attaching a _debug block to the responses of
+// requests with ?debug=true made with one of the given admin tokens.
+func (hh HttpHandlers) WithDebug(auth *AdminAuth) HttpHandlers {
+	hh.debugAuth = auth
+	return hh
 }
 
 func (hh *HttpHandlers) HealthCheck(neoURL string) fthealth.Check {
@@ -29,7 +93,7 @@ func (hh *HttpHandlers) HealthCheck(neoURL string) fthealth.Check {
 		BusinessImpact:   "Unable to respond to Relations API requests",
 		Name:             "Check connectivity to Neo4j",
 		PanicGuide:       "https://runbooks.in.ft.com/upp-relations-api",
-		Severity:         1,
+		Severity:         2,
 		TechnicalSummary: fmt.Sprintf(`Cannot connect to Neo4j (%v). Check that Neo4j instance is up and running`, neoURL),
 		Checker:          hh.Checker,
 	}
@@ -44,21 +108,6 @@ func (hh *HttpHandlers) Checker() (string, error) {
 	return "Connectivity to Neo4j is ok", err
 }
 
-func (hh *HttpHandlers) GTG() gtg.Status {
-	statusCheck := func() gtg.Status {
-		return gtgCheck(hh.Checker)
-	}
-
-	return gtg.FailFastParallelCheck([]gtg.StatusChecker{statusCheck})()
-}
-
-func gtgCheck(handler func() (string, error)) gtg.Status {
-	if _, err := handler(); err != nil {
-		return gtg.Status{GoodToGo: false, Message: err.Error()}
-	}
-	return gtg.Status{GoodToGo: true}
-}
-
 func (hh *HttpHandlers) GetContentRelations(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 
@@ -67,47 +116,72 @@ func (hh *HttpHandlers) GetContentRelations(w http.ResponseWriter, r *http.Reque
 
 	err := validateUuid(contentUUID)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		msg, jsonErr := json.Marshal(ErrorMessage{fmt.Sprintf("The given uuid is not valid, err=%v", err)})
-		if jsonErr != nil {
-			w.Write([]byte(fmt.Sprintf("Error message couldn't be encoded in json: , err=%s", jsonErr.Error())))
-		} else {
-			w.Write([]byte(msg))
-		}
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidUUID,
+			detail:  fmt.Sprintf("The given uuid is not valid, err=%v", err),
+		})
+		return
+	}
+	urls, err := hh.urls.forRequest(r)
+	if err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidParameter,
+			detail:  fmt.Sprintf("The given idFormat is not valid, err=%v", err),
+		})
 		return
 	}
 
-	rel, found, err := hh.cypherDriver.findContentRelations(contentUUID)
+	driver, debug := hh.debugDriver(r)
+	rel, found, err := driver.findContentRelations(contentUUID)
+	debug.finish()
+	rel, found, stale, err := hh.stale.contentRelations(contentUUID, rel, found, err)
+	// unresolved items are keys as well, the response changes once they are written as Content
+	surrogateKeys := rel.surrogateKeys(contentUUID)
+	if err == nil && found && !includeUnresolved(r) {
+		rel = rel.withoutUnresolved()
+		found = !rel.isEmpty()
+	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		msg, jsonErr := json.Marshal(ErrorMessage{fmt.Sprintf("Error retrieving relations for %s, err=%v", contentUUID, err)})
-		if jsonErr != nil {
-			w.Write([]byte(fmt.Sprintf("Error message couldn't be encoded in json: , err=%s", jsonErr.Error())))
-		} else {
-			w.Write([]byte(msg))
-		}
+		setCacheControl(w, hh.errorCacheControlHeader, debug)
+		writeError(w, r, apiError{
+			status:  http.StatusServiceUnavailable,
+			problem: problemUnavailable,
+			detail:  fmt.Sprintf("Error retrieving relations for %s, err=%v", contentUUID, err),
+			debug:   debug,
+		})
 		return
 	}
 	if !found {
-		w.WriteHeader(http.StatusNotFound)
-		msg, jsonErr := json.Marshal(ErrorMessage{fmt.Sprintf("No relations found for content with uuid %s", contentUUID)})
-		if jsonErr != nil {
-			w.Write([]byte(fmt.Sprintf("Error message couldn't be encoded in json: , err=%s", jsonErr.Error())))
-		} else {
-			w.Write([]byte(msg))
-		}
+		setCacheControl(w, hh.notFoundCacheControlHeader, debug)
+		writeError(w, r, apiError{
+			status:  http.StatusNotFound,
+			problem: problemRelationsNotFound,
+			detail:  fmt.Sprintf("No relations found for content with uuid %s", contentUUID),
+			debug:   debug,
+		})
 		return
 	}
 
-	w.Header().Set("Cache-Control", hh.cacheControlHeader)
-	w.WriteHeader(http.StatusOK)
-
-	if err = json.NewEncoder(w).Encode(rel); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg, _ := json.Marshal(ErrorMessage{fmt.Sprintf("Error parsing result for content with uuid %s, err=%v", contentUUID, err)})
-		w.Write([]byte(msg))
+	// encoded before the status is sent, so that a failure is still reported as an error
+	var body bytes.Buffer
+	rel = urls.relations(rel)
+	if err = json.NewEncoder(&body).Encode(debugRelations{rel, debug}); err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusInternalServerError,
+			problem: problemEncoding,
+			detail:  fmt.Sprintf("Error parsing result for content with uuid %s, err=%v", contentUUID, err),
+		})
+		return
 	}
+
+	hh.setResponseCacheControl(w, stale, debug)
+	hh.setSurrogateHeaders(w, surrogateKeys, stale, debug)
+	hh.urls.setVary(w)
+	w.WriteHeader(http.StatusOK)
+	_, _ = body.WriteTo(w)
 }
 
 func (hh *HttpHandlers) GetContentCollectionRelations(w http.ResponseWriter, r *http.Request) {
@@ -118,49 +192,125 @@ func (hh *HttpHandlers) GetContentCollectionRelations(w http.ResponseWriter, r *
 
 	err := validateUuid(contentUUID)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
-		msg, jsonErr := json.Marshal(ErrorMessage{fmt.Sprintf("The given uuid is not valid, err=%v", err)})
-		if jsonErr != nil {
-			w.Write([]byte(fmt.Sprintf("Error message couldn't be encoded in json: , err=%s", jsonErr.Error())))
-		} else {
-			w.Write([]byte(msg))
-		}
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidUUID,
+			detail:  fmt.Sprintf("The given uuid is not valid, err=%v", err),
+		})
 		return
 	}
 
-	rel, found, err := hh.cypherDriver.findContentCollectionRelations(contentUUID)
+	driver, debug := hh.debugDriver(r)
+	rel, found, err := driver.findContentCollectionRelations(contentUUID)
+	debug.finish()
+	rel, found, stale, err := hh.stale.contentCollectionRelations(contentUUID, rel, found, err)
+	surrogateKeys := rel.surrogateKeys(contentUUID)
+	if !includeUnresolved(r) {
+		rel.UnresolvedContains = nil
+	}
 
 	if err != nil {
-		w.WriteHeader(http.StatusServiceUnavailable)
-		msg, jsonErr := json.Marshal(ErrorMessage{fmt.Sprintf("Error retrieving relations for %s, err=%v", contentUUID, err)})
-		if jsonErr != nil {
-			w.Write([]byte(fmt.Sprintf("Error message couldn't be encoded in json: , err=%s", jsonErr.Error())))
-		} else {
-			w.Write([]byte(msg))
-		}
+		setCacheControl(w, hh.errorCacheControlHeader, debug)
+		writeError(w, r, apiError{
+			status:  http.StatusServiceUnavailable,
+			problem: problemUnavailable,
+			detail:  fmt.Sprintf("Error retrieving relations for %s, err=%v", contentUUID, err),
+			debug:   debug,
+		})
 		return
 	}
 	if !found {
-		w.WriteHeader(http.StatusNotFound)
-		msg, jsonErr := json.Marshal(ErrorMessage{fmt.Sprintf("No relations found for content collection with uuid %s", contentUUID)})
-		if jsonErr != nil {
-			w.Write([]byte(fmt.Sprintf("Error message couldn't be encoded in json: , err=%s", jsonErr.Error())))
-		} else {
-			w.Write([]byte(msg))
-		}
+		setCacheControl(w, hh.notFoundCacheControlHeader, debug)
+		writeError(w, r, apiError{
+			status:  http.StatusNotFound,
+			problem: problemRelationsNotFound,
+			detail:  fmt.Sprintf("No relations found for content collection with uuid %s", contentUUID),
+			debug:   debug,
+		})
 		return
 	}
 
-	w.Header().Set("Cache-Control", hh.cacheControlHeader)
+	var body bytes.Buffer
+	if err = json.NewEncoder(&body).Encode(debugCCRelations{rel, debug}); err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusInternalServerError,
+			problem: problemEncoding,
+			detail:  fmt.Sprintf("Error parsing result for content collection with uuid %s, err=%v", contentUUID, err),
+		})
+		return
+	}
+
+	hh.setResponseCacheControl(w, stale, debug)
+	hh.setSurrogateHeaders(w, surrogateKeys, stale, debug)
 	w.WriteHeader(http.StatusOK)
+	_, _ = body.WriteTo(w)
+}
 
-	if err = json.NewEncoder(w).Encode(rel); err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
-		msg, _ := json.Marshal(ErrorMessage{fmt.Sprintf("Error parsing result for content collection with uuid %s, err=%v", contentUUID, err)})
-		w.Write([]byte(msg))
+// debugDriver returns a driver tracing its queries, bypassing the cache, when
+// debug output was requested by an admin. Otherwise the lookup debug is nil.
+func (hh *HttpHandlers) debugDriver(r *http.Request) (Driver, *lookupDebug) {
+	if debug, _ := strconv.ParseBool(r.URL.Query().Get("debug")); !debug || !hh.debugAuth.Enabled() {
+		return hh.cypherDriver, nil
+	}
+	if _, ok := hh.debugAuth.identify(r); !ok {
+		return hh.cypherDriver, nil
+	}
+	trace := newLookupTrace()
+	driver, ok := tracedDriver(hh.cypherDriver, trace)
+	if !ok {
+		return hh.cypherDriver, nil
+	}
+	return driver, &lookupDebug{lookupTrace: trace, start: time.Now()}
+}
+
+// setSurrogateHeaders lets the CDN cache the response for its own duration
+// and purge it by the UUID of any content or collection it was built from.
+// Stale responses stand in for an error, the CDN must not keep them.
+func (hh *HttpHandlers) setSurrogateHeaders(w http.ResponseWriter, keys []string, stale *staleness, debug *lookupDebug) {
+	if debug != nil {
+		return
+	}
+	w.Header().Set("Surrogate-Key", strings.Join(keys, " "))
+	if stale != nil {
+		w.Header().Set("Surrogate-Control", "max-age=0")
+	} else if hh.surrogateControlHeader != "" {
+		w.Header().Set("Surrogate-Control", hh.surrogateControlHeader)
 	}
 }
 
+// setResponseCacheControl sets the Cache-Control of a relations response.
+// Stale responses are cached no longer than errors, as they stand in for
+// one, and not at all when errors aren't.
+func (hh *HttpHandlers) setResponseCacheControl(w http.ResponseWriter, stale *staleness, debug *lookupDebug) {
+	if stale == nil {
+		setCacheControl(w, hh.cacheControlHeader, debug)
+		return
+	}
+	stale.setHeaders(w)
+	if hh.errorCacheControlHeader == "" {
+		setCacheControl(w, "no-store", debug)
+		return
+	}
+	setCacheControl(w, hh.errorCacheControlHeader, debug)
+}
+
+func setCacheControl(w http.ResponseWriter, cacheControlHeader string, debug *lookupDebug) {
+	if debug != nil {
+		// debug output is specific to the admin who asked for it
+		w.Header().Set("Cache-Control", "no-store")
+		return
+	}
+	if cacheControlHeader != "" {
+		w.Header().Set("Cache-Control", cacheControlHeader)
+	}
+}
+
+// includeUnresolved reports whether items that were never written as Content were requested
+func includeUnresolved(r *http.Request) bool {
+	include, _ := strconv.ParseBool(r.URL.Query().Get("includeUnresolved"))
+	return include
+}
+
 func validateUuid(contentUUID string) error {
 	parsedUUID, err := uuid.Parse(contentUUID)
 	if err != nil {
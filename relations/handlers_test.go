@@ -2,15 +2,19 @@ package relations
 
 import (
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"github.com/stretchr/testify/require"
 )
 
 type test struct {
@@ -22,9 +26,9 @@ type test struct {
 }
 
 const knownUUID = "f78c1482-a65c-413e-b753-ca3ce3cb84f0"
-const successfulContentResponse = `{"curatedRelatedContent":[{"id":"http://id-f78c1482-a65c-413e-b753-ca3ce3cb84f0", "apiUrl":"http://apiurl-f78c1482-a65c-413e-b753-ca3ce3cb84f0"}],
-"contains":[{"id":"http://id-f78c1482-a65c-413e-b753-ca3ce3cb84f0", "apiUrl":"http://apiurl-f78c1482-a65c-413e-b753-ca3ce3cb84f0"}],
-"containedIn":[{"id":"http://id-f78c1482-a65c-413e-b753-ca3ce3cb84f0", "apiUrl":"http://apiurl-f78c1482-a65c-413e-b753-ca3ce3cb84f0"}]}`
+const successfulContentResponse = `{"curatedRelatedContent":[{"id":"http://api.ft.com/things/f78c1482-a65c-413e-b753-ca3ce3cb84f0", "apiUrl":"http://api.ft.com/content/f78c1482-a65c-413e-b753-ca3ce3cb84f0"}],
+"contains":[{"id":"http://api.ft.com/things/f78c1482-a65c-413e-b753-ca3ce3cb84f0", "apiUrl":"http://api.ft.com/content/f78c1482-a65c-413e-b753-ca3ce3cb84f0"}],
+"containedIn":[{"id":"http://api.ft.com/things/f78c1482-a65c-413e-b753-ca3ce3cb84f0", "apiUrl":"http://api.ft.com/content/f78c1482-a65c-413e-b753-ca3ce3cb84f0"}]}`
 const successfulContentCollectionResponse = `{"containedIn": "f78c1482-a65c-413e-b753-ca3ce3cb84f0",
 "contains":["f78c1482-a65c-413e-b753-ca3ce3cb84f0"]}`
 
@@ -37,7 +41,7 @@ func TestGetContentRelationsHandler(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		hh := HttpHandlers{test.cypherDriverMock, ""}
+		hh := NewHttpHandlers(test.cypherDriverMock, testURLs, "")
 		rec := httptest.NewRecorder()
 		r := mux.NewRouter()
 		r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
@@ -56,7 +60,7 @@ func TestGetContentCollectionRelationsHandler(t *testing.T) {
 	}
 
 	for _, test := range tests {
-		hh := HttpHandlers{test.cypherDriverMock, ""}
+		hh := NewHttpHandlers(test.cypherDriverMock, testURLs, "")
 		rec := httptest.NewRecorder()
 		r := mux.NewRouter()
 		r.HandleFunc("/contentcollection/{uuid}/relations", hh.GetContentCollectionRelations).Methods("GET")
@@ -83,6 +87,7 @@ type cypherDriverMock struct {
 	mock.Mock
 	contentUUID string
 	failRead    bool
+	failWrite   bool
 }
 
 func (cdm *cypherDriverMock) findContentRelations(contentUUID string) (relations, bool, error) {
@@ -91,9 +96,9 @@ func (cdm *cypherDriverMock) findContentRelations(contentUUID string) (relations
 	}
 	if contentUUID == cdm.contentUUID {
 		return relations{
-			CuratedRelatedContents: []relatedContent{{ID: "http://id-" + contentUUID, APIURL: "http://apiurl-" + contentUUID}},
-			Contains:               []relatedContent{{ID: "http://id-" + contentUUID, APIURL: "http://apiurl-" + contentUUID}},
-			ContainedIn:            []relatedContent{{ID: "http://id-" + contentUUID, APIURL: "http://apiurl-" + contentUUID}},
+			CuratedRelatedContents: []relatedContent{{uuid: contentUUID}},
+			Contains:               []relatedContent{{uuid: contentUUID}},
+			ContainedIn:            []relatedContent{{uuid: contentUUID}},
 		}, true, nil
 	}
 	return relations{}, false, nil
@@ -112,6 +117,214 @@ func (cdm *cypherDriverMock) findContentCollectionRelations(contentUUID string)
 	return ccRelations{}, false, nil
 }
 
+func (cdm *cypherDriverMock) findContentCollectionLeads(contentCollectionUUID string) ([]string, error) {
+	if cdm.failRead {
+		return nil, errors.New("TEST failing to READ")
+	}
+	if contentCollectionUUID == cdm.contentUUID {
+		return []string{contentCollectionUUID}, nil
+	}
+	return nil, nil
+}
+
+func (cdm *cypherDriverMock) findRelatedContentUUIDs(afterUUID string, limit int) ([]string, error) {
+	if cdm.failRead {
+		return nil, errors.New("TEST failing to READ")
+	}
+	if cdm.contentUUID > afterUUID && limit > 0 {
+		return []string{cdm.contentUUID}, nil
+	}
+	return []string{}, nil
+}
+
 func (cdm *cypherDriverMock) checkConnectivity() error {
+	if cdm.failWrite {
+		return errors.New("TEST failing to WRITE")
+	}
+	return nil
+}
+
+func (cdm *cypherDriverMock) checkReadConnectivity() error {
+	if cdm.failRead {
+		return errors.New("TEST failing to READ")
+	}
 	return nil
 }
+
+func TestGetRelationsHandlersIncludeUnresolved(t *testing.T) {
+	danglingUUID := "3fc9fe3e-af8c-9a9a-961a-e5065392bb31"
+	driver := &mutableDriverMock{
+		cypherDriverMock: cypherDriverMock{contentUUID: collectionUUID},
+		relations: map[string]relations{
+			knownUUID: {CuratedRelatedContents: []relatedContent{
+				{uuid: item1UUID},
+				{uuid: danglingUUID, Unresolved: true},
+			}},
+			leadUUID: {Contains: []relatedContent{
+				{uuid: danglingUUID, Unresolved: true},
+			}},
+		},
+	}
+	ccDriver := &unresolvedCollectionDriverMock{mutableDriverMock: driver, unresolved: []string{danglingUUID}}
+
+	tests := []test{
+		{"ResolvedOnly", newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil), nil, http.StatusOK,
+			`{"curatedRelatedContent":[{"id":"http://api.ft.com/things/` + item1UUID + `","apiUrl":"http://api.ft.com/content/` + item1UUID + `"}]}`},
+		{"IncludeUnresolved", newRequest("GET", fmt.Sprintf("/content/%s/relations?includeUnresolved=true", knownUUID), nil), nil, http.StatusOK,
+			`{"curatedRelatedContent":[{"id":"http://api.ft.com/things/` + item1UUID + `","apiUrl":"http://api.ft.com/content/` + item1UUID + `"},
+			{"id":"http://api.ft.com/things/` + danglingUUID + `","apiUrl":"http://api.ft.com/content/` + danglingUUID + `","unresolved":true}]}`},
+		{"OnlyUnresolvedNotFound", newRequest("GET", fmt.Sprintf("/content/%s/relations", leadUUID), nil), nil, http.StatusNotFound,
+			message("No relations found for content with uuid " + leadUUID)},
+		{"OnlyUnresolved", newRequest("GET", fmt.Sprintf("/content/%s/relations?includeUnresolved=true", leadUUID), nil), nil, http.StatusOK,
+			`{"contains":[{"id":"http://api.ft.com/things/` + danglingUUID + `","apiUrl":"http://api.ft.com/content/` + danglingUUID + `","unresolved":true}]}`},
+		{"CollectionResolvedOnly", newRequest("GET", fmt.Sprintf("/contentcollection/%s/relations", collectionUUID), nil), nil, http.StatusOK,
+			`{"containedIn":"` + collectionUUID + `","contains":["` + collectionUUID + `"]}`},
+		{"CollectionIncludeUnresolved", newRequest("GET", fmt.Sprintf("/contentcollection/%s/relations?includeUnresolved=true", collectionUUID), nil), nil, http.StatusOK,
+			`{"containedIn":"` + collectionUUID + `","contains":["` + collectionUUID + `"],"unresolvedContains":["` + danglingUUID + `"]}`},
+	}
+
+	for _, test := range tests {
+		hh := NewHttpHandlers(ccDriver, testURLs, "")
+		rec := httptest.NewRecorder()
+		r := mux.NewRouter()
+		r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+		r.HandleFunc("/contentcollection/{uuid}/relations", hh.GetContentCollectionRelations).Methods("GET")
+		r.ServeHTTP(rec, test.req)
+		assert.True(t, test.statusCode == rec.Code, fmt.Sprintf("%s: Wrong response code, was %d, should be %d", test.name, rec.Code, test.statusCode))
+		assert.JSONEq(t, test.body, rec.Body.String(), fmt.Sprintf("%s: Wrong body", test.name))
+	}
+}
+
+type unresolvedCollectionDriverMock struct {
+	*mutableDriverMock
+	unresolved []string
+}
+
+func (m *unresolvedCollectionDriverMock) findContentCollectionRelations(contentUUID string) (ccRelations, bool, error) {
+	rel, found, err := m.cypherDriverMock.findContentCollectionRelations(contentUUID)
+	rel.UnresolvedContains = m.unresolved
+	return rel, found, err
+}
+
+func TestGetContentRelationsDebugIgnoredWhenUntraceable(t *testing.T) {
+	auth, err := NewAdminAuth("ops:token-1")
+	require.NoError(t, err)
+	hh := NewHttpHandlers(&cypherDriverMock{contentUUID: knownUUID}, testURLs, "max-age=30").WithDebug(auth)
+
+	req := newRequest("GET", fmt.Sprintf("/content/%s/relations?debug=true", knownUUID), nil)
+	req.Header.Set("Authorization", "Bearer token-1")
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "max-age=30", rec.Header().Get("Cache-Control"))
+	assert.JSONEq(t, successfulContentResponse, rec.Body.String())
+}
+
+func TestLookupDebugEncoding(t *testing.T) {
+	trace := newLookupTrace()
+	trace.addQuery(QueryTrace{Cypher: "MATCH (n) RETURN n", Params: map[string]interface{}{"contentUUID": knownUUID}, Rows: 1, Duration: 2 * time.Millisecond})
+	trace.addUUIDs("contains", nil)
+	debug := &lookupDebug{lookupTrace: trace, DurationMs: 3}
+
+	body, err := json.Marshal(debugRelations{relations{Contains: []relatedContent{{ID: "http://id"}}}, debug})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{"contains":[{"id":"http://id"}],"_debug":{
+		"queries":[{"cypher":"MATCH (n) RETURN n","params":{"contentUUID":"`+knownUUID+`"},"rows":1,"durationMs":2}],
+		"rawUUIDs":{"contains":[]},"durationMs":3}}`, string(body))
+
+	body, err = json.Marshal(debugRelations{relations: relations{}})
+	require.NoError(t, err)
+	assert.JSONEq(t, `{}`, string(body), "No _debug block should be attached to requests not debugged")
+}
+
+func TestGetRelationsHandlersSurrogateHeaders(t *testing.T) {
+	danglingUUID := "3fc9fe3e-af8c-9a9a-961a-e5065392bb31"
+	packageUUID := "8e1b7f5a-5d0c-4d3c-9a2a-1f3c9e0a7b21"
+	driver := &mutableDriverMock{
+		cypherDriverMock: cypherDriverMock{contentUUID: collectionUUID},
+		relations: map[string]relations{
+			knownUUID: {
+				CuratedRelatedContents: []relatedContent{{uuid: item1UUID}, {uuid: danglingUUID, Unresolved: true}},
+				ContainedIn:            []relatedContent{{uuid: packageUUID}},
+				collectionUUIDs:        []string{leadUUID, collectionUUID},
+			},
+		},
+	}
+	hh := NewHttpHandlers(driver, testURLs, "max-age=30, public").WithSurrogateControl("max-age=86400")
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+	r.HandleFunc("/contentcollection/{uuid}/relations", hh.GetContentCollectionRelations).Methods("GET")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, strings.Join([]string{knownUUID, item1UUID, danglingUUID, packageUUID, leadUUID, collectionUUID}, " "), rec.Header().Get("Surrogate-Key"))
+	assert.Equal(t, "max-age=86400", rec.Header().Get("Surrogate-Control"))
+	assert.Equal(t, "max-age=30, public", rec.Header().Get("Cache-Control"))
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/contentcollection/%s/relations", collectionUUID), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, collectionUUID, rec.Header().Get("Surrogate-Key"), "the package and the content are the collection itself in the mock")
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", otherUUID), nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+	assert.Empty(t, rec.Header().Get("Surrogate-Key"))
+	assert.Empty(t, rec.Header().Get("Surrogate-Control"))
+}
+
+func TestGetContentRelationsSurrogateControlDisabled(t *testing.T) {
+	hh := NewHttpHandlers(&cypherDriverMock{contentUUID: knownUUID}, testURLs, "max-age=30")
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+
+	assert.Equal(t, knownUUID, rec.Header().Get("Surrogate-Key"))
+	assert.Empty(t, rec.Header().Get("Surrogate-Control"))
+}
+
+func TestCachePolicyHeader(t *testing.T) {
+	assert.Equal(t, "max-age=30, public", CachePolicy{MaxAge: 30 * time.Second}.Header())
+	assert.Equal(t, "max-age=0, public", CachePolicy{}.Header())
+	assert.Equal(t, "max-age=60, stale-while-revalidate=30, stale-if-error=86400, public",
+		CachePolicy{MaxAge: time.Minute, StaleWhileRevalidate: 30 * time.Second, StaleIfError: 24 * time.Hour}.Header())
+}
+
+func TestErrorCacheControl(t *testing.T) {
+	tests := []struct {
+		name          string
+		url           string
+		driver        *cypherDriverMock
+		status        int
+		cacheControl  string
+		notFoundCache string
+		errorCache    string
+	}{
+		{"ContentFound", "/content/%s/relations", &cypherDriverMock{contentUUID: knownUUID}, http.StatusOK, "max-age=30, public", "max-age=300, public", "max-age=5, public"},
+		{"ContentNotFound", "/content/%s/relations", &cypherDriverMock{contentUUID: otherUUID}, http.StatusNotFound, "max-age=300, public", "max-age=300, public", "max-age=5, public"},
+		{"ContentReadError", "/content/%s/relations", &cypherDriverMock{contentUUID: knownUUID, failRead: true}, http.StatusServiceUnavailable, "max-age=5, public", "max-age=300, public", "max-age=5, public"},
+		{"CollectionNotFound", "/contentcollection/%s/relations", &cypherDriverMock{contentUUID: otherUUID}, http.StatusNotFound, "max-age=300, public", "max-age=300, public", "max-age=5, public"},
+		{"CollectionReadError", "/contentcollection/%s/relations", &cypherDriverMock{contentUUID: knownUUID, failRead: true}, http.StatusServiceUnavailable, "max-age=5, public", "max-age=300, public", "max-age=5, public"},
+		{"NotFoundNotCached", "/content/%s/relations", &cypherDriverMock{contentUUID: otherUUID}, http.StatusNotFound, "", "", ""},
+		{"ReadErrorNotCached", "/contentcollection/%s/relations", &cypherDriverMock{contentUUID: knownUUID, failRead: true}, http.StatusServiceUnavailable, "", "", ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			hh := NewHttpHandlers(test.driver, testURLs, "max-age=30, public").WithErrorCacheControl(test.notFoundCache, test.errorCache)
+			r := mux.NewRouter()
+			r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+			r.HandleFunc("/contentcollection/{uuid}/relations", hh.GetContentCollectionRelations).Methods("GET")
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf(test.url, knownUUID), nil))
+
+			assert.Equal(t, test.status, rec.Code)
+			assert.Equal(t, test.cacheControl, rec.Header().Get("Cache-Control"))
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package relations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/service-status-go/gtg"
+)
+
+// canaryFields are the relations of the canary content that can be expected to be non empty
+var canaryFields = map[string]func(relations) []relatedContent{
+	"curatedRelatedContent": func(r relations) []relatedContent { return r.CuratedRelatedContents },
+	"contains":              func(r relations) []relatedContent { return r.Contains },
+	"containedIn":           func(r relations) []relatedContent { return r.ContainedIn },
+}
+
+// HealthConfig configures the checks looking beyond connectivity to Neo4j.
+type HealthConfig struct {
+	// CanaryUUID is content with known relations looked up by the canary check, which is disabled when empty
+	CanaryUUID string
+	// CanaryExpect lists the relations of the canary content expected to be non empty
+	CanaryExpect []string
+	// LatencyBudget is the longest the canary lookup, or a read without canary, may take; 0 disables the check
+	LatencyBudget time.Duration
+}
+
+// NewDeepHealthChecks returns the read connectivity, canary and latency
+// budget checks of the driver, which should not be cached so that the
+// lookups reach Neo4j.
+func NewDeepHealthChecks(driver Driver, config HealthConfig) ([]fthealth.Check, error) {
+	checks := []fthealth.Check{{
+		BusinessImpact:   "Unable to respond to Relations API requests",
+		Name:             "Check reads from Neo4j",
+		PanicGuide:       "https://runbooks.in.ft.com/upp-relations-api",
+		Severity:         1,
+		TechnicalSummary: "Cannot read from Neo4j. Check that a Neo4j member, core or read replica, is up and running",
+		Checker: func() (string, error) {
+			if err := driver.checkReadConnectivity(); err != nil {
+				return "Error reading from Neo4j", err
+			}
+			return "Reads from Neo4j are ok", nil
+		},
+	}}
+
+	if config.CanaryUUID != "" {
+		if err := validateUuid(config.CanaryUUID); err != nil {
+			return nil, fmt.Errorf("Invalid canary UUID %s", config.CanaryUUID)
+		}
+		expect := make([]string, 0, len(config.CanaryExpect))
+		for _, field := range config.CanaryExpect {
+			field = strings.TrimSpace(field)
+			if canaryFields[field] == nil {
+				return nil, fmt.Errorf("Unknown canary relations %s, expected curatedRelatedContent, contains or containedIn", field)
+			}
+			expect = append(expect, field)
+		}
+		checks = append(checks, fthealth.Check{
+			BusinessImpact:   "Relations API responses may be missing relations or be wrong",
+			Name:             "Check the relations of the canary content",
+			PanicGuide:       "https://runbooks.in.ft.com/upp-relations-api",
+			Severity:         1,
+			TechnicalSummary: fmt.Sprintf("The relations of the canary content %s are not the expected ones. Check that the content and its collections are still in Neo4j and that the indexes exist", config.CanaryUUID),
+			Checker: func() (string, error) {
+				return checkCanary(driver, config.CanaryUUID, expect)
+			},
+		})
+	}
+
+	if config.LatencyBudget > 0 {
+		checks = append(checks, fthealth.Check{
+			BusinessImpact:   "Relations API responses are slow",
+			Name:             "Check the latency of Neo4j lookups",
+			PanicGuide:       "https://runbooks.in.ft.com/upp-relations-api",
+			Severity:         3,
+			TechnicalSummary: fmt.Sprintf("Neo4j lookups take longer than %v. Check the load on Neo4j and that the indexes exist", config.LatencyBudget),
+			Checker: func() (string, error) {
+				return checkLatency(driver, config)
+			},
+		})
+	}
+	return checks, nil
+}
+
+func checkCanary(driver Driver, canaryUUID string, expect []string) (string, error) {
+	rel, found, err := driver.findContentRelations(canaryUUID)
+	if err != nil {
+		return "Error looking up the canary relations", err
+	}
+	if !found {
+		return "Canary relations not found", fmt.Errorf("No relations found for canary content %s", canaryUUID)
+	}
+
+	for _, field := range expect {
+		related := canaryFields[field](rel)
+		if len(related) == 0 {
+			return "Unexpected canary relations", fmt.Errorf("Expected %s relations for canary content %s, found none", field, canaryUUID)
+		}
+		for _, rc := range related {
+			if validateUuid(rc.uuid) != nil {
+				return "Unexpected canary relations", fmt.Errorf("Invalid UUID %q in the %s relations of canary content %s", rc.uuid, field, canaryUUID)
+			}
+		}
+	}
+	return fmt.Sprintf("Relations of canary content %s are as expected", canaryUUID), nil
+}
+
+func checkLatency(driver Driver, config HealthConfig) (string, error) {
+	start := time.Now()
+	var err error
+	if config.CanaryUUID != "" {
+		_, _, err = driver.findContentRelations(config.CanaryUUID)
+	} else {
+		err = driver.checkReadConnectivity()
+	}
+	elapsed := time.Since(start)
+	if err != nil {
+		return "Error timing a Neo4j lookup", err
+	}
+	if elapsed > config.LatencyBudget {
+		return "Neo4j lookups are slow", fmt.Errorf("Lookup took %v, over the latency budget of %v", elapsed, config.LatencyBudget)
+	}
+	return fmt.Sprintf("Lookup took %v, within the latency budget of %v", elapsed, config.LatencyBudget), nil
+}
+
+type checkOutcome struct {
+	output    string
+	err       error
+	checkedAt time.Time
+}
+
+// HealthMonitor runs the health checks on a schedule and serves their last
+// outcome, so that /__health and /__gtg never wait for Neo4j.
+type HealthMonitor struct {
+	checks   []fthealth.Check
+	interval time.Duration
+	mu       sync.RWMutex
+	outcomes []*checkOutcome
+	log      *logger.UPPLogger
+}
+
+// NewHealthMonitor creates a monitor running the checks every interval once started.
+func NewHealthMonitor(checks []fthealth.Check, interval time.Duration, log *logger.UPPLogger) *HealthMonitor {
+	return &HealthMonitor{
+		checks:   checks,
+		interval: interval,
+		outcomes: make([]*checkOutcome, len(checks)),
+		log:      log,
+	}
+}
+
+// Start runs the checks immediately, then every interval until the context is done.
+func (m *HealthMonitor) Start(ctx context.Context) {
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		m.runAll()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (m *HealthMonitor) runAll() {
+	var wg sync.WaitGroup
+	for i := range m.checks {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			m.run(i)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func (m *HealthMonitor) run(i int) {
+	check := m.checks[i]
+	output, err := check.Checker()
+
+	m.mu.Lock()
+	previous := m.outcomes[i]
+	m.outcomes[i] = &checkOutcome{output: output, err: err, checkedAt: time.Now()}
+	m.mu.Unlock()
+
+	if err != nil && (previous == nil || previous.err == nil) {
+		m.log.WithError(err).WithField("check", check.Name).Warn("Health check started failing")
+	} else if err == nil && previous != nil && previous.err != nil {
+		m.log.WithField("check", check.Name).Info("Health check recovered")
+	}
+}
+
+// outcome returns the last outcome of the check, failing when it has not
+// completed yet or not recently enough for its outcome to be trusted.
+func (m *HealthMonitor) outcome(i int) (string, error) {
+	m.mu.RLock()
+	outcome := m.outcomes[i]
+	m.mu.RUnlock()
+
+	if outcome == nil {
+		return "Not checked yet", errors.New("The check has not completed yet")
+	}
+	if time.Since(outcome.checkedAt) > 3*m.interval {
+		return "Stale check", fmt.Errorf("The check has not completed since %s", outcome.checkedAt.Format(time.RFC3339))
+	}
+	return fmt.Sprintf("%s (checked at %s)", outcome.output, outcome.checkedAt.Format(time.RFC3339)), outcome.err
+}
+
+// Checks returns the checks reporting their last outcome instead of running.
+func (m *HealthMonitor) Checks() []fthealth.Check {
+	checks := make([]fthealth.Check, 0, len(m.checks))
+	for i, check := range m.checks {
+		i := i
+		check.Checker = func() (string, error) {
+			return m.outcome(i)
+		}
+		checks = append(checks, check)
+	}
+	return checks
+}
+
+// GTG reports the service not good to go while a severity 1 check fails.
+func (m *HealthMonitor) GTG() gtg.Status {
+	var failing []string
+	for i, check := range m.checks {
+		if check.Severity != 1 {
+			continue
+		}
+		if _, err := m.outcome(i); err != nil {
+			failing = append(failing, fmt.Sprintf("%s: %v", check.Name, err))
+		}
+	}
+	if len(failing) > 0 {
+		return gtg.Status{GoodToGo: false, Message: strings.Join(failing, "; ")}
+	}
+	return gtg.Status{GoodToGo: true}
+}
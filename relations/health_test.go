@@ -0,0 +1,167 @@
+package relations
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const otherUUID = "2a4cd6a7-4e3f-4bd5-9f8e-7c4a2f9bd1e3"
+
+type slowDriverMock struct {
+	cypherDriverMock
+	delay time.Duration
+}
+
+func (m *slowDriverMock) findContentRelations(contentUUID string) (relations, bool, error) {
+	time.Sleep(m.delay)
+	return m.cypherDriverMock.findContentRelations(contentUUID)
+}
+
+func checkerByName(t *testing.T, checks []fthealth.Check, name string) func() (string, error) {
+	for _, check := range checks {
+		if check.Name == name {
+			return check.Checker
+		}
+	}
+	require.Failf(t, "check not found", name)
+	return nil
+}
+
+func TestNewDeepHealthChecksValidation(t *testing.T) {
+	driver := &cypherDriverMock{contentUUID: knownUUID}
+
+	checks, err := NewDeepHealthChecks(driver, HealthConfig{})
+	require.NoError(t, err)
+	assert.Len(t, checks, 1, "only the read check is expected without canary nor latency budget")
+
+	checks, err = NewDeepHealthChecks(driver, HealthConfig{CanaryUUID: knownUUID, CanaryExpect: []string{"contains", " containedIn"}, LatencyBudget: time.Second})
+	require.NoError(t, err)
+	assert.Len(t, checks, 3)
+
+	_, err = NewDeepHealthChecks(driver, HealthConfig{CanaryUUID: "not-a-uuid"})
+	assert.Error(t, err)
+	_, err = NewDeepHealthChecks(driver, HealthConfig{CanaryUUID: knownUUID, CanaryExpect: []string{"related"}})
+	assert.Error(t, err)
+}
+
+func TestReadConnectivityCheck(t *testing.T) {
+	checks, err := NewDeepHealthChecks(&cypherDriverMock{}, HealthConfig{})
+	require.NoError(t, err)
+	_, err = checkerByName(t, checks, "Check reads from Neo4j")()
+	assert.NoError(t, err)
+
+	checks, err = NewDeepHealthChecks(&cypherDriverMock{failRead: true}, HealthConfig{})
+	require.NoError(t, err)
+	_, err = checkerByName(t, checks, "Check reads from Neo4j")()
+	assert.Error(t, err)
+}
+
+func TestCanaryCheck(t *testing.T) {
+	tests := []struct {
+		name       string
+		driver     Driver
+		canaryUUID string
+		expect     []string
+		ok         bool
+	}{
+		{"Expected", &cypherDriverMock{contentUUID: knownUUID}, knownUUID, []string{"curatedRelatedContent", "contains", "containedIn"}, true},
+		{"FoundOnly", &cypherDriverMock{contentUUID: knownUUID}, knownUUID, nil, true},
+		{"NotFound", &cypherDriverMock{contentUUID: knownUUID}, otherUUID, nil, false},
+		{"MissingRelations", &mutableDriverMock{relations: map[string]relations{knownUUID: {Contains: []relatedContent{{uuid: otherUUID}}}}}, knownUUID, []string{"curatedRelatedContent"}, false},
+		{"InvalidRelations", &mutableDriverMock{relations: map[string]relations{knownUUID: {Contains: []relatedContent{{uuid: "broken"}}}}}, knownUUID, []string{"contains"}, false},
+		{"ReadError", &cypherDriverMock{failRead: true}, knownUUID, nil, false},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checks, err := NewDeepHealthChecks(test.driver, HealthConfig{CanaryUUID: test.canaryUUID, CanaryExpect: test.expect})
+			require.NoError(t, err)
+			_, err = checkerByName(t, checks, "Check the relations of the canary content")()
+			assert.Equal(t, test.ok, err == nil, "unexpected error %v", err)
+		})
+	}
+}
+
+func TestLatencyBudgetCheck(t *testing.T) {
+	driver := &slowDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: knownUUID}, delay: 20 * time.Millisecond}
+
+	checks, err := NewDeepHealthChecks(driver, HealthConfig{CanaryUUID: knownUUID, LatencyBudget: time.Second})
+	require.NoError(t, err)
+	_, err = checkerByName(t, checks, "Check the latency of Neo4j lookups")()
+	assert.NoError(t, err)
+
+	checks, err = NewDeepHealthChecks(driver, HealthConfig{CanaryUUID: knownUUID, LatencyBudget: 5 * time.Millisecond})
+	require.NoError(t, err)
+	_, err = checkerByName(t, checks, "Check the latency of Neo4j lookups")()
+	assert.Error(t, err)
+}
+
+func TestHealthMonitorServesLastOutcome(t *testing.T) {
+	var runs int
+	var failing error
+	checks := []fthealth.Check{
+		{Name: "critical", Severity: 1, Checker: func() (string, error) {
+			runs++
+			return "ok", failing
+		}},
+		{Name: "minor", Severity: 3, Checker: func() (string, error) {
+			return "slow", errors.New("over budget")
+		}},
+	}
+	monitor := NewHealthMonitor(checks, time.Minute, logger.NewUPPLogger("test", "PANIC"))
+	cached := monitor.Checks()
+
+	_, err := cached[0].Checker()
+	assert.Error(t, err, "checks should fail until they ran")
+	assert.False(t, monitor.GTG().GoodToGo)
+
+	monitor.runAll()
+	output, err := cached[0].Checker()
+	assert.NoError(t, err)
+	assert.Contains(t, output, "ok")
+	_, err = cached[0].Checker()
+	assert.NoError(t, err)
+	assert.Equal(t, 1, runs, "the cached checks should not run the check")
+	assert.True(t, monitor.GTG().GoodToGo, "failing checks of lower severity should not affect GTG")
+
+	failing = errors.New("down")
+	monitor.runAll()
+	_, err = cached[0].Checker()
+	assert.Equal(t, failing, err)
+	assert.False(t, monitor.GTG().GoodToGo)
+	assert.Contains(t, monitor.GTG().Message, "critical")
+}
+
+func TestHealthMonitorStaleOutcome(t *testing.T) {
+	checks := []fthealth.Check{{Name: "critical", Severity: 1, Checker: func() (string, error) { return "ok", nil }}}
+	monitor := NewHealthMonitor(checks, time.Minute, logger.NewUPPLogger("test", "PANIC"))
+	monitor.runAll()
+	monitor.outcomes[0].checkedAt = time.Now().Add(-5 * time.Minute)
+
+	_, err := monitor.Checks()[0].Checker()
+	assert.Error(t, err)
+	assert.False(t, monitor.GTG().GoodToGo)
+}
+
+func TestHealthMonitorGoodToGoWithoutWrites(t *testing.T) {
+	driver := &cypherDriverMock{contentUUID: knownUUID, failWrite: true}
+	hh := NewHttpHandlers(driver, testURLs, "")
+	deep, err := NewDeepHealthChecks(driver, HealthConfig{CanaryUUID: knownUUID})
+	require.NoError(t, err)
+	monitor := NewHealthMonitor(append([]fthealth.Check{hh.HealthCheck("bolt://localhost:7687")}, deep...), time.Minute, logger.NewUPPLogger("test", "PANIC"))
+	monitor.runAll()
+
+	_, err = checkerByName(t, monitor.Checks(), "Check connectivity to Neo4j")()
+	assert.Error(t, err, "the write check should fail")
+	assert.True(t, monitor.GTG().GoodToGo, "a read-only service should stay good to go without writes")
+
+	driver.failRead = true
+	monitor.runAll()
+	assert.False(t, monitor.GTG().GoodToGo)
+}
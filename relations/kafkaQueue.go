@@ -0,0 +1,50 @@
+package relations
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/segmentio/kafka-go"
+)
+
+type kafkaQueue struct {
+	reader *kafka.Reader
+}
+
+// NewKafkaQueue returns a Queue reading the given topic as part of the given
+// consumer group. Every replica needs its own group to read every event of the
+// topic, a new group starts from the latest events.
+func NewKafkaQueue(brokers []string, topic, consumerGroup string) Queue {
+	return &kafkaQueue{
+		reader: kafka.NewReader(kafka.ReaderConfig{
+			Brokers:     brokers,
+			Topic:       topic,
+			GroupID:     consumerGroup,
+			StartOffset: kafka.LastOffset,
+		}),
+	}
+}
+
+func (q *kafkaQueue) Consume(ctx context.Context, handle func(Message)) error {
+	for {
+		m, err := q.reader.ReadMessage(ctx)
+		if err != nil {
+			if ctx.Err() != nil || errors.Is(err, io.EOF) {
+				return nil
+			}
+			return fmt.Errorf("Error reading from kafka topic %s, err=%v", q.reader.Config().Topic, err)
+		}
+
+		headers := make(map[string]string, len(m.Headers))
+		for _, h := range m.Headers {
+			headers[h.Key] = string(h.Value)
+		}
+		handle(Message{Headers: headers, Body: m.Value})
+	}
+}
+
+func (q *kafkaQueue) Close() error {
+	return q.reader.Close()
+}
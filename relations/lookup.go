@@ -0,0 +1,228 @@
+package relations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+)
+
+// QueryTrace describes a query executed by the cypher driver.
+type QueryTrace struct {
+	Cypher   string                 `json:"cypher"`
+	Params   map[string]interface{} `json:"params"`
+	Rows     int                    `json:"rows"`
+	Duration time.Duration          `json:"-"`
+	Error    string                 `json:"error,omitempty"`
+}
+
+func (t QueryTrace) MarshalJSON() ([]byte, error) {
+	type trace QueryTrace
+	return json.Marshal(struct {
+		trace
+		DurationMs float64 `json:"durationMs"`
+	}{trace(t), float64(t.Duration.Microseconds()) / 1000})
+}
+
+// lookupTrace records the queries run by a traced driver and the UUIDs they
+// found, before they are transformed into the response. A nil trace records nothing.
+type lookupTrace struct {
+	mu       sync.Mutex
+	Queries  []QueryTrace        `json:"queries"`
+	RawUUIDs map[string][]string `json:"rawUUIDs"`
+}
+
+func newLookupTrace() *lookupTrace {
+	return &lookupTrace{Queries: []QueryTrace{}, RawUUIDs: map[string][]string{}}
+}
+
+func (t *lookupTrace) addQuery(q QueryTrace) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.Queries = append(t.Queries, q)
+}
+
+func (t *lookupTrace) addUUIDs(list string, uuids []string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if uuids == nil {
+		uuids = []string{}
+	}
+	t.RawUUIDs[list] = uuids
+}
+
+// tracedDriver returns a driver recording its queries to trace, bypassing any
+// cache so that the queries are actually run. It returns false when the
+// driver can't be traced.
+func tracedDriver(driver Driver, trace *lookupTrace) (Driver, bool) {
+	switch d := driver.(type) {
+	case *cypherDriver:
+		return d.withTrace(trace), true
+	case *cachedDriver:
+		return tracedDriver(d.driver, trace)
+	case *staleRecordingDriver:
+		return tracedDriver(d.Driver, trace)
+	}
+	return driver, false
+}
+
+// resultRows counts the rows decoded into a query result.
+func resultRows(result interface{}, err error) int {
+	if errors.Is(err, cmneo4j.ErrNoResultsFound) || result == nil {
+		return 0
+	}
+	v := reflect.ValueOf(result)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Slice {
+		return v.Len()
+	}
+	return 1
+}
+
+// LookupResult is the outcome of a relations lookup made outside of the HTTP server.
+type LookupResult struct {
+	Kind     string        `json:"kind"`
+	UUID     string        `json:"uuid"`
+	Found    bool          `json:"found"`
+	Content  *relations    `json:"relations,omitempty"`
+	Coll     *ccRelations  `json:"ccRelations,omitempty"`
+	Queries  []QueryTrace  `json:"queries"`
+	Duration time.Duration `json:"-"`
+}
+
+// LookupContentRelations finds the relations of a content item, tracing the
+// executed queries when the driver is a cypher driver.
+func LookupContentRelations(driver Driver, urls *PublicURLs, contentUUID string) (LookupResult, error) {
+	result := LookupResult{Kind: "content", UUID: contentUUID}
+	trace := newLookupTrace()
+	traced, _ := tracedDriver(driver, trace)
+
+	start := time.Now()
+	rel, found, err := traced.findContentRelations(contentUUID)
+	result.Duration = time.Since(start)
+	result.Queries = trace.Queries
+	if err != nil {
+		return result, err
+	}
+	result.Found = found
+	rel = urls.defaults().relations(rel)
+	result.Content = &rel
+	return result, nil
+}
+
+// LookupContentCollectionRelations finds the relations of a content collection,
+// tracing the executed queries when the driver is a cypher driver. Collection
+// relations are plain UUIDs, the URLs are only taken to match LookupContentRelations.
+func LookupContentCollectionRelations(driver Driver, _ *PublicURLs, contentCollectionUUID string) (LookupResult, error) {
+	result := LookupResult{Kind: "contentcollection", UUID: contentCollectionUUID}
+	trace := newLookupTrace()
+	traced, _ := tracedDriver(driver, trace)
+
+	start := time.Now()
+	rel, found, err := traced.findContentCollectionRelations(contentCollectionUUID)
+	result.Duration = time.Since(start)
+	result.Queries = trace.Queries
+	if err != nil {
+		return result, err
+	}
+	result.Found = found
+	result.Coll = &rel
+	return result, nil
+}
+
+func (r LookupResult) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(struct {
+		LookupResult
+		DurationMs float64 `json:"durationMs"`
+	}{r, float64(r.Duration.Microseconds()) / 1000})
+}
+
+func (r LookupResult) WriteTable(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+
+	status := "found"
+	if !r.Found {
+		status = "not found"
+	}
+	fmt.Fprintf(tw, "%s %s: %s in %v\n\n", r.Kind, r.UUID, status, r.Duration.Round(time.Microsecond))
+
+	fmt.Fprintln(tw, "RELATION\tID\tAPI URL\tUNRESOLVED")
+	if r.Content != nil {
+		writeRelatedContentRows(tw, "curatedRelatedContent", r.Content.CuratedRelatedContents)
+		writeRelatedContentRows(tw, "contains", r.Content.Contains)
+		writeRelatedContentRows(tw, "containedIn", r.Content.ContainedIn)
+	}
+	if r.Coll != nil {
+		if r.Coll.ContainedIn != "" {
+			fmt.Fprintf(tw, "containedIn\t%s\t\t\n", r.Coll.ContainedIn)
+		}
+		for _, u := range r.Coll.Contains {
+			fmt.Fprintf(tw, "contains\t%s\t\t\n", u)
+		}
+		for _, u := range r.Coll.UnresolvedContains {
+			fmt.Fprintf(tw, "contains\t%s\t\tyes\n", u)
+		}
+	}
+
+	fmt.Fprintln(tw, "\nQUERY\tROWS\tDURATION\tCYPHER")
+	for i, q := range r.Queries {
+		fmt.Fprintf(tw, "%d\t%d\t%v\t%s\n", i+1, q.Rows, q.Duration.Round(time.Microsecond), firstLine(q.Cypher))
+	}
+	return tw.Flush()
+}
+
+func writeRelatedContentRows(w io.Writer, relation string, related []relatedContent) {
+	for _, rc := range related {
+		unresolved := ""
+		if rc.Unresolved {
+			unresolved = "yes"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", relation, rc.ID, rc.APIURL, unresolved)
+	}
+}
+
+func firstLine(s string) string {
+	line, _, _ := strings.Cut(s, "\n")
+	return line
+}
+
+// lookupDebug is the _debug block attached to the responses of debugged requests.
+type lookupDebug struct {
+	*lookupTrace
+	start      time.Time
+	DurationMs float64 `json:"durationMs"`
+}
+
+func (d *lookupDebug) finish() {
+	if d == nil {
+		return
+	}
+	d.DurationMs = float64(time.Since(d.start).Microseconds()) / 1000
+}
+
+type debugRelations struct {
+	relations
+	Debug *lookupDebug `json:"_debug,omitempty"`
+}
+
+type debugCCRelations struct {
+	ccRelations
+	Debug *lookupDebug `json:"_debug,omitempty"`
+}
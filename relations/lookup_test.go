@@ -0,0 +1,57 @@
+package relations
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLookupContentRelations(t *testing.T) {
+	result, err := LookupContentRelations(&cypherDriverMock{contentUUID: knownUUID}, testURLs, knownUUID)
+	require.NoError(t, err)
+	assert.True(t, result.Found)
+	assert.Equal(t, "content", result.Kind)
+	assert.Len(t, result.Content.Contains, 1)
+	assert.Nil(t, result.Coll)
+	assert.Empty(t, result.Queries, "Only the cypher driver traces queries")
+
+	var table bytes.Buffer
+	require.NoError(t, result.WriteTable(&table))
+	assert.Contains(t, table.String(), "content "+knownUUID+": found")
+	assert.Contains(t, table.String(), "curatedRelatedContent  http://api.ft.com/things/"+knownUUID)
+
+	_, err = LookupContentRelations(&cypherDriverMock{failRead: true}, testURLs, knownUUID)
+	assert.Error(t, err)
+}
+
+func TestLookupContentCollectionRelationsNotFound(t *testing.T) {
+	result, err := LookupContentCollectionRelations(&cypherDriverMock{contentUUID: knownUUID}, testURLs, leadUUID)
+	require.NoError(t, err)
+	assert.False(t, result.Found)
+	assert.Equal(t, "contentcollection", result.Kind)
+
+	result.Queries = []QueryTrace{{Cypher: "MATCH (n)\nRETURN n", Params: map[string]interface{}{"uuid": leadUUID}, Duration: 1500 * time.Microsecond}}
+	var out bytes.Buffer
+	require.NoError(t, result.WriteJSON(&out))
+
+	var decoded map[string]interface{}
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.Equal(t, false, decoded["found"])
+	queries := decoded["queries"].([]interface{})
+	require.Len(t, queries, 1)
+	assert.Equal(t, 1.5, queries[0].(map[string]interface{})["durationMs"])
+	assert.Equal(t, "MATCH (n)\nRETURN n", queries[0].(map[string]interface{})["cypher"])
+}
+
+func TestResultRows(t *testing.T) {
+	assert.Equal(t, 2, resultRows(&[]neoRelatedContent{{}, {}}, nil))
+	assert.Equal(t, 1, resultRows(&struct{}{}, nil))
+	assert.Equal(t, 0, resultRows(&struct{}{}, cmneo4j.ErrNoResultsFound))
+	assert.Equal(t, 1, resultRows(&struct{}{}, errors.New("other")))
+}
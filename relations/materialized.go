@@ -0,0 +1,475 @@
+package relations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	logger "github.com/Financial-Times/go-logger/v2"
+	metrics "github.com/rcrowley/go-metrics"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	materializedContentBucket    = []byte("content")
+	materializedCollectionBucket = []byte("contentcollection")
+	// materializedMetaBucket holds the builtAt marker, written once a rebuild completed
+	materializedMetaBucket = []byte("meta")
+	materializedBuiltAtKey = []byte("builtAt")
+
+	materializedCollections = metrics.GetOrRegisterCounter("relations.materialized_collections", metrics.DefaultRegistry)
+	materializeFailures     = metrics.GetOrRegisterCounter("relations.materialize_failures", metrics.DefaultRegistry)
+)
+
+// MaterializedStore keeps the relations of every content and content
+// collection, as computed by the Materializer, in an embedded bbolt file.
+// Content is only stored while it has relations, so that its keys list the
+// related content in UUID order.
+type MaterializedStore struct {
+	db *bolt.DB
+}
+
+// materializedCollection is the JSON stored for a content collection.
+type materializedCollection struct {
+	Found     bool        `json:"found"`
+	Relations ccRelations `json:"relations"`
+	Leads     []string    `json:"leads"`
+	// Content lists the content whose relations were built from the collection
+	Content []string `json:"content"`
+}
+
+// OpenMaterializedStore opens, or creates, the store file. The file is locked
+// while open, opening it from a second process fails after a second.
+func OpenMaterializedStore(path string) (*MaterializedStore, error) {
+	db, err := bolt.Open(path, 0644, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range [][]byte{materializedContentBucket, materializedCollectionBucket, materializedMetaBucket} {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &MaterializedStore{db: db}, nil
+}
+
+func (ms *MaterializedStore) Close() error {
+	return ms.db.Close()
+}
+
+// builtAt returns when the store was rebuilt, and false when it never was:
+// a store only opened is empty, and would answer 404 for every content.
+func (ms *MaterializedStore) builtAt() (time.Time, bool, error) {
+	var builtAt time.Time
+	var built bool
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(materializedMetaBucket).Get(materializedBuiltAtKey)
+		if data == nil {
+			return nil
+		}
+		built = true
+		return builtAt.UnmarshalText(data)
+	})
+	return builtAt, built, err
+}
+
+func (ms *MaterializedStore) markBuilt(builtAt time.Time) error {
+	data, err := builtAt.UTC().MarshalText()
+	if err != nil {
+		return err
+	}
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(materializedMetaBucket).Put(materializedBuiltAtKey, data)
+	})
+}
+
+// HealthCheck fails while the store was never rebuilt, and reports when it was.
+func (ms *MaterializedStore) HealthCheck() fthealth.Check {
+	return fthealth.Check{
+		BusinessImpact:   "Unable to respond to Relations API requests",
+		Name:             "Check the materialized store",
+		PanicGuide:       "https://runbooks.in.ft.com/upp-relations-api",
+		Severity:         1,
+		TechnicalSummary: "The relations are served from a materialized store which was never rebuilt. Stop the service, run the rebuild command on its --materialized-store-file and restart it",
+		Checker:          ms.checkBuilt,
+	}
+}
+
+func (ms *MaterializedStore) checkBuilt() (string, error) {
+	builtAt, built, err := ms.builtAt()
+	if err != nil {
+		return "Error reading the materialized store", err
+	}
+	if !built {
+		return "The materialized store was never rebuilt", errors.New("the materialized store has no builtAt marker")
+	}
+	return fmt.Sprintf("Serving the materialized store rebuilt at %s", builtAt.Format(time.RFC3339)), nil
+}
+
+func (ms *MaterializedStore) contentRelations(contentUUID string) (relations, bool, error) {
+	var entry cacheEntry
+	var found bool
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(materializedContentBucket).Get([]byte(contentUUID))
+		if data == nil {
+			return nil
+		}
+		var err error
+		entry, err = decodeStoredEntry(contentCacheKeyPrefix+contentUUID, data)
+		found = err == nil
+		return err
+	})
+	return entry.contentRel, found, err
+}
+
+func (ms *MaterializedStore) collection(contentCollectionUUID string) (materializedCollection, bool, error) {
+	var collection materializedCollection
+	var stored bool
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(materializedCollectionBucket).Get([]byte(contentCollectionUUID))
+		if data == nil {
+			return nil
+		}
+		stored = true
+		return json.Unmarshal(data, &collection)
+	})
+	return collection, stored, err
+}
+
+// relatedContentUUIDs lists, in order, up to limit UUIDs of stored content after the given one.
+func (ms *MaterializedStore) relatedContentUUIDs(afterUUID string, limit int) ([]string, error) {
+	uuids := []string{}
+	err := ms.db.View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(materializedContentBucket).Cursor()
+		k, _ := c.Seek([]byte(afterUUID))
+		if k != nil && bytes.Equal(k, []byte(afterUUID)) {
+			k, _ = c.Next()
+		}
+		for ; k != nil && len(uuids) < limit; k, _ = c.Next() {
+			uuids = append(uuids, string(k))
+		}
+		return nil
+	})
+	return uuids, err
+}
+
+// materializedContent is the relations computed for a content.
+type materializedContent struct {
+	uuid      string
+	relations relations
+	found     bool
+}
+
+// put stores the content, dropping the content found without relations, and the collections.
+func (ms *MaterializedStore) put(contents []materializedContent, collections map[string]materializedCollection) error {
+	return ms.db.Update(func(tx *bolt.Tx) error {
+		contentBucket := tx.Bucket(materializedContentBucket)
+		for _, c := range contents {
+			if !c.found {
+				if err := contentBucket.Delete([]byte(c.uuid)); err != nil {
+					return err
+				}
+				continue
+			}
+			data, err := encodeStoredEntry(cacheEntry{key: contentCacheKeyPrefix + c.uuid, contentRel: c.relations, found: true})
+			if err != nil {
+				return err
+			}
+			if err := contentBucket.Put([]byte(c.uuid), data); err != nil {
+				return err
+			}
+		}
+
+		collectionBucket := tx.Bucket(materializedCollectionBucket)
+		for u, collection := range collections {
+			data, err := json.Marshal(collection)
+			if err != nil {
+				return err
+			}
+			if err := collectionBucket.Put([]byte(u), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+type materializedDriver struct {
+	store *MaterializedStore
+}
+
+// NewMaterializedDriver creates a driver serving the relations from the store
+// with a single key lookup.
+func NewMaterializedDriver(store *MaterializedStore) Driver {
+	return &materializedDriver{store: store}
+}
+
+func (md *materializedDriver) findContentRelations(contentUUID string) (relations, bool, error) {
+	rel, found, err := md.store.contentRelations(contentUUID)
+	if err != nil {
+		return relations{}, false, fmt.Errorf("Error reading the materialized relations of uuid=%s, err=%v", contentUUID, err)
+	}
+	return rel, found, nil
+}
+
+func (md *materializedDriver) findContentCollectionRelations(contentCollectionUUID string) (ccRelations, bool, error) {
+	collection, _, err := md.store.collection(contentCollectionUUID)
+	if err != nil {
+		return ccRelations{}, false, fmt.Errorf("Error reading the materialized relations of uuid=%s, err=%v", contentCollectionUUID, err)
+	}
+	return collection.Relations, collection.Found, nil
+}
+
+func (md *materializedDriver) findContentCollectionLeads(contentCollectionUUID string) ([]string, error) {
+	collection, _, err := md.store.collection(contentCollectionUUID)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading the materialized relations of uuid=%s, err=%v", contentCollectionUUID, err)
+	}
+	return collection.Leads, nil
+}
+
+func (md *materializedDriver) findRelatedContentUUIDs(afterUUID string, limit int) ([]string, error) {
+	uuids, err := md.store.relatedContentUUIDs(afterUUID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing related content after uuid=%s, err=%v", afterUUID, err)
+	}
+	return uuids, nil
+}
+
+func (md *materializedDriver) checkConnectivity() error {
+	return md.checkReadConnectivity()
+}
+
+func (md *materializedDriver) checkReadConnectivity() error {
+	return md.store.db.View(func(tx *bolt.Tx) error {
+		if tx.Bucket(materializedContentBucket) == nil {
+			return errors.New("the materialized store has no content bucket")
+		}
+		return nil
+	})
+}
+
+// Materializer computes the relations of the content affected by published
+// collections from the source driver and stores them, so that reads never
+// run the multi-hop queries. The handlers are passed each event once its
+// relations are stored, to drop what they built from the previous ones.
+type Materializer struct {
+	source   Driver
+	store    *MaterializedStore
+	handlers []CollectionEventHandler
+	events   chan CollectionEvent
+	stopped  chan struct{}
+	log      *logger.UPPLogger
+}
+
+func NewMaterializer(source Driver, store *MaterializedStore, log *logger.UPPLogger, handlers ...CollectionEventHandler) *Materializer {
+	return &Materializer{
+		source:   source,
+		store:    store,
+		handlers: handlers,
+		events:   make(chan CollectionEvent, 100),
+		stopped:  make(chan struct{}),
+		log:      log,
+	}
+}
+
+// HandleCollectionEvent queues the collection to be materialized.
+func (m *Materializer) HandleCollectionEvent(event CollectionEvent) {
+	select {
+	case m.events <- event:
+	case <-m.stopped:
+	}
+}
+
+// Start materializes the published collections until the context is cancelled.
+func (m *Materializer) Start(ctx context.Context) {
+	defer close(m.stopped)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case event := <-m.events:
+			if err := m.materialize(event); err != nil {
+				materializeFailures.Inc(1)
+				m.log.WithError(err).WithUUID(event.UUID).Error("Failed to materialize the relations of the collection, they are served stale until it is published again or the store is rebuilt")
+				continue
+			}
+			for _, h := range m.handlers {
+				h.HandleCollectionEvent(event)
+			}
+		}
+	}
+}
+
+// materialize recomputes the collection and the content whose relations may
+// have changed with it: its leads, its items and the content previously built from it.
+func (m *Materializer) materialize(event CollectionEvent) error {
+	previous, _, err := m.store.collection(event.UUID)
+	if err != nil {
+		return err
+	}
+	collection, err := m.collection(event.UUID)
+	if err != nil {
+		return err
+	}
+
+	affected := mergeUUIDs(collection.Leads, event.ItemUUIDs(), collection.Relations.Contains, collection.Relations.UnresolvedContains, previous.Content)
+	contents := make([]materializedContent, 0, len(affected))
+	for _, u := range affected {
+		c, err := m.content(u)
+		if err != nil {
+			return err
+		}
+		contents = append(contents, c)
+	}
+
+	collection.Content = dependantContent(event.UUID, collection.Leads, contents)
+	if err := m.store.put(contents, map[string]materializedCollection{event.UUID: collection}); err != nil {
+		return err
+	}
+	materializedCollections.Inc(1)
+	return nil
+}
+
+// Rebuild fills an empty store with the relations of every related content
+// listed by the source, batchSize at a time, and of their collections. The
+// store is marked built once every relations are stored.
+func (m *Materializer) Rebuild(ctx context.Context, batchSize int) (int, error) {
+	if batchSize < 1 {
+		return 0, fmt.Errorf("the rebuild batch size must be at least 1, got %d", batchSize)
+	}
+	dependants := map[string][]string{}
+	var count int
+	for after := ""; ; {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		uuids, err := m.source.findRelatedContentUUIDs(after, batchSize)
+		if err != nil {
+			return count, err
+		}
+		if len(uuids) == 0 {
+			break
+		}
+
+		contents := make([]materializedContent, 0, len(uuids))
+		for _, u := range uuids {
+			c, err := m.content(u)
+			if err != nil {
+				return count, err
+			}
+			contents = append(contents, c)
+			for _, cc := range c.relations.collectionUUIDs {
+				dependants[cc] = append(dependants[cc], u)
+			}
+		}
+		if err := m.store.put(contents, nil); err != nil {
+			return count, err
+		}
+		count += len(uuids)
+		after = uuids[len(uuids)-1]
+	}
+
+	collections := map[string]materializedCollection{}
+	for cc, content := range dependants {
+		if err := ctx.Err(); err != nil {
+			return count, err
+		}
+		collection, err := m.collection(cc)
+		if err != nil {
+			return count, err
+		}
+		collection.Content = mergeUUIDs(collection.Leads, content)
+		collections[cc] = collection
+		if len(collections) >= batchSize {
+			if err := m.store.put(nil, collections); err != nil {
+				return count, err
+			}
+			collections = map[string]materializedCollection{}
+		}
+	}
+	if err := m.store.put(nil, collections); err != nil {
+		return count, err
+	}
+	return count, m.store.markBuilt(time.Now())
+}
+
+func (m *Materializer) content(contentUUID string) (materializedContent, error) {
+	rel, found, err := m.source.findContentRelations(contentUUID)
+	if err != nil {
+		return materializedContent{}, err
+	}
+	return materializedContent{uuid: contentUUID, relations: rel, found: found}, nil
+}
+
+func (m *Materializer) collection(contentCollectionUUID string) (materializedCollection, error) {
+	rel, found, err := m.source.findContentCollectionRelations(contentCollectionUUID)
+	if err != nil {
+		return materializedCollection{}, err
+	}
+	leads, err := m.source.findContentCollectionLeads(contentCollectionUUID)
+	if err != nil {
+		return materializedCollection{}, err
+	}
+	return materializedCollection{Found: found, Relations: rel, Leads: leads}, nil
+}
+
+// dependantContent lists the leads of the collection and the content whose relations were built from it.
+func dependantContent(contentCollectionUUID string, leads []string, contents []materializedContent) []string {
+	var dependants []string
+	for _, c := range contents {
+		for _, cc := range c.relations.collectionUUIDs {
+			if cc == contentCollectionUUID {
+				dependants = append(dependants, c.uuid)
+				break
+			}
+		}
+	}
+	return mergeUUIDs(leads, dependants)
+}
+
+// RebuildMaterializedStore rebuilds the store of the path from the source into
+// a new file, which then replaces the store. The store is held open until it
+// is replaced, so that the rebuild is refused while a service materializes
+// events into it: the events it would miss, or write to the replaced file,
+// are left in Kafka until the service is started on the rebuilt store.
+func RebuildMaterializedStore(ctx context.Context, source Driver, path string, batchSize int, log *logger.UPPLogger) (int, error) {
+	live, err := OpenMaterializedStore(path)
+	if errors.Is(err, bolt.ErrTimeout) {
+		return 0, fmt.Errorf("the materialized store %s is in use, stop the service serving it before rebuilding it", path)
+	}
+	if err != nil {
+		return 0, err
+	}
+	defer live.Close()
+
+	rebuildPath := path + ".rebuild"
+	if err := os.Remove(rebuildPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	store, err := OpenMaterializedStore(rebuildPath)
+	if err != nil {
+		return 0, err
+	}
+	count, err := NewMaterializer(source, store, log).Rebuild(ctx, batchSize)
+	if closeErr := store.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(rebuildPath)
+		return count, err
+	}
+	return count, os.Rename(rebuildPath, path)
+}
@@ -0,0 +1,174 @@
+package relations
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMaterializedStore(t *testing.T) *MaterializedStore {
+	store, err := OpenMaterializedStore(filepath.Join(t.TempDir(), "relations.bolt"))
+	require.NoError(t, err)
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+// materializedConformanceStore materializes the relations written to SQLite
+// whenever its driver is taken.
+type materializedConformanceStore struct {
+	sqlConformanceStore
+	t *testing.T
+}
+
+func newMaterializedConformanceStore(t *testing.T) conformanceStore {
+	return materializedConformanceStore{sqlConformanceStore: newSQLiteConformanceStore(t).(sqlConformanceStore), t: t}
+}
+
+func (s materializedConformanceStore) driver() Driver {
+	store := newTestMaterializedStore(s.t)
+	_, err := NewMaterializer(s.sqlConformanceStore.driver(), store, logger.NewUPPLogger("test", "PANIC")).Rebuild(context.Background(), 2)
+	require.NoError(s.t, err)
+	return NewMaterializedDriver(store)
+}
+
+func TestMaterializerCollectionEvent(t *testing.T) {
+	source := newSQLiteConformanceStore(t).(sqlConformanceStore)
+	source.writeContent(t, []payloadData{leadContentSP, leadContentCP, relatedContent1, relatedContent2, relatedContent3})
+	source.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	store := newTestMaterializedStore(t)
+	handler := &recordingEventHandler{}
+	materializer := NewMaterializer(source.driver(), store, logger.NewUPPLogger("test", "PANIC"), handler)
+	count, err := materializer.Rebuild(context.Background(), 10)
+	require.NoError(t, err)
+	assert.Equal(t, 4, count, "the lead of the story package is listed before the story package is written")
+
+	driver := NewMaterializedDriver(store)
+	_, found, err := driver.findContentRelations(relatedContent2.uuid)
+	require.NoError(t, err)
+	require.True(t, found)
+	_, found, err = driver.findContentRelations(leadContentSP.uuid)
+	require.NoError(t, err)
+	require.False(t, found)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go materializer.Start(ctx)
+
+	source.exec(t, "DELETE FROM collection_contains WHERE item_uuid = $1", relatedContent2.uuid)
+	source.writeContentCollection(t, []payloadData{storyPackage}, "StoryPackage")
+	materializer.HandleCollectionEvent(CollectionEvent{UUID: contentPackage.uuid, Items: []collectionItem{{UUID: relatedContent1.uuid}}})
+	materializer.HandleCollectionEvent(CollectionEvent{UUID: storyPackage.uuid})
+	require.Eventually(t, func() bool { return len(handler.received()) == 2 }, time.Second, 10*time.Millisecond,
+		"the handlers should be passed the events once materialized")
+
+	_, found, err = driver.findContentRelations(relatedContent2.uuid)
+	require.NoError(t, err)
+	assert.False(t, found, "the content removed from the collection should lose its relations")
+	rel, found, err := driver.findContentRelations(leadContentCP.uuid)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, []relatedContent{{uuid: relatedContent1.uuid}}, rel.Contains)
+	ccRel, found, err := driver.findContentCollectionRelations(contentPackage.uuid)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, []string{relatedContent1.uuid}, ccRel.Contains)
+
+	rel, found, err = driver.findContentRelations(leadContentSP.uuid)
+	require.NoError(t, err)
+	require.True(t, found, "the lead of the newly published story package should get its relations")
+	assert.Len(t, rel.CuratedRelatedContents, 4)
+	leads, err := driver.findContentCollectionLeads(storyPackage.uuid)
+	require.NoError(t, err)
+	assert.Equal(t, []string{leadContentSP.uuid}, leads)
+
+	uuids, err := driver.findRelatedContentUUIDs("", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{relatedContent1.uuid, leadContentCP.uuid, leadContentSP.uuid}, uuids)
+}
+
+func TestRebuildMaterializedStore(t *testing.T) {
+	source := newSQLiteConformanceStore(t).(sqlConformanceStore)
+	source.writeContent(t, []payloadData{leadContentCP, relatedContent1, relatedContent2})
+	source.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	path := filepath.Join(t.TempDir(), "relations.bolt")
+	stale, err := OpenMaterializedStore(path)
+	require.NoError(t, err)
+	require.NoError(t, stale.put([]materializedContent{{uuid: relatedContent3.uuid, relations: relations{ContainedIn: []relatedContent{{uuid: leadContentSP.uuid}}}, found: true}}, nil))
+	_, err = stale.HealthCheck().Checker()
+	assert.Error(t, err, "a store never rebuilt should fail its health check")
+	require.NoError(t, stale.Close())
+
+	count, err := RebuildMaterializedStore(context.Background(), source.driver(), path, 2, logger.NewUPPLogger("test", "PANIC"))
+	require.NoError(t, err)
+	assert.Equal(t, 3, count)
+	_, err = os.Stat(path + ".rebuild")
+	assert.True(t, os.IsNotExist(err), "the rebuilt store should replace the previous one")
+
+	store, err := OpenMaterializedStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+	uuids, err := NewMaterializedDriver(store).findRelatedContentUUIDs("", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{relatedContent1.uuid, leadContentCP.uuid, relatedContent2.uuid}, uuids, "the stale content should be dropped")
+	output, err := store.HealthCheck().Checker()
+	require.NoError(t, err)
+	assert.Contains(t, output, "rebuilt at")
+}
+
+func TestMaterializedStoreNeverRebuiltIsNotGoodToGo(t *testing.T) {
+	store := newTestMaterializedStore(t)
+	monitor := NewHealthMonitor([]fthealth.Check{store.HealthCheck()}, time.Minute, logger.NewUPPLogger("test", "PANIC"))
+	monitor.runAll()
+	assert.False(t, monitor.GTG().GoodToGo, "an empty store would answer 404 for every content")
+
+	_, err := NewMaterializer(newSQLiteConformanceStore(t).driver(), store, logger.NewUPPLogger("test", "PANIC")).Rebuild(context.Background(), 2)
+	require.NoError(t, err)
+	monitor.runAll()
+	assert.True(t, monitor.GTG().GoodToGo, "a rebuilt store should be good to go, even without content")
+}
+
+func TestRebuildMaterializedStoreRefusesEmptyBatches(t *testing.T) {
+	source := newSQLiteConformanceStore(t).(sqlConformanceStore)
+	source.writeContent(t, []payloadData{leadContentCP, relatedContent1})
+	source.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	path := filepath.Join(t.TempDir(), "relations.bolt")
+	_, err := RebuildMaterializedStore(context.Background(), source.driver(), path, 1, logger.NewUPPLogger("test", "PANIC"))
+	require.NoError(t, err)
+
+	_, err = RebuildMaterializedStore(context.Background(), source.driver(), path, 0, logger.NewUPPLogger("test", "PANIC"))
+	assert.Error(t, err)
+
+	store, err := OpenMaterializedStore(path)
+	require.NoError(t, err)
+	defer store.Close()
+	uuids, err := NewMaterializedDriver(store).findRelatedContentUUIDs("", 10)
+	require.NoError(t, err)
+	assert.Equal(t, []string{relatedContent1.uuid, leadContentCP.uuid}, uuids, "the store should be kept")
+}
+
+func TestRebuildMaterializedStoreRefusesStoreInUse(t *testing.T) {
+	source := newSQLiteConformanceStore(t).(sqlConformanceStore)
+	source.writeContent(t, []payloadData{leadContentCP, relatedContent1})
+	source.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	path := filepath.Join(t.TempDir(), "relations.bolt")
+	served, err := OpenMaterializedStore(path)
+	require.NoError(t, err)
+	defer served.Close()
+
+	_, err = RebuildMaterializedStore(context.Background(), source.driver(), path, 2, logger.NewUPPLogger("test", "PANIC"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "is in use")
+	_, err = os.Stat(path + ".rebuild")
+	assert.True(t, os.IsNotExist(err), "nothing should be rebuilt while the store is served")
+}
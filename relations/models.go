@@ -7,18 +7,73 @@ type relations struct {
 	Contains []relatedContent `json:"contains,omitempty"`
 	//This is used to relate to content-packages that contain this content (or content-package)
 	ContainedIn []relatedContent `json:"containedIn,omitempty"`
+	//The content collections traversed while looking up the relations, not part of the response
+	collectionUUIDs []string
 }
 
 type ccRelations struct {
-	ContainedIn string `json:"containedIn,omitempty"`
+	ContainedIn string   `json:"containedIn,omitempty"`
 	Contains    []string `json:"contains,omitempty"`
+	//Contained items that were never written as Content, only returned on request
+	UnresolvedContains []string `json:"unresolvedContains,omitempty"`
 }
 
 type relatedContent struct {
-	ID     string `json:"id,omitempty"`
-	APIURL string `json:"apiUrl,omitempty"`
+	ID string `json:"id,omitempty"`
+	//The ID in the legacy thing URL format, only sent on request while migrating
+	LegacyID string `json:"legacyId,omitempty"`
+	APIURL   string `json:"apiUrl,omitempty"`
+	//Set for curated or contained items that were never written as Content
+	Unresolved bool `json:"unresolved,omitempty"`
+	//The UUID the ID and API URL are built from when rendering the response
+	uuid string
 }
 
 type neoRelatedContent struct {
-	UUID string `json:"uuid"`
+	UUID     string `json:"uuid"`
+	Resolved bool   `json:"resolved"`
+}
+
+// withoutUnresolved returns a copy of the relations without the items that were never written as Content.
+func (r relations) withoutUnresolved() relations {
+	r.CuratedRelatedContents = resolvedOnly(r.CuratedRelatedContents)
+	r.Contains = resolvedOnly(r.Contains)
+	r.ContainedIn = resolvedOnly(r.ContainedIn)
+	return r
+}
+
+// surrogateKeys lists the content UUID, the related content UUIDs and the
+// collection UUIDs the relations were built from, so that the cached
+// responses can be purged when any of them changes.
+func (r relations) surrogateKeys(contentUUID string) []string {
+	keys := []string{contentUUID}
+	for _, related := range [][]relatedContent{r.CuratedRelatedContents, r.Contains, r.ContainedIn} {
+		for _, rc := range related {
+			keys = append(keys, rc.uuid)
+		}
+	}
+	return mergeUUIDs(keys, r.collectionUUIDs)
+}
+
+// surrogateKeys lists the collection UUID, the contained content UUIDs and the package UUID of the relations.
+func (r ccRelations) surrogateKeys(contentCollectionUUID string) []string {
+	keys := []string{contentCollectionUUID}
+	if r.ContainedIn != "" {
+		keys = append(keys, r.ContainedIn)
+	}
+	return mergeUUIDs(keys, r.Contains, r.UnresolvedContains)
+}
+
+func (r relations) isEmpty() bool {
+	return len(r.CuratedRelatedContents) == 0 && len(r.Contains) == 0 && len(r.ContainedIn) == 0
+}
+
+func resolvedOnly(related []relatedContent) []relatedContent {
+	resolved := []relatedContent{}
+	for _, rc := range related {
+		if !rc.Unresolved {
+			resolved = append(resolved, rc)
+		}
+	}
+	return resolved
 }
@@ -0,0 +1,274 @@
+package relations
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+)
+
+const notificationUpdateType = "http://www.ft.com/thing/ThingChangeType/UPDATE"
+
+type notification struct {
+	Type             string `json:"type"`
+	ID               string `json:"id"`
+	LegacyID         string `json:"legacyId,omitempty"`
+	APIURL           string `json:"apiUrl"`
+	PublishReference string `json:"publishReference,omitempty"`
+	LastModified     string `json:"lastModified"`
+}
+
+type notificationLink struct {
+	Href string `json:"href"`
+	Rel  string `json:"rel"`
+}
+
+type notificationsPage struct {
+	RequestURL    string             `json:"requestUrl"`
+	Notifications []notification     `json:"notifications"`
+	Links         []notificationLink `json:"links"`
+}
+
+type notificationEntry struct {
+	// seq and receivedAt are assigned by the store in the order the entries arrive
+	seq              uint64
+	receivedAt       time.Time
+	contentUUID      string
+	publishReference string
+	// lastModified is the time of the collection version given by the publish event, if any
+	lastModified time.Time
+}
+
+// notificationStore keeps notification entries in the order they arrived, so
+// that an event published late is still after the position of every consumer.
+type notificationStore interface {
+	// epoch identifies the store the seq of the entries are numbered by, it
+	// differs between replicas and after a restart
+	epoch() string
+	add(entries ...notificationEntry)
+	// page returns up to limit entries after the seq cursor, or received from since when the cursor is 0
+	page(since time.Time, seq uint64, limit int) []notificationEntry
+}
+
+type memoryNotificationStore struct {
+	id         string
+	mu         sync.RWMutex
+	entries    []notificationEntry
+	nextSeq    uint64
+	maxEntries int
+	retention  time.Duration
+	now        func() time.Time
+}
+
+func newMemoryNotificationStore(maxEntries int, retention time.Duration) *memoryNotificationStore {
+	id := make([]byte, 6)
+	rand.Read(id)
+	return &memoryNotificationStore{id: hex.EncodeToString(id), maxEntries: maxEntries, retention: retention, nextSeq: 1, now: time.Now}
+}
+
+func (s *memoryNotificationStore) epoch() string {
+	return s.id
+}
+
+func (s *memoryNotificationStore) add(entries ...notificationEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// receivedAt never goes back, even when the clock does, so that it stays in seq order
+	now := s.now().UTC()
+	if n := len(s.entries); n > 0 && now.Before(s.entries[n-1].receivedAt) {
+		now = s.entries[n-1].receivedAt
+	}
+	for _, e := range entries {
+		e.seq = s.nextSeq
+		e.receivedAt = now
+		s.nextSeq++
+		s.entries = append(s.entries, e)
+	}
+
+	drop := 0
+	if s.retention > 0 {
+		oldest := now.Add(-s.retention)
+		drop = sort.Search(len(s.entries), func(i int) bool { return !s.entries[i].receivedAt.Before(oldest) })
+	}
+	if s.maxEntries > 0 && len(s.entries)-drop > s.maxEntries {
+		drop = len(s.entries) - s.maxEntries
+	}
+	s.entries = append([]notificationEntry{}, s.entries[drop:]...)
+}
+
+func (s *memoryNotificationStore) page(since time.Time, seq uint64, limit int) []notificationEntry {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	var i int
+	if seq > 0 {
+		i = sort.Search(len(s.entries), func(i int) bool { return s.entries[i].seq > seq })
+	} else {
+		i = sort.Search(len(s.entries), func(i int) bool { return !s.entries[i].receivedAt.Before(since) })
+	}
+	end := i + limit
+	if end > len(s.entries) {
+		end = len(s.entries)
+	}
+	return append([]notificationEntry{}, s.entries[i:end]...)
+}
+
+// RelationsChangeFeed records the content whose relations changed with every
+// new version of a published collection and serves them as a notifications
+// feed, in the order the events were received. The feed is kept in the memory
+// of the instance: each replica serves its own feed, the cursors of another
+// replica or of a previous run fall back to the since time.
+type RelationsChangeFeed struct {
+	tracker  *changeTracker
+	store    notificationStore
+	urls     *PublicURLs
+	pageSize int
+	log      *logger.UPPLogger
+}
+
+// NewRelationsChangeFeed creates a feed keeping at most maxEntries notifications
+// for the retention period, and the last versions of at most as many collections.
+func NewRelationsChangeFeed(driver Driver, urls *PublicURLs, pageSize, maxEntries int, retention time.Duration, log *logger.UPPLogger) *RelationsChangeFeed {
+	return &RelationsChangeFeed{
+		tracker:  newChangeTracker(driver, maxEntries),
+		store:    newMemoryNotificationStore(maxEntries, retention),
+		urls:     urls,
+		pageSize: pageSize,
+		log:      log,
+	}
+}
+
+// HandleCollectionEvent records the content whose relations changed with the
+// collection, unless this version of the collection has already been seen.
+func (f *RelationsChangeFeed) HandleCollectionEvent(event CollectionEvent) {
+	// Without a valid lastModified, versions are only told apart by their publish reference
+	lastModified, err := time.Parse(time.RFC3339Nano, event.LastModified)
+	if err != nil {
+		f.log.WithUUID(event.UUID).WithTransactionID(event.PublishReference).Warnf("Invalid lastModified %q in the collection event", event.LastModified)
+		lastModified = time.Time{}
+	}
+
+	affected, newVersion, err := f.tracker.changedContent(event, collectionVersion{lastModified: lastModified, publishReference: event.PublishReference})
+	if err != nil {
+		f.log.WithError(err).WithUUID(event.UUID).Error("Failed to read the leads of the collection, recording every content of its versions")
+	}
+	if !newVersion {
+		return
+	}
+
+	entries := make([]notificationEntry, 0, len(affected))
+	for _, contentUUID := range affected {
+		entries = append(entries, notificationEntry{
+			contentUUID:      contentUUID,
+			publishReference: event.PublishReference,
+			lastModified:     lastModified,
+		})
+	}
+	f.store.add(entries...)
+}
+
+func (f *RelationsChangeFeed) GetNotifications(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	query := r.URL.Query()
+	since, err := time.Parse(time.RFC3339Nano, query.Get("since"))
+	if err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidParameter,
+			detail:  "A valid since parameter in RFC3339 format is required, e.g. 2017-03-03T12:17:51.288Z",
+		})
+		return
+	}
+	var cursor uint64
+	if c := query.Get("cursor"); c != "" {
+		epoch, seq, ok := parseFeedCursor(c)
+		if !ok {
+			writeError(w, r, apiError{
+				status:  http.StatusBadRequest,
+				problem: problemInvalidParameter,
+				detail:  fmt.Sprintf("The given cursor %q is not valid", c),
+			})
+			return
+		}
+		// The entries are numbered by each replica and run, cursors of
+		// another one resume from the since time instead
+		if epoch == f.store.epoch() {
+			cursor = seq
+		}
+	}
+
+	urls, err := f.urls.forRequest(r)
+	if err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidParameter,
+			detail:  fmt.Sprintf("The given idFormat is not valid, err=%v", err),
+		})
+		return
+	}
+	entries := f.store.page(since, cursor, f.pageSize)
+	page := notificationsPage{
+		RequestURL:    feedURL(urls, query),
+		Notifications: make([]notification, 0, len(entries)),
+	}
+	for _, e := range entries {
+		lastModified := e.lastModified
+		if lastModified.IsZero() {
+			lastModified = e.receivedAt
+		}
+		page.Notifications = append(page.Notifications, notification{
+			Type:             notificationUpdateType,
+			ID:               urls.thingIDURL(e.contentUUID),
+			LegacyID:         urls.legacyThingIDURL(e.contentUUID),
+			APIURL:           urls.apiURL(e.contentUUID) + "/relations",
+			PublishReference: e.publishReference,
+			LastModified:     lastModified.UTC().Format(time.RFC3339Nano),
+		})
+	}
+
+	next := url.Values{}
+	next.Set("since", query.Get("since"))
+	if c := query.Get("cursor"); c != "" {
+		next.Set("cursor", c)
+	}
+	if idFormat := query.Get("idFormat"); idFormat != "" {
+		next.Set("idFormat", idFormat)
+	}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		next.Set("since", last.receivedAt.Format(time.RFC3339Nano))
+		next.Set("cursor", f.store.epoch()+"-"+strconv.FormatUint(last.seq, 10))
+	}
+	page.Links = []notificationLink{{Href: feedURL(urls, next), Rel: "next"}}
+
+	f.urls.setVary(w)
+	if err = json.NewEncoder(w).Encode(page); err != nil {
+		f.log.WithError(err).Error("Failed to encode notifications")
+	}
+}
+
+// parseFeedCursor reads a cursor made of the epoch of the store and the seq of
+// an entry. Cursors holding a seq only, of a previous version, have no epoch.
+func parseFeedCursor(cursor string) (string, uint64, bool) {
+	var epoch string
+	if i := strings.LastIndex(cursor, "-"); i >= 0 {
+		epoch, cursor = cursor[:i], cursor[i+1:]
+	}
+	seq, err := strconv.ParseUint(cursor, 10, 64)
+	return epoch, seq, err == nil && seq > 0
+}
+
+func feedURL(urls urlBuilder, query url.Values) string {
+	return urls.apiBaseURL + "/content/relations/notifications?" + query.Encode()
+}
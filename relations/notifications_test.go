@@ -0,0 +1,220 @@
+package relations
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const (
+	item1UUID = "3fc9fe3e-af8c-1a1a-961a-e5065392bb31"
+	item2UUID = "3fc9fe3e-af8c-2a2a-961a-e5065392bb31"
+)
+
+func getNotificationsPage(t *testing.T, feed *RelationsChangeFeed, target string) notificationsPage {
+	rec := httptest.NewRecorder()
+	feed.GetNotifications(rec, newRequest("GET", target, nil))
+	require.Equal(t, http.StatusOK, rec.Code)
+
+	var page notificationsPage
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&page))
+	return page
+}
+
+func nextLink(t *testing.T, page notificationsPage) string {
+	require.Len(t, page.Links, 1)
+	u, err := url.Parse(page.Links[0].Href)
+	require.NoError(t, err)
+	return u.RequestURI()
+}
+
+func TestRelationsChangeFeedRecordsAffectedContent(t *testing.T) {
+	driver := &mutableDriverMock{leads: map[string][]string{collectionUUID: {leadUUID}}}
+	feed := NewRelationsChangeFeed(driver, testURLs, 2, 100, 0, logger.NewUPPLogger("test", "PANIC"))
+	now := time.Date(2017, 3, 3, 12, 17, 51, 288000000, time.UTC)
+	feed.store.(*memoryNotificationStore).now = func() time.Time { return now }
+
+	feed.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}, {UUID: item2UUID}},
+		PublishReference: "tid_1", LastModified: "2017-03-03T12:17:51.288Z"})
+	// redelivery of the same version is ignored
+	feed.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}, {UUID: item2UUID}},
+		PublishReference: "tid_1", LastModified: "2017-03-03T12:17:51.288Z"})
+	// item2 removed from the collection is affected, as is the lead, not item1
+	now = time.Date(2017, 3, 3, 12, 20, 0, 0, time.UTC)
+	feed.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}},
+		PublishReference: "tid_2", LastModified: "2017-03-03T12:20:00Z"})
+
+	page := getNotificationsPage(t, feed, "/content/relations/notifications?since=2017-03-03T12:17:51.288Z")
+	assert.Equal(t, "http://api.ft.com/content/relations/notifications?since=2017-03-03T12%3A17%3A51.288Z", page.RequestURL)
+	assert.Equal(t, []notification{
+		{Type: notificationUpdateType, ID: "http://api.ft.com/things/" + leadUUID, APIURL: "http://api.ft.com/content/" + leadUUID + "/relations",
+			PublishReference: "tid_1", LastModified: "2017-03-03T12:17:51.288Z"},
+		{Type: notificationUpdateType, ID: "http://api.ft.com/things/" + item1UUID, APIURL: "http://api.ft.com/content/" + item1UUID + "/relations",
+			PublishReference: "tid_1", LastModified: "2017-03-03T12:17:51.288Z"},
+	}, page.Notifications)
+
+	page = getNotificationsPage(t, feed, nextLink(t, page))
+	require.Len(t, page.Notifications, 2)
+	assert.Equal(t, "http://api.ft.com/things/"+item2UUID, page.Notifications[0].ID)
+	assert.Equal(t, "tid_1", page.Notifications[0].PublishReference)
+	assert.Equal(t, "http://api.ft.com/things/"+leadUUID, page.Notifications[1].ID)
+	assert.Equal(t, "tid_2", page.Notifications[1].PublishReference)
+
+	page = getNotificationsPage(t, feed, nextLink(t, page))
+	require.Len(t, page.Notifications, 1)
+	assert.Equal(t, "http://api.ft.com/things/"+item2UUID, page.Notifications[0].ID)
+	assert.Equal(t, "tid_2", page.Notifications[0].PublishReference)
+
+	last := getNotificationsPage(t, feed, nextLink(t, page))
+	assert.Empty(t, last.Notifications)
+	assert.Equal(t, nextLink(t, page), nextLink(t, last), "An empty page should link to itself")
+
+	page = getNotificationsPage(t, feed, "/content/relations/notifications?since=2017-03-03T12:18:00Z")
+	assert.Len(t, page.Notifications, 2)
+}
+
+func TestRelationsChangeFeedDeliversLateEvents(t *testing.T) {
+	driver := &mutableDriverMock{leads: map[string][]string{}}
+	feed := NewRelationsChangeFeed(driver, testURLs, 10, 100, 0, logger.NewUPPLogger("test", "PANIC"))
+
+	feed.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}},
+		PublishReference: "tid_1", LastModified: "2017-03-03T12:20:00Z"})
+	page := getNotificationsPage(t, feed, "/content/relations/notifications?since=2017-03-03T00:00:00Z")
+	require.Len(t, page.Notifications, 1)
+
+	// a collection published before the position of the consumer, but read after it
+	feed.HandleCollectionEvent(CollectionEvent{UUID: otherUUID, Items: []collectionItem{{UUID: item2UUID}},
+		PublishReference: "tid_2", LastModified: "2017-03-03T12:10:00Z"})
+	// an event without a valid lastModified is recorded at the time it is read
+	feed.HandleCollectionEvent(CollectionEvent{UUID: knownUUID, Items: []collectionItem{{UUID: item1UUID}},
+		PublishReference: "tid_3", LastModified: "not a time"})
+
+	page = getNotificationsPage(t, feed, nextLink(t, page))
+	require.Len(t, page.Notifications, 2)
+	assert.Equal(t, "tid_2", page.Notifications[0].PublishReference)
+	assert.Equal(t, "2017-03-03T12:10:00Z", page.Notifications[0].LastModified)
+	assert.Equal(t, "tid_3", page.Notifications[1].PublishReference)
+	assert.NotEmpty(t, page.Notifications[1].LastModified)
+}
+
+func TestRelationsChangeFeedRecordsChangedContentOnly(t *testing.T) {
+	driver := &mutableDriverMock{leads: map[string][]string{collectionUUID: {leadUUID}}}
+	feed := NewRelationsChangeFeed(driver, testURLs, 10, 100, 0, logger.NewUPPLogger("test", "PANIC"))
+	publish := func(tid string, items ...string) []string {
+		event := CollectionEvent{UUID: collectionUUID, Items: []collectionItem{}, PublishReference: tid}
+		for _, u := range items {
+			event.Items = append(event.Items, collectionItem{UUID: u})
+		}
+		feed.HandleCollectionEvent(event)
+		var changed []string
+		for _, e := range feed.store.page(time.Time{}, 0, 100) {
+			if e.publishReference == tid {
+				changed = append(changed, e.contentUUID)
+			}
+		}
+		return changed
+	}
+
+	assert.Equal(t, []string{leadUUID, item1UUID, item2UUID}, publish("tid_1", item1UUID, item2UUID))
+	assert.Empty(t, publish("tid_2", item1UUID, item2UUID), "a version with the same items changes nothing")
+	assert.Equal(t, []string{leadUUID}, publish("tid_3", item2UUID, item1UUID), "reordering the items changes the lead only")
+
+	driver.mu.Lock()
+	driver.leads[collectionUUID] = []string{otherUUID}
+	driver.mu.Unlock()
+	assert.Equal(t, []string{leadUUID, otherUUID, item2UUID, item1UUID}, publish("tid_4", item2UUID, item1UUID), "a new lead changes every content")
+}
+
+func TestRelationsChangeFeedCursorsOfAnotherReplica(t *testing.T) {
+	driver := &mutableDriverMock{leads: map[string][]string{}}
+	replicaA := NewRelationsChangeFeed(driver, testURLs, 10, 100, 0, logger.NewUPPLogger("test", "PANIC"))
+	replicaB := NewRelationsChangeFeed(driver, testURLs, 10, 100, 0, logger.NewUPPLogger("test", "PANIC"))
+	now := time.Date(2017, 3, 3, 12, 0, 0, 0, time.UTC)
+	for _, feed := range []*RelationsChangeFeed{replicaA, replicaB} {
+		feed.store.(*memoryNotificationStore).now = func() time.Time { return now }
+	}
+	publish := func(collection, item, tid string) {
+		event := CollectionEvent{UUID: collection, Items: []collectionItem{{UUID: item}}, PublishReference: tid}
+		replicaA.HandleCollectionEvent(event)
+		replicaB.HandleCollectionEvent(event)
+	}
+
+	// replica B read an event replica A did not, its seq are numbered differently
+	replicaB.HandleCollectionEvent(CollectionEvent{UUID: otherUUID, Items: []collectionItem{{UUID: item2UUID}}, PublishReference: "tid_b"})
+	publish(collectionUUID, item1UUID, "tid_1")
+	page := getNotificationsPage(t, replicaA, "/content/relations/notifications?since=2017-03-03T00:00:00Z")
+	require.Len(t, page.Notifications, 1)
+	next := nextLink(t, page)
+
+	now = now.Add(time.Minute)
+	publish(knownUUID, item2UUID, "tid_2")
+	assert.Len(t, getNotificationsPage(t, replicaA, next).Notifications, 1)
+	page = getNotificationsPage(t, replicaB, next)
+	require.Len(t, page.Notifications, 3, "the cursor of another replica should resume from the since time")
+	assert.Equal(t, "tid_2", page.Notifications[2].PublishReference)
+
+	// cursors without epoch, of a previous run, resume from the since time too
+	page = getNotificationsPage(t, replicaA, "/content/relations/notifications?since=2017-03-03T12:01:00Z&cursor=5000")
+	require.Len(t, page.Notifications, 1)
+	assert.Equal(t, "tid_2", page.Notifications[0].PublishReference)
+}
+
+func TestChangeTrackerForgetsLeastRecentlyPublishedCollections(t *testing.T) {
+	tracker := newChangeTracker(&mutableDriverMock{leads: map[string][]string{}}, 1)
+	v1 := collectionVersion{publishReference: "tid_1"}
+	event := CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}}}
+
+	_, newVersion, err := tracker.changedContent(event, v1)
+	require.NoError(t, err)
+	assert.True(t, newVersion)
+	_, newVersion, _ = tracker.changedContent(event, v1)
+	assert.False(t, newVersion, "a redelivered version should be ignored")
+
+	tracker.changedContent(CollectionEvent{UUID: otherUUID, Items: []collectionItem{}}, v1)
+	assert.Len(t, tracker.collections, 1)
+	changed, newVersion, _ := tracker.changedContent(event, v1)
+	assert.True(t, newVersion, "the forgotten collection should be seen as new")
+	assert.Equal(t, []string{item1UUID}, changed)
+}
+
+func TestRelationsChangeFeedRequiresSince(t *testing.T) {
+	feed := NewRelationsChangeFeed(&mutableDriverMock{}, testURLs, 2, 100, 0, logger.NewUPPLogger("test", "PANIC"))
+
+	for _, target := range []string{"/content/relations/notifications", "/content/relations/notifications?since=yesterday",
+		"/content/relations/notifications?since=2017-03-03T12:18:00Z&cursor=abc"} {
+		rec := httptest.NewRecorder()
+		feed.GetNotifications(rec, newRequest("GET", target, nil))
+		assert.Equal(t, http.StatusBadRequest, rec.Code, target)
+	}
+}
+
+func TestMemoryNotificationStoreRetention(t *testing.T) {
+	now := time.Date(2017, 3, 3, 12, 0, 0, 0, time.UTC)
+	store := newMemoryNotificationStore(3, time.Hour)
+
+	received := now.Add(-2 * time.Hour)
+	store.now = func() time.Time { return received }
+	store.add(notificationEntry{contentUUID: "old", lastModified: now})
+	// retention applies to the time entries are received, not to their lastModified
+	received = now.Add(-time.Minute)
+	store.add(
+		notificationEntry{contentUUID: "a", lastModified: now.Add(-3 * time.Hour)},
+		notificationEntry{contentUUID: "b", lastModified: now.Add(-2 * time.Minute)},
+		notificationEntry{contentUUID: "c", lastModified: now.Add(-time.Minute)},
+	)
+	received = now
+	store.add(notificationEntry{contentUUID: "d", lastModified: now})
+
+	var uuids []string
+	for _, e := range store.page(time.Time{}, 0, 10) {
+		uuids = append(uuids, e.contentUUID)
+	}
+	assert.Equal(t, []string{"b", "c", "d"}, uuids)
+}
@@ -0,0 +1,375 @@
+package relations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/gorilla/mux"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisPurgeClaimsPrefix = redisKeyPrefix + "purge/claims/"
+	// purgeClaimTTL is how long a publish event stays claimed by the replica purging it
+	purgeClaimTTL = 24 * time.Hour
+	// purgeClaimTimeout bounds the claim of a publish event
+	purgeClaimTimeout = 5 * time.Second
+)
+
+var (
+	// purgedKeys counts the surrogate keys the CDN confirmed purging
+	purgedKeys = metrics.GetOrRegisterCounter("relations.cdn_purged_keys", metrics.DefaultRegistry)
+	// purgeFailures counts the surrogate keys still not purged after every attempt
+	purgeFailures = metrics.GetOrRegisterCounter("relations.cdn_purge_failures", metrics.DefaultRegistry)
+	// purgeEventsDropped counts the collection events dropped while the purge queue was full
+	purgeEventsDropped = metrics.GetOrRegisterCounter("relations.cdn_purge_events_dropped", metrics.DefaultRegistry)
+)
+
+// Purger drops the cached responses tagged with any of the surrogate keys
+// from the CDN, whatever their query string or host.
+type Purger interface {
+	Purge(ctx context.Context, keys []string) error
+}
+
+// HTTPPurger purges surrogate keys by sending a PURGE request to the CDN,
+// with the keys in its Surrogate-Key header.
+type HTTPPurger struct {
+	baseURL string
+	auth    string
+	client  *http.Client
+}
+
+// NewHTTPPurger creates a purger for the CDN serving the API at baseURL, in
+// the format scheme://host. The PURGE requests carry auth as their
+// Authorization header, unless it is empty.
+func NewHTTPPurger(baseURL, auth string, client *http.Client) (*HTTPPurger, error) {
+	u, err := url.ParseRequestURI(baseURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" {
+		return nil, errors.New("Invalid CDN purge URL " + baseURL + ", expected an absolute http or https URL")
+	}
+	return &HTTPPurger{baseURL: strings.TrimRight(baseURL, "/"), auth: auth, client: client}, nil
+}
+
+// Purge sends a single PURGE request for the keys. Keys the CDN has no cached
+// response for are considered purged.
+func (p *HTTPPurger) Purge(ctx context.Context, keys []string) error {
+	req, err := http.NewRequestWithContext(ctx, "PURGE", p.baseURL+"/", nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Surrogate-Key", strings.Join(keys, " "))
+	if p.auth != "" {
+		req.Header.Set("Authorization", p.auth)
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode >= 200 && resp.StatusCode <= 299 {
+		return nil
+	}
+	return fmt.Errorf("Purging %d surrogate keys responded with status %d", len(keys), resp.StatusCode)
+}
+
+type PurgeConfig struct {
+	// BatchSize is the maximum number of surrogate keys sent to the purger at a time
+	BatchSize int
+	// FlushInterval is the longest keys wait for their batch to fill up
+	FlushInterval time.Duration
+	// MaxAttempts is the number of times a batch is tried before its keys are given up
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubled on every following retry
+	InitialBackoff time.Duration
+	// Delay is how long the purge of a publish event waits, rounded up to the
+	// FlushInterval, for Neo4j and the caches of every replica to be up to date
+	Delay time.Duration
+}
+
+// PurgeClaims tells apart the replicas reading the same publish events, so
+// that a single one purges the responses affected by each event.
+type PurgeClaims interface {
+	// claim reports whether the event was not claimed yet
+	claim(key string) (bool, error)
+}
+
+// RedisPurgeClaims are PurgeClaims shared by every replica of the service,
+// the first one to claim an event purges it.
+type RedisPurgeClaims struct {
+	client redis.UniversalClient
+}
+
+func NewRedisPurgeClaims(client redis.UniversalClient) *RedisPurgeClaims {
+	return &RedisPurgeClaims{client: client}
+}
+
+func (c *RedisPurgeClaims) claim(key string) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), purgeClaimTimeout)
+	defer cancel()
+	return c.client.SetNX(ctx, redisPurgeClaimsPrefix+key, 1, purgeClaimTTL).Result()
+}
+
+// PurgeEmitter purges from the CDN, in batches, the relations responses
+// affected by published collections, or collections changed by an admin.
+// Every relations response is tagged with the UUIDs of the collections it
+// was built from, so the responses affected by a change of a collection are
+// purged by its UUID. The content it now lists and its leads are purged by
+// their own UUID, as their responses may not have been built from it yet.
+type PurgeEmitter struct {
+	driver  Driver
+	purger  Purger
+	claims  PurgeClaims
+	config  PurgeConfig
+	log     *logger.UPPLogger
+	events  chan CollectionEvent
+	keys    chan []string
+	batches chan []string
+	stopped chan struct{}
+}
+
+// NewPurgeEmitter creates an emitter sending the affected surrogate keys to
+// the purger once started. Without claims, every replica purges the events it
+// reads.
+func NewPurgeEmitter(driver Driver, purger Purger, claims PurgeClaims, config PurgeConfig, log *logger.UPPLogger) *PurgeEmitter {
+	return &PurgeEmitter{
+		driver:  driver,
+		purger:  purger,
+		claims:  claims,
+		config:  config,
+		log:     log,
+		events:  make(chan CollectionEvent, 100),
+		keys:    make(chan []string, 100),
+		batches: make(chan []string, 100),
+		stopped: make(chan struct{}),
+	}
+}
+
+// HandleCollectionEvent queues the event. It never blocks the consumer: the
+// event is dropped and counted in relations.cdn_purge_events_dropped while
+// the queue is full, its responses then expire with the CDN cache duration.
+func (pe *PurgeEmitter) HandleCollectionEvent(event CollectionEvent) {
+	select {
+	case pe.events <- event:
+	case <-pe.stopped:
+	default:
+		purgeEventsDropped.Inc(1)
+		pe.log.WithUUID(event.UUID).WithTransactionID(event.PublishReference).Warn("CDN purge is busy, dropping the collection event")
+	}
+}
+
+// Start batches the affected keys until the context is cancelled, then
+// purges the keys still pending. The batches are purged, and retried, apart
+// from the batching, so that a slow CDN doesn't hold up the events. The keys
+// of a publish event are only looked up and batched once its delay is over.
+func (pe *PurgeEmitter) Start(ctx context.Context) {
+	defer close(pe.stopped)
+	ticker := time.NewTicker(pe.config.FlushInterval)
+	defer ticker.Stop()
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case batch := <-pe.batches:
+				pe.purge(ctx, batch)
+			}
+		}
+	}()
+	defer wg.Wait()
+
+	var pending []string
+	queued := map[string]bool{}
+	flush := func(batch []string) {
+		for _, key := range batch {
+			delete(queued, key)
+		}
+		select {
+		case pe.batches <- batch:
+		default:
+			purgeFailures.Inc(int64(len(batch)))
+			pe.log.WithField("keys", batch).Error("CDN purge is busy, giving up the batch")
+		}
+	}
+	queue := func(keys []string) {
+		for _, key := range keys {
+			if !queued[key] {
+				queued[key] = true
+				pending = append(pending, key)
+			}
+		}
+	}
+	add := func(keys []string) {
+		queue(keys)
+		for len(pending) >= pe.config.BatchSize {
+			flush(pending[:pe.config.BatchSize:pe.config.BatchSize])
+			pending = pending[pe.config.BatchSize:]
+		}
+	}
+
+	var delayed []delayedEvent
+	for {
+		select {
+		case <-ctx.Done():
+			for _, d := range delayed {
+				queue(pe.affectedKeys(d.event))
+			}
+			if len(pending) > 0 {
+				// the context is done, the last batch gets a single attempt of its own
+				pe.purgeOnce(context.Background(), pending)
+			}
+			return
+		case event := <-pe.events:
+			if !pe.claim(event) {
+				continue
+			}
+			if pe.config.Delay <= 0 {
+				add(pe.affectedKeys(event))
+			} else {
+				delayed = append(delayed, delayedEvent{event: event, due: time.Now().Add(pe.config.Delay)})
+			}
+		case keys := <-pe.keys:
+			add(keys)
+		case now := <-ticker.C:
+			for len(delayed) > 0 && !delayed[0].due.After(now) {
+				add(pe.affectedKeys(delayed[0].event))
+				delayed = delayed[1:]
+			}
+			if len(pending) > 0 {
+				flush(pending)
+				pending = nil
+			}
+		}
+	}
+}
+
+type delayedEvent struct {
+	event CollectionEvent
+	due   time.Time
+}
+
+// claim reports whether the replica purges the event. When the claim fails,
+// the event is purged anyway, as purging it twice does no harm.
+func (pe *PurgeEmitter) claim(event CollectionEvent) bool {
+	if pe.claims == nil {
+		return true
+	}
+	claimed, err := pe.claims.claim(event.UUID + "/" + event.eventID())
+	if err != nil {
+		pe.log.WithError(err).WithUUID(event.UUID).WithTransactionID(event.PublishReference).Warn("Failed to claim the purge of the collection event, purging it anyway")
+		return true
+	}
+	return claimed
+}
+
+// affectedKeys lists the surrogate keys of the relations responses affected
+// by the change of the collection: its UUID, and the UUIDs of the content it
+// lists and of its leads. When the leads can't be looked up, the responses
+// already built from the collection are still purged by its UUID.
+func (pe *PurgeEmitter) affectedKeys(event CollectionEvent) []string {
+	leads, err := pe.driver.findContentCollectionLeads(event.UUID)
+	if err != nil {
+		pe.log.WithError(err).WithUUID(event.UUID).Error("Failed to look up the leads of the collection to purge")
+	}
+	return mergeUUIDs(event.AffectedUUIDs(), leads)
+}
+
+func (pe *PurgeEmitter) purge(ctx context.Context, keys []string) {
+	backoff := pe.config.InitialBackoff
+	var err error
+	attempt := 1
+	for ; ; attempt++ {
+		if err = pe.purger.Purge(ctx, keys); err == nil {
+			purgedKeys.Inc(int64(len(keys)))
+			return
+		}
+		if attempt >= pe.config.MaxAttempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	purgeFailures.Inc(int64(len(keys)))
+	pe.log.WithError(err).WithField("attempts", attempt).WithField("keys", keys).Error("Failed to purge relations responses from the CDN")
+}
+
+func (pe *PurgeEmitter) purgeOnce(ctx context.Context, keys []string) {
+	if err := pe.purger.Purge(ctx, keys); err != nil {
+		purgeFailures.Inc(int64(len(keys)))
+		pe.log.WithError(err).WithField("keys", keys).Error("Failed to purge relations responses from the CDN on shutdown")
+		return
+	}
+	purgedKeys.Inc(int64(len(keys)))
+}
+
+type purgeResponse struct {
+	Keys []string `json:"keys"`
+}
+
+// PurgeCollection queues the purge of the relations responses affected by a
+// change of the collection. The items it now lists can be sent as the items
+// of a collection event.
+func (pe *PurgeEmitter) PurgeCollection(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	event := CollectionEvent{UUID: mux.Vars(r)["uuid"]}
+	if err := validateUuid(event.UUID); err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidUUID,
+			detail:  fmt.Sprintf("The given uuid is not valid, err=%v", err),
+		})
+		return
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil && !errors.Is(err, io.EOF) {
+			writeError(w, r, apiError{
+				status:  http.StatusBadRequest,
+				problem: problemInvalidParameter,
+				detail:  fmt.Sprintf("The collection could not be decoded, err=%v", err),
+			})
+			return
+		}
+		event.UUID = mux.Vars(r)["uuid"]
+	}
+
+	keys := pe.affectedKeys(event)
+	select {
+	case pe.keys <- keys:
+	case <-pe.stopped:
+		writeError(w, r, apiError{
+			status:  http.StatusServiceUnavailable,
+			problem: problemUnavailable,
+			detail:  "The CDN purge is stopped",
+		})
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	pe.log.WithUUID(event.UUID).WithField("admin", adminIdentity(r)).Infof("Queued the purge of %d surrogate keys", len(keys))
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(purgeResponse{Keys: keys})
+}
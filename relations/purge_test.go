@@ -0,0 +1,304 @@
+package relations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recordingPurger records the purged batches, failing the first failures
+// calls. While block is set, every call waits for it to be closed.
+type recordingPurger struct {
+	mu       sync.Mutex
+	batches  [][]string
+	calls    int
+	failures int
+	block    chan struct{}
+}
+
+func (p *recordingPurger) Purge(_ context.Context, keys []string) error {
+	if p.block != nil {
+		<-p.block
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.calls++
+	if p.calls <= p.failures {
+		return errors.New("CDN unavailable")
+	}
+	p.batches = append(p.batches, append([]string{}, keys...))
+	return nil
+}
+
+func (p *recordingPurger) purged() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	var keys []string
+	for _, batch := range p.batches {
+		keys = append(keys, batch...)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (p *recordingPurger) callCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.calls
+}
+
+func (p *recordingPurger) batchCount() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.batches)
+}
+
+func newTestPurgeEmitter(purger Purger, config PurgeConfig) (*PurgeEmitter, *mutableDriverMock) {
+	driver := &mutableDriverMock{
+		relations: map[string]relations{},
+		leads:     map[string][]string{collectionUUID: {leadUUID}},
+	}
+	return NewPurgeEmitter(driver, purger, nil, config, logger.NewUPPLogger("test", "PANIC")), driver
+}
+
+func startPurgeEmitter(t *testing.T, emitter *PurgeEmitter) {
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		emitter.Start(ctx)
+		close(done)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+func TestPurgeEmitterPurgesAffectedKeys(t *testing.T) {
+	purger := &recordingPurger{}
+	emitter, _ := newTestPurgeEmitter(purger, PurgeConfig{BatchSize: 100, FlushInterval: 10 * time.Millisecond, MaxAttempts: 1})
+	startPurgeEmitter(t, emitter)
+
+	// the responses built from the collection, including the ones of items it
+	// no longer lists, are purged by its UUID
+	emitter.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}}})
+	require.Eventually(t, func() bool { return len(purger.purged()) > 0 }, time.Second, 5*time.Millisecond)
+	assert.ElementsMatch(t, []string{collectionUUID, leadUUID, item1UUID}, purger.purged())
+}
+
+func TestPurgeEmitterBatches(t *testing.T) {
+	purger := &recordingPurger{}
+	emitter, _ := newTestPurgeEmitter(purger, PurgeConfig{BatchSize: 2, FlushInterval: time.Hour, MaxAttempts: 1})
+	startPurgeEmitter(t, emitter)
+
+	// three keys per event, duplicates are only purged once per batch
+	emitter.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}}})
+	require.Eventually(t, func() bool { return purger.batchCount() == 1 }, time.Second, 5*time.Millisecond)
+	assert.Len(t, purger.batches[0], 2)
+
+	emitter.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}}})
+	require.Eventually(t, func() bool { return purger.batchCount() == 2 }, time.Second, 5*time.Millisecond)
+	assert.Len(t, purger.batches[1], 2)
+}
+
+func TestPurgeEmitterRetries(t *testing.T) {
+	purger := &recordingPurger{failures: 2}
+	emitter, _ := newTestPurgeEmitter(purger, PurgeConfig{BatchSize: 100, FlushInterval: 10 * time.Millisecond, MaxAttempts: 3, InitialBackoff: time.Millisecond})
+	startPurgeEmitter(t, emitter)
+
+	emitter.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}}})
+	require.Eventually(t, func() bool { return purger.batchCount() == 1 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 3, purger.callCount())
+}
+
+func TestPurgeEmitterGivesUp(t *testing.T) {
+	purger := &recordingPurger{failures: 100}
+	emitter, _ := newTestPurgeEmitter(purger, PurgeConfig{BatchSize: 100, FlushInterval: 10 * time.Millisecond, MaxAttempts: 2, InitialBackoff: time.Millisecond})
+	startPurgeEmitter(t, emitter)
+
+	failures := purgeFailures.Count()
+	emitter.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}}})
+	require.Eventually(t, func() bool { return purgeFailures.Count() == failures+3 }, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 2, purger.callCount())
+}
+
+func TestPurgeEmitterNeverBlocksTheConsumer(t *testing.T) {
+	purger := &recordingPurger{block: make(chan struct{})}
+	emitter, _ := newTestPurgeEmitter(purger, PurgeConfig{BatchSize: 1, FlushInterval: time.Hour, MaxAttempts: 3, InitialBackoff: time.Hour})
+	startPurgeEmitter(t, emitter)
+	t.Cleanup(func() { close(purger.block) })
+
+	// the purge of the first batch hangs, events keep being taken until the queues are full
+	dropped := purgeEventsDropped.Count()
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < 1000; i++ {
+			emitter.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}}})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("HandleCollectionEvent blocked while the CDN was slow")
+	}
+	assert.Greater(t, purgeEventsDropped.Count(), dropped)
+}
+
+func TestPurgeCollectionEndpoint(t *testing.T) {
+	purger := &recordingPurger{}
+	emitter, _ := newTestPurgeEmitter(purger, PurgeConfig{BatchSize: 100, FlushInterval: 10 * time.Millisecond, MaxAttempts: 1})
+	startPurgeEmitter(t, emitter)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/__purge/contentcollection/{uuid}", emitter.PurgeCollection).Methods("POST")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/__purge/contentcollection/"+collectionUUID, nil))
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var resp purgeResponse
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.ElementsMatch(t, []string{collectionUUID, leadUUID}, resp.Keys)
+	require.Eventually(t, func() bool { return purger.batchCount() == 1 }, time.Second, 5*time.Millisecond)
+
+	// the items the collection now lists are purged as well
+	body, _ := json.Marshal(CollectionEvent{Items: []collectionItem{{UUID: item1UUID}}})
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/__purge/contentcollection/"+collectionUUID, bytes.NewReader(body)))
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&resp))
+	assert.Contains(t, resp.Keys, item1UUID)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/__purge/contentcollection/99999", nil))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("POST", "/__purge/contentcollection/"+collectionUUID, bytes.NewReader([]byte("{"))))
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+}
+
+func TestHTTPPurger(t *testing.T) {
+	var mu sync.Mutex
+	var requests []string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requests = append(requests, r.Method+" "+r.URL.Path+" "+r.Header.Get("Surrogate-Key"))
+		mu.Unlock()
+		switch r.Header.Get("Surrogate-Key") {
+		case knownUUID + " " + collectionUUID:
+			w.WriteHeader(http.StatusOK)
+		case item1UUID:
+			w.WriteHeader(http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusForbidden)
+		}
+	}))
+	defer cdn.Close()
+
+	purger, err := NewHTTPPurger(cdn.URL+"/", "", cdn.Client())
+	require.NoError(t, err)
+
+	assert.NoError(t, purger.Purge(context.Background(), []string{knownUUID, collectionUUID}))
+	assert.NoError(t, purger.Purge(context.Background(), []string{item1UUID}))
+	assert.Error(t, purger.Purge(context.Background(), []string{leadUUID}))
+	assert.Equal(t, []string{
+		"PURGE / " + knownUUID + " " + collectionUUID,
+		"PURGE / " + item1UUID,
+		"PURGE / " + leadUUID,
+	}, requests)
+
+	_, err = NewHTTPPurger("ftp://cdn.ft.com", "", cdn.Client())
+	assert.Error(t, err)
+}
+
+func TestHTTPPurgerAuth(t *testing.T) {
+	var auth string
+	cdn := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		auth = r.Header.Get("Authorization")
+	}))
+	defer cdn.Close()
+
+	purger, err := NewHTTPPurger(cdn.URL, "Bearer purge-token", cdn.Client())
+	require.NoError(t, err)
+	require.NoError(t, purger.Purge(context.Background(), []string{knownUUID}))
+	assert.Equal(t, "Bearer purge-token", auth)
+}
+
+func TestPurgeEmitterDelaysPublishEvents(t *testing.T) {
+	purger := &recordingPurger{}
+	emitter, _ := newTestPurgeEmitter(purger, PurgeConfig{BatchSize: 100, FlushInterval: 10 * time.Millisecond, MaxAttempts: 1, Delay: 100 * time.Millisecond})
+	startPurgeEmitter(t, emitter)
+
+	start := time.Now()
+	emitter.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: item1UUID}}})
+	require.Eventually(t, func() bool { return len(purger.purged()) > 0 }, time.Second, 5*time.Millisecond)
+	assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond, "the purge should wait for the delay")
+	assert.ElementsMatch(t, []string{collectionUUID, leadUUID, item1UUID}, purger.purged())
+}
+
+func TestPurgeEmitterPurgesDelayedEventsOnShutdown(t *testing.T) {
+	purger := &recordingPurger{}
+	emitter, _ := newTestPurgeEmitter(purger, PurgeConfig{BatchSize: 100, FlushInterval: time.Hour, MaxAttempts: 1, Delay: time.Hour})
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		emitter.Start(ctx)
+		close(done)
+	}()
+
+	emitter.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{}})
+	// the event is read once the queue is empty
+	require.Eventually(t, func() bool { return len(emitter.events) == 0 }, time.Second, 5*time.Millisecond)
+	cancel()
+	<-done
+	assert.ElementsMatch(t, []string{collectionUUID, leadUUID}, purger.purged())
+}
+
+func TestPurgeEmitterClaimsEventsAcrossReplicas(t *testing.T) {
+	mr := miniredis.RunT(t)
+	purger := &recordingPurger{}
+	config := PurgeConfig{BatchSize: 100, FlushInterval: 10 * time.Millisecond, MaxAttempts: 1}
+	var replicas []*PurgeEmitter
+	for i := 0; i < 2; i++ {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		driver := &mutableDriverMock{relations: map[string]relations{}, leads: map[string][]string{}}
+		emitter := NewPurgeEmitter(driver, purger, NewRedisPurgeClaims(client), config, logger.NewUPPLogger("test", "PANIC"))
+		startPurgeEmitter(t, emitter)
+		replicas = append(replicas, emitter)
+	}
+
+	event := CollectionEvent{UUID: collectionUUID, Items: []collectionItem{}, PublishReference: "tid_purge"}
+	for _, emitter := range replicas {
+		emitter.HandleCollectionEvent(event)
+	}
+	require.Eventually(t, func() bool { return purger.batchCount() > 0 }, time.Second, 5*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{collectionUUID}, purger.purged(), "a single replica should purge the event")
+
+	// another publish of the collection is purged again
+	event.PublishReference = "tid_purge_again"
+	replicas[1].HandleCollectionEvent(event)
+	require.Eventually(t, func() bool { return purger.batchCount() == 2 }, time.Second, 5*time.Millisecond)
+
+	// without Redis, the event is purged anyway
+	mr.Close()
+	event.PublishReference = "tid_purge_unclaimed"
+	replicas[0].HandleCollectionEvent(event)
+	require.Eventually(t, func() bool { return purger.batchCount() == 3 }, 10*time.Second, 5*time.Millisecond)
+}
@@ -0,0 +1,70 @@
+package relations
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// Message is a single message read from a queue.
+type Message struct {
+	Headers map[string]string
+	Body    []byte
+}
+
+// Queue is a source of publish messages.
+type Queue interface {
+	// Consume passes every received message to handle until the context is cancelled or the queue is closed.
+	Consume(ctx context.Context, handle func(Message)) error
+	Close() error
+}
+
+var errQueueClosed = errors.New("queue is closed")
+
+// MemoryQueue is an in-memory Queue, mainly useful for tests and local development.
+type MemoryQueue struct {
+	messages  chan Message
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+func NewMemoryQueue(capacity int) *MemoryQueue {
+	return &MemoryQueue{
+		messages: make(chan Message, capacity),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Publish adds a message to the queue, blocking while the queue is full.
+func (q *MemoryQueue) Publish(msg Message) error {
+	select {
+	case <-q.closed:
+		return errQueueClosed
+	default:
+	}
+
+	select {
+	case <-q.closed:
+		return errQueueClosed
+	case q.messages <- msg:
+		return nil
+	}
+}
+
+func (q *MemoryQueue) Consume(ctx context.Context, handle func(Message)) error {
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-q.closed:
+			return nil
+		case msg := <-q.messages:
+			handle(msg)
+		}
+	}
+}
+
+func (q *MemoryQueue) Close() error {
+	q.closeOnce.Do(func() { close(q.closed) })
+	return nil
+}
@@ -0,0 +1,384 @@
+package relations
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	metrics "github.com/rcrowley/go-metrics"
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisKeyPrefix = "relations-api:"
+	// redisDependantsPrefix prefixes the sets of the keys of the entries built from a UUID
+	redisDependantsPrefix = redisKeyPrefix + "dependants/"
+	// redisAdminTimeout bounds the admin commands scanning the keys, which take longer than lookups
+	redisAdminTimeout = 30 * time.Second
+)
+
+var (
+	// redisFailures counts the Redis commands that failed, the lookups falling through to Neo4j
+	redisFailures = metrics.GetOrRegisterCounter("relations.redis_cache_failures", metrics.DefaultRegistry)
+	// redisSkipped counts the Redis commands not sent while the circuit breaker is open
+	redisSkipped = metrics.GetOrRegisterCounter("relations.redis_cache_skipped", metrics.DefaultRegistry)
+	// redisInvalidationsSkipped counts the UUIDs not invalidated while the circuit breaker is open
+	redisInvalidationsSkipped = metrics.GetOrRegisterCounter("relations.redis_cache_invalidations_skipped", metrics.DefaultRegistry)
+)
+
+type RedisCacheConfig struct {
+	// TTL is the time entries are kept in Redis
+	TTL time.Duration
+	// Timeout is the longest a Redis command may take before it is considered failed
+	Timeout time.Duration
+	// FailureThreshold is the number of consecutive failures opening the circuit breaker
+	FailureThreshold int
+	// Cooldown is how long the circuit breaker stays open before Redis is tried again
+	Cooldown time.Duration
+}
+
+// RedisCache is a RelationsCache shared by every replica of the service.
+// While Redis fails, the circuit breaker opens and the lookups go straight to
+// Neo4j, as if nothing was cached.
+type RedisCache struct {
+	invalidationLog
+	client  redis.UniversalClient
+	config  RedisCacheConfig
+	breaker *circuitBreaker
+	log     *logger.UPPLogger
+
+	// hits, misses and invalidations are counted by each replica
+	hits          atomic.Int64
+	misses        atomic.Int64
+	invalidations atomic.Int64
+}
+
+func NewRedisCache(client redis.UniversalClient, config RedisCacheConfig, log *logger.UPPLogger) *RedisCache {
+	return &RedisCache{
+		client:  client,
+		config:  config,
+		breaker: newCircuitBreaker("Redis cache", config.FailureThreshold, config.Cooldown, log),
+		log:     log,
+	}
+}
+
+func (rc *RedisCache) get(key string) (cacheEntry, bool) {
+	var data []byte
+	err := rc.do(func(ctx context.Context) error {
+		var err error
+		data, err = rc.client.Get(ctx, redisKeyPrefix+key).Bytes()
+		if errors.Is(err, redis.Nil) {
+			data = nil
+			return nil
+		}
+		return err
+	})
+	if err != nil || data == nil {
+		rc.misses.Add(1)
+		return cacheEntry{}, false
+	}
+
+	entry, err := decodeStoredEntry(key, data)
+	if err != nil {
+		rc.log.WithError(err).WithField("key", key).Warn("Failed to decode relations cached in Redis")
+		rc.misses.Add(1)
+		return cacheEntry{}, false
+	}
+	rc.hits.Add(1)
+	return entry, true
+}
+
+func (rc *RedisCache) set(entry cacheEntry) {
+	// Only the invalidations of this replica are seen, every replica
+	// invalidates Redis on the events it reads
+	if rc.invalidatedSince(entry.lookupStarted, entry.dependencies) {
+		return
+	}
+	data, err := encodeStoredEntry(entry)
+	if err != nil {
+		rc.log.WithError(err).WithField("key", entry.key).Warn("Failed to encode relations for Redis")
+		return
+	}
+	rc.do(func(ctx context.Context) error {
+		_, err := rc.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, redisKeyPrefix+entry.key, data, rc.config.TTL)
+			for _, dep := range entry.dependencies {
+				pipe.SAdd(ctx, redisDependantsPrefix+dep, entry.key)
+				pipe.Expire(ctx, redisDependantsPrefix+dep, rc.config.TTL)
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+// Invalidate drops every entry that was built from any of the given content
+// or collection UUIDs. Entries are left to expire when Redis fails or its
+// circuit breaker is open, which is logged and counted in
+// relations.redis_cache_invalidations_skipped.
+func (rc *RedisCache) Invalidate(uuids ...string) {
+	if _, err := rc.invalidate(uuids...); err != nil {
+		rc.log.WithError(err).WithField("uuids", uuids).Warn("Failed to invalidate relations cached in Redis, they will be served until they expire")
+	}
+}
+
+// invalidate drops the entries built from the UUIDs in two pipelines, reading
+// the dependants sets then deleting them along their entries. It may take as
+// long as the admin commands, and its failures don't open the circuit breaker
+// of the lookups. While the breaker is open, nothing is invalidated.
+func (rc *RedisCache) invalidate(uuids ...string) (int, error) {
+	rc.record(uuids...)
+	if len(uuids) == 0 {
+		return 0, nil
+	}
+	if !rc.breaker.allow() {
+		redisInvalidationsSkipped.Inc(int64(len(uuids)))
+		return 0, errCircuitOpen
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisAdminTimeout)
+	defer cancel()
+	dependants := make([]*redis.StringSliceCmd, len(uuids))
+	_, err := rc.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, u := range uuids {
+			dependants[i] = pipe.SMembers(ctx, redisDependantsPrefix+u)
+		}
+		return nil
+	})
+	if err != nil {
+		redisFailures.Inc(1)
+		return 0, err
+	}
+
+	var deleted []*redis.IntCmd
+	_, err = rc.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, u := range uuids {
+			keys := dependants[i].Val()
+			if len(keys) == 0 {
+				continue
+			}
+			toDelete := make([]string, 0, len(keys))
+			for _, key := range keys {
+				toDelete = append(toDelete, redisKeyPrefix+key)
+			}
+			deleted = append(deleted, pipe.Del(ctx, toDelete...))
+			pipe.Del(ctx, redisDependantsPrefix+u)
+		}
+		return nil
+	})
+	var dropped int64
+	for _, cmd := range deleted {
+		dropped += cmd.Val()
+	}
+	if err != nil {
+		redisFailures.Inc(1)
+	}
+	rc.invalidations.Add(dropped)
+	return int(dropped), err
+}
+
+func (rc *RedisCache) shared() bool {
+	return true
+}
+
+func (rc *RedisCache) stats() (CacheStats, error) {
+	stats := CacheStats{
+		Backend:       "redis",
+		Hits:          rc.hits.Load(),
+		Misses:        rc.misses.Load(),
+		Invalidations: rc.invalidations.Load(),
+	}
+	stats.HitRatio = hitRatio(stats.Hits, stats.Misses)
+	err := rc.doWithin(redisAdminTimeout, func(ctx context.Context) error {
+		err := rc.scan(ctx, func(keys []string) error {
+			stats.Entries += len(keys)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		// Redis evicts keys of every application sharing it, not only relations.
+		// Some Redis deployments refuse INFO, the evictions are then left out.
+		info, err := rc.client.Info(ctx, "stats").Result()
+		if err != nil {
+			rc.log.WithError(err).Debug("Failed to read the evictions of Redis")
+			return nil
+		}
+		for _, line := range strings.Split(info, "\r\n") {
+			if value, ok := strings.CutPrefix(line, "evicted_keys:"); ok {
+				stats.Evictions, _ = strconv.ParseInt(value, 10, 64)
+			}
+		}
+		return nil
+	})
+	return stats, err
+}
+
+// scan passes the keys of the cached relations to the callback, a batch at a time.
+func (rc *RedisCache) scan(ctx context.Context, callback func(keys []string) error) error {
+	for _, prefix := range []string{contentCacheKeyPrefix, contentCollectionCacheKeyPrefix} {
+		var cursor uint64
+		for {
+			keys, next, err := rc.client.Scan(ctx, cursor, redisKeyPrefix+prefix+"*", 500).Result()
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				if err := callback(keys); err != nil {
+					return err
+				}
+			}
+			if cursor = next; cursor == 0 {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+func (rc *RedisCache) lookup(uuid string) ([]CachedEntry, error) {
+	cached := []CachedEntry{}
+	err := rc.do(func(ctx context.Context) error {
+		for _, key := range cacheKeys(uuid) {
+			data, err := rc.client.Get(ctx, redisKeyPrefix+key).Bytes()
+			if errors.Is(err, redis.Nil) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			ttl, err := rc.client.PTTL(ctx, redisKeyPrefix+key).Result()
+			if err != nil {
+				return err
+			}
+			entry, err := decodeStoredEntry(key, data)
+			if err != nil {
+				return err
+			}
+			cached = append(cached, CachedEntry{Key: key, Found: entry.found, ExpiresAt: time.Now().Add(ttl)})
+		}
+		return nil
+	})
+	return cached, err
+}
+
+func (rc *RedisCache) evict(uuid string) (int, error) {
+	rc.record(uuid)
+	var dropped int64
+	err := rc.do(func(ctx context.Context) error {
+		keys := cacheKeys(uuid)
+		for i, key := range keys {
+			keys[i] = redisKeyPrefix + key
+		}
+		var err error
+		dropped, err = rc.client.Del(ctx, keys...).Result()
+		return err
+	})
+	rc.invalidations.Add(dropped)
+	return int(dropped), err
+}
+
+// flush drops the cached relations only, as Redis may be shared with other applications.
+func (rc *RedisCache) flush() (int, error) {
+	rc.recordFlush()
+	var dropped int64
+	err := rc.doWithin(redisAdminTimeout, func(ctx context.Context) error {
+		err := rc.scan(ctx, func(keys []string) error {
+			n, err := rc.client.Del(ctx, keys...).Result()
+			dropped += n
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		// the dependants sets only reference dropped entries now
+		var cursor uint64
+		for {
+			keys, next, err := rc.client.Scan(ctx, cursor, redisDependantsPrefix+"*", 500).Result()
+			if err != nil {
+				return err
+			}
+			if len(keys) > 0 {
+				if err := rc.client.Del(ctx, keys...).Err(); err != nil {
+					return err
+				}
+			}
+			if cursor = next; cursor == 0 {
+				return nil
+			}
+		}
+	})
+	rc.invalidations.Add(dropped)
+	return int(dropped), err
+}
+
+// do runs the commands through the circuit breaker, within the timeout.
+func (rc *RedisCache) do(commands func(ctx context.Context) error) error {
+	return rc.doWithin(rc.config.Timeout, commands)
+}
+
+func (rc *RedisCache) doWithin(timeout time.Duration, commands func(ctx context.Context) error) error {
+	if !rc.breaker.allow() {
+		redisSkipped.Inc(1)
+		return errCircuitOpen
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := commands(ctx)
+	if err != nil {
+		redisFailures.Inc(1)
+	}
+	rc.breaker.record(err)
+	return err
+}
+
+var errCircuitOpen = errors.New("circuit breaker is open")
+
+// circuitBreaker stops calls to a failing dependency for a cooldown once
+// threshold calls in a row failed. The first call after the cooldown closes
+// it again when it succeeds, or opens it for another cooldown.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+	now       func() time.Time
+	log       *logger.UPPLogger
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration, log *logger.UPPLogger) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown, now: time.Now, log: log}
+}
+
+func (cb *circuitBreaker) allow() bool {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+	return !cb.now().Before(cb.openUntil)
+}
+
+func (cb *circuitBreaker) record(err error) {
+	cb.mu.Lock()
+	defer cb.mu.Unlock()
+
+	if err == nil {
+		if cb.failures >= cb.threshold {
+			cb.log.Infof("%s recovered, closing its circuit breaker", cb.name)
+		}
+		cb.failures = 0
+		return
+	}
+	cb.failures++
+	if cb.failures == cb.threshold {
+		cb.log.WithError(err).Warnf("%s failed %d times in a row, opening its circuit breaker for %v", cb.name, cb.failures, cb.cooldown)
+	}
+	if cb.failures >= cb.threshold {
+		cb.openUntil = cb.now().Add(cb.cooldown)
+	}
+}
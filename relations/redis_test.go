@@ -0,0 +1,151 @@
+package relations
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRedisCache(t *testing.T) (*RedisCache, *miniredis.Miniredis) {
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+	cache := NewRedisCache(client, RedisCacheConfig{
+		TTL:              time.Minute,
+		Timeout:          time.Second,
+		FailureThreshold: 2,
+		Cooldown:         time.Minute,
+	}, logger.NewUPPLogger("test", "PANIC"))
+	return cache, mr
+}
+
+func TestRedisCacheRoundTrip(t *testing.T) {
+	cache, _ := newTestRedisCache(t)
+	contentRel := relations{
+		CuratedRelatedContents: []relatedContent{{uuid: item1UUID}, {uuid: otherUUID, Unresolved: true}},
+		Contains:               []relatedContent{},
+		ContainedIn:            []relatedContent{{uuid: collectionUUID}},
+		collectionUUIDs:        []string{leadUUID},
+	}
+	cache.set(cacheEntry{key: contentCacheKeyPrefix + knownUUID, contentRel: contentRel, found: true, dependencies: []string{knownUUID, leadUUID}})
+	ccRel := ccRelations{ContainedIn: leadUUID, Contains: []string{item1UUID}, UnresolvedContains: []string{otherUUID}}
+	cache.set(cacheEntry{key: contentCollectionCacheKeyPrefix + collectionUUID, ccRel: ccRel, found: true, dependencies: []string{collectionUUID}})
+
+	entry, ok := cache.get(contentCacheKeyPrefix + knownUUID)
+	require.True(t, ok)
+	assert.True(t, entry.found)
+	assert.Equal(t, contentRel, entry.contentRel)
+	assert.Equal(t, []string{knownUUID, leadUUID}, entry.dependencies)
+
+	entry, ok = cache.get(contentCollectionCacheKeyPrefix + collectionUUID)
+	require.True(t, ok)
+	assert.Equal(t, ccRel, entry.ccRel)
+
+	_, ok = cache.get(contentCacheKeyPrefix + otherUUID)
+	assert.False(t, ok)
+}
+
+func TestRedisCacheTTL(t *testing.T) {
+	cache, mr := newTestRedisCache(t)
+	cache.set(cacheEntry{key: contentCacheKeyPrefix + knownUUID, dependencies: []string{knownUUID}})
+
+	_, ok := cache.get(contentCacheKeyPrefix + knownUUID)
+	assert.True(t, ok, "not found results should be cached too")
+
+	mr.FastForward(2 * time.Minute)
+	_, ok = cache.get(contentCacheKeyPrefix + knownUUID)
+	assert.False(t, ok)
+	assert.False(t, mr.Exists(redisDependantsPrefix+knownUUID), "the dependants should expire with the entries")
+}
+
+func TestRedisCacheInvalidation(t *testing.T) {
+	mock := &countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}
+	cache, _ := newTestRedisCache(t)
+	driver := NewCachedDriver(mock, cache)
+
+	_, found, err := driver.findContentRelations(leadUUID)
+	require.NoError(t, err)
+	require.True(t, found)
+	_, _, err = driver.findContentRelations(leadUUID)
+	require.NoError(t, err)
+	assert.Equal(t, 1, mock.contentReads)
+
+	NewCacheInvalidator(cache, mock, logger.NewUPPLogger("test", "PANIC")).HandleCollectionEvent(CollectionEvent{UUID: collectionUUID})
+	_, _, err = driver.findContentRelations(leadUUID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, mock.contentReads, "entries built from the published collection should be dropped")
+}
+
+func TestRedisCacheCircuitBreaker(t *testing.T) {
+	mock := &countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}
+	cache, mr := newTestRedisCache(t)
+	now := time.Now()
+	cache.breaker.now = func() time.Time { return now }
+	driver := NewCachedDriver(mock, cache)
+
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	failures, skipped := redisFailures.Count(), redisSkipped.Count()
+	for i := 0; i < 4; i++ {
+		_, found, err := driver.findContentRelations(leadUUID)
+		require.NoError(t, err, "Redis failures should fall through to Neo4j")
+		assert.True(t, found)
+	}
+	assert.Equal(t, 4, mock.contentReads)
+	assert.Equal(t, failures+2, redisFailures.Count(), "the breaker should open after the get and the set of the first lookup failed")
+	assert.Equal(t, skipped+6, redisSkipped.Count())
+
+	mr.SetError("")
+	_, _, err := driver.findContentRelations(leadUUID)
+	require.NoError(t, err)
+	assert.Equal(t, skipped+8, redisSkipped.Count(), "Redis should not be tried before the cooldown")
+
+	now = now.Add(2 * time.Minute)
+	_, _, err = driver.findContentRelations(leadUUID)
+	require.NoError(t, err)
+	_, _, err = driver.findContentRelations(leadUUID)
+	require.NoError(t, err)
+	assert.Equal(t, 6, mock.contentReads, "the lookups should be cached again once Redis recovered")
+}
+
+func TestRedisCacheInvalidatesSeveralUUIDs(t *testing.T) {
+	cache, mr := newTestRedisCache(t)
+	cache.set(cacheEntry{key: contentCacheKeyPrefix + knownUUID, found: true, dependencies: []string{knownUUID, collectionUUID}})
+	cache.set(cacheEntry{key: contentCacheKeyPrefix + leadUUID, found: true, dependencies: []string{leadUUID}})
+	cache.set(cacheEntry{key: contentCacheKeyPrefix + otherUUID, found: true, dependencies: []string{otherUUID}})
+
+	dropped, err := cache.invalidate(collectionUUID, leadUUID, item1UUID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, dropped)
+	assert.False(t, mr.Exists(redisDependantsPrefix+collectionUUID))
+	_, ok := cache.get(contentCacheKeyPrefix + otherUUID)
+	assert.True(t, ok, "entries built from other UUIDs should be kept")
+}
+
+func TestRedisCacheInvalidationFailuresKeepTheBreakerClosed(t *testing.T) {
+	cache, mr := newTestRedisCache(t)
+	cache.set(cacheEntry{key: contentCacheKeyPrefix + knownUUID, found: true, dependencies: []string{knownUUID}})
+
+	mr.SetError("LOADING Redis is loading the dataset in memory")
+	for i := 0; i < 3; i++ {
+		_, err := cache.invalidate(knownUUID)
+		assert.Error(t, err)
+	}
+	mr.SetError("")
+	_, ok := cache.get(contentCacheKeyPrefix + knownUUID)
+	assert.True(t, ok, "failed invalidations should not open the circuit breaker of the lookups")
+
+	now := time.Now()
+	cache.breaker.now = func() time.Time { return now }
+	cache.breaker.record(errors.New("lookup failed"))
+	cache.breaker.record(errors.New("lookup failed"))
+	skipped := redisInvalidationsSkipped.Count()
+	_, err := cache.invalidate(knownUUID, leadUUID)
+	assert.ErrorIs(t, err, errCircuitOpen)
+	assert.Equal(t, skipped+2, redisInvalidationsSkipped.Count())
+}
@@ -0,0 +1,238 @@
+package relations
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/service-status-go/gtg"
+)
+
+type schemaRequirement struct {
+	label    string
+	property string
+	unique   bool
+}
+
+// requiredSchema are the labels the lookups match by uuid, which need a uniqueness constraint to be fast
+var requiredSchema = []schemaRequirement{
+	{"Content", "uuid", true},
+	{"Curation", "uuid", true},
+	{"ContentCollection", "uuid", true},
+	{"ContentPackage", "uuid", true},
+}
+
+// recentCollectionsSchema are the indexes the cache warm-up lists the recently modified collections from
+var recentCollectionsSchema = []schemaRequirement{
+	{"Curation", "lastModified", false},
+	{"ContentCollection", "lastModified", false},
+}
+
+// SchemaRequirement is the state of the index of a label property and, when
+// it must be unique, of its uniqueness constraint.
+type SchemaRequirement struct {
+	Label    string `json:"label"`
+	Property string `json:"property"`
+	// Unique tells whether a uniqueness constraint is required on top of the index
+	Unique     bool `json:"unique"`
+	Constraint bool `json:"uniquenessConstraint"`
+	// IndexState is the state of the index on the property, e.g. ONLINE or POPULATING, empty when missing
+	IndexState string `json:"indexState,omitempty"`
+}
+
+func (r SchemaRequirement) present() bool {
+	return (r.Constraint || !r.Unique) && r.IndexState == "ONLINE"
+}
+
+func (r SchemaRequirement) String() string {
+	var missing []string
+	if r.Unique && !r.Constraint {
+		missing = append(missing, "uniqueness constraint")
+	}
+	if r.IndexState == "" {
+		missing = append(missing, "index")
+	} else if r.IndexState != "ONLINE" {
+		missing = append(missing, "online index (currently "+r.IndexState+")")
+	}
+	return fmt.Sprintf(":%s(%s) has no %s", r.Label, r.Property, strings.Join(missing, " nor "))
+}
+
+// SchemaReport is the outcome of the last schema verification.
+type SchemaReport struct {
+	CheckedAt    time.Time           `json:"checkedAt"`
+	Requirements []SchemaRequirement `json:"requirements"`
+	Missing      int                 `json:"missing"`
+	Error        string              `json:"error,omitempty"`
+}
+
+// SchemaVerifier checks that the constraints and indexes the lookups rely on exist in Neo4j.
+type SchemaVerifier struct {
+	driver       NeoDriver
+	requirements []schemaRequirement
+	mu           sync.RWMutex
+	report       *SchemaReport
+	log          *logger.UPPLogger
+}
+
+// NewSchemaVerifier creates a verifier, which reports nothing until Verify is called.
+func NewSchemaVerifier(driver NeoDriver, log *logger.UPPLogger) *SchemaVerifier {
+	return &SchemaVerifier{driver: driver, requirements: requiredSchema, log: log}
+}
+
+// WithRecentCollectionsIndexes also requires the lastModified indexes the
+// cache warm-up lists the recently modified collections from.
+func (v *SchemaVerifier) WithRecentCollectionsIndexes() *SchemaVerifier {
+	v.requirements = append(append([]schemaRequirement{}, v.requirements...), recentCollectionsSchema...)
+	return v
+}
+
+type schemaEntry struct {
+	LabelsOrTypes []string `json:"labelsOrTypes"`
+	Properties    []string `json:"properties"`
+	Type          string   `json:"type"`
+	State         string   `json:"state"`
+}
+
+func (e schemaEntry) covers(label, property string) bool {
+	return len(e.LabelsOrTypes) == 1 && e.LabelsOrTypes[0] == label && len(e.Properties) == 1 && e.Properties[0] == property
+}
+
+// Verify inspects the constraints and indexes of Neo4j and records the report.
+func (v *SchemaVerifier) Verify() SchemaReport {
+	report := SchemaReport{CheckedAt: time.Now(), Requirements: []SchemaRequirement{}}
+
+	// The queries are run separately, as the driver stops executing queries after one that returns no results
+	var constraints, indexes []schemaEntry
+	err := v.driver.Read(&cmneo4j.Query{
+		Cypher: "SHOW CONSTRAINTS YIELD labelsOrTypes, properties, type",
+		Result: &constraints,
+	})
+	if err == nil || errors.Is(err, cmneo4j.ErrNoResultsFound) {
+		err = v.driver.Read(&cmneo4j.Query{
+			Cypher: "SHOW INDEXES YIELD labelsOrTypes, properties, state",
+			Result: &indexes,
+		})
+	}
+	if err != nil && !errors.Is(err, cmneo4j.ErrNoResultsFound) {
+		report.Error = fmt.Sprintf("Error inspecting the Neo4j schema, err=%v", err)
+		v.record(report)
+		return report
+	}
+
+	for _, required := range v.requirements {
+		requirement := SchemaRequirement{Label: required.label, Property: required.property, Unique: required.unique}
+		for _, c := range constraints {
+			if c.covers(required.label, required.property) && (c.Type == "UNIQUENESS" || c.Type == "NODE_KEY") {
+				requirement.Constraint = true
+			}
+		}
+		for _, i := range indexes {
+			if i.covers(required.label, required.property) {
+				requirement.IndexState = i.State
+			}
+		}
+		if !requirement.present() {
+			report.Missing++
+		}
+		report.Requirements = append(report.Requirements, requirement)
+	}
+	v.record(report)
+	return report
+}
+
+func (v *SchemaVerifier) record(report SchemaReport) {
+	v.mu.Lock()
+	previous := v.report
+	v.report = &report
+	v.mu.Unlock()
+
+	if report.Error != "" {
+		return
+	}
+	if report.Missing > 0 && (previous == nil || previous.Missing != report.Missing) {
+		for _, r := range report.Requirements {
+			if !r.present() {
+				v.log.Warnf("Neo4j schema is incomplete, %v", r)
+			}
+		}
+	} else if report.Missing == 0 && previous != nil && previous.Missing > 0 {
+		v.log.Info("Neo4j schema is complete")
+	}
+}
+
+// Report returns the last report, if any.
+func (v *SchemaVerifier) Report() (SchemaReport, bool) {
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if v.report == nil {
+		return SchemaReport{}, false
+	}
+	return *v.report, true
+}
+
+// HealthCheck verifies the schema every time it runs.
+func (v *SchemaVerifier) HealthCheck() fthealth.Check {
+	return fthealth.Check{
+		BusinessImpact:   "Relations API responses may be slow",
+		Name:             "Check the Neo4j schema",
+		PanicGuide:       "https://runbooks.in.ft.com/upp-relations-api",
+		Severity:         2,
+		TechnicalSummary: "Uniqueness constraints on uuid are missing for labels matched by the lookups, see /__schema. Check the schema of Neo4j was created by the writers",
+		Checker: func() (string, error) {
+			return v.Verify().outcome()
+		},
+	}
+}
+
+func (r SchemaReport) outcome() (string, error) {
+	if r.Error != "" {
+		return "Error inspecting the Neo4j schema", errors.New(r.Error)
+	}
+	var missing []string
+	for _, requirement := range r.Requirements {
+		if !requirement.present() {
+			missing = append(missing, requirement.String())
+		}
+	}
+	if len(missing) > 0 {
+		return "Neo4j schema is incomplete", errors.New(strings.Join(missing, "; "))
+	}
+	return "Neo4j schema is complete", nil
+}
+
+// GTG reports the service not good to go until the last verification found the schema complete.
+func (v *SchemaVerifier) GTG() gtg.Status {
+	report, ok := v.Report()
+	if !ok {
+		return gtg.Status{GoodToGo: false, Message: "The Neo4j schema has not been verified yet"}
+	}
+	if _, err := report.outcome(); err != nil {
+		return gtg.Status{GoodToGo: false, Message: err.Error()}
+	}
+	return gtg.Status{GoodToGo: true}
+}
+
+// ServeReport writes the last report, verifying the schema when it was never verified.
+func (v *SchemaVerifier) ServeReport(w http.ResponseWriter, r *http.Request) {
+	report, ok := v.Report()
+	if !ok {
+		report = v.Verify()
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.Header().Set("Cache-Control", "no-store")
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusInternalServerError,
+			problem: problemEncoding,
+			detail:  "Error encoding the Neo4j schema report",
+		})
+	}
+}
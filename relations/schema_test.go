@@ -0,0 +1,155 @@
+package relations
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// schemaDriverMock answers the schema queries with the JSON rows of the command they start with.
+type schemaDriverMock struct {
+	rows map[string]string
+	err  error
+}
+
+func (m *schemaDriverMock) Read(queries ...*cmneo4j.Query) error {
+	if m.err != nil {
+		return m.err
+	}
+	for _, q := range queries {
+		for command, rows := range m.rows {
+			if strings.HasPrefix(q.Cypher, command) {
+				if err := json.Unmarshal([]byte(rows), q.Result); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (m *schemaDriverMock) VerifyWriteConnectivity() error { return nil }
+
+func (m *schemaDriverMock) Close() error { return nil }
+
+const completeConstraints = `[
+	{"labelsOrTypes": ["Content"], "properties": ["uuid"], "type": "UNIQUENESS"},
+	{"labelsOrTypes": ["Curation"], "properties": ["uuid"], "type": "UNIQUENESS"},
+	{"labelsOrTypes": ["ContentCollection"], "properties": ["uuid"], "type": "UNIQUENESS"},
+	{"labelsOrTypes": ["ContentPackage"], "properties": ["uuid"], "type": "NODE_KEY"},
+	{"labelsOrTypes": ["Thing"], "properties": ["uuid"], "type": "UNIQUENESS"}
+]`
+
+const completeIndexes = `[
+	{"labelsOrTypes": ["Content"], "properties": ["uuid"], "state": "ONLINE"},
+	{"labelsOrTypes": ["Curation"], "properties": ["uuid"], "state": "ONLINE"},
+	{"labelsOrTypes": ["ContentCollection"], "properties": ["uuid"], "state": "ONLINE"},
+	{"labelsOrTypes": ["ContentPackage"], "properties": ["uuid"], "state": "ONLINE"}
+]`
+
+func TestSchemaVerifierComplete(t *testing.T) {
+	verifier := NewSchemaVerifier(&schemaDriverMock{rows: map[string]string{
+		"SHOW CONSTRAINTS": completeConstraints,
+		"SHOW INDEXES":     completeIndexes,
+	}}, logger.NewUPPLogger("test", "PANIC"))
+
+	assert.False(t, verifier.GTG().GoodToGo, "the schema should not be GTG before it is verified")
+
+	report := verifier.Verify()
+	assert.Empty(t, report.Error)
+	assert.Equal(t, 0, report.Missing)
+	assert.Len(t, report.Requirements, 4)
+	assert.True(t, verifier.GTG().GoodToGo)
+
+	_, err := verifier.HealthCheck().Checker()
+	assert.NoError(t, err)
+}
+
+func TestSchemaVerifierMissing(t *testing.T) {
+	verifier := NewSchemaVerifier(&schemaDriverMock{rows: map[string]string{
+		"SHOW CONSTRAINTS": `[
+			{"labelsOrTypes": ["Content"], "properties": ["uuid"], "type": "UNIQUENESS"},
+			{"labelsOrTypes": ["Curation"], "properties": ["uuid"], "type": "UNIQUENESS"},
+			{"labelsOrTypes": ["ContentCollection"], "properties": ["uuid"], "type": "UNIQUENESS"},
+			{"labelsOrTypes": ["ContentPackage"], "properties": ["uuid", "publishReference"], "type": "NODE_KEY"}
+		]`,
+		"SHOW INDEXES": `[
+			{"labelsOrTypes": ["Content"], "properties": ["uuid"], "state": "ONLINE"},
+			{"labelsOrTypes": ["Curation"], "properties": ["uuid"], "state": "POPULATING"},
+			{"labelsOrTypes": ["ContentCollection"], "properties": ["uuid"], "state": "ONLINE"}
+		]`,
+	}}, logger.NewUPPLogger("test", "PANIC"))
+
+	report := verifier.Verify()
+	assert.Equal(t, 2, report.Missing)
+
+	_, err := verifier.HealthCheck().Checker()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ":Curation(uuid) has no online index (currently POPULATING)")
+	assert.Contains(t, err.Error(), ":ContentPackage(uuid) has no uniqueness constraint nor index")
+	assert.False(t, verifier.GTG().GoodToGo)
+}
+
+func TestSchemaVerifierRecentCollectionsIndexes(t *testing.T) {
+	verifier := NewSchemaVerifier(&schemaDriverMock{rows: map[string]string{
+		"SHOW CONSTRAINTS": completeConstraints,
+		"SHOW INDEXES": `[
+			{"labelsOrTypes": ["Content"], "properties": ["uuid"], "state": "ONLINE"},
+			{"labelsOrTypes": ["Curation"], "properties": ["uuid"], "state": "ONLINE"},
+			{"labelsOrTypes": ["ContentCollection"], "properties": ["uuid"], "state": "ONLINE"},
+			{"labelsOrTypes": ["ContentPackage"], "properties": ["uuid"], "state": "ONLINE"},
+			{"labelsOrTypes": ["Curation"], "properties": ["lastModified"], "state": "ONLINE"}
+		]`,
+	}}, logger.NewUPPLogger("test", "PANIC")).WithRecentCollectionsIndexes()
+
+	report := verifier.Verify()
+	assert.Equal(t, 1, report.Missing, "the lastModified indexes need no uniqueness constraint")
+
+	_, err := verifier.HealthCheck().Checker()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), ":ContentCollection(lastModified) has no index")
+	assert.NotContains(t, err.Error(), ":ContentCollection(lastModified) has no uniqueness constraint")
+}
+
+func TestSchemaVerifierNoSchema(t *testing.T) {
+	verifier := NewSchemaVerifier(&schemaDriverMock{err: cmneo4j.ErrNoResultsFound}, logger.NewUPPLogger("test", "PANIC"))
+
+	report := verifier.Verify()
+	assert.Empty(t, report.Error)
+	assert.Equal(t, 4, report.Missing)
+}
+
+func TestSchemaVerifierError(t *testing.T) {
+	verifier := NewSchemaVerifier(&schemaDriverMock{err: errors.New("connection refused")}, logger.NewUPPLogger("test", "PANIC"))
+
+	report := verifier.Verify()
+	assert.NotEmpty(t, report.Error)
+	_, err := verifier.HealthCheck().Checker()
+	assert.Error(t, err)
+	assert.False(t, verifier.GTG().GoodToGo)
+}
+
+func TestSchemaReportEndpoint(t *testing.T) {
+	verifier := NewSchemaVerifier(&schemaDriverMock{rows: map[string]string{
+		"SHOW CONSTRAINTS": completeConstraints,
+		"SHOW INDEXES":     completeIndexes,
+	}}, logger.NewUPPLogger("test", "PANIC"))
+
+	rec := httptest.NewRecorder()
+	verifier.ServeReport(rec, httptest.NewRequest("GET", "/__schema", nil))
+
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	var report SchemaReport
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&report))
+	assert.Equal(t, 0, report.Missing)
+	assert.Equal(t, SchemaRequirement{Label: "Content", Property: "uuid", Unique: true, Constraint: true, IndexState: "ONLINE"}, report.Requirements[0])
+}
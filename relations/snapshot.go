@@ -0,0 +1,295 @@
+package relations
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"time"
+
+	fthealth "github.com/Financial-Times/go-fthealth/v1_1"
+)
+
+// SnapshotVersion is the version of the snapshot files written, files of
+// other versions are refused.
+const SnapshotVersion = 1
+
+// snapshotHeader is the first line of a snapshot file.
+type snapshotHeader struct {
+	Version   int       `json:"version"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+// snapshotRecord is a line of a snapshot file, either a content, stored as a
+// cache entry, or a content collection.
+type snapshotRecord struct {
+	UUID       string              `json:"uuid"`
+	Content    json.RawMessage     `json:"content,omitempty"`
+	Collection *snapshotCollection `json:"collection,omitempty"`
+}
+
+type snapshotCollection struct {
+	Found     bool        `json:"found"`
+	Relations ccRelations `json:"relations"`
+	Leads     []string    `json:"leads,omitempty"`
+}
+
+// SnapshotStats summarises a snapshot.
+type SnapshotStats struct {
+	CreatedAt   time.Time
+	Content     int
+	Collections int
+}
+
+// WriteSnapshot writes the relations of every related content listed by the
+// source, batchSize at a time, and of their collections to w, as gzipped
+// lines of JSON after a versioned header.
+func WriteSnapshot(ctx context.Context, source Driver, w io.Writer, batchSize int) (SnapshotStats, error) {
+	stats := SnapshotStats{CreatedAt: time.Now().UTC()}
+	if batchSize < 1 {
+		return stats, fmt.Errorf("the snapshot batch size must be at least 1, got %d", batchSize)
+	}
+	gz := gzip.NewWriter(w)
+	enc := json.NewEncoder(gz)
+	if err := enc.Encode(snapshotHeader{Version: SnapshotVersion, CreatedAt: stats.CreatedAt}); err != nil {
+		return stats, err
+	}
+
+	collectionUUIDs := map[string]bool{}
+	for after := ""; ; {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		uuids, err := source.findRelatedContentUUIDs(after, batchSize)
+		if err != nil {
+			return stats, err
+		}
+		if len(uuids) == 0 {
+			break
+		}
+		for _, u := range uuids {
+			rel, found, err := source.findContentRelations(u)
+			if err != nil {
+				return stats, err
+			}
+			if !found {
+				continue
+			}
+			data, err := encodeStoredEntry(cacheEntry{key: contentCacheKeyPrefix + u, contentRel: rel, found: true})
+			if err != nil {
+				return stats, err
+			}
+			if err := enc.Encode(snapshotRecord{UUID: u, Content: data}); err != nil {
+				return stats, err
+			}
+			stats.Content++
+			for _, cc := range rel.collectionUUIDs {
+				collectionUUIDs[cc] = true
+			}
+		}
+		after = uuids[len(uuids)-1]
+	}
+
+	sorted := make([]string, 0, len(collectionUUIDs))
+	for cc := range collectionUUIDs {
+		sorted = append(sorted, cc)
+	}
+	sort.Strings(sorted)
+	for _, cc := range sorted {
+		if err := ctx.Err(); err != nil {
+			return stats, err
+		}
+		rel, found, err := source.findContentCollectionRelations(cc)
+		if err != nil {
+			return stats, err
+		}
+		leads, err := source.findContentCollectionLeads(cc)
+		if err != nil {
+			return stats, err
+		}
+		if err := enc.Encode(snapshotRecord{UUID: cc, Collection: &snapshotCollection{Found: found, Relations: rel, Leads: leads}}); err != nil {
+			return stats, err
+		}
+		stats.Collections++
+	}
+	return stats, gz.Close()
+}
+
+// CreateSnapshot writes the snapshot of the source to a new file, which then
+// replaces the file of the path, so that a failed snapshot never overwrites
+// a good one. A snapshot without content never replaces an existing file.
+func CreateSnapshot(ctx context.Context, source Driver, path string, batchSize int) (SnapshotStats, error) {
+	tmpPath := path + ".tmp"
+	f, err := os.Create(tmpPath)
+	if err != nil {
+		return SnapshotStats{}, err
+	}
+	w := bufio.NewWriter(f)
+	stats, err := WriteSnapshot(ctx, source, w, batchSize)
+	if err == nil {
+		err = w.Flush()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil && stats.Content == 0 {
+		if _, statErr := os.Stat(path); statErr == nil {
+			err = fmt.Errorf("the source listed no content, refusing to replace the snapshot %s", path)
+		}
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return stats, err
+	}
+	return stats, os.Rename(tmpPath, path)
+}
+
+// Snapshot holds the relations of a snapshot file in memory.
+type Snapshot struct {
+	createdAt   time.Time
+	content     map[string]relations
+	uuids       []string
+	collections map[string]snapshotCollection
+	now         func() time.Time
+}
+
+// ReadSnapshot reads a snapshot written by WriteSnapshot.
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	gz, err := gzip.NewReader(r)
+	if err != nil {
+		return nil, fmt.Errorf("not a snapshot: %w", err)
+	}
+	defer gz.Close()
+	dec := json.NewDecoder(gz)
+
+	var header snapshotHeader
+	if err := dec.Decode(&header); err != nil {
+		return nil, fmt.Errorf("not a snapshot: %w", err)
+	}
+	if header.Version != SnapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d, expected %d", header.Version, SnapshotVersion)
+	}
+
+	s := &Snapshot{
+		createdAt:   header.CreatedAt,
+		content:     map[string]relations{},
+		collections: map[string]snapshotCollection{},
+		now:         time.Now,
+	}
+	for {
+		var record snapshotRecord
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("corrupt snapshot after %d content and %d collections: %w", len(s.content), len(s.collections), err)
+		}
+		switch {
+		case record.Content != nil:
+			entry, err := decodeStoredEntry(contentCacheKeyPrefix+record.UUID, record.Content)
+			if err != nil {
+				return nil, fmt.Errorf("corrupt snapshot content uuid=%s: %w", record.UUID, err)
+			}
+			s.content[record.UUID] = entry.contentRel
+			s.uuids = append(s.uuids, record.UUID)
+		case record.Collection != nil:
+			s.collections[record.UUID] = *record.Collection
+		}
+	}
+	sort.Strings(s.uuids)
+	return s, nil
+}
+
+// OpenSnapshot reads the snapshot file of the path.
+func OpenSnapshot(path string) (*Snapshot, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ReadSnapshot(bufio.NewReader(f))
+}
+
+// Stats summarises the snapshot.
+func (s *Snapshot) Stats() SnapshotStats {
+	return SnapshotStats{CreatedAt: s.createdAt, Content: len(s.content), Collections: len(s.collections)}
+}
+
+// HealthCheck reports the age of the snapshot, and fails once it is older
+// than maxAge, unless maxAge is 0.
+func (s *Snapshot) HealthCheck(maxAge time.Duration) fthealth.Check {
+	return fthealth.Check{
+		BusinessImpact:   "Relations served are not up to date with the latest publishes",
+		Name:             "Check the age of the snapshot",
+		PanicGuide:       "https://runbooks.in.ft.com/upp-relations-api",
+		Severity:         2,
+		TechnicalSummary: "The relations are served from a snapshot file instead of Neo4j. Create a new snapshot with the snapshot create command and restart the service",
+		Checker:          s.checkAge(maxAge),
+	}
+}
+
+func (s *Snapshot) checkAge(maxAge time.Duration) func() (string, error) {
+	return func() (string, error) {
+		age := s.now().Sub(s.createdAt).Truncate(time.Second)
+		msg := fmt.Sprintf("Serving the snapshot created at %s, %v ago", s.createdAt.Format(time.RFC3339), age)
+		if maxAge > 0 && age > maxAge {
+			return msg, fmt.Errorf("the snapshot is older than %v", maxAge)
+		}
+		return msg, nil
+	}
+}
+
+type snapshotDriver struct {
+	snapshot *Snapshot
+}
+
+// NewSnapshotDriver creates a driver serving the relations from the snapshot,
+// without any store to connect to.
+func NewSnapshotDriver(snapshot *Snapshot) Driver {
+	return &snapshotDriver{snapshot: snapshot}
+}
+
+func (sd *snapshotDriver) findContentRelations(contentUUID string) (relations, bool, error) {
+	rel, found := sd.snapshot.content[contentUUID]
+	return rel, found, nil
+}
+
+func (sd *snapshotDriver) findContentCollectionRelations(contentCollectionUUID string) (ccRelations, bool, error) {
+	collection := sd.snapshot.collections[contentCollectionUUID]
+	return collection.Relations, collection.Found, nil
+}
+
+func (sd *snapshotDriver) findContentCollectionLeads(contentCollectionUUID string) ([]string, error) {
+	leads := sd.snapshot.collections[contentCollectionUUID].Leads
+	if leads == nil {
+		return []string{}, nil
+	}
+	return leads, nil
+}
+
+func (sd *snapshotDriver) findRelatedContentUUIDs(afterUUID string, limit int) ([]string, error) {
+	uuids := sd.snapshot.uuids
+	i := sort.SearchStrings(uuids, afterUUID)
+	if i < len(uuids) && uuids[i] == afterUUID {
+		i++
+	}
+	end := i + limit
+	if end > len(uuids) {
+		end = len(uuids)
+	}
+	return append([]string{}, uuids[i:end]...), nil
+}
+
+func (sd *snapshotDriver) checkConnectivity() error {
+	return nil
+}
+
+func (sd *snapshotDriver) checkReadConnectivity() error {
+	return nil
+}
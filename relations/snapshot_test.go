@@ -0,0 +1,115 @@
+package relations
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// snapshotConformanceStore snapshots the relations written to SQLite
+// whenever its driver is taken.
+type snapshotConformanceStore struct {
+	sqlConformanceStore
+	t *testing.T
+}
+
+func newSnapshotConformanceStore(t *testing.T) conformanceStore {
+	return snapshotConformanceStore{sqlConformanceStore: newSQLiteConformanceStore(t).(sqlConformanceStore), t: t}
+}
+
+func (s snapshotConformanceStore) driver() Driver {
+	var buf bytes.Buffer
+	_, err := WriteSnapshot(context.Background(), s.sqlConformanceStore.driver(), &buf, 2)
+	require.NoError(s.t, err)
+	snapshot, err := ReadSnapshot(&buf)
+	require.NoError(s.t, err)
+	return NewSnapshotDriver(snapshot)
+}
+
+func TestCreateSnapshot(t *testing.T) {
+	source := newSQLiteConformanceStore(t).(sqlConformanceStore)
+	source.writeContent(t, []payloadData{leadContentSP, leadContentCP, relatedContent1, relatedContent2, relatedContent3})
+	source.writeContentCollection(t, []payloadData{storyPackage}, "StoryPackage")
+	source.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+
+	path := filepath.Join(t.TempDir(), "relations.snapshot")
+	require.NoError(t, os.WriteFile(path, []byte("previous"), 0644))
+	stats, err := CreateSnapshot(context.Background(), source.driver(), path, 2)
+	require.NoError(t, err)
+	assert.Equal(t, 4, stats.Content)
+	assert.Equal(t, 2, stats.Collections)
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "the new snapshot should replace the previous one")
+
+	snapshot, err := OpenSnapshot(path)
+	require.NoError(t, err)
+	assert.Equal(t, stats, snapshot.Stats())
+
+	driver := NewSnapshotDriver(snapshot)
+	rel, found, err := driver.findContentRelations(leadContentSP.uuid)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Len(t, rel.CuratedRelatedContents, 4)
+	assert.Equal(t, []string{storyPackage.uuid}, rel.collectionUUIDs)
+	ccRel, found, err := driver.findContentCollectionRelations(contentPackage.uuid)
+	require.NoError(t, err)
+	require.True(t, found)
+	assert.Equal(t, leadContentCP.uuid, ccRel.ContainedIn)
+}
+
+func TestCreateSnapshotKeepsThePreviousOne(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "relations.snapshot")
+	require.NoError(t, os.WriteFile(path, []byte("previous"), 0644))
+
+	source := newSQLiteConformanceStore(t).(sqlConformanceStore)
+	source.writeContent(t, []payloadData{leadContentCP, relatedContent1})
+	source.writeContentCollection(t, []payloadData{contentPackage}, "ContentPackage")
+	_, err := CreateSnapshot(context.Background(), source.driver(), path, 0)
+	assert.Error(t, err, "an empty batch should be refused")
+
+	empty := newSQLiteConformanceStore(t).(sqlConformanceStore)
+	stats, err := CreateSnapshot(context.Background(), empty.driver(), path, 2)
+	assert.Error(t, err, "a snapshot without content should not replace the previous one")
+	assert.Equal(t, 0, stats.Content)
+
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "previous", string(data))
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "the refused snapshot should be removed")
+}
+
+func TestReadSnapshotRefusesOtherVersions(t *testing.T) {
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	_, err := gz.Write([]byte(`{"version":2,"createdAt":"2024-01-01T00:00:00Z"}` + "\n"))
+	require.NoError(t, err)
+	require.NoError(t, gz.Close())
+
+	_, err = ReadSnapshot(&buf)
+	assert.EqualError(t, err, "unsupported snapshot version 2, expected 1")
+
+	_, err = ReadSnapshot(bytes.NewBufferString("not gzipped"))
+	assert.Error(t, err)
+}
+
+func TestSnapshotHealthCheckReportsAge(t *testing.T) {
+	createdAt := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	snapshot := &Snapshot{createdAt: createdAt, now: func() time.Time { return createdAt.Add(90 * time.Minute) }}
+
+	msg, err := snapshot.HealthCheck(0).Checker()
+	assert.NoError(t, err, "the snapshot should never be too old without a maximum age")
+	assert.Equal(t, "Serving the snapshot created at 2024-01-01T00:00:00Z, 1h30m0s ago", msg)
+
+	_, err = snapshot.HealthCheck(2 * time.Hour).Checker()
+	assert.NoError(t, err)
+	_, err = snapshot.HealthCheck(time.Hour).Checker()
+	assert.EqualError(t, err, "the snapshot is older than 1h0m0s")
+}
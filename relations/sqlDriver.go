@@ -0,0 +1,285 @@
+package relations
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// SQLSchema creates the adjacency tables the SQL driver reads, when missing.
+// It runs unchanged on SQLite and Postgres. A curation is curated for its
+// lead content and selects items, a collection is contained by its lead
+// content package and contains items; items which are not in content are
+// returned as unresolved, like the Things never written as Content in Neo4j.
+const SQLSchema = `
+CREATE TABLE IF NOT EXISTS content (
+    uuid VARCHAR(36) PRIMARY KEY
+);
+CREATE TABLE IF NOT EXISTS curations (
+    uuid        VARCHAR(36) PRIMARY KEY,
+    curated_for VARCHAR(36)
+);
+CREATE INDEX IF NOT EXISTS curations_curated_for ON curations (curated_for);
+CREATE TABLE IF NOT EXISTS curation_selects (
+    curation_uuid VARCHAR(36) NOT NULL,
+    item_uuid     VARCHAR(36) NOT NULL,
+    item_order    INTEGER NOT NULL,
+    PRIMARY KEY (curation_uuid, item_uuid)
+);
+CREATE TABLE IF NOT EXISTS collections (
+    uuid         VARCHAR(36) PRIMARY KEY,
+    package_uuid VARCHAR(36)
+);
+CREATE INDEX IF NOT EXISTS collections_package_uuid ON collections (package_uuid);
+CREATE TABLE IF NOT EXISTS collection_contains (
+    collection_uuid VARCHAR(36) NOT NULL,
+    item_uuid       VARCHAR(36) NOT NULL,
+    item_order      INTEGER NOT NULL,
+    PRIMARY KEY (collection_uuid, item_uuid)
+);
+CREATE INDEX IF NOT EXISTS collection_contains_item_uuid ON collection_contains (item_uuid);
+`
+
+type sqlDriver struct {
+	db *sql.DB
+}
+
+// NewSQLDriver creates a driver reading the relations from the SQLSchema tables.
+func NewSQLDriver(db *sql.DB) Driver {
+	return &sqlDriver{db: db}
+}
+
+// InitialiseSQLSchema creates the SQLSchema tables missing from the database.
+func InitialiseSQLSchema(db *sql.DB) error {
+	_, err := db.Exec(SQLSchema)
+	return err
+}
+
+// sqlRelatedContent is a collection and one of its items, if any, as read
+// from the adjacency tables.
+type sqlRelatedContent struct {
+	collectionUUID string
+	uuid           sql.NullString
+	resolved       bool
+}
+
+func (sd *sqlDriver) findContentRelations(contentUUID string) (relations, bool, error) {
+	// The items are left joined, so that the collections of the content are
+	// returned even when they have no items
+	crc, err := sd.queryRelatedContent(`
+            SELECT cu.uuid, s.item_uuid, i.uuid IS NOT NULL
+            FROM content c
+            JOIN curations cu ON cu.curated_for = c.uuid
+            LEFT JOIN curation_selects s ON s.curation_uuid = cu.uuid
+            LEFT JOIN content i ON i.uuid = s.item_uuid
+            WHERE c.uuid = $1
+            ORDER BY s.item_order
+            `, contentUUID)
+	if err != nil {
+		return relations{}, false, fmt.Errorf("Error querying SQL for uuid=%s, err=%v", contentUUID, err)
+	}
+
+	cpContains, err := sd.queryRelatedContent(`
+            SELECT cc.uuid, s.item_uuid, i.uuid IS NOT NULL
+            FROM collections cc
+            LEFT JOIN collection_contains s ON s.collection_uuid = cc.uuid
+            LEFT JOIN content i ON i.uuid = s.item_uuid
+            WHERE cc.package_uuid = $1
+            ORDER BY s.item_order
+            `, contentUUID)
+	if err != nil {
+		return relations{}, false, fmt.Errorf("Error querying SQL for uuid=%s, err=%v", contentUUID, err)
+	}
+
+	cpContainedIn, err := sd.queryRelatedContent(`
+            SELECT cc.uuid, cc.package_uuid, cc.package_uuid IS NOT NULL
+            FROM content c
+            JOIN collection_contains s ON s.item_uuid = c.uuid
+            JOIN collections cc ON cc.uuid = s.collection_uuid
+            WHERE c.uuid = $1
+            ORDER BY s.item_order, cc.uuid
+            `, contentUUID)
+	if err != nil {
+		return relations{}, false, fmt.Errorf("Error querying SQL for uuid=%s, err=%v", contentUUID, err)
+	}
+
+	crcUUIDs, crcUnresolved, crcCollections := splitSQLRelatedContent(crc)
+	containsUUIDs, containsUnresolved, containsCollections := splitSQLRelatedContent(cpContains)
+	containedInUUIDs, _, containedInCollections := splitSQLRelatedContent(cpContainedIn)
+	found := len(crcUUIDs) != 0 || len(containsUUIDs) != 0 || len(containedInUUIDs) != 0
+
+	mappedCRC := transformToRelatedContent(crcUUIDs)
+	mappedCPC := transformToRelatedContent(containsUUIDs)
+	flagUnresolved(mappedCRC, crcUUIDs, crcUnresolved)
+	flagUnresolved(mappedCPC, containsUUIDs, containsUnresolved)
+	danglingReferenceLookups.Inc(int64(len(crcUnresolved) + len(containsUnresolved)))
+	relations := relations{
+		CuratedRelatedContents: mappedCRC,
+		Contains:               mappedCPC,
+		ContainedIn:            transformToRelatedContent(containedInUUIDs),
+		collectionUUIDs:        mergeUUIDs(crcCollections, containsCollections, containedInCollections),
+	}
+
+	return relations, found, nil
+}
+
+func (sd *sqlDriver) findContentCollectionRelations(contentCollectionUUID string) (ccRelations, bool, error) {
+	containedIn, err := sd.queryUUIDs(`
+            SELECT package_uuid FROM collections
+            WHERE uuid = $1 AND package_uuid IS NOT NULL
+            `, contentCollectionUUID)
+	if err != nil {
+		return ccRelations{}, false, fmt.Errorf("Error querying SQL for uuid=%s, err=%v", contentCollectionUUID, err)
+	}
+
+	contains, err := sd.queryItems(`
+            SELECT s.item_uuid, i.uuid IS NOT NULL
+            FROM collection_contains s
+            LEFT JOIN content i ON i.uuid = s.item_uuid
+            WHERE s.collection_uuid = $1
+            ORDER BY s.item_order
+            `, contentCollectionUUID)
+	if err != nil {
+		return ccRelations{}, false, fmt.Errorf("Error querying SQL for uuid=%s, err=%v", contentCollectionUUID, err)
+	}
+
+	found := len(containedIn) != 0
+	var mappedContainedIn string
+	if found {
+		mappedContainedIn = containedIn[0]
+	}
+	mappedContains, unresolvedContains := transformContainsToCCRelations(contains)
+	danglingReferenceLookups.Inc(int64(len(unresolvedContains)))
+	ccRelations := ccRelations{mappedContainedIn, mappedContains, unresolvedContains}
+
+	return ccRelations, found, nil
+}
+
+func (sd *sqlDriver) findContentCollectionLeads(contentCollectionUUID string) ([]string, error) {
+	// A story package is curated for its lead content, a content package
+	// collection is contained by its lead content
+	leads, err := sd.queryUUIDs(`
+            SELECT c.uuid FROM curations cu
+            JOIN content c ON c.uuid = cu.curated_for
+            WHERE cu.uuid = $1
+            UNION
+            SELECT package_uuid FROM collections
+            WHERE uuid = $1 AND package_uuid IS NOT NULL
+            `, contentCollectionUUID)
+	if err != nil {
+		return nil, fmt.Errorf("Error querying SQL for uuid=%s, err=%v", contentCollectionUUID, err)
+	}
+	return leads, nil
+}
+
+func (sd *sqlDriver) findRelatedContentUUIDs(afterUUID string, limit int) ([]string, error) {
+	// Each side walks its primary key or index in order from afterUUID and
+	// stops after limit rows, instead of sorting every related UUID per page
+	uuids, err := sd.queryUUIDs(`
+            SELECT uuid FROM (
+                SELECT uuid FROM (
+                    SELECT c.uuid AS uuid FROM content c
+                    WHERE c.uuid > $1
+                    AND (EXISTS (SELECT 1 FROM curations cu WHERE cu.curated_for = c.uuid)
+                        OR EXISTS (SELECT 1 FROM collection_contains s
+                            JOIN collections cc ON cc.uuid = s.collection_uuid
+                            WHERE s.item_uuid = c.uuid AND cc.package_uuid IS NOT NULL))
+                    ORDER BY c.uuid
+                    LIMIT $2
+                ) related_content
+                UNION
+                SELECT uuid FROM (
+                    SELECT DISTINCT package_uuid AS uuid FROM collections
+                    WHERE package_uuid > $1
+                    ORDER BY package_uuid
+                    LIMIT $2
+                ) related_packages
+            ) related
+            ORDER BY uuid
+            LIMIT $2
+            `, afterUUID, limit)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing related content after uuid=%s, err=%v", afterUUID, err)
+	}
+	return uuids, nil
+}
+
+func (sd *sqlDriver) checkConnectivity() error {
+	return sd.db.Ping()
+}
+
+func (sd *sqlDriver) checkReadConnectivity() error {
+	var ok int
+	return sd.db.QueryRow("SELECT 1").Scan(&ok)
+}
+
+func (sd *sqlDriver) queryRelatedContent(query string, args ...interface{}) ([]sqlRelatedContent, error) {
+	rows, err := sd.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var related []sqlRelatedContent
+	for rows.Next() {
+		var r sqlRelatedContent
+		if err := rows.Scan(&r.collectionUUID, &r.uuid, &r.resolved); err != nil {
+			return nil, err
+		}
+		related = append(related, r)
+	}
+	return related, rows.Err()
+}
+
+// queryItems reads the items of a collection and whether they are content.
+func (sd *sqlDriver) queryItems(query string, args ...interface{}) ([]neoRelatedContent, error) {
+	rows, err := sd.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var items []neoRelatedContent
+	for rows.Next() {
+		var item neoRelatedContent
+		if err := rows.Scan(&item.UUID, &item.Resolved); err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, rows.Err()
+}
+
+func (sd *sqlDriver) queryUUIDs(query string, args ...interface{}) ([]string, error) {
+	rows, err := sd.db.Query(query, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	uuids := []string{}
+	for rows.Next() {
+		var u string
+		if err := rows.Scan(&u); err != nil {
+			return nil, err
+		}
+		uuids = append(uuids, u)
+	}
+	return uuids, rows.Err()
+}
+
+// splitSQLRelatedContent returns the items in order, the unresolved ones and
+// the distinct collections they were read from.
+func splitSQLRelatedContent(related []sqlRelatedContent) (uuids, unresolved, collectionUUIDs []string) {
+	var collections []string
+	for _, r := range related {
+		collections = append(collections, r.collectionUUID)
+		if !r.uuid.Valid {
+			continue
+		}
+		uuids = append(uuids, r.uuid.String)
+		if !r.resolved {
+			unresolved = append(unresolved, r.uuid.String)
+		}
+	}
+	return uuids, unresolved, mergeUUIDs(collections)
+}
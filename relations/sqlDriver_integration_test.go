@@ -0,0 +1,40 @@
+//go:build integration
+// +build integration
+
+package relations
+
+import (
+	"database/sql"
+	"os"
+	"testing"
+
+	_ "github.com/jackc/pgx/v5/stdlib"
+	"github.com/stretchr/testify/require"
+)
+
+func init() {
+	conformanceStores["postgres"] = newPostgresConformanceStore
+}
+
+// newPostgresConformanceStore empties the SQLSchema tables of the database of
+// POSTGRES_TEST_URL after each scenario, which must be a database of its own.
+func newPostgresConformanceStore(t *testing.T) conformanceStore {
+	if testing.Short() {
+		t.Skip("Short flag is set. Skipping integration test")
+	}
+	url := os.Getenv("POSTGRES_TEST_URL")
+	if url == "" {
+		t.Skip("POSTGRES_TEST_URL is not set. Skipping Postgres integration test")
+	}
+	db, err := sql.Open("pgx", url)
+	require.NoError(t, err)
+	require.NoError(t, InitialiseSQLSchema(db))
+	t.Cleanup(func() {
+		for _, table := range []string{"content", "curations", "curation_selects", "collections", "collection_contains"} {
+			_, err := db.Exec("DELETE FROM " + table)
+			require.NoError(t, err)
+		}
+		db.Close()
+	})
+	return sqlConformanceStore{db: db}
+}
@@ -0,0 +1,179 @@
+package relations
+
+import (
+	"container/list"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+var (
+	// staleResponses counts the lookups that failed and were answered with a stale copy
+	staleResponses = metrics.GetOrRegisterCounter("relations.stale_responses", metrics.DefaultRegistry)
+	// staleMisses counts the lookups that failed without a stale copy recent enough to answer them
+	staleMisses = metrics.GetOrRegisterCounter("relations.stale_misses", metrics.DefaultRegistry)
+)
+
+// StaleStore is a bounded LRU store of the last relations found for each
+// content and content collection, answering lookups while Neo4j fails.
+// Unlike the Cache, its entries are never invalidated, they are only served
+// on errors and for no longer than the maximum staleness. The relations are
+// recorded by the driver returned by NewStaleRecordingDriver, as they are
+// loaded from the store, so that the age of a stale copy is never reset by
+// cache hits.
+type StaleStore struct {
+	mu           sync.Mutex
+	maxEntries   int
+	maxStaleness time.Duration
+	entries      map[string]*list.Element
+	lru          *list.List
+	now          func() time.Time
+}
+
+type staleEntry struct {
+	key        string
+	contentRel relations
+	ccRel      ccRelations
+	storedAt   time.Time
+}
+
+// staleness describes a stale response, nil for fresh ones.
+type staleness struct {
+	age time.Duration
+}
+
+// NewStaleStore creates a store of at most maxEntries relations, served for up to maxStaleness.
+func NewStaleStore(maxEntries int, maxStaleness time.Duration) *StaleStore {
+	return &StaleStore{
+		maxEntries:   maxEntries,
+		maxStaleness: maxStaleness,
+		entries:      map[string]*list.Element{},
+		lru:          list.New(),
+		now:          time.Now,
+	}
+}
+
+func (s *StaleStore) get(key string) (staleEntry, time.Duration, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	el, ok := s.entries[key]
+	if !ok {
+		return staleEntry{}, 0, false
+	}
+	entry := el.Value.(*staleEntry)
+	age := s.now().Sub(entry.storedAt)
+	if age > s.maxStaleness {
+		s.lru.Remove(el)
+		delete(s.entries, key)
+		return staleEntry{}, 0, false
+	}
+	s.lru.MoveToFront(el)
+	return *entry, age, true
+}
+
+func (s *StaleStore) set(entry staleEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[entry.key]; ok {
+		s.lru.Remove(el)
+	}
+	entry.storedAt = s.now()
+	s.entries[entry.key] = s.lru.PushFront(&entry)
+	for s.lru.Len() > s.maxEntries {
+		oldest := s.lru.Remove(s.lru.Back()).(*staleEntry)
+		delete(s.entries, oldest.key)
+	}
+}
+
+func (s *StaleStore) delete(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if el, ok := s.entries[key]; ok {
+		s.lru.Remove(el)
+		delete(s.entries, key)
+	}
+}
+
+// contentRelations replaces the error of a failed lookup with the last
+// relations found, if recent enough.
+func (s *StaleStore) contentRelations(contentUUID string, rel relations, found bool, err error) (relations, bool, *staleness, error) {
+	if s == nil || err == nil {
+		return rel, found, nil, err
+	}
+	entry, age, ok := s.get(contentCacheKeyPrefix + contentUUID)
+	if !ok {
+		staleMisses.Inc(1)
+		return rel, found, nil, err
+	}
+	staleResponses.Inc(1)
+	return entry.contentRel, true, &staleness{age: age}, nil
+}
+
+// contentCollectionRelations is contentRelations for content collections.
+func (s *StaleStore) contentCollectionRelations(contentCollectionUUID string, rel ccRelations, found bool, err error) (ccRelations, bool, *staleness, error) {
+	if s == nil || err == nil {
+		return rel, found, nil, err
+	}
+	entry, age, ok := s.get(contentCollectionCacheKeyPrefix + contentCollectionUUID)
+	if !ok {
+		staleMisses.Inc(1)
+		return rel, found, nil, err
+	}
+	staleResponses.Inc(1)
+	return entry.ccRel, true, &staleness{age: age}, nil
+}
+
+type staleRecordingDriver struct {
+	Driver
+	store *StaleStore
+}
+
+// NewStaleRecordingDriver wraps the given driver so that the relations it
+// finds are recorded in the store, to be served stale once lookups fail. It
+// goes beneath the cache, which would otherwise record cached relations as
+// fresh. Content without relations is not recorded, as it would evict the
+// content with relations, which is the minority. Its last relations are
+// dropped instead, so that relations since removed are never served again.
+func NewStaleRecordingDriver(driver Driver, store *StaleStore) Driver {
+	return &staleRecordingDriver{Driver: driver, store: store}
+}
+
+func (sd *staleRecordingDriver) findContentRelations(contentUUID string) (relations, bool, error) {
+	rel, found, err := sd.Driver.findContentRelations(contentUUID)
+	if err == nil {
+		sd.store.record(contentCacheKeyPrefix+contentUUID, found, staleEntry{contentRel: rel})
+	}
+	return rel, found, err
+}
+
+func (sd *staleRecordingDriver) findContentCollectionRelations(contentCollectionUUID string) (ccRelations, bool, error) {
+	rel, found, err := sd.Driver.findContentCollectionRelations(contentCollectionUUID)
+	if err == nil {
+		sd.store.record(contentCollectionCacheKeyPrefix+contentCollectionUUID, found, staleEntry{ccRel: rel})
+	}
+	return rel, found, err
+}
+
+func (s *StaleStore) record(key string, found bool, entry staleEntry) {
+	if !found {
+		s.delete(key)
+		return
+	}
+	entry.key = key
+	s.set(entry)
+}
+
+// setHeaders flags the response as stale, as RFC 7234 asks of caches serving stale responses.
+func (st *staleness) setHeaders(w http.ResponseWriter) {
+	if st == nil {
+		return
+	}
+	w.Header().Set("Warning", `110 - "Response is Stale"`)
+	w.Header().Set("Age", strconv.Itoa(int(st.age/time.Second)))
+}
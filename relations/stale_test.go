@@ -0,0 +1,157 @@
+package relations
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+func newStaleTestRouter(driver Driver, store *StaleStore) *mux.Router {
+	hh := NewHttpHandlers(NewStaleRecordingDriver(driver, store), testURLs, "max-age=30, public").WithErrorCacheControl("", "max-age=5, public").WithStaleIfError(store)
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+	r.HandleFunc("/contentcollection/{uuid}/relations", hh.GetContentCollectionRelations).Methods("GET")
+	return r
+}
+
+func TestStaleIfError(t *testing.T) {
+	now := time.Now()
+	store := NewStaleStore(10, time.Hour)
+	store.now = func() time.Time { return now }
+	driver := &cypherDriverMock{contentUUID: knownUUID}
+	r := newStaleTestRouter(driver, store)
+
+	for _, path := range []string{"/content/%s/relations", "/contentcollection/%s/relations"} {
+		t.Run(path, func(t *testing.T) {
+			driver.failRead = false
+			rec := httptest.NewRecorder()
+			r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf(path, knownUUID), nil))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Empty(t, rec.Header().Get("Warning"))
+			fresh := rec.Body.String()
+
+			driver.failRead = true
+			now = now.Add(90 * time.Second)
+			served := staleResponses.Count()
+			rec = httptest.NewRecorder()
+			r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf(path, knownUUID), nil))
+			assert.Equal(t, http.StatusOK, rec.Code)
+			assert.Equal(t, fresh, rec.Body.String())
+			assert.Equal(t, `110 - "Response is Stale"`, rec.Header().Get("Warning"))
+			assert.Equal(t, "90", rec.Header().Get("Age"))
+			assert.Equal(t, "max-age=5, public", rec.Header().Get("Cache-Control"), "stale responses should be cached as briefly as errors")
+			assert.Equal(t, "max-age=0", rec.Header().Get("Surrogate-Control"), "the CDN should not keep stale responses")
+			assert.Equal(t, served+1, staleResponses.Count())
+
+			now = now.Add(time.Hour)
+			misses := staleMisses.Count()
+			rec = httptest.NewRecorder()
+			r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf(path, knownUUID), nil))
+			assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "copies older than the maximum staleness should not be served")
+			assert.Equal(t, misses+1, staleMisses.Count())
+		})
+	}
+}
+
+func TestStaleIfErrorAgeSinceLoaded(t *testing.T) {
+	now := time.Now()
+	store := NewStaleStore(10, time.Hour)
+	store.now = func() time.Time { return now }
+	driver := &cypherDriverMock{contentUUID: knownUUID}
+	cache := NewCache(10, time.Hour)
+	hh := NewHttpHandlers(NewCachedDriver(NewStaleRecordingDriver(driver, store), cache), testURLs, "max-age=30, public").WithStaleIfError(store)
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// served from the cache, the relations are not loaded again
+	now = now.Add(60 * time.Second)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	cache.Invalidate(knownUUID)
+	driver.failRead = true
+	now = now.Add(30 * time.Second)
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "90", rec.Header().Get("Age"), "the age should count from when the relations were loaded, not cached")
+}
+
+func TestStaleIfErrorNotFoundNotStored(t *testing.T) {
+	driver := &cypherDriverMock{contentUUID: knownUUID}
+	r := newStaleTestRouter(driver, NewStaleStore(10, time.Hour))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", otherUUID), nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	driver.failRead = true
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", otherUUID), nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+}
+
+func TestStaleIfErrorWithoutErrorCaching(t *testing.T) {
+	driver := &cypherDriverMock{contentUUID: knownUUID}
+	store := NewStaleStore(10, time.Hour)
+	hh := NewHttpHandlers(NewStaleRecordingDriver(driver, store), testURLs, "max-age=30, public").WithStaleIfError(store).WithSurrogateControl("max-age=3600")
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+	assert.Equal(t, "max-age=3600", rec.Header().Get("Surrogate-Control"))
+
+	driver.failRead = true
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, "no-store", rec.Header().Get("Cache-Control"))
+	assert.Equal(t, "max-age=0", rec.Header().Get("Surrogate-Control"))
+}
+
+func TestStaleIfErrorForgetsRemovedRelations(t *testing.T) {
+	driver := &cypherDriverMock{contentUUID: knownUUID}
+	r := newStaleTestRouter(driver, NewStaleStore(10, time.Hour))
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	// the relations are removed, then Neo4j fails
+	driver.contentUUID = otherUUID
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+
+	driver.failRead = true
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, newRequest("GET", fmt.Sprintf("/content/%s/relations", knownUUID), nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code, "relations since removed should not be served stale")
+}
+
+func TestStaleStoreEvictsLeastRecentlyUsed(t *testing.T) {
+	store := NewStaleStore(2, time.Hour)
+	store.set(staleEntry{key: "content/a"})
+	store.set(staleEntry{key: "content/b"})
+	_, _, ok := store.get("content/a")
+	assert.True(t, ok)
+	store.set(staleEntry{key: "content/c"})
+
+	_, _, ok = store.get("content/b")
+	assert.False(t, ok)
+	_, _, ok = store.get("content/a")
+	assert.True(t, ok)
+	_, _, ok = store.get("content/c")
+	assert.True(t, ok)
+}
@@ -0,0 +1,169 @@
+package relations
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const (
+	// idFormatLegacy and idFormatBoth are the values of the idFormat query parameter selecting legacy thing IDs
+	idFormatLegacy = "legacy"
+	idFormatBoth   = "both"
+)
+
+// PublicURLs builds the URLs of the responses. The API base URL is the
+// configured public API URL, unless the request was forwarded for one of the
+// allowed hosts. Thing IDs use the configured thing URL, or the legacy one
+// when requested while migrating between the two.
+type PublicURLs struct {
+	defaultAPIURL  string
+	thingURL       string
+	legacyThingURL string
+	allowedHosts   map[string]bool
+}
+
+// NewPublicURLs validates the public API URL, in the format scheme://host, the
+// thing URLs the IDs are built from, the legacy one being optional, and the
+// hosts X-Forwarded-Host is trusted for.
+func NewPublicURLs(publicAPIURL, thingURL, legacyThingURL string, allowedHosts []string) (*PublicURLs, error) {
+	if _, err := url.ParseRequestURI(publicAPIURL); err != nil {
+		return nil, err
+	}
+	thingURL, err := validThingURL(thingURL)
+	if err != nil {
+		return nil, err
+	}
+	if legacyThingURL != "" {
+		if legacyThingURL, err = validThingURL(legacyThingURL); err != nil {
+			return nil, err
+		}
+	}
+
+	urls := &PublicURLs{
+		defaultAPIURL:  strings.TrimRight(publicAPIURL, "/"),
+		thingURL:       thingURL,
+		legacyThingURL: legacyThingURL,
+		allowedHosts:   map[string]bool{},
+	}
+	for _, host := range allowedHosts {
+		host = strings.ToLower(strings.TrimSpace(host))
+		if host == "" {
+			continue
+		}
+		if strings.ContainsAny(host, "/?#@") {
+			return nil, errors.New("Invalid allowed API host " + host + ", expected a host with an optional port")
+		}
+		urls.allowedHosts[host] = true
+	}
+	return urls, nil
+}
+
+// validThingURL checks the thing URL is an absolute http or https URL and ends it with a slash.
+func validThingURL(thingURL string) (string, error) {
+	u, err := url.ParseRequestURI(thingURL)
+	if err != nil {
+		return "", err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" || u.Host == "" || u.RawQuery != "" {
+		return "", errors.New("Invalid thing URL " + thingURL + ", expected an absolute http or https URL without query")
+	}
+	return strings.TrimRight(thingURL, "/") + "/", nil
+}
+
+// defaults returns the URL builder used outside of requests.
+func (p *PublicURLs) defaults() urlBuilder {
+	return urlBuilder{apiBaseURL: p.defaultAPIURL, thingURL: p.thingURL}
+}
+
+// forRequest returns the URL builder for the API host the request was
+// forwarded for when it is allowed, otherwise the default one, with the thing
+// IDs in the format requested by the idFormat parameter. An unknown format, or
+// legacy IDs without a legacy thing URL configured, is an error.
+func (p *PublicURLs) forRequest(r *http.Request) (urlBuilder, error) {
+	b := p.defaults()
+	switch idFormat := r.URL.Query().Get("idFormat"); idFormat {
+	case "":
+	case idFormatLegacy, idFormatBoth:
+		if p.legacyThingURL == "" {
+			return urlBuilder{}, fmt.Errorf("the idFormat %q is not available, no legacy thing URL is configured", idFormat)
+		}
+		if idFormat == idFormatLegacy {
+			b.thingURL = p.legacyThingURL
+		} else {
+			b.legacyThingURL = p.legacyThingURL
+		}
+	default:
+		return urlBuilder{}, fmt.Errorf("the idFormat %q is not one of %q or %q", idFormat, idFormatLegacy, idFormatBoth)
+	}
+
+	// the first forwarded host is the one the client called
+	host, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Host"), ",")
+	host = strings.ToLower(strings.TrimSpace(host))
+	if host == "" || !p.allowedHosts[host] {
+		return b, nil
+	}
+
+	scheme, _, _ := strings.Cut(r.Header.Get("X-Forwarded-Proto"), ",")
+	scheme = strings.ToLower(strings.TrimSpace(scheme))
+	if scheme != "http" && scheme != "https" {
+		scheme, _, _ = strings.Cut(p.defaultAPIURL, "://")
+	}
+	b.apiBaseURL = scheme + "://" + host
+	return b, nil
+}
+
+// setVary tells caches that the URLs of the response depend on the forwarded host.
+func (p *PublicURLs) setVary(w http.ResponseWriter) {
+	if len(p.allowedHosts) > 0 {
+		w.Header().Add("Vary", "X-Forwarded-Host, X-Forwarded-Proto")
+	}
+}
+
+// urlBuilder builds the URLs of a single response.
+type urlBuilder struct {
+	apiBaseURL string
+	thingURL   string
+	// legacyThingURL is set when legacy IDs are sent along the current ones
+	legacyThingURL string
+}
+
+func (b urlBuilder) thingIDURL(uuid string) string {
+	return b.thingURL + uuid
+}
+
+// legacyThingIDURL returns the legacy ID of the thing, empty unless requested.
+func (b urlBuilder) legacyThingIDURL(uuid string) string {
+	if b.legacyThingURL == "" {
+		return ""
+	}
+	return b.legacyThingURL + uuid
+}
+
+func (b urlBuilder) apiURL(uuid string) string {
+	return b.apiBaseURL + "/content/" + uuid
+}
+
+// relations returns a copy of the relations with the URLs of every related content set.
+func (b urlBuilder) relations(rel relations) relations {
+	rel.CuratedRelatedContents = b.relatedContent(rel.CuratedRelatedContents)
+	rel.Contains = b.relatedContent(rel.Contains)
+	rel.ContainedIn = b.relatedContent(rel.ContainedIn)
+	return rel
+}
+
+func (b urlBuilder) relatedContent(related []relatedContent) []relatedContent {
+	if related == nil {
+		return nil
+	}
+	rendered := make([]relatedContent, 0, len(related))
+	for _, rc := range related {
+		rc.ID = b.thingIDURL(rc.uuid)
+		rc.LegacyID = b.legacyThingIDURL(rc.uuid)
+		rc.APIURL = b.apiURL(rc.uuid)
+		rendered = append(rendered, rc)
+	}
+	return rendered
+}
@@ -0,0 +1,162 @@
+package relations
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testURLs, _ = NewPublicURLs(publicAPIURL, "http://api.ft.com/things/", "", nil)
+
+func TestNewPublicURLsValidation(t *testing.T) {
+	_, err := NewPublicURLs("", "http://api.ft.com/things/", "", nil)
+	assert.Error(t, err)
+	_, err = NewPublicURLs("http://api.ft.com", "http://api.ft.com/things/", "", []string{"api.ft.com/content"})
+	assert.Error(t, err)
+	_, err = NewPublicURLs("http://api.ft.com/", "http://api.ft.com/things/", "", []string{"api-t.ft.com", " ", "localhost:8080"})
+	assert.NoError(t, err)
+}
+
+func TestPublicURLsForRequest(t *testing.T) {
+	urls, err := NewPublicURLs("https://api.ft.com/", "http://api.ft.com/things/", "", []string{"api-t.ft.com", "API-Dev.ft.com"})
+	require.NoError(t, err)
+
+	tests := []struct {
+		name           string
+		forwardedHost  string
+		forwardedProto string
+		expected       string
+	}{
+		{"NotForwarded", "", "", "https://api.ft.com"},
+		{"AllowedHost", "api-t.ft.com", "http", "http://api-t.ft.com"},
+		{"AllowedHostDefaultScheme", "api-dev.ft.com", "", "https://api-dev.ft.com"},
+		{"InvalidScheme", "api-t.ft.com", "javascript", "https://api-t.ft.com"},
+		{"FirstForwardedHost", "api-t.ft.com, internal:8080", "https, http", "https://api-t.ft.com"},
+		{"UnknownHost", "evil.example.com", "https", "https://api.ft.com"},
+		{"UnknownFirstHost", "evil.example.com, api-t.ft.com", "https", "https://api.ft.com"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/content/"+knownUUID+"/relations", nil)
+		if test.forwardedHost != "" {
+			req.Header.Set("X-Forwarded-Host", test.forwardedHost)
+		}
+		if test.forwardedProto != "" {
+			req.Header.Set("X-Forwarded-Proto", test.forwardedProto)
+		}
+		b, err := urls.forRequest(req)
+		require.NoError(t, err, test.name)
+		assert.Equal(t, test.expected+"/content/"+knownUUID, b.apiURL(knownUUID), test.name)
+	}
+}
+
+func TestGetContentRelationsForwardedHost(t *testing.T) {
+	urls, err := NewPublicURLs("http://api.ft.com", "http://api.ft.com/things/", "", []string{"api-t.ft.com"})
+	require.NoError(t, err)
+	hh := NewHttpHandlers(&cypherDriverMock{contentUUID: knownUUID}, urls, "")
+
+	req := newRequest("GET", "/content/"+knownUUID+"/relations", nil)
+	req.Header.Set("X-Forwarded-Host", "api-t.ft.com")
+	req.Header.Set("X-Forwarded-Proto", "https")
+	rec := httptest.NewRecorder()
+	r := mux.NewRouter()
+	r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+	r.ServeHTTP(rec, req)
+
+	assert.Equal(t, "X-Forwarded-Host, X-Forwarded-Proto", rec.Header().Get("Vary"))
+	assert.Contains(t, rec.Body.String(), `"apiUrl":"https://api-t.ft.com/content/`+knownUUID+`"`)
+	assert.Contains(t, rec.Body.String(), `"id":"http://api.ft.com/things/`+knownUUID+`"`)
+}
+
+func TestThingURLValidation(t *testing.T) {
+	urls, err := NewPublicURLs(publicAPIURL, "https://www.ft.com/thing", "", nil)
+	require.NoError(t, err)
+	assert.Equal(t, "https://www.ft.com/thing/"+knownUUID, urls.defaults().thingIDURL(knownUUID))
+
+	for _, invalid := range []string{"", "things/", "ftp://api.ft.com/things/", "http:///things/", "http://api.ft.com/things/?a=b"} {
+		_, err = NewPublicURLs(publicAPIURL, invalid, "", nil)
+		assert.Error(t, err, invalid)
+		_, err = NewPublicURLs(publicAPIURL, "https://www.ft.com/thing/", invalid+"x", nil)
+		assert.Error(t, err, invalid)
+	}
+}
+
+func TestPublicURLsIDFormat(t *testing.T) {
+	migrating, err := NewPublicURLs(publicAPIURL, "https://www.ft.com/thing/", "http://api.ft.com/things/", nil)
+	require.NoError(t, err)
+	related := []relatedContent{{uuid: knownUUID}}
+
+	tests := []struct {
+		name     string
+		urls     *PublicURLs
+		idFormat string
+		id       string
+		legacyID string
+	}{
+		{"Default", migrating, "", "https://www.ft.com/thing/" + knownUUID, ""},
+		{"Legacy", migrating, "legacy", "http://api.ft.com/things/" + knownUUID, ""},
+		{"Both", migrating, "both", "https://www.ft.com/thing/" + knownUUID, "http://api.ft.com/things/" + knownUUID},
+		{"NotMigrating", testURLs, "", "http://api.ft.com/things/" + knownUUID, ""},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/content/"+knownUUID+"/relations?idFormat="+test.idFormat, nil)
+		b, err := test.urls.forRequest(req)
+		require.NoError(t, err, test.name)
+		rendered := b.relatedContent(related)
+		assert.Equal(t, test.id, rendered[0].ID, test.name)
+		assert.Equal(t, test.legacyID, rendered[0].LegacyID, test.name)
+	}
+}
+
+func TestPublicURLsInvalidIDFormat(t *testing.T) {
+	migrating, err := NewPublicURLs(publicAPIURL, "https://www.ft.com/thing/", "http://api.ft.com/things/", nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		urls     *PublicURLs
+		idFormat string
+	}{
+		{"Unknown", migrating, "other"},
+		{"LegacyNotMigrating", testURLs, "legacy"},
+		{"BothNotMigrating", testURLs, "both"},
+	}
+
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/content/"+knownUUID+"/relations?idFormat="+test.idFormat, nil)
+		_, err := test.urls.forRequest(req)
+		assert.Error(t, err, test.name)
+	}
+}
+
+func TestGetContentRelationsInvalidIDFormat(t *testing.T) {
+	migrating, err := NewPublicURLs(publicAPIURL, "https://www.ft.com/thing/", "http://api.ft.com/things/", nil)
+	require.NoError(t, err)
+
+	tests := []struct {
+		name     string
+		urls     *PublicURLs
+		idFormat string
+	}{
+		{"Unknown", migrating, "other"},
+		{"LegacyNotMigrating", testURLs, "legacy"},
+	}
+
+	for _, test := range tests {
+		hh := NewHttpHandlers(&cypherDriverMock{contentUUID: knownUUID}, test.urls, "")
+		req := newRequest("GET", "/content/"+knownUUID+"/relations?idFormat="+test.idFormat, nil)
+		req.Header.Set("Accept", problemContentType)
+		rec := httptest.NewRecorder()
+		r := mux.NewRouter()
+		r.HandleFunc("/content/{uuid}/relations", hh.GetContentRelations).Methods("GET")
+		r.ServeHTTP(rec, req)
+
+		assert.Equal(t, http.StatusBadRequest, rec.Code, test.name)
+		assert.Contains(t, rec.Body.String(), "problem:invalid-parameter", test.name)
+	}
+}
@@ -1,19 +1,10 @@
 package relations
 
-import (
-	"strings"
-)
-
-const thingURL = "http://api.ft.com/things/"
-
-func transformToRelatedContent(uuids []string, publicAPIURL string) []relatedContent {
+// transformToRelatedContent maps the UUIDs to related content, their URLs are set when the response is rendered.
+func transformToRelatedContent(uuids []string) []relatedContent {
 	mappedRelatedContent := []relatedContent{}
 	for _, u := range uuids {
-		c := relatedContent{
-			APIURL: apiURL(u, publicAPIURL),
-			ID:     thingIDURL(u),
-		}
-		mappedRelatedContent = append(mappedRelatedContent, c)
+		mappedRelatedContent = append(mappedRelatedContent, relatedContent{uuid: u})
 	}
 
 	return mappedRelatedContent
@@ -27,18 +18,45 @@ func transformContainedInToCCRelations(containedIn []neoRelatedContent) string {
 	return leadArticleUuid
 }
 
-func transformContainsToCCRelations(neoRelatedContent []neoRelatedContent) []string {
-	var contains []string
+func transformContainsToCCRelations(neoRelatedContent []neoRelatedContent) (contains []string, unresolved []string) {
 	for _, neoContent := range neoRelatedContent {
-		contains = append(contains, neoContent.UUID)
+		if neoContent.Resolved {
+			contains = append(contains, neoContent.UUID)
+		} else {
+			unresolved = append(unresolved, neoContent.UUID)
+		}
+	}
+	return contains, unresolved
+}
+
+func flagUnresolved(related []relatedContent, uuids []string, unresolvedUUIDs []string) {
+	unresolved := map[string]bool{}
+	for _, u := range unresolvedUUIDs {
+		unresolved[u] = true
+	}
+	for i, u := range uuids {
+		related[i].Unresolved = unresolved[u]
 	}
-	return contains
 }
 
-func thingIDURL(uuid string) string {
-	return thingURL + uuid
+func mergeUUIDs(lists ...[]string) []string {
+	seen := map[string]bool{}
+	var merged []string
+	for _, list := range lists {
+		for _, u := range list {
+			if !seen[u] {
+				seen[u] = true
+				merged = append(merged, u)
+			}
+		}
+	}
+	return merged
 }
 
-func apiURL(uuid, baseURL string) string {
-	return strings.TrimRight(baseURL, "/") + "/content/" + uuid
+func neoUUIDs(neoRelatedContent []neoRelatedContent) []string {
+	uuids := make([]string, 0, len(neoRelatedContent))
+	for _, neoContent := range neoRelatedContent {
+		uuids = append(uuids, neoContent.UUID)
+	}
+	return uuids
 }
@@ -13,27 +13,43 @@ var givenNeoRelatedContent []string = []string{
 }
 
 var expectedRelatedContent []relatedContent = []relatedContent{
-	{ID: "http://api.ft.com/things/db90a9db-6cb6-4ba0-8648-c0676087aba2", APIURL: "http://api.ft.com/content/db90a9db-6cb6-4ba0-8648-c0676087aba2"},
-	{ID: "http://api.ft.com/things/f78c1482-abab-413e-b753-ca3ce3cb84f0", APIURL: "http://api.ft.com/content/f78c1482-abab-413e-b753-ca3ce3cb84f0"},
+	{ID: "http://api.ft.com/things/db90a9db-6cb6-4ba0-8648-c0676087aba2", APIURL: "http://api.ft.com/content/db90a9db-6cb6-4ba0-8648-c0676087aba2", uuid: "db90a9db-6cb6-4ba0-8648-c0676087aba2"},
+	{ID: "http://api.ft.com/things/f78c1482-abab-413e-b753-ca3ce3cb84f0", APIURL: "http://api.ft.com/content/f78c1482-abab-413e-b753-ca3ce3cb84f0", uuid: "f78c1482-abab-413e-b753-ca3ce3cb84f0"},
 }
 
 var publicAPIURL = "http://api.ft.com"
 
 func TestTransformToRelatedContentHappyFlow(t *testing.T) {
-	relatedContent := transformToRelatedContent(givenNeoRelatedContent, publicAPIURL)
+	relatedContent := testURLs.defaults().relatedContent(transformToRelatedContent(givenNeoRelatedContent))
 
-	expected, _ := json.Marshal(expectedRelatedContent)
-	actual, _ := json.Marshal(relatedContent)
-	assert.JSONEq(t, string(expected), string(actual))
+	assert.Equal(t, expectedRelatedContent, relatedContent)
 }
 
 func TestTransformToRelatedContentNoRelations(t *testing.T) {
 	givenNeoRelatedContent := []string{}
 	expectedRelatedContent := []string{}
 
-	relatedContent := transformToRelatedContent(givenNeoRelatedContent, publicAPIURL)
+	relatedContent := testURLs.defaults().relatedContent(transformToRelatedContent(givenNeoRelatedContent))
 
 	expected, _ := json.Marshal(expectedRelatedContent)
 	actual, _ := json.Marshal(relatedContent)
 	assert.JSONEq(t, string(expected), string(actual))
 }
+
+func TestTransformContainsToCCRelationsSplitsUnresolved(t *testing.T) {
+	contains, unresolved := transformContainsToCCRelations([]neoRelatedContent{
+		{UUID: "db90a9db-6cb6-4ba0-8648-c0676087aba2", Resolved: true},
+		{UUID: "f78c1482-abab-413e-b753-ca3ce3cb84f0"},
+	})
+
+	assert.Equal(t, []string{"db90a9db-6cb6-4ba0-8648-c0676087aba2"}, contains)
+	assert.Equal(t, []string{"f78c1482-abab-413e-b753-ca3ce3cb84f0"}, unresolved)
+}
+
+func TestFlagUnresolved(t *testing.T) {
+	related := transformToRelatedContent(givenNeoRelatedContent)
+	flagUnresolved(related, givenNeoRelatedContent, []string{"f78c1482-abab-413e-b753-ca3ce3cb84f0"})
+
+	assert.False(t, related[0].Unresolved)
+	assert.True(t, related[1].Unresolved)
+}
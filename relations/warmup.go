@@ -0,0 +1,203 @@
+package relations
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/Financial-Times/service-status-go/gtg"
+)
+
+type WarmupConfig struct {
+	// RecentCollections is the number of most recently modified collections whose relations are preloaded
+	RecentCollections int
+	// Concurrency is the number of lookups run at a time
+	Concurrency int
+	// Timeout is the longest the warm-up may hold back GTG, lookups still pending are then skipped
+	Timeout time.Duration
+}
+
+// CacheWarmer preloads the cache behind the driver before the service reports
+// GTG, so the first requests after a deploy do not all go to Neo4j.
+type CacheWarmer struct {
+	driver       Driver
+	neo          NeoDriver
+	contentUUIDs []string
+	config       WarmupConfig
+	log          *logger.UPPLogger
+	mu           sync.Mutex
+	done         bool
+}
+
+// NewCacheWarmer creates a warmer looking up the given content and the
+// content of the most recently modified collections through the cached driver.
+func NewCacheWarmer(driver Driver, neo NeoDriver, contentUUIDs []string, config WarmupConfig, log *logger.UPPLogger) *CacheWarmer {
+	return &CacheWarmer{driver: driver, neo: neo, contentUUIDs: contentUUIDs, config: config, log: log}
+}
+
+// ReadWarmupUUIDs reads one content UUID per line, skipping blank lines and lines starting with #.
+func ReadWarmupUUIDs(r io.Reader) ([]string, error) {
+	var uuids []string
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		u := strings.TrimSpace(scanner.Text())
+		if u == "" || strings.HasPrefix(u, "#") {
+			continue
+		}
+		if err := validateUuid(u); err != nil {
+			return nil, fmt.Errorf("Invalid uuid on line %d, err=%v", line, err)
+		}
+		uuids = append(uuids, u)
+	}
+	return uuids, scanner.Err()
+}
+
+// Start warms the cache up, returning once done or after the timeout, when
+// the lookups still running finish in the background.
+func (cw *CacheWarmer) Start(ctx context.Context) {
+	defer cw.finish()
+	ctx, cancel := context.WithTimeout(ctx, cw.config.Timeout)
+	defer cancel()
+
+	start := time.Now()
+	warmed := make(chan int, 1)
+	go func() {
+		warmed <- cw.warm(ctx)
+	}()
+
+	select {
+	case n := <-warmed:
+		cw.log.WithField("duration", time.Since(start).String()).Infof("Warmed the cache up with the relations of %d content and content collections", n)
+	case <-ctx.Done():
+		cw.log.WithField("timeout", cw.config.Timeout.String()).Warn("Cache warm-up timed out, the remaining relations will be looked up on request")
+	}
+}
+
+func (cw *CacheWarmer) warm(ctx context.Context) int {
+	var collections []string
+	if cw.config.RecentCollections > 0 {
+		var err error
+		if collections, err = cw.recentCollections(); err != nil {
+			cw.log.WithError(err).Warn("Failed to list the recently modified collections to warm the cache up with")
+		}
+	}
+
+	var mu sync.Mutex
+	contentUUIDs := append([]string{}, cw.contentUUIDs...)
+	cw.parallel(ctx, collections, func(u string) error {
+		rel, _, err := cw.driver.findContentCollectionRelations(u)
+		if err != nil {
+			return err
+		}
+		leads, err := cw.driver.findContentCollectionLeads(u)
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		contentUUIDs = append(contentUUIDs, leads...)
+		contentUUIDs = append(contentUUIDs, rel.Contains...)
+		mu.Unlock()
+		return nil
+	})
+
+	contentUUIDs = mergeUUIDs(contentUUIDs)
+	cw.parallel(ctx, contentUUIDs, func(u string) error {
+		_, _, err := cw.driver.findContentRelations(u)
+		return err
+	})
+	return len(collections) + len(contentUUIDs)
+}
+
+// parallel looks up the UUIDs with bounded concurrency, until the context is done.
+func (cw *CacheWarmer) parallel(ctx context.Context, uuids []string, lookup func(u string) error) {
+	concurrency := cw.config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	jobs := make(chan string)
+	var workers sync.WaitGroup
+	for i := 0; i < concurrency; i++ {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			for u := range jobs {
+				if err := lookup(u); err != nil {
+					cw.log.WithError(err).WithUUID(u).Warn("Failed to warm the cache up")
+				}
+			}
+		}()
+	}
+
+	defer workers.Wait()
+	defer close(jobs)
+	for _, u := range uuids {
+		select {
+		case jobs <- u:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// recentCollections lists the most recently modified collections. Each label
+// is read from its lastModified index in order, and only limit rows of each
+// are sorted together.
+func (cw *CacheWarmer) recentCollections() ([]string, error) {
+	var results []struct {
+		UUID string `json:"uuid"`
+	}
+	err := cw.neo.Read(&cmneo4j.Query{
+		Cypher: `
+                CALL {
+                    MATCH (cc:Curation)
+                    WHERE cc.lastModified IS NOT NULL
+                    RETURN cc.uuid as uuid, cc.lastModified as lastModified
+                    ORDER BY lastModified DESC
+                    LIMIT $limit
+                    UNION
+                    MATCH (cc:ContentCollection)
+                    WHERE cc.lastModified IS NOT NULL
+                    RETURN cc.uuid as uuid, cc.lastModified as lastModified
+                    ORDER BY lastModified DESC
+                    LIMIT $limit
+                }
+                RETURN uuid
+                ORDER BY lastModified DESC
+                LIMIT $limit
+                `,
+		Params: map[string]interface{}{"limit": cw.config.RecentCollections},
+		Result: &results,
+	})
+	if err != nil && !errors.Is(err, cmneo4j.ErrNoResultsFound) {
+		return nil, err
+	}
+
+	uuids := make([]string, 0, len(results))
+	for _, r := range results {
+		uuids = append(uuids, r.UUID)
+	}
+	return uuids, nil
+}
+
+func (cw *CacheWarmer) finish() {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	cw.done = true
+}
+
+// GTG reports the service not good to go until the warm-up is done or timed out.
+func (cw *CacheWarmer) GTG() gtg.Status {
+	cw.mu.Lock()
+	defer cw.mu.Unlock()
+	if !cw.done {
+		return gtg.Status{GoodToGo: false, Message: "Warming the cache up"}
+	}
+	return gtg.Status{GoodToGo: true}
+}
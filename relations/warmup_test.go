@@ -0,0 +1,112 @@
+package relations
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	cmneo4j "github.com/Financial-Times/cm-neo4j-driver"
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// recentCollectionsMock lists the given collections as the most recently modified ones.
+type recentCollectionsMock struct {
+	schemaDriverMock
+	uuids []string
+}
+
+func (m *recentCollectionsMock) Read(queries ...*cmneo4j.Query) error {
+	if len(m.uuids) == 0 {
+		return cmneo4j.ErrNoResultsFound
+	}
+	results := queries[0].Result.(*[]struct {
+		UUID string `json:"uuid"`
+	})
+	for _, u := range m.uuids {
+		*results = append(*results, struct {
+			UUID string `json:"uuid"`
+		}{u})
+	}
+	return nil
+}
+
+// recordingDriverMock records the content looked up.
+type recordingDriverMock struct {
+	mutableDriverMock
+	mu      sync.Mutex
+	content []string
+	delay   time.Duration
+}
+
+func (m *recordingDriverMock) findContentRelations(contentUUID string) (relations, bool, error) {
+	time.Sleep(m.delay)
+	m.mu.Lock()
+	m.content = append(m.content, contentUUID)
+	m.mu.Unlock()
+	return m.mutableDriverMock.findContentRelations(contentUUID)
+}
+
+func (m *recordingDriverMock) lookedUp() []string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]string{}, m.content...)
+}
+
+func TestReadWarmupUUIDs(t *testing.T) {
+	uuids, err := ReadWarmupUUIDs(strings.NewReader("# most read\n" + knownUUID + "\n\n  " + item1UUID + "  \n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{knownUUID, item1UUID}, uuids)
+
+	_, err = ReadWarmupUUIDs(strings.NewReader(knownUUID + "\nnot-a-uuid\n"))
+	assert.ErrorContains(t, err, "line 2")
+}
+
+func TestCacheWarmer(t *testing.T) {
+	driver := &recordingDriverMock{mutableDriverMock: mutableDriverMock{
+		cypherDriverMock: cypherDriverMock{contentUUID: collectionUUID},
+		relations:        map[string]relations{},
+		leads:            map[string][]string{collectionUUID: {leadUUID}},
+	}}
+	warmer := NewCacheWarmer(driver, &recentCollectionsMock{uuids: []string{collectionUUID}}, []string{knownUUID, leadUUID},
+		WarmupConfig{RecentCollections: 10, Concurrency: 2, Timeout: time.Second}, logger.NewUPPLogger("test", "PANIC"))
+
+	assert.False(t, warmer.GTG().GoodToGo)
+	warmer.Start(context.Background())
+	assert.True(t, warmer.GTG().GoodToGo)
+	assert.ElementsMatch(t, []string{knownUUID, leadUUID, collectionUUID}, driver.lookedUp(), "the given content, the leads and the items of the collections should be looked up once")
+}
+
+func TestCacheWarmerFillsCache(t *testing.T) {
+	mock := &countingDriverMock{cypherDriverMock: cypherDriverMock{contentUUID: leadUUID}}
+	driver := NewCachedDriver(mock, NewCache(10, time.Minute))
+	warmer := NewCacheWarmer(driver, &recentCollectionsMock{}, []string{leadUUID, knownUUID},
+		WarmupConfig{RecentCollections: 10, Concurrency: 4, Timeout: time.Second}, logger.NewUPPLogger("test", "PANIC"))
+	warmer.Start(context.Background())
+	require.Equal(t, 2, mock.contentReads)
+
+	_, _, err := driver.findContentRelations(leadUUID)
+	require.NoError(t, err)
+	assert.Equal(t, 2, mock.contentReads, "warmed up relations should be served from the cache")
+}
+
+func TestCacheWarmerTimeout(t *testing.T) {
+	driver := &recordingDriverMock{
+		mutableDriverMock: mutableDriverMock{relations: map[string]relations{}},
+		delay:             200 * time.Millisecond,
+	}
+	uuids := []string{knownUUID, item1UUID, leadUUID, otherUUID, collectionUUID}
+	warmer := NewCacheWarmer(driver, &recentCollectionsMock{}, uuids,
+		WarmupConfig{Concurrency: 1, Timeout: 20 * time.Millisecond}, logger.NewUPPLogger("test", "PANIC"))
+
+	start := time.Now()
+	warmer.Start(context.Background())
+	assert.Less(t, time.Since(start), 150*time.Millisecond, "the warm-up should not hold back GTG beyond its timeout")
+	assert.True(t, warmer.GTG().GoodToGo)
+
+	time.Sleep(300 * time.Millisecond)
+	assert.Less(t, len(driver.lookedUp()), len(uuids), "lookups should stop being scheduled after the timeout")
+}
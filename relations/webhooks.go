@@ -0,0 +1,492 @@
+package relations
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	uuid "github.com/google/uuid"
+	"github.com/gorilla/mux"
+	metrics "github.com/rcrowley/go-metrics"
+)
+
+const webhookSignatureHeader = "X-Relations-Signature"
+
+// WebhookSubscription is a subscriber notified when the relations of a content item change.
+type WebhookSubscription struct {
+	ID        string    `json:"id"`
+	URL       string    `json:"url"`
+	Secret    string    `json:"secret,omitempty"`
+	CreatedBy string    `json:"createdBy,omitempty"`
+	CreatedAt time.Time `json:"createdAt"`
+}
+
+type WebhookConfig struct {
+	// MaxAttempts is the number of times a delivery is tried before it is dead-lettered
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, doubled on every following retry
+	InitialBackoff time.Duration
+	// ReevaluationInterval is how often every tracked content item is re-evaluated, 0 disables it
+	ReevaluationInterval time.Duration
+	// MaxTrackedContent bounds the number of content items whose last relations are kept
+	MaxTrackedContent int
+	// MaxConcurrentDeliveries bounds the deliveries in flight, the following ones wait for a slot
+	MaxConcurrentDeliveries int
+}
+
+type webhookPayload struct {
+	UUID             string     `json:"uuid"`
+	Before           *relations `json:"before"`
+	After            *relations `json:"after"`
+	PublishReference string     `json:"publishReference,omitempty"`
+	ChangedAt        time.Time  `json:"changedAt"`
+}
+
+type deadLetter struct {
+	SubscriptionID string          `json:"subscriptionId"`
+	URL            string          `json:"url"`
+	Attempts       int             `json:"attempts"`
+	LastError      string          `json:"lastError"`
+	FailedAt       time.Time       `json:"failedAt"`
+	Payload        json.RawMessage `json:"payload"`
+}
+
+// relationsSnapshot is the last relations of a content, before the public URLs are built.
+type relationsSnapshot struct {
+	rel   relations
+	found bool
+}
+
+// webhookEventsDropped counts the collection events dropped while the notifier was busy
+var webhookEventsDropped = metrics.GetOrRegisterCounter("relations.webhook_events_dropped", metrics.DefaultRegistry)
+
+// WebhookNotifier re-evaluates the relations of content affected by published
+// collections, or periodically, and POSTs the before and after relations to
+// every subscriber when they differ. Payloads are signed with the subscriber
+// secret using HMAC-SHA256. Deliveries that still fail after all retries are
+// written to the dead-letter log.
+type WebhookNotifier struct {
+	driver        Driver
+	store         WebhookStore
+	urls          *PublicURLs
+	config        WebhookConfig
+	client        *http.Client
+	deadLetter    io.Writer
+	log           *logger.UPPLogger
+	events        chan CollectionEvent
+	stopped       chan struct{}
+	deliveries    sync.WaitGroup
+	deliverySlots chan struct{}
+
+	// mu serialises the evaluations, so that the tracked content stays within its bound
+	mu           sync.Mutex
+	deadLetterMu sync.Mutex
+}
+
+// NewWebhookNotifier creates a notifier keeping its subscriptions and the
+// tracked relations in the store. Failed deliveries are written as JSON lines
+// to deadLetter, or logged when it is nil.
+func NewWebhookNotifier(driver Driver, store WebhookStore, urls *PublicURLs, config WebhookConfig, client *http.Client, deadLetter io.Writer, log *logger.UPPLogger) *WebhookNotifier {
+	return &WebhookNotifier{
+		driver:        driver,
+		store:         store,
+		urls:          urls,
+		config:        config,
+		client:        client,
+		deadLetter:    deadLetter,
+		log:           log,
+		events:        make(chan CollectionEvent, 100),
+		stopped:       make(chan struct{}),
+		deliverySlots: make(chan struct{}, config.MaxConcurrentDeliveries),
+	}
+}
+
+// HandleCollectionEvent queues the event. With the periodic re-evaluation it
+// never blocks the consumer: the event is dropped and counted in
+// relations.webhook_events_dropped while the queue is full, the re-evaluation
+// then catches up on the changes. Without it, the consumer waits for room in
+// the queue, as nothing would notify the changes of a dropped event.
+func (wn *WebhookNotifier) HandleCollectionEvent(event CollectionEvent) {
+	if wn.config.ReevaluationInterval <= 0 {
+		select {
+		case wn.events <- event:
+		case <-wn.stopped:
+		}
+		return
+	}
+	select {
+	case wn.events <- event:
+	case <-wn.stopped:
+	default:
+		webhookEventsDropped.Inc(1)
+		wn.log.WithUUID(event.UUID).WithTransactionID(event.PublishReference).Warn("Webhook notifier is busy, dropping the collection event")
+	}
+}
+
+// Start processes collection events and periodic re-evaluations until the
+// context is cancelled, then waits for in-flight deliveries.
+func (wn *WebhookNotifier) Start(ctx context.Context) {
+	defer close(wn.stopped)
+	var tick <-chan time.Time
+	if wn.config.ReevaluationInterval > 0 {
+		ticker := time.NewTicker(wn.config.ReevaluationInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			wn.deliveries.Wait()
+			return
+		case event := <-wn.events:
+			wn.processEvent(ctx, event)
+		case <-tick:
+			wn.reevaluate(ctx)
+		}
+	}
+}
+
+// processEvent evaluates the leads and the items of the collection, and the
+// tracked content whose relations were built from it, which covers the items
+// the collection no longer lists.
+func (wn *WebhookNotifier) processEvent(ctx context.Context, event CollectionEvent) {
+	leads, err := wn.driver.findContentCollectionLeads(event.UUID)
+	if err != nil {
+		wn.log.WithError(err).WithUUID(event.UUID).Error("Failed to work out the content affected by the collection")
+		return
+	}
+	dependants, err := wn.store.trackedDependants(event.UUID)
+	if err != nil {
+		wn.log.WithError(err).WithUUID(event.UUID).Error("Failed to read the content tracked for webhooks")
+		return
+	}
+
+	for _, contentUUID := range mergeUUIDs(leads, event.ItemUUIDs(), dependants) {
+		wn.evaluate(ctx, contentUUID, event.PublishReference, event.eventID())
+	}
+}
+
+func (wn *WebhookNotifier) reevaluate(ctx context.Context) {
+	tracked, err := wn.store.trackedContent()
+	if err != nil {
+		wn.log.WithError(err).Error("Failed to read the content tracked for webhooks")
+		return
+	}
+
+	// The replicas re-evaluating in the same interval claim the changes alike
+	round := "reevaluation/" + time.Now().Truncate(wn.config.ReevaluationInterval).UTC().Format(time.RFC3339Nano)
+	for _, contentUUID := range tracked {
+		if ctx.Err() != nil {
+			return
+		}
+		wn.evaluate(ctx, contentUUID, "", round)
+	}
+}
+
+// evaluate notifies the change of the relations of the content, if any. The
+// eventID identifies what the content is evaluated for alike on every replica.
+func (wn *WebhookNotifier) evaluate(ctx context.Context, contentUUID, publishReference, eventID string) {
+	after, found, err := wn.driver.findContentRelations(contentUUID)
+	if err != nil {
+		wn.log.WithError(err).WithUUID(contentUUID).Error("Failed to re-evaluate relations")
+		return
+	}
+
+	changed, before, err := wn.track(contentUUID, eventID, relationsSnapshot{rel: after, found: found})
+	if err != nil {
+		wn.log.WithError(err).WithUUID(contentUUID).Error("Failed to track the relations for webhooks")
+		return
+	}
+	if !changed {
+		return
+	}
+
+	payload := webhookPayload{
+		UUID:             contentUUID,
+		PublishReference: publishReference,
+		ChangedAt:        time.Now().UTC(),
+	}
+	if before.found {
+		rel := wn.urls.defaults().relations(before.rel)
+		payload.Before = &rel
+	}
+	if found {
+		rel := wn.urls.defaults().relations(after)
+		payload.After = &rel
+	}
+	wn.notify(ctx, payload)
+}
+
+// track stores the new relations of the content and reports whether they
+// differ from the previous ones and this instance is the one to notify it.
+// Content seen for the first time is tracked from then on but not notified,
+// as its previous relations are not known.
+func (wn *WebhookNotifier) track(contentUUID, eventID string, after relationsSnapshot) (changed bool, before relationsSnapshot, err error) {
+	wn.mu.Lock()
+	defer wn.mu.Unlock()
+
+	before, known, err := wn.store.snapshot(contentUUID)
+	if err != nil {
+		return false, before, err
+	}
+	if !known {
+		if !after.found {
+			return false, before, nil
+		}
+		tracked, err := wn.store.trackedCount()
+		if err != nil || tracked >= wn.config.MaxTrackedContent {
+			return false, before, err
+		}
+		return false, before, wn.store.putSnapshot(contentUUID, after)
+	}
+	urls := wn.urls.defaults()
+	if before.found == after.found && sameRelations(urls.relations(before.rel), urls.relations(after.rel)) {
+		return false, before, nil
+	}
+
+	if err := wn.store.putSnapshot(contentUUID, after); err != nil {
+		return false, before, err
+	}
+	claimed, err := wn.store.claim(changeKey(contentUUID, eventID, before, after))
+	return claimed, before, err
+}
+
+// changeKey identifies a change of the relations of a content for an event,
+// which every replica reading the event works out alike. The same change
+// brought again by another event has another key.
+func changeKey(contentUUID, eventID string, before, after relationsSnapshot) string {
+	hash := sha256.New()
+	hash.Write([]byte(contentUUID))
+	hash.Write([]byte(eventID))
+	for _, snapshot := range []relationsSnapshot{before, after} {
+		data, _ := encodeStoredEntry(cacheEntry{key: contentCacheKeyPrefix + contentUUID, contentRel: snapshot.rel, found: snapshot.found})
+		hash.Write(data)
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+func (wn *WebhookNotifier) notify(ctx context.Context, payload webhookPayload) {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		wn.log.WithError(err).WithUUID(payload.UUID).Error("Failed to encode webhook payload")
+		return
+	}
+
+	subs, err := wn.subscriptionList()
+	if err != nil {
+		wn.log.WithError(err).WithUUID(payload.UUID).Error("Failed to read the webhook subscriptions")
+		return
+	}
+	for _, sub := range subs {
+		select {
+		case wn.deliverySlots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		wn.deliveries.Add(1)
+		go func(sub WebhookSubscription) {
+			defer func() {
+				<-wn.deliverySlots
+				wn.deliveries.Done()
+			}()
+			wn.deliver(ctx, sub, payload.PublishReference, body)
+		}(sub)
+	}
+}
+
+func (wn *WebhookNotifier) deliver(ctx context.Context, sub WebhookSubscription, transactionID string, body []byte) {
+	backoff := wn.config.InitialBackoff
+	var lastErr error
+	attempt := 1
+	for ; ; attempt++ {
+		lastErr = wn.post(ctx, sub, transactionID, body)
+		if lastErr == nil {
+			return
+		}
+		if attempt >= wn.config.MaxAttempts || ctx.Err() != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+
+	wn.writeDeadLetter(deadLetter{
+		SubscriptionID: sub.ID,
+		URL:            sub.URL,
+		Attempts:       attempt,
+		LastError:      lastErr.Error(),
+		FailedAt:       time.Now().UTC(),
+		Payload:        body,
+	})
+}
+
+func (wn *WebhookNotifier) post(ctx context.Context, sub WebhookSubscription, transactionID string, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(webhookSignatureHeader, "sha256="+signPayload(sub.Secret, body))
+	if transactionID != "" {
+		req.Header.Set("X-Request-Id", transactionID)
+	}
+
+	resp, err := wn.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Webhook %s responded with status %d", sub.URL, resp.StatusCode)
+	}
+	return nil
+}
+
+func (wn *WebhookNotifier) writeDeadLetter(letter deadLetter) {
+	entry := wn.log.WithField("subscriptionId", letter.SubscriptionID).WithField("attempts", letter.Attempts)
+	if wn.deadLetter == nil {
+		entry.WithField("payload", string(letter.Payload)).Errorf("Webhook delivery failed: %s", letter.LastError)
+		return
+	}
+
+	line, err := json.Marshal(letter)
+	if err != nil {
+		entry.WithError(err).Error("Failed to encode dead letter")
+		return
+	}
+	wn.deadLetterMu.Lock()
+	defer wn.deadLetterMu.Unlock()
+	if _, err := wn.deadLetter.Write(append(line, '\n')); err != nil {
+		entry.WithError(err).Error("Failed to write dead letter")
+		return
+	}
+	entry.Warnf("Webhook delivery failed, written to the dead-letter log: %s", letter.LastError)
+}
+
+// subscriptionList returns the registered subscriptions ordered by creation time.
+func (wn *WebhookNotifier) subscriptionList() ([]WebhookSubscription, error) {
+	subs, err := wn.store.subscriptions()
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(subs, func(i, j int) bool { return subs[i].CreatedAt.Before(subs[j].CreatedAt) })
+	return subs, nil
+}
+
+func (wn *WebhookNotifier) CreateSubscription(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	var sub WebhookSubscription
+	if err := json.NewDecoder(r.Body).Decode(&sub); err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidSubscription,
+			detail:  fmt.Sprintf("The subscription could not be decoded, err=%v", err),
+		})
+		return
+	}
+	if u, err := url.ParseRequestURI(sub.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidSubscription,
+			detail:  "The subscription url must be an absolute http or https url",
+		})
+		return
+	}
+	if sub.Secret == "" {
+		writeError(w, r, apiError{
+			status:  http.StatusBadRequest,
+			problem: problemInvalidSubscription,
+			detail:  "The subscription secret is required",
+		})
+		return
+	}
+
+	sub.ID = uuid.NewString()
+	sub.CreatedBy = adminIdentity(r)
+	sub.CreatedAt = time.Now().UTC()
+	if err := wn.store.addSubscription(sub); err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusServiceUnavailable,
+			problem: problemUnavailable,
+			detail:  fmt.Sprintf("The subscription could not be stored, err=%v", err),
+		})
+		return
+	}
+
+	wn.log.WithField("subscriptionId", sub.ID).WithField("caller", sub.CreatedBy).Infof("Registered webhook %s", sub.URL)
+	sub.Secret = ""
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(sub)
+}
+
+func (wn *WebhookNotifier) ListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+
+	subs, err := wn.subscriptionList()
+	if err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusServiceUnavailable,
+			problem: problemUnavailable,
+			detail:  fmt.Sprintf("The subscriptions could not be read, err=%v", err),
+		})
+		return
+	}
+	for i := range subs {
+		subs[i].Secret = ""
+	}
+	json.NewEncoder(w).Encode(subs)
+}
+
+func (wn *WebhookNotifier) DeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+
+	found, err := wn.store.removeSubscription(id)
+	if err != nil {
+		writeError(w, r, apiError{
+			status:  http.StatusServiceUnavailable,
+			problem: problemUnavailable,
+			detail:  fmt.Sprintf("The subscription could not be removed, err=%v", err),
+		})
+		return
+	}
+	if !found {
+		writeError(w, r, apiError{
+			status:  http.StatusNotFound,
+			problem: problemNotFound,
+			detail:  fmt.Sprintf("No webhook subscription with id %s", id),
+		})
+		return
+	}
+	wn.log.WithField("subscriptionId", id).WithField("caller", adminIdentity(r)).Info("Removed webhook")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func signPayload(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func sameRelations(a, b relations) bool {
+	aJSON, _ := json.Marshal(a)
+	bJSON, _ := json.Marshal(b)
+	return bytes.Equal(aJSON, bJSON)
+}
@@ -0,0 +1,340 @@
+package relations
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	logger "github.com/Financial-Times/go-logger/v2"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gorilla/mux"
+	"github.com/redis/go-redis/v9"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type webhookRecorder struct {
+	mu       sync.Mutex
+	requests []*http.Request
+	bodies   [][]byte
+	failures int
+}
+
+func (wr *webhookRecorder) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	wr.requests = append(wr.requests, r)
+	wr.bodies = append(wr.bodies, body)
+	if len(wr.requests) <= wr.failures {
+		w.WriteHeader(http.StatusInternalServerError)
+	}
+}
+
+func (wr *webhookRecorder) count() int {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+	return len(wr.requests)
+}
+
+type mutableDriverMock struct {
+	cypherDriverMock
+	mu        sync.Mutex
+	relations map[string]relations
+	leads     map[string][]string
+}
+
+func (m *mutableDriverMock) findContentRelations(contentUUID string) (relations, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	rel, found := m.relations[contentUUID]
+	return rel, found, nil
+}
+
+func (m *mutableDriverMock) findContentCollectionLeads(contentCollectionUUID string) ([]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.leads[contentCollectionUUID], nil
+}
+
+func (m *mutableDriverMock) set(contentUUID string, rel relations) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.relations[contentUUID] = rel
+}
+
+func newWebhookTestNotifier(driver Driver, deadLetter io.Writer) *WebhookNotifier {
+	return newWebhookTestNotifierWithStore(driver, NewMemoryWebhookStore(), deadLetter)
+}
+
+func newWebhookTestNotifierWithStore(driver Driver, store WebhookStore, deadLetter io.Writer) *WebhookNotifier {
+	config := WebhookConfig{MaxAttempts: 3, InitialBackoff: time.Millisecond, MaxTrackedContent: 10, MaxConcurrentDeliveries: 2}
+	return NewWebhookNotifier(driver, store, testURLs, config, http.DefaultClient, deadLetter, logger.NewUPPLogger("test", "PANIC"))
+}
+
+func subscribe(t *testing.T, wn *WebhookNotifier, url, secret string) WebhookSubscription {
+	body, _ := json.Marshal(map[string]string{"url": url, "secret": secret})
+	rec := httptest.NewRecorder()
+	wn.CreateSubscription(rec, newRequest("POST", "/__webhooks", body))
+	require.Equal(t, http.StatusCreated, rec.Code)
+
+	var sub WebhookSubscription
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sub))
+	assert.Empty(t, sub.Secret, "The secret should not be returned")
+	return sub
+}
+
+func TestWebhookNotifierPostsSignedChanges(t *testing.T) {
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+
+	driver := &mutableDriverMock{
+		relations: map[string]relations{},
+		leads:     map[string][]string{collectionUUID: {leadUUID}},
+	}
+	driver.set(leadUUID, relations{collectionUUIDs: []string{collectionUUID}})
+	wn := newWebhookTestNotifier(driver, nil)
+	subscribe(t, wn, server.URL, "s3cret")
+
+	// The lead seen for the first time is tracked, not notified
+	wn.processEvent(context.Background(), CollectionEvent{UUID: collectionUUID, Items: []collectionItem{}, PublishReference: "tid_first"})
+	wn.deliveries.Wait()
+	assert.Equal(t, 0, recorder.count())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wn.Start(ctx)
+
+	driver.set(leadUUID, relations{Contains: []relatedContent{{uuid: knownUUID}}, collectionUUIDs: []string{collectionUUID}})
+	event := CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: knownUUID}}, PublishReference: "tid_test"}
+	wn.HandleCollectionEvent(event)
+	require.Eventually(t, func() bool { return recorder.count() == 1 }, time.Second, 5*time.Millisecond)
+
+	// Republishing without changes doesn't notify, a change to the lead's relations does
+	wn.HandleCollectionEvent(event)
+	driver.set(leadUUID, relations{collectionUUIDs: []string{collectionUUID}})
+	wn.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID, Items: []collectionItem{}, PublishReference: "tid_removed"})
+	require.Eventually(t, func() bool { return recorder.count() == 2 }, time.Second, 5*time.Millisecond)
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	req := recorder.requests[0]
+	assert.Equal(t, "sha256="+signPayload("s3cret", recorder.bodies[0]), req.Header.Get(webhookSignatureHeader))
+	assert.Equal(t, "tid_test", req.Header.Get("X-Request-Id"))
+
+	var first, second map[string]interface{}
+	require.NoError(t, json.Unmarshal(recorder.bodies[0], &first))
+	require.NoError(t, json.Unmarshal(recorder.bodies[1], &second))
+	assert.Equal(t, leadUUID, first["uuid"])
+	assert.Equal(t, map[string]interface{}{}, first["before"])
+	assert.Equal(t, map[string]interface{}{"contains": []interface{}{map[string]interface{}{
+		"id":     "http://api.ft.com/things/" + knownUUID,
+		"apiUrl": "http://api.ft.com/content/" + knownUUID,
+	}}}, first["after"])
+	assert.Equal(t, first["after"], second["before"])
+	assert.Equal(t, map[string]interface{}{}, second["after"])
+}
+
+func TestWebhookNotifierRetriesAndDeadLetters(t *testing.T) {
+	recovering := &webhookRecorder{failures: 2}
+	recoveringServer := httptest.NewServer(recovering)
+	defer recoveringServer.Close()
+	failing := &webhookRecorder{failures: 100}
+	failingServer := httptest.NewServer(failing)
+	defer failingServer.Close()
+
+	deadLetters := &bytes.Buffer{}
+	wn := newWebhookTestNotifier(&mutableDriverMock{}, deadLetters)
+	subscribe(t, wn, recoveringServer.URL, "secret")
+	failingSub := subscribe(t, wn, failingServer.URL, "secret")
+
+	wn.notify(context.Background(), webhookPayload{UUID: knownUUID})
+	wn.deliveries.Wait()
+
+	assert.Equal(t, 3, recovering.count())
+	assert.Equal(t, 3, failing.count())
+
+	var letter deadLetter
+	require.NoError(t, json.Unmarshal(deadLetters.Bytes(), &letter))
+	assert.Equal(t, failingSub.ID, letter.SubscriptionID)
+	assert.Equal(t, 3, letter.Attempts)
+	assert.Equal(t, fmt.Sprintf("Webhook %s responded with status 500", failingServer.URL), letter.LastError)
+	assert.JSONEq(t, string(failing.bodies[0]), string(letter.Payload))
+}
+
+func TestWebhookSubscriptionAdminHandlers(t *testing.T) {
+	auth, err := NewAdminAuth("ops:token-1")
+	require.NoError(t, err)
+	wn := newWebhookTestNotifier(&mutableDriverMock{}, nil)
+
+	r := mux.NewRouter()
+	r.HandleFunc("/__webhooks", auth.Wrap(wn.ListSubscriptions)).Methods("GET")
+	r.HandleFunc("/__webhooks", auth.Wrap(wn.CreateSubscription)).Methods("POST")
+	r.HandleFunc("/__webhooks/{id}", auth.Wrap(wn.DeleteSubscription)).Methods("DELETE")
+
+	do := func(method, url, body, token string) *httptest.ResponseRecorder {
+		req := newRequest(method, url, []byte(body))
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		return rec
+	}
+
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/__webhooks", "", "").Code)
+	assert.Equal(t, http.StatusUnauthorized, do("GET", "/__webhooks", "", "wrong").Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/__webhooks", `{"url":"not a url","secret":"s"}`, "token-1").Code)
+	assert.Equal(t, http.StatusBadRequest, do("POST", "/__webhooks", `{"url":"https://example.com/hook"}`, "token-1").Code)
+
+	rec := do("POST", "/__webhooks", `{"url":"https://example.com/hook","secret":"s"}`, "token-1")
+	require.Equal(t, http.StatusCreated, rec.Code)
+	var sub WebhookSubscription
+	require.NoError(t, json.NewDecoder(rec.Body).Decode(&sub))
+	assert.Equal(t, "ops", sub.CreatedBy)
+
+	rec = do("GET", "/__webhooks", "", "token-1")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.NotContains(t, rec.Body.String(), `"secret"`)
+	assert.Contains(t, rec.Body.String(), sub.ID)
+
+	assert.Equal(t, http.StatusNoContent, do("DELETE", "/__webhooks/"+sub.ID, "", "token-1").Code)
+	assert.Equal(t, http.StatusNotFound, do("DELETE", "/__webhooks/"+sub.ID, "", "token-1").Code)
+}
+
+func TestWebhookNotifierSharesRedisStoreAcrossReplicas(t *testing.T) {
+	recorder := &webhookRecorder{}
+	server := httptest.NewServer(recorder)
+	defer server.Close()
+	mr := miniredis.RunT(t)
+	newStore := func() WebhookStore {
+		client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+		t.Cleanup(func() { client.Close() })
+		return NewRedisWebhookStore(client)
+	}
+
+	driver := &mutableDriverMock{
+		relations: map[string]relations{},
+		leads:     map[string][]string{collectionUUID: {leadUUID}},
+	}
+	driver.set(leadUUID, relations{collectionUUIDs: []string{collectionUUID}})
+	replicaA := newWebhookTestNotifierWithStore(driver, newStore(), nil)
+	replicaB := newWebhookTestNotifierWithStore(driver, newStore(), nil)
+	subscribe(t, replicaA, server.URL, "s3cret")
+	replicaA.processEvent(context.Background(), CollectionEvent{UUID: collectionUUID, PublishReference: "tid_first"})
+
+	// Every replica reads every event, a single one notifies the change
+	driver.set(leadUUID, relations{Contains: []relatedContent{{uuid: knownUUID}}, collectionUUIDs: []string{collectionUUID}})
+	event := CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: knownUUID}}, PublishReference: "tid_added"}
+	replicaA.processEvent(context.Background(), event)
+	replicaB.processEvent(context.Background(), event)
+	replicaA.deliveries.Wait()
+	replicaB.deliveries.Wait()
+	assert.Equal(t, 1, recorder.count())
+
+	// A restarted replica knows the subscriptions and the last relations notified
+	restarted := newWebhookTestNotifierWithStore(driver, newStore(), nil)
+	driver.set(leadUUID, relations{collectionUUIDs: []string{collectionUUID}})
+	restarted.processEvent(context.Background(), CollectionEvent{UUID: collectionUUID, PublishReference: "tid_removed"})
+	restarted.deliveries.Wait()
+	require.Equal(t, 2, recorder.count())
+
+	// The same change brought again by another event is notified again
+	driver.set(leadUUID, relations{Contains: []relatedContent{{uuid: knownUUID}}, collectionUUIDs: []string{collectionUUID}})
+	replicaA.processEvent(context.Background(), CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: knownUUID}}, PublishReference: "tid_added_again"})
+	replicaB.processEvent(context.Background(), CollectionEvent{UUID: collectionUUID, Items: []collectionItem{{UUID: knownUUID}}, PublishReference: "tid_added_again"})
+	replicaA.deliveries.Wait()
+	replicaB.deliveries.Wait()
+	require.Equal(t, 3, recorder.count())
+
+	recorder.mu.Lock()
+	defer recorder.mu.Unlock()
+	var payload map[string]interface{}
+	require.NoError(t, json.Unmarshal(recorder.bodies[1], &payload))
+	assert.NotNil(t, payload["before"], "The relations notified before the restart should be sent as before")
+	require.NoError(t, json.Unmarshal(recorder.bodies[2], &payload))
+	assert.Equal(t, "tid_added_again", payload["publishReference"])
+}
+
+func TestWebhookNotifierDropsEventsWhileBusy(t *testing.T) {
+	wn := newWebhookTestNotifier(&mutableDriverMock{}, nil)
+	wn.config.ReevaluationInterval = time.Hour
+	dropped := webhookEventsDropped.Count()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(wn.events)+5; i++ {
+			wn.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Queuing events should not block the consumer")
+	}
+	assert.Equal(t, int64(5), webhookEventsDropped.Count()-dropped)
+}
+
+func TestWebhookNotifierQueuesEveryEventWithoutReevaluation(t *testing.T) {
+	wn := newWebhookTestNotifier(&mutableDriverMock{}, nil)
+	dropped := webhookEventsDropped.Count()
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < cap(wn.events)+5; i++ {
+			wn.HandleCollectionEvent(CollectionEvent{UUID: collectionUUID})
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+		t.Fatal("Events should wait for room in the queue when nothing re-evaluates the dropped ones")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go wn.Start(ctx)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Events should be queued once the notifier processes them")
+	}
+	assert.Equal(t, int64(0), webhookEventsDropped.Count()-dropped)
+}
+
+func TestWebhookNotifierBoundsConcurrentDeliveries(t *testing.T) {
+	var mu sync.Mutex
+	var inFlight, maxInFlight int
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		inFlight++
+		if inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+	}))
+	defer server.Close()
+
+	wn := newWebhookTestNotifier(&mutableDriverMock{}, nil)
+	for i := 0; i < 5; i++ {
+		subscribe(t, wn, server.URL, "secret")
+	}
+	wn.notify(context.Background(), webhookPayload{UUID: knownUUID})
+	wn.deliveries.Wait()
+
+	assert.Equal(t, 2, maxInFlight)
+}
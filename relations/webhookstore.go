@@ -0,0 +1,274 @@
+package relations
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	redisWebhooksPrefix = redisKeyPrefix + "webhooks/"
+	// webhookClaimTTL is how long a change stays claimed by the replica notifying it
+	webhookClaimTTL = 24 * time.Hour
+	// webhookStoreTimeout bounds the commands of the Redis webhook store
+	webhookStoreTimeout = 5 * time.Second
+)
+
+// WebhookStore keeps the webhook subscriptions and the last relations of the
+// tracked content, which the notifier compares new relations to.
+type WebhookStore interface {
+	subscriptions() ([]WebhookSubscription, error)
+	addSubscription(sub WebhookSubscription) error
+	removeSubscription(id string) (bool, error)
+	// snapshot returns the last relations of the content, when it is tracked
+	snapshot(contentUUID string) (relationsSnapshot, bool, error)
+	// putSnapshot tracks the content and the collections its relations were built from
+	putSnapshot(contentUUID string, snapshot relationsSnapshot) error
+	trackedCount() (int, error)
+	trackedContent() ([]string, error)
+	// trackedDependants lists the tracked content whose last relations were built from the collection
+	trackedDependants(collectionUUID string) ([]string, error)
+	// claim reports whether the change of the key, see changeKey, was not
+	// claimed yet, so that a single replica notifies the change of each event
+	claim(key string) (bool, error)
+}
+
+// memoryWebhookStore keeps the subscriptions and snapshots of a single
+// instance, they are lost on restart.
+type memoryWebhookStore struct {
+	mu        sync.Mutex
+	subs      map[string]WebhookSubscription
+	snapshots map[string]relationsSnapshot
+}
+
+// NewMemoryWebhookStore creates a WebhookStore held in the memory of the instance.
+func NewMemoryWebhookStore() WebhookStore {
+	return &memoryWebhookStore{
+		subs:      map[string]WebhookSubscription{},
+		snapshots: map[string]relationsSnapshot{},
+	}
+}
+
+func (s *memoryWebhookStore) subscriptions() ([]WebhookSubscription, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	subs := make([]WebhookSubscription, 0, len(s.subs))
+	for _, sub := range s.subs {
+		subs = append(subs, sub)
+	}
+	return subs, nil
+}
+
+func (s *memoryWebhookStore) addSubscription(sub WebhookSubscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subs[sub.ID] = sub
+	return nil
+}
+
+func (s *memoryWebhookStore) removeSubscription(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, found := s.subs[id]
+	delete(s.subs, id)
+	return found, nil
+}
+
+func (s *memoryWebhookStore) snapshot(contentUUID string) (relationsSnapshot, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshot, known := s.snapshots[contentUUID]
+	return snapshot, known, nil
+}
+
+func (s *memoryWebhookStore) putSnapshot(contentUUID string, snapshot relationsSnapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.snapshots[contentUUID] = snapshot
+	return nil
+}
+
+func (s *memoryWebhookStore) trackedCount() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.snapshots), nil
+}
+
+func (s *memoryWebhookStore) trackedContent() ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tracked := make([]string, 0, len(s.snapshots))
+	for contentUUID := range s.snapshots {
+		tracked = append(tracked, contentUUID)
+	}
+	sort.Strings(tracked)
+	return tracked, nil
+}
+
+func (s *memoryWebhookStore) trackedDependants(collectionUUID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var dependants []string
+	for contentUUID, snapshot := range s.snapshots {
+		for _, u := range snapshot.rel.collectionUUIDs {
+			if u == collectionUUID {
+				dependants = append(dependants, contentUUID)
+				break
+			}
+		}
+	}
+	sort.Strings(dependants)
+	return dependants, nil
+}
+
+func (s *memoryWebhookStore) claim(key string) (bool, error) {
+	return true, nil
+}
+
+// RedisWebhookStore is a WebhookStore shared by every replica of the service,
+// which survives their restarts. Every replica reads every publish event, the
+// first one to claim a change notifies it.
+type RedisWebhookStore struct {
+	client redis.UniversalClient
+}
+
+func NewRedisWebhookStore(client redis.UniversalClient) *RedisWebhookStore {
+	return &RedisWebhookStore{client: client}
+}
+
+func (s *RedisWebhookStore) do(commands func(ctx context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), webhookStoreTimeout)
+	defer cancel()
+	return commands(ctx)
+}
+
+func (s *RedisWebhookStore) subscriptions() ([]WebhookSubscription, error) {
+	var subs []WebhookSubscription
+	err := s.do(func(ctx context.Context) error {
+		values, err := s.client.HVals(ctx, redisWebhooksPrefix+"subscriptions").Result()
+		if err != nil {
+			return err
+		}
+		subs = make([]WebhookSubscription, 0, len(values))
+		for _, v := range values {
+			var sub WebhookSubscription
+			if err := json.Unmarshal([]byte(v), &sub); err != nil {
+				return err
+			}
+			subs = append(subs, sub)
+		}
+		return nil
+	})
+	return subs, err
+}
+
+func (s *RedisWebhookStore) addSubscription(sub WebhookSubscription) error {
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	return s.do(func(ctx context.Context) error {
+		return s.client.HSet(ctx, redisWebhooksPrefix+"subscriptions", sub.ID, data).Err()
+	})
+}
+
+func (s *RedisWebhookStore) removeSubscription(id string) (bool, error) {
+	var removed int64
+	err := s.do(func(ctx context.Context) error {
+		var err error
+		removed, err = s.client.HDel(ctx, redisWebhooksPrefix+"subscriptions", id).Result()
+		return err
+	})
+	return removed > 0, err
+}
+
+func (s *RedisWebhookStore) snapshot(contentUUID string) (relationsSnapshot, bool, error) {
+	var snapshot relationsSnapshot
+	var known bool
+	err := s.do(func(ctx context.Context) error {
+		data, err := s.client.Get(ctx, redisWebhooksPrefix+"content/"+contentUUID).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		entry, err := decodeStoredEntry(contentCacheKeyPrefix+contentUUID, data)
+		if err != nil {
+			return err
+		}
+		snapshot, known = relationsSnapshot{rel: entry.contentRel, found: entry.found}, true
+		return nil
+	})
+	return snapshot, known, err
+}
+
+func (s *RedisWebhookStore) putSnapshot(contentUUID string, snapshot relationsSnapshot) error {
+	previous, known, err := s.snapshot(contentUUID)
+	if err != nil {
+		return err
+	}
+	data, err := encodeStoredEntry(cacheEntry{key: contentCacheKeyPrefix + contentUUID, contentRel: snapshot.rel, found: snapshot.found})
+	if err != nil {
+		return err
+	}
+	return s.do(func(ctx context.Context) error {
+		_, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+			if known {
+				for _, cc := range previous.rel.collectionUUIDs {
+					pipe.SRem(ctx, redisWebhooksPrefix+"dependants/"+cc, contentUUID)
+				}
+			}
+			pipe.Set(ctx, redisWebhooksPrefix+"content/"+contentUUID, data, 0)
+			pipe.SAdd(ctx, redisWebhooksPrefix+"tracked", contentUUID)
+			for _, cc := range snapshot.rel.collectionUUIDs {
+				pipe.SAdd(ctx, redisWebhooksPrefix+"dependants/"+cc, contentUUID)
+			}
+			return nil
+		})
+		return err
+	})
+}
+
+func (s *RedisWebhookStore) trackedCount() (int, error) {
+	var count int64
+	err := s.do(func(ctx context.Context) error {
+		var err error
+		count, err = s.client.SCard(ctx, redisWebhooksPrefix+"tracked").Result()
+		return err
+	})
+	return int(count), err
+}
+
+func (s *RedisWebhookStore) trackedContent() ([]string, error) {
+	return s.members(redisWebhooksPrefix + "tracked")
+}
+
+func (s *RedisWebhookStore) trackedDependants(collectionUUID string) ([]string, error) {
+	return s.members(redisWebhooksPrefix + "dependants/" + collectionUUID)
+}
+
+func (s *RedisWebhookStore) members(key string) ([]string, error) {
+	var members []string
+	err := s.do(func(ctx context.Context) error {
+		var err error
+		members, err = s.client.SMembers(ctx, key).Result()
+		return err
+	})
+	sort.Strings(members)
+	return members, err
+}
+
+func (s *RedisWebhookStore) claim(key string) (bool, error) {
+	var claimed bool
+	err := s.do(func(ctx context.Context) error {
+		var err error
+		claimed, err = s.client.SetNX(ctx, redisWebhooksPrefix+"claims/"+key, 1, webhookClaimTTL).Result()
+		return err
+	})
+	return claimed, err
+}